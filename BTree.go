@@ -1,14 +1,35 @@
 package main
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
 
 const (
 	BNODE_NODE         = 1    // internal nodes without values
 	BNODE_LEAF         = 2    // leaf nodes with values
+	BNODE_FREE         = 3    // pages of the free list, see freelist.go
 	HEADER             = 4    // Header Size
-	BTREE_PAGE_SIZE    = 4096 // Page Size
+	BTREE_PAGE_SIZE    = 4096 // default Page Size
 	BTREE_MAX_KEY_SIZE = 1000
 	BTREE_MAX_VAL_SIZE = 3000
+
+	// the page size is chosen when a database is created. The limit is 32K because the
+	// offsets are 16 bits and a node that is about to be split holds more than a page.
+	BTREE_MIN_PAGE_SIZE = 4096
+	BTREE_MAX_PAGE_SIZE = 32768
+
+	// a tree only gets deeper when its root is split, so even a tree that fills the whole
+	// 64-bit page space is far less deep. A deeper path is a cycle of corrupted pages.
+	BTREE_MAX_DEPTH = 64
+
+	// flag in the node type, the keys are stored without their common prefix
+	BNODE_PREFIX = 0x8000
+	// a prefix-compressed node holds at most twice its size in uncompressed keys and values.
+	// a merge can shorten the prefix, this keeps the merged node within a temporary buffer.
+	BTREE_MAX_EXPANSION = 2
 )
 
 // BNode represents a single Node in the B tree
@@ -18,13 +39,43 @@ type BNode struct {
 	// KV Paris
 	// | klen | vlen | key | val |
 	// | 2B   | 2B   | ... | ... |
+	//
+	// A prefix-compressed node (BNODE_PREFIX is set in the type) stores the common prefix
+	// of its keys once, and the KV pairs only hold the rest of each key:
+	// | type | nkeys | plen | prefix | pointers   | offsets    | key-values
+	// | 2B   | 2B    | 2B   | plen   | nkeys * 8B | nkeys * 2B | ...
+	// The prefix is shared by the whole key range of the node, which is given by the keys
+	// of the node and its next sibling in the parent (see fencePrefix), not just by the
+	// keys that are in the node right now. So an insert never has to shorten it.
 	data []byte
 }
 
 // Type of the node (internal or leaf)
 func (node BNode) btype() uint16 {
 	// read first 2 bytes ( 16bit = 2 * 8 = 2 bytes) as uint
-	return binary.LittleEndian.Uint16(node.data)
+	return binary.LittleEndian.Uint16(node.data) &^ BNODE_PREFIX
+}
+
+// prefixed reports whether the node is prefix-compressed
+func (node BNode) prefixed() bool {
+	return binary.LittleEndian.Uint16(node.data)&BNODE_PREFIX != 0
+}
+
+// prefix returns the common prefix of the keys of a prefix-compressed node, nil otherwise
+func (node BNode) prefix() []byte {
+	if !node.prefixed() {
+		return nil
+	}
+	plen := binary.LittleEndian.Uint16(node.data[HEADER:])
+	return node.data[HEADER+2:][:plen]
+}
+
+// base returns the size of the header including the prefix, which is where the pointers start
+func (node BNode) base() uint16 {
+	if !node.prefixed() {
+		return HEADER
+	}
+	return HEADER + 2 + binary.LittleEndian.Uint16(node.data[HEADER:])
 }
 
 // number of keys in the node
@@ -38,18 +89,35 @@ func (node BNode) setHeader(btype uint16, nkeys uint16) {
 	binary.LittleEndian.PutUint16(node.data[2:4], nkeys)
 }
 
+// setPrefix makes the node prefix-compressed with the given prefix. It must be called right
+// after setHeader since the prefix moves the pointers, offsets and KV pairs.
+func (node BNode) setPrefix(prefix []byte) {
+	binary.LittleEndian.PutUint16(node.data[0:2], node.btype()|BNODE_PREFIX)
+	binary.LittleEndian.PutUint16(node.data[HEADER:], uint16(len(prefix)))
+	copy(node.data[HEADER+2:], prefix)
+}
+
+// setHeaderLike sets the header of a new node that covers the same key range as old,
+// so it keeps the prefix of old if it has one.
+func (node BNode) setHeaderLike(old BNode, btype uint16, nkeys uint16) {
+	node.setHeader(btype, nkeys)
+	if old.prefixed() {
+		node.setPrefix(old.prefix())
+	}
+}
+
 // retrieves the pointer at the provided index. the pointer represents a link to child nodes in the B-tree
 func (node BNode) getPtr(idx uint16) uint64 {
 	// make sure that the index is less than the number of keys in the node
 	assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.base() + 8*idx
 	return binary.LittleEndian.Uint64(node.data[pos:])
 }
 
 // sets the pointer at the provided index to a given value
 func (node BNode) setPtr(idx uint16, val uint64) {
 	assert(idx < node.nkeys())
-	pos := HEADER + 8*idx
+	pos := node.base() + 8*idx
 	binary.LittleEndian.PutUint64(node.data[pos:], val)
 }
 
@@ -67,7 +135,7 @@ func (node BNode) setPtr(idx uint16, val uint64) {
 // This position can be used with functions like getOffset and setOffset to read or write a specific offset.
 func offsetPos(node BNode, idx uint16) uint16 {
 	assert(1 <= idx && idx <= node.nkeys())
-	return HEADER + 8*node.nkeys() + 2*(idx-1)
+	return node.base() + 8*node.nkeys() + 2*(idx-1)
 }
 
 // getOffset returns the offset value at the given index within the node's data.
@@ -82,17 +150,38 @@ func (node BNode) getOffset(idx uint16) uint16 {
 	return binary.LittleEndian.Uint16(node.data[offsetPos(node, idx):])
 }
 
+// setOffset writes the offset value at the given index within the node's data.
+// Offset 0 is implicit and never stored, so idx must be 1-based like in offsetPos.
+func (node BNode) setOffset(idx uint16, offset uint16) {
+	binary.LittleEndian.PutUint16(node.data[offsetPos(node, idx):], offset)
+}
+
 // kvPos returns the position of the KV pair at index idx inside the node slice
 func (node BNode) kvPos(idx uint16) uint16 {
 	assert(idx <= node.nkeys())
-	// Size Of Headers + Size Of Pointers + Size of Offsets + Offset to KV-Pair
-	return HEADER + 8*node.nkeys() + 2*node.nkeys() + node.getOffset(idx)
+	// Size Of Headers + Size Of Pointers + Size of Offsets + Offset to KV-Pair.
+	// a node being built holds up to two pages, the sum must not wrap around.
+	pos := int(node.base()) + 8*int(node.nkeys()) + 2*int(node.nkeys()) + int(node.getOffset(idx))
+	assert(pos <= math.MaxUint16)
+	return uint16(pos)
 }
 
 // getKey retrieves the key at the given index within the BNode's data byte slice.
 // It calculates the byte position of the key using the kvPos function and the length of the key,
-// then returns the key as a byte slice.
+// then returns the key as a byte slice. The key of a prefix-compressed node is assembled
+// into a new slice, use cmpKey to compare keys without that.
 func (node BNode) getKey(idx uint16) []byte {
+	suffix := node.keySuffix(idx)
+	prefix := node.prefix()
+	if len(prefix) == 0 {
+		return suffix
+	}
+	key := make([]byte, 0, len(prefix)+len(suffix))
+	return append(append(key, prefix...), suffix...)
+}
+
+// keySuffix returns the key at the given index as it's stored, without the prefix of the node.
+func (node BNode) keySuffix(idx uint16) []byte {
 	assert(idx < node.nkeys())
 	pos := node.kvPos(idx)
 	// KV-Pairs always start with 2-bytes key length, 2 bytes value length and then the key and the value
@@ -120,11 +209,273 @@ func (node BNode) nbytes() uint16 {
 	return node.kvPos(node.nkeys())
 }
 
+// expanded returns the size of the node if its keys were stored in full.
+func (node BNode) expanded() int {
+	return int(node.nbytes()) + (int(node.nkeys())-1)*len(node.prefix())
+}
+
+// cmpKey compares the key at the given index with the given key like bytes.Compare.
+func (node BNode) cmpKey(idx uint16, key []byte) int {
+	prefix := node.prefix()
+	n := min(len(prefix), len(key))
+	// a key shorter than the prefix is never equal to it
+	if cmp := bytes.Compare(prefix, key[:n]); cmp != 0 {
+		return cmp
+	}
+	return bytes.Compare(node.keySuffix(idx), key[n:])
+}
+
+// nodeLookupLE returns the index of the last key in the node that is less than or equal to the given key.
+// The keys of an internal node are lower bounds of its kids, so the first key of a node is less than
+// or equal to the key it was reached by, except after the first key of a leaf was deleted.
+// Index 0 is the fallback either way, and callers that work on leaves must compare it.
+// Keys are sorted and the offsets give O(1) access to any key, so this is a binary search
+// for the first key in [1, nkeys) that is greater than the key.
+func nodeLookupLE(node BNode, key []byte) uint16 {
+	lo, hi := uint16(1), node.nkeys()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if node.cmpKey(mid, key) <= 0 {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo - 1
+}
+
+// nodeAppendRange copies n KV pairs (with their pointers) starting at srcOld in the old node
+// to the position dstNew in the new node. The header of the new node must already be set,
+// and the KV pairs before dstNew must already be in place since the offsets are relative to them.
+func nodeAppendRange(new BNode, old BNode, dstNew uint16, srcOld uint16, n uint16) {
+	assert(srcOld+n <= old.nkeys())
+	assert(dstNew+n <= new.nkeys())
+	if n == 0 {
+		return
+	}
+	if !bytes.Equal(new.prefix(), old.prefix()) {
+		// the keys have to be encoded for the prefix of the new node
+		for i := uint16(0); i < n; i++ {
+			nodeAppendKV(new, dstNew+i, old.getPtr(srcOld+i), old.getKey(srcOld+i), old.getVal(srcOld+i))
+		}
+		return
+	}
+	// pointers
+	for i := uint16(0); i < n; i++ {
+		new.setPtr(dstNew+i, old.getPtr(srcOld+i))
+	}
+	// offsets, rebased from the start of the copied range in the old node to dstNew in the new node.
+	// the range is [1, n] since the offset at dstNew is already known.
+	dstBegin := new.getOffset(dstNew)
+	srcBegin := old.getOffset(srcOld)
+	for i := uint16(1); i <= n; i++ {
+		offset := int(dstBegin) + int(old.getOffset(srcOld+i)) - int(srcBegin)
+		assert(offset <= math.MaxUint16)
+		new.setOffset(dstNew+i, uint16(offset))
+	}
+	// KV pairs can be copied in one go since they are packed sequentially
+	begin := old.kvPos(srcOld)
+	end := old.kvPos(srcOld + n)
+	copy(new.data[new.kvPos(dstNew):], old.data[begin:end])
+}
+
+// nodeAppendKV writes a single pointer and KV pair at the given index of the new node
+// and sets the offset of the next KV pair accordingly. The key must have the prefix of the node.
+func nodeAppendKV(new BNode, idx uint16, ptr uint64, key []byte, val []byte) {
+	if prefix := new.prefix(); len(prefix) > 0 {
+		assert(bytes.HasPrefix(key, prefix))
+		key = key[len(prefix):]
+	}
+	// pointer
+	new.setPtr(idx, ptr)
+	// | klen | vlen | key | val |
+	pos := new.kvPos(idx)
+	// the KV pair must fit into the buffer and its end into an offset
+	end := int(pos) + 4 + len(key) + len(val)
+	assert(end <= len(new.data) && end-int(new.kvPos(0)) <= math.MaxUint16)
+	binary.LittleEndian.PutUint16(new.data[pos+0:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(new.data[pos+2:], uint16(len(val)))
+	copy(new.data[pos+4:], key)
+	copy(new.data[pos+4+uint16(len(key)):], val)
+	// the offset of the next key
+	new.setOffset(idx+1, new.getOffset(idx)+4+uint16(len(key)+len(val)))
+}
+
 type BTree struct {
 	// pointer (a nonzero page number)
 	root uint64
+	// the maximum size of a node in bytes, which is the page size minus the page trailer
+	nodeSize int
+	// the first root is prefix-compressed, the other nodes are like the nodes they come from
+	prefixed bool
+	// the fill factor of the nodes built by BulkLoad, BTREE_BULK_FILL if not set
+	fill float64
 	// callbacks for managing on-disk pages
-	get func(uint64) BNode // dereference a pointer
-	new func(BNode) uint64 // allocate a new page
-	del func(uint64)       // deallocate a page
+	get func(uint64) (BNode, error) // dereference a pointer
+	new func(BNode) uint64          // allocate a new page
+	del func(uint64)                // deallocate a page
+	// optional, hints that the pages will be read soon
+	prefetch func([]uint64)
+	// optional, encodes the values of a database with KV.CompressValues, KV.ValueChecksums
+	// or KV.ExpiringKeys, see values.go
+	vals *valCodec
+	// the time of the transaction in unix milliseconds, the keys whose deadline is not after it
+	// are expired, see ttl.go. Nothing expires at 0.
+	now int64
+}
+
+// getNode dereferences a pointer and validates the node, so that a corrupted page
+// surfaces as an error identifying the page instead of an out-of-range panic.
+func (tree *BTree) getNode(ptr uint64) (BNode, error) {
+	node, err := tree.get(ptr)
+	if err != nil {
+		return BNode{}, err
+	}
+	if err := nodeCheck(node); err != nil {
+		return BNode{}, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	return node, nil
+}
+
+// Get looks up a key and returns its value. The returned slice points into the page
+// and must not be modified or retained beyond the lifetime of the page.
+// An expired key is not found.
+func (tree *BTree) Get(key []byte) ([]byte, bool, error) {
+	stored, ok, err := tree.getStored(key)
+	if !ok || tree.vals.expired(stored, tree.now) {
+		return nil, false, err
+	}
+	val, err := tree.vals.decode(stored)
+	return val, err == nil, err
+}
+
+// getStored looks up a key and returns its value as it's stored, see values.go.
+func (tree *BTree) getStored(key []byte) ([]byte, bool, error) {
+	if err := checkKey(key); err != nil {
+		return nil, false, err
+	}
+	if tree.root == 0 {
+		return nil, false, nil
+	}
+	node, err := tree.getNode(tree.root)
+	if err != nil {
+		return nil, false, err
+	}
+	return treeGet(tree, node, key)
+}
+
+// treeGet descends from the given node to the leaf that may contain the key.
+func treeGet(tree *BTree, node BNode, key []byte) ([]byte, bool, error) {
+	for depth := 1; ; depth++ {
+		idx := nodeLookupLE(node, key)
+		if node.btype() == BNODE_LEAF {
+			if node.cmpKey(idx, key) == 0 {
+				return node.getVal(idx), true, nil
+			}
+			return nil, false, nil
+		}
+		if err := checkDepth(depth); err != nil {
+			return nil, false, err
+		}
+		kid, err := tree.getNode(node.getPtr(idx))
+		if err != nil {
+			return nil, false, err
+		}
+		node = kid
+	}
+}
+
+// treeLevel is a node on the path from the root to a leaf, see treePath.
+type treeLevel struct {
+	ptr    uint64
+	node   BNode
+	idx    uint16 // the index of the key, or of the kid the path goes on to
+	lo, hi []byte // the key range of the node, see kidFences
+}
+
+// treePath descends from the root to the leaf that may contain the key and returns the path.
+// The updates walk it back up instead of recursing, so their stack doesn't grow with the tree.
+func treePath(tree *BTree, key []byte) ([]treeLevel, error) {
+	var path []treeLevel
+	var lo, hi []byte
+	for ptr := tree.root; ; {
+		if err := checkDepth(len(path)); err != nil {
+			return nil, err
+		}
+		node, err := tree.getNode(ptr)
+		if err != nil {
+			return nil, err
+		}
+		idx := nodeLookupLE(node, key)
+		path = append(path, treeLevel{ptr: ptr, node: node, idx: idx, lo: lo, hi: hi})
+		if node.btype() == BNODE_LEAF {
+			return path, nil
+		}
+		lo, hi = kidFences(node, idx, lo, hi)
+		ptr = node.getPtr(idx)
+	}
+}
+
+// checkDepth fails a descent that went BTREE_MAX_DEPTH levels deep without reaching a leaf.
+func checkDepth(depth int) error {
+	if depth >= BTREE_MAX_DEPTH {
+		return fmt.Errorf("%w: the tree is deeper than %d levels", ErrCorruptNode, BTREE_MAX_DEPTH)
+	}
+	return nil
+}
+
+// nodeFits reports whether a node of the given size, and the given size without
+// prefix compression, fits into a page.
+func nodeFits(nbytes int, expanded int, size int) bool {
+	return nbytes <= size && expanded <= BTREE_MAX_EXPANSION*size
+}
+
+// kidFences returns the key range [lo, hi) of the kid at idx of an internal node
+// whose key range is [lo, hi). A nil hi is unbounded.
+// The ranges are only needed for the prefixes, so nothing is returned for other nodes.
+func kidFences(node BNode, idx uint16, lo []byte, hi []byte) ([]byte, []byte) {
+	if !node.prefixed() {
+		return nil, nil
+	}
+	if idx > 0 {
+		lo = node.getKey(idx)
+	}
+	if idx+1 < node.nkeys() {
+		hi = node.getKey(idx + 1)
+	}
+	return lo, hi
+}
+
+// fencePrefix returns the prefix of a node with the key range [lo, hi).
+// Every key in between shares the common prefix of lo and hi, since they are sorted.
+// An unbounded range has no prefix.
+func fencePrefix(lo []byte, hi []byte) []byte {
+	if hi == nil {
+		return nil
+	}
+	return commonPrefix(lo, hi)
+}
+
+// commonPrefix returns the longest common prefix of two keys.
+func commonPrefix(a []byte, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
+
+func init() {
+	// a node with a single KV pair of the maximum size must always fit into a page
+	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
+	assert(node1max <= BTREE_MIN_PAGE_SIZE-PAGE_TRAILER)
+}
+
+// checkPageSize validates a page size, which must be a power of two within the limits.
+func checkPageSize(size int) error {
+	if size < BTREE_MIN_PAGE_SIZE || size > BTREE_MAX_PAGE_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("bad page size %d, must be a power of two from %d to %d",
+			size, BTREE_MIN_PAGE_SIZE, BTREE_MAX_PAGE_SIZE)
+	}
+	return nil
 }
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+)
+
+// nodeLookupLELinear is the linear scan equivalent of nodeLookupLE, the baseline of the benchmarks.
+func nodeLookupLELinear(node BNode, key []byte) uint16 {
+	nkeys := node.nkeys()
+	found := uint16(0)
+	for i := uint16(1); i < nkeys; i++ {
+		cmp := node.cmpKey(i, key)
+		if cmp <= 0 {
+			found = i
+		}
+		if cmp >= 0 {
+			break
+		}
+	}
+	return found
+}
+
+// testLeaf builds a leaf with nkeys 8-byte keys 0, 2, 4, ... and empty values.
+// Wide nodes don't fit into a page, which is fine since the node is never stored.
+func testLeaf(nkeys uint16) BNode {
+	node := BNode{data: make([]byte, HEADER+int(nkeys)*(8+2+4+8))}
+	node.setHeader(BNODE_LEAF, nkeys)
+	for i := uint16(0); i < nkeys; i++ {
+		key := binary.BigEndian.AppendUint64(nil, 2*uint64(i))
+		nodeAppendKV(node, i, 0, key, nil)
+	}
+	return node
+}
+
+// testLookups returns keys for the leaves of testLeaf, existing ones as well as keys that fall
+// into the gaps between them.
+func testLookups(nkeys uint16) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	lookups := make([][]byte, 1024)
+	for i := range lookups {
+		lookups[i] = binary.BigEndian.AppendUint64(nil, uint64(rng.Intn(2*int(nkeys))))
+	}
+	return lookups
+}
+
+func TestNodeLookupLE(t *testing.T) {
+	for _, nkeys := range []uint16{1, 2, 3, 8, 33, 512} {
+		node := testLeaf(nkeys)
+		for k := uint64(0); k < 2*uint64(nkeys)+2; k++ {
+			key := binary.BigEndian.AppendUint64(nil, k)
+			if got, want := nodeLookupLE(node, key), nodeLookupLELinear(node, key); got != want {
+				t.Fatalf("%d keys, key %d: got %d, want %d", nkeys, k, got, want)
+			}
+		}
+	}
+}
+
+func benchmarkNodeLookupLE(b *testing.B, lookup func(BNode, []byte) uint16) {
+	for _, nkeys := range []uint16{8, 32, 128, 512, 2048} {
+		node, lookups := testLeaf(nkeys), testLookups(nkeys)
+		b.Run(fmt.Sprintf("keys=%d", nkeys), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				lookup(node, lookups[i%len(lookups)])
+			}
+		})
+	}
+}
+
+func BenchmarkNodeLookupLE(b *testing.B) {
+	benchmarkNodeLookupLE(b, nodeLookupLE)
+}
+
+func BenchmarkNodeLookupLELinear(b *testing.B) {
+	benchmarkNodeLookupLE(b, nodeLookupLELinear)
+}
+
+// testTree is a BTree on in-memory pages, checked against a map of the keys it should hold.
+type testTree struct {
+	tree  BTree
+	ref   map[string]string
+	pages map[uint64]BNode
+	next  uint64 // the last page allocated
+}
+
+func newTestTree() *testTree {
+	c := &testTree{ref: map[string]string{}, pages: map[uint64]BNode{}}
+	c.tree = BTree{
+		nodeSize: BTREE_PAGE_SIZE - PAGE_TRAILER,
+		get: func(ptr uint64) (BNode, error) {
+			node, ok := c.pages[ptr]
+			if !ok {
+				return BNode{}, fmt.Errorf("page %d is not allocated", ptr)
+			}
+			return node, nil
+		},
+		new: func(node BNode) uint64 {
+			if int(node.nbytes()) > c.tree.nodeSize {
+				panic("the node doesn't fit into a page")
+			}
+			c.next++
+			c.pages[c.next] = node
+			return c.next
+		},
+		del: func(ptr uint64) {
+			if _, ok := c.pages[ptr]; !ok {
+				panic(fmt.Sprintf("page %d freed twice", ptr))
+			}
+			delete(c.pages, ptr)
+		},
+	}
+	return c
+}
+
+func (c *testTree) insert(t *testing.T, key string, val string) {
+	if err := c.tree.Insert([]byte(key), []byte(val)); err != nil {
+		t.Fatalf("insert %q: %v", key, err)
+	}
+	c.ref[key] = val
+}
+
+func (c *testTree) delete(t *testing.T, key string) {
+	_, want := c.ref[key]
+	ok, err := c.tree.Delete([]byte(key))
+	if err != nil || ok != want {
+		t.Fatalf("delete %q: got %v, %v, want %v", key, ok, err, want)
+	}
+	delete(c.ref, key)
+}
+
+// check walks the subtree of a node with the key range [lo, hi), validating its nodes, and
+// returns its depth and the number of its pages.
+func (c *testTree) check(t *testing.T, ptr uint64, lo []byte, hi []byte) (int, int) {
+	node, err := c.tree.getNode(ptr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nkeys := node.nkeys()
+	if nkeys == 0 {
+		t.Fatalf("page %d has no keys", ptr)
+	}
+	if !nodeFits(int(node.nbytes()), node.expanded(), c.tree.nodeSize) {
+		t.Fatalf("page %d doesn't fit", ptr)
+	}
+	if node.prefixed() != c.tree.prefixed {
+		t.Fatalf("page %d: prefixed %v in a tree with prefixed %v", ptr, node.prefixed(), c.tree.prefixed)
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		key := node.getKey(i)
+		if bytes.Compare(key, lo) < 0 || hi != nil && bytes.Compare(key, hi) >= 0 {
+			t.Fatalf("page %d: key %q out of [%q, %q)", ptr, key, lo, hi)
+		}
+		if i > 0 && bytes.Compare(node.getKey(i-1), key) >= 0 {
+			t.Fatalf("page %d: the keys are not sorted", ptr)
+		}
+	}
+	if node.btype() == BNODE_LEAF {
+		return 1, 1
+	}
+	depth, pages := 0, 1
+	for i := uint16(0); i < nkeys; i++ {
+		klo, khi := kidFences(node, i, lo, hi)
+		d, n := c.check(t, node.getPtr(i), klo, khi)
+		if i > 0 && d != depth {
+			t.Fatalf("page %d: the kids have different depths", ptr)
+		}
+		depth, pages = d, pages+n
+	}
+	return depth + 1, pages
+}
+
+// verify checks the structure of the tree and that it holds exactly the keys of the map,
+// and returns the depth of the tree.
+func (c *testTree) verify(t *testing.T) int {
+	t.Helper()
+	depth, pages := 0, 0
+	if c.tree.root != 0 {
+		depth, pages = c.check(t, c.tree.root, nil, nil)
+	}
+	if pages != len(c.pages) {
+		t.Fatalf("%d pages are reachable, %d are allocated", pages, len(c.pages))
+	}
+	want := make([]string, 0, len(c.ref))
+	for key := range c.ref {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	cur := c.tree.Seek(nil)
+	for _, key := range want {
+		if !cur.Valid() || string(cur.Key()) != key || string(cur.Val()) != c.ref[key] {
+			t.Fatalf("the cursor is at %q, want %q: %v", cur.Key(), key, cur.Err())
+		}
+		cur.Next()
+	}
+	if cur.Valid() || cur.Err() != nil {
+		t.Fatalf("the cursor is at %q after the last key: %v", cur.Key(), cur.Err())
+	}
+	return depth
+}
+
+func TestTreeReference(t *testing.T) {
+	for _, prefixed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("prefixed=%v", prefixed), func(t *testing.T) {
+			n := 200000
+			if testing.Short() {
+				n = 20000
+			}
+			rng := rand.New(rand.NewSource(1))
+			c := newTestTree()
+			c.tree.prefixed = prefixed
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("key%07d", rng.Intn(n/4))
+				if rng.Intn(3) == 0 {
+					c.delete(t, key)
+				} else {
+					c.insert(t, key, fmt.Sprintf("val%d", i))
+				}
+				if i%(n/10) == 0 {
+					c.verify(t)
+				}
+			}
+			c.verify(t)
+			for key := range c.ref {
+				c.delete(t, key)
+			}
+			c.verify(t)
+		})
+	}
+}
+
+func TestTreeDeep(t *testing.T) {
+	// the longest keys make the tree as deep as it gets
+	rng := rand.New(rand.NewSource(1))
+	c := newTestTree()
+	for i := 0; i < 20000; i++ {
+		key := fmt.Sprintf("%08d%0*d", rng.Intn(1e8), BTREE_MAX_KEY_SIZE-8, i)
+		c.insert(t, key, "")
+		if i%3 == 0 {
+			c.delete(t, key)
+		}
+	}
+	if depth := c.verify(t); depth < 6 {
+		t.Fatalf("the tree is %d levels deep", depth)
+	}
+	for key := range c.ref {
+		c.delete(t, key)
+	}
+	c.verify(t)
+}
+
+func TestTreeCorrupt(t *testing.T) {
+	c := newTestTree()
+	for i := 0; i < 1000; i++ {
+		c.insert(t, fmt.Sprintf("key%04d", i), "")
+	}
+	// the root links to a page that links to itself
+	root, _ := c.tree.getNode(c.tree.root)
+	if root.btype() != BNODE_NODE || root.nkeys() < 3 {
+		t.Fatal("the tree is too shallow")
+	}
+	self := root.getPtr(1)
+	node := BNode{data: make([]byte, c.tree.nodeSize)}
+	node.setHeader(BNODE_NODE, 1)
+	nodeAppendKV(node, 0, self, root.getKey(1), nil)
+	c.pages[self] = node
+	key := append(bytes.Clone(root.getKey(1)), 0)
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"Get", func() error { _, _, err := c.tree.Get(key); return err }},
+		{"Insert", func() error { return c.tree.Insert(key, nil) }},
+		{"Delete", func() error { _, err := c.tree.Delete(key); return err }},
+		{"Seek", func() error { return c.tree.Seek(key).Err() }},
+		{"DeleteRange", func() error { _, err := c.tree.DeleteRange(key, nil); return err }},
+		// drops the page as a whole
+		{"DeleteRange/drop", func() error { _, err := c.tree.DeleteRange([]byte("key"), nil); return err }},
+	}
+	for _, test := range tests {
+		if err := test.run(); !errors.Is(err, ErrCorruptNode) {
+			t.Errorf("%s: %v", test.name, err)
+		}
+	}
+}
+
+// testKeys iterates over the keys 0, 2, 4, ... as 8-byte big-endian numbers, with empty values.
+type testKeys struct {
+	i, n uint64
+	key  []byte
+}
+
+func (it *testKeys) Valid() bool { return it.i < it.n }
+func (it *testKeys) Key() []byte {
+	it.key = binary.BigEndian.AppendUint64(it.key[:0], 2*it.i)
+	return it.key
+}
+func (it *testKeys) Val() []byte { return nil }
+func (it *testKeys) Next()       { it.i++ }
+func (it *testKeys) Err() error  { return nil }
+
+// TestTreeHuge loads a million keys, or over a hundred million with SCRATCHDB_HUGE=1
+// which takes minutes and a few GB of disk.
+func TestTreeHuge(t *testing.T) {
+	N := 1 << 20
+	if os.Getenv("SCRATCHDB_HUGE") == "1" {
+		N = 1 << 27
+	} else if testing.Short() {
+		N = 1 << 16
+	}
+	db := &KV{Path: t.TempDir() + "/db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.BulkLoad(&testKeys{n: uint64(N)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// random updates all over the tree, the odd keys are new
+	rng := rand.New(rand.NewSource(1))
+	ref := map[uint64]bool{} // the updated keys, whether they exist
+	count := N
+	for b := 0; b < 16; b++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 1<<14; i++ {
+			k := uint64(rng.Int63n(int64(2 * N)))
+			key := binary.BigEndian.AppendUint64(nil, k)
+			exists, ok := ref[k]
+			if !ok {
+				exists = k%2 == 0
+			}
+			if rng.Intn(2) == 0 {
+				if err := tx.Set(key, nil); err != nil {
+					t.Fatal(err)
+				}
+				if !exists {
+					count++
+				}
+				ref[k] = true
+			} else {
+				deleted, err := tx.Del(key)
+				if err != nil || deleted != exists {
+					t.Fatalf("delete %d: got %v, %v, want %v", k, deleted, err, exists)
+				}
+				if exists {
+					count--
+				}
+				ref[k] = false
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for k, want := range ref {
+		if _, ok, err := tx.Get(binary.BigEndian.AppendUint64(nil, k)); err != nil || ok != want {
+			t.Fatalf("get %d: got %v, %v, want %v", k, ok, err, want)
+		}
+	}
+	n := 0
+	cur := tx.Seek(nil)
+	for ; cur.Valid(); cur.Next() {
+		n++
+	}
+	if cur.Err() != nil || n != count {
+		t.Fatalf("%d keys, want %d: %v", n, count, cur.Err())
+	}
+}
+
+func TestTreeBulkLoad(t *testing.T) {
+	for _, prefixed := range []bool{false, true} {
+		for _, n := range []int{0, 1, 100, 50000} {
+			t.Run(fmt.Sprintf("prefixed=%v,n=%d", prefixed, n), func(t *testing.T) {
+				c := newTestTree()
+				c.tree.prefixed = prefixed
+				c.tree.fill = 0.7
+				it := &freezeIter{}
+				for i := 0; i < n; i++ {
+					key, val := fmt.Sprintf("key%07d", 2*i), fmt.Sprint("val", i)
+					it.entries = append(it.entries, freezeEntry{key: []byte(key), val: []byte(val)})
+					c.ref[key] = val
+				}
+				if err := c.tree.BulkLoad(it); err != nil {
+					t.Fatal(err)
+				}
+				c.verify(t)
+				// the nodes have room for the keys in between
+				for i := 0; i < n; i += 3 {
+					c.insert(t, fmt.Sprintf("key%07d", 2*i+1), "new")
+				}
+				c.verify(t)
+				if n > 0 {
+					if err := c.tree.BulkLoad(&freezeIter{entries: []freezeEntry{{key: []byte("a")}}}); !errors.Is(err, ErrNotEmpty) {
+						t.Fatalf("BulkLoad into a tree with keys: %v", err)
+					}
+				}
+			})
+		}
+	}
+	c := newTestTree()
+	unsorted := &freezeIter{entries: []freezeEntry{{key: []byte("b")}, {key: []byte("a")}}}
+	if err := c.tree.BulkLoad(unsorted); !errors.Is(err, ErrUnsorted) {
+		t.Fatalf("unsorted keys: %v", err)
+	}
+	if c.tree.root != 0 {
+		t.Fatal("a failed BulkLoad set the root")
+	}
+}
@@ -0,0 +1,830 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+// DB_SIG is the signature at the start of the master page
+const DB_SIG = "ScratchDB-Master"
+
+// DB_FORMAT is the version of the file format written by this code. Files with a newer
+// version are refused. Files written before the version was recorded have 0 in its place.
+const DB_FORMAT = 2
+
+// flags in the master page
+const (
+	// the pages end with a CRC32C checksum of the page. New databases always have it,
+	// databases created before checksums were added don't.
+	MASTER_FLAG_CHECKSUM = 1
+	// the database was written by Freeze and can't be modified
+	MASTER_FLAG_FROZEN = 2
+	// the database was created with prefix-compressed nodes, see KV.PrefixKeys
+	MASTER_FLAG_PREFIX = 4
+	// the values are tagged and can be compressed with a dictionary, see KV.CompressValues
+	MASTER_FLAG_VALUES = 8
+	// the values end with a CRC32C checksum, see KV.ValueChecksums
+	MASTER_FLAG_VALSUM = 16
+	// the values start with a deadline and the keys can expire, see KV.ExpiringKeys
+	MASTER_FLAG_TTL = 32
+
+	MASTER_FLAGS_KNOWN = MASTER_FLAG_CHECKSUM | MASTER_FLAG_FROZEN | MASTER_FLAG_PREFIX | MASTER_FLAG_VALUES |
+		MASTER_FLAG_VALSUM | MASTER_FLAG_TTL
+)
+
+// MASTER_SIZE is the size of the used part of the master page
+const MASTER_SIZE = 64
+
+// PAGE_TRAILER is the size of the checksum at the end of each page
+const PAGE_TRAILER = 4
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// KV is a key-value store that persists a BTree to a single memory-mapped file.
+// The first page of the file is the master page, the remaining pages are BTree nodes.
+//
+// Every commit creates a new version of the tree. Pages are never modified while a version
+// that references them can still be read: a page freed by a commit is only reused once
+// there is no read-only transaction left on an older version. The free pages are stored
+// with each commit, see freelist.go.
+type KV struct {
+	Path     string
+	Trace    *TraceWriter // optional, records every Get/Set/Del and transaction boundaries
+	PageSize int          // page size of a new database, BTREE_PAGE_SIZE if not set
+	// store the common prefix of the keys of each node once in a new database, which fits
+	// more keys into a node when they share long prefixes, like time-ordered or namespaced keys.
+	PrefixKeys bool
+	BulkFill   float64 // fill factor of the nodes built by Tx.BulkLoad, from 0.5 to 1, BTREE_BULK_FILL if not set
+	CachePages int     // verified pages kept by the page cache, PAGE_CACHE_PAGES if not set, negative to disable
+	// compress the values of a new database with a zstd dictionary trained on the first values
+	// written to it, which pays off for many small values that look alike, see dict.go.
+	// The values can then be at most BTREE_MAX_VAL_SIZE-1 bytes.
+	CompressValues bool
+	// store a checksum of each value of a new database, computed before the value is encoded
+	// and verified when it's read, which catches corruption the page checksums can't, see values.go.
+	// Reading a corrupted value returns ErrValueChecksum. The values can then be 4 bytes shorter.
+	ValueChecksums bool
+	// allow keys with a TTL in a new database, see Tx.SetWithTTL and ttl.go. Each value then starts
+	// with its deadline, a byte for the keys without one, and the values can be 8 bytes shorter.
+	ExpiringKeys bool
+	// secondary indexes of the main keyspace, see Tx.IndexScan and index.go. Open builds the new ones.
+	Indexes []Index
+	// low-memory profile without background goroutines, see constrained.go
+	Constrained bool
+	// background jobs, see jobs.go
+	MaxJobs     int // the number of background jobs that can run at once, 1 if not set
+	JobPageRate int // pages per second that background jobs can read or write, unlimited if not set
+	// remote databases, see remote.go
+	RemoteCachePages int // pages cached by OpenHTTP, REMOTE_CACHE_PAGES if not set
+	// WAL mode, see wal.go
+	WAL             bool // commit to a write-ahead log instead of the main file
+	CheckpointPages int  // the number of pages in the WAL that triggers a checkpoint, WAL_CHECKPOINT_PAGES if not set
+	FullRecovery    bool // verify and checkpoint the whole WAL before Open returns, instead of a lazy recovery
+	// several processes can open the database, one of them writes for the others, see lease.go
+	Shared bool
+	// internals
+	fp      dbFile       // the database file, or a memFile
+	static  bool         // opened from memory by OpenBytes or from a server by OpenHTTP, read-only
+	remote  *remotePages // the pages of a database opened by OpenHTTP, instead of the mapped file
+	jobs    *scheduler
+	cache   *pageCache // nil if disabled or if the pages have no checksums
+	lease   *lease     // nil unless in shared mode
+	sweeper *sweeper   // purges the expired keys, see ttl.go
+	watch   watchers   // see watch.go
+	writer  sync.Mutex // held by the writable transaction
+	mu      sync.Mutex // protects the fields below that are read by Begin
+	tree    BTree      // the committed tree
+	mmap    struct {
+		file   int      // file size, can be larger than the database size
+		total  int      // mmap size, can be larger than the file size
+		chunks [][]byte // multiple mmaps, can be non-continuous
+	}
+	flags   uint32         // MASTER_FLAG_*
+	version uint64         // version of the committed tree, incremented by every commit
+	readers map[uint64]int // number of read-only transactions on each version
+	pins    map[uint64]int // number of snapshots of each version, nil until loaded, see snapshot.go
+	trainer bool           // a job is training the dictionary of the values, see dict.go
+	page    struct {
+		size    int               // page size in bytes
+		flushed uint64            // database size in number of pages
+		nappend uint64            // pages appended to the file by the writable transaction
+		nreuse  int               // pages taken from free.ready by the writable transaction
+		updates map[uint64][]byte // pages allocated by the writable transaction, not yet written
+		freed   []uint64          // committed pages freed by the writable transaction
+		scrap   []uint64          // pages allocated and freed again by the writable transaction
+		// the free list written by the writable transaction, see freelist.go
+		freeHead  uint64
+		freePages []uint64
+	}
+	free struct {
+		pending []freedPages // freed pages that older versions may still reference
+		ready   []uint64     // freed pages that no version being read references
+		head    uint64       // the first page of the stored free list, 0 if none
+		pages   []uint64     // the pages of the stored free list
+	}
+	wal struct {
+		fp        *os.File  // nil if not in WAL mode
+		size      int64     // the end of the last complete record
+		base      uint64    // database size as of the last checkpoint, the pages below are in the main file
+		index     *walIndex // pages committed since the last checkpoint
+		npages    int       // number of page images in the WAL
+		scheduled bool      // a checkpoint job is queued or running
+		buf       []byte
+	}
+}
+
+// freedPages is a list of pages that were freed by the commit of a version.
+// The pages are still referenced by all the older versions.
+type freedPages struct {
+	version uint64
+	ptrs    []uint64
+}
+
+// dbFile is the storage of the database: an *os.File, or a memFile for a database in memory.
+// The pages are read and written through the chunks returned by mmapChunk,
+// only the master page is written with WriteAt.
+type dbFile interface {
+	io.WriterAt
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// mmapChunk maps size bytes of the file at the given offset into memory.
+func mmapChunk(fp dbFile, offset int64, size int) ([]byte, error) {
+	if m, ok := fp.(*memFile); ok {
+		return m.alloc(offset, size), nil
+	}
+	return mmapFile(fp.(*os.File), offset, size)
+}
+
+// mmapInit maps the whole file into memory. The mapping is larger than the file
+// so that the file can grow for a while before a new mapping is needed.
+func mmapInit(fp dbFile, fileSize int, mmapSize int) ([]byte, error) {
+	assert(mmapSize%BTREE_MAX_PAGE_SIZE == 0)
+	for mmapSize < fileSize {
+		if mmapSize > math.MaxInt/2 {
+			mmapSize = fileSize // doubling would overflow
+			break
+		}
+		mmapSize *= 2
+	}
+	// mmapSize can be larger than the file
+	chunk, err := mmapChunk(fp, 0, mmapSize)
+	if err != nil {
+		return nil, fmt.Errorf("mmap: %w", err)
+	}
+	return chunk, nil
+}
+
+// Open opens (or creates) the database file at db.Path and loads the master page.
+// An existing database keeps the page size it was created with, db.PageSize is ignored.
+func (db *KV) Open() error {
+	db.constrain()
+	if db.PageSize != 0 {
+		if err := checkPageSize(db.PageSize); err != nil {
+			return fmt.Errorf("KV.Open: %w", err)
+		}
+	}
+	if db.Shared && db.WAL {
+		return fmt.Errorf("KV.Open: WAL mode in shared mode: %w", errors.ErrUnsupported)
+	}
+	fp, err := os.OpenFile(db.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	db.fp = fp
+	db.jobs = newScheduler(db.MaxJobs, db.JobPageRate, db.Constrained)
+
+	fi, err := fp.Stat()
+	if err != nil {
+		err = fmt.Errorf("stat: %w", err)
+		goto fail
+	}
+	err = openMapped(db, fi.Size(), db.mmapSize())
+	if err != nil {
+		goto fail
+	}
+	db.wal.base = db.page.flushed
+	if db.WAL && db.flags&MASTER_FLAG_FROZEN != 0 {
+		err = fmt.Errorf("WAL mode: %w", ErrReadOnly)
+		goto fail
+	}
+	if db.Shared {
+		err = leaseOpen(db)
+		if err != nil {
+			goto fail
+		}
+	}
+	err = walOpen(db)
+	if err != nil {
+		goto fail
+	}
+	if db.lease == nil {
+		err = freeLoad(db) // the leader loads it when it takes over, see leaseReload
+		if err != nil {
+			goto fail
+		}
+	}
+	err = indexOpen(db)
+	if err != nil {
+		goto fail
+	}
+	db.sweepStart()
+	return nil
+
+fail:
+	db.Close()
+	return fmt.Errorf("KV.Open: %w", err)
+}
+
+// openMapped maps the file of the given size and loads the master page.
+func openMapped(db *KV, size int64, mmapSize int) error {
+	fileSize, err := intSize(size)
+	if err != nil {
+		return err
+	}
+	chunk, err := mmapInit(db.fp, fileSize, mmapSize)
+	if err != nil {
+		return err
+	}
+	db.mmap.file = fileSize
+	db.mmap.total = len(chunk)
+	db.mmap.chunks = [][]byte{chunk}
+	db.readers = map[uint64]int{}
+	db.page.updates = map[uint64][]byte{}
+
+	// btree callbacks, the get callback is set by each transaction
+	db.tree.new = db.pageNew
+	db.tree.del = db.pageDel
+	db.tree.fill = db.BulkFill
+
+	return masterLoad(db)
+}
+
+// Close stops the background jobs, unmaps the file and closes it.
+// A database opened from memory is just released.
+func (db *KV) Close() {
+	if db.sweeper != nil {
+		db.sweeper.close()
+		db.sweeper = nil
+	}
+	db.watchClose()
+	if db.lease != nil {
+		db.lease.close()
+	}
+	if db.jobs != nil {
+		db.jobs.close()
+	}
+	if db.remote != nil {
+		db.remote.close()
+	}
+	db.tree.vals.close()
+	if db.static {
+		db.mmap.chunks = nil
+		return
+	}
+	if _, ok := db.fp.(*memFile); !ok {
+		for _, chunk := range db.mmap.chunks {
+			err := munmap(chunk)
+			assert(err == nil)
+		}
+	}
+	db.mmap.chunks = nil
+	if db.wal.fp != nil {
+		_ = db.wal.fp.Close()
+	}
+	if db.fp != nil {
+		_ = db.fp.Close()
+	}
+}
+
+// Get reads a key in its own read-only transaction. The returned value is a copy.
+func (db *KV) Get(key []byte) ([]byte, bool, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	val, ok, err := tx.Get(key)
+	return bytes.Clone(val), ok, err
+}
+
+// Stats describes the state of a KV.
+type Stats struct {
+	Version   uint64 // version of the committed tree
+	Pages     uint64 // database size in number of pages, including the master page
+	FreePages int    // freed pages, pending or ready for reuse
+	Readers   int    // open read-only transactions
+	WALPages  int    // page images in the WAL waiting for a checkpoint
+
+	CacheHits   uint64 // page reads served by the page cache
+	CacheMisses uint64 // page reads that verified the page
+
+	Jobs        []JobInfo // running jobs first, then the queued ones in the order they will start
+	JobsPaused  bool
+	JobsDone    int
+	JobsFailed  int
+	JobsLastErr error // the error of the last job that failed
+}
+
+// Stats returns the current state of the KV.
+func (db *KV) Stats() Stats {
+	var st Stats
+	db.mu.Lock()
+	st.Version = db.version
+	st.Pages = db.page.flushed
+	st.FreePages = len(db.free.ready)
+	for _, f := range db.free.pending {
+		st.FreePages += len(f.ptrs)
+	}
+	for _, n := range db.readers {
+		st.Readers += n
+	}
+	st.WALPages = db.wal.npages
+	db.mu.Unlock()
+	db.jobs.stats(&st)
+	if db.cache != nil {
+		st.CacheHits = db.cache.hits.Load()
+		st.CacheMisses = db.cache.misses.Load()
+	}
+	return st
+}
+
+// Set inserts or updates a key in its own transaction.
+func (db *KV) Set(key []byte, val []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(key, val); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Del deletes a key in its own transaction and reports whether it existed.
+func (db *KV) Del(key []byte) (bool, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := tx.Del(key)
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	return deleted, tx.Commit()
+}
+
+// CompareAndSwap sets a key to new if its value is expectedOld in its own transaction,
+// see Tx.CompareAndSwap.
+func (db *KV) CompareAndSwap(key []byte, expectedOld []byte, new []byte) (bool, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return false, err
+	}
+	swapped, err := tx.CompareAndSwap(key, expectedOld, new)
+	if err != nil || !swapped {
+		tx.Rollback()
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// pageGet dereferences a pointer to a page in the mapped file, as seen by a transaction
+// that began when the database had the given size and the given chunks were mapped.
+// The pages of a database opened by OpenHTTP are read from the server instead.
+// The checksum of the page is verified and the trailer is cut off, the result is kept in the page cache.
+func (db *KV) pageGet(chunks [][]byte, flushed uint64, ptr uint64) (BNode, error) {
+	if ptr >= flushed {
+		return BNode{}, fmt.Errorf("page %d: %w: pointer beyond the end of the database", ptr, ErrCorruptNode)
+	}
+	if db.cache != nil {
+		if node, ok := db.cache.get(ptr); ok {
+			return node, nil
+		}
+	}
+	var page []byte
+	if db.remote != nil {
+		data, err := db.remote.get(ptr)
+		if err != nil {
+			return BNode{}, fmt.Errorf("page %d: %w", ptr, err)
+		}
+		page = data
+	} else {
+		page = pageGetMapped(chunks, db.page.size, ptr).data
+	}
+	if db.flags&MASTER_FLAG_CHECKSUM != 0 && !pageVerify(page) {
+		return BNode{}, fmt.Errorf("page %d: %w", ptr, ErrChecksum)
+	}
+	node := BNode{data: page[:db.tree.nodeSize]}
+	if db.cache != nil {
+		db.cache.put(ptr, node)
+	}
+	return node, nil
+}
+
+// pageNew allocates a page for the writable transaction. The page is kept in memory until flushed.
+// Pages freed earlier in the same transaction are reused first, then the pages that no reader
+// can see anymore, and only then the file is extended.
+func (db *KV) pageNew(node BNode) uint64 {
+	assert(len(node.data) <= db.tree.nodeSize)
+	var ptr uint64
+	if n := len(db.page.scrap); n > 0 {
+		ptr = db.page.scrap[n-1]
+		db.page.scrap = db.page.scrap[:n-1]
+	} else if db.page.nreuse < len(db.free.ready) {
+		db.page.nreuse++
+		ptr = db.free.ready[len(db.free.ready)-db.page.nreuse]
+	} else {
+		ptr = db.page.flushed + db.page.nappend
+		db.page.nappend++
+	}
+	db.page.updates[ptr] = node.data
+	return ptr
+}
+
+// pageDel frees a page for the writable transaction.
+// A page that was allocated by the same transaction isn't referenced by anything else and can be
+// reused right away. A committed page is freed when the transaction commits, but it is not reused
+// before all readers of older versions are gone.
+func (db *KV) pageDel(ptr uint64) {
+	if _, ok := db.page.updates[ptr]; ok {
+		delete(db.page.updates, ptr)
+		db.page.scrap = append(db.page.scrap, ptr)
+		return
+	}
+	db.page.freed = append(db.page.freed, ptr)
+}
+
+// pageReset drops the pages allocated and freed by the writable transaction.
+func (db *KV) pageReset() {
+	db.page.nappend = 0
+	db.page.nreuse = 0
+	clear(db.page.updates)
+	db.page.freed = db.page.freed[:0]
+	db.page.scrap = db.page.scrap[:0]
+	db.page.freeHead, db.page.freePages = 0, nil
+}
+
+// freeRelease moves the pending freed pages that no reader or snapshot can see anymore to the
+// ready list. A page freed by version v is referenced by the versions before v only. Must hold db.mu.
+func (db *KV) freeRelease() {
+	oldest := db.version + 1
+	for v := range db.readers {
+		oldest = min(oldest, v)
+	}
+	for v := range db.pins {
+		oldest = min(oldest, v)
+	}
+	n := 0
+	for _, f := range db.free.pending {
+		if f.version > oldest {
+			break // pending is ordered by version
+		}
+		db.free.ready = append(db.free.ready, f.ptrs...)
+		n++
+	}
+	db.free.pending = append(db.free.pending[:0], db.free.pending[n:]...)
+}
+
+// readersAdd adds n transactions that read a version, n is negative when they are closed.
+// Must hold db.mu.
+func (db *KV) readersAdd(version uint64, n int) {
+	if db.readers[version] += n; db.readers[version] == 0 {
+		delete(db.readers, version)
+	}
+}
+
+// extendFile grows the file to hold at least npages pages.
+func extendFile(db *KV, npages uint64) error {
+	need, err := pagesSize(npages, db.page.size)
+	if err != nil {
+		return err
+	}
+	if db.mmap.file >= need {
+		return nil
+	}
+	filePages := uint64(db.mmap.file / db.page.size)
+	for filePages < npages {
+		// the file size is increased exponentially,
+		// so that we don't have to extend the file for every update.
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+	fileSize, err := pagesSize(filePages, db.page.size)
+	if err != nil {
+		fileSize = need // no room to grow ahead
+	}
+	if err := db.fp.Truncate(int64(fileSize)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	db.mmap.file = fileSize
+	return nil
+}
+
+// extendMmap maps additional chunks until the mapping covers npages pages.
+// Existing chunks are never remapped, so BNodes pointing into them remain valid.
+func extendMmap(db *KV, npages uint64) error {
+	need, err := pagesSize(npages, db.page.size)
+	if err != nil {
+		return err
+	}
+	for db.mmap.total < need {
+		// double the address space, or map the rest if that would overflow
+		size := db.mmap.total
+		if size > math.MaxInt-db.mmap.total {
+			size = need - db.mmap.total
+		}
+		chunk, err := mmapChunk(db.fp, int64(db.mmap.total), size)
+		if err != nil {
+			return fmt.Errorf("mmap: %w", err)
+		}
+		db.mmap.total += size
+		db.mmap.chunks = append(db.mmap.chunks, chunk)
+	}
+	return nil
+}
+
+// pagesSize returns the size of npages pages in bytes. The file is mapped into memory, so
+// it can't be larger than an int, which only limits a 32-bit platform.
+func pagesSize(npages uint64, pageSize int) (int, error) {
+	if npages > uint64(math.MaxInt/pageSize) {
+		return 0, fmt.Errorf("%w: %d pages of %d bytes", ErrFileTooLarge, npages, pageSize)
+	}
+	return int(npages) * pageSize, nil
+}
+
+// intSize returns the size of a file as an int, see pagesSize.
+func intSize(size int64) (int, error) {
+	if uint64(size) > math.MaxInt {
+		return 0, fmt.Errorf("%w: %d bytes", ErrFileTooLarge, size)
+	}
+	return int(size), nil
+}
+
+// flushPages persists the pages allocated by the writable transaction and makes the given root
+// the committed tree. On failure the allocated pages are dropped and the committed tree is unchanged.
+func flushPages(db *KV, root uint64) error {
+	freeStore(db)
+	var err error
+	if db.wal.fp != nil {
+		err = walAppend(db, root)
+	} else {
+		err = writePages(db)
+		if err == nil {
+			err = syncPages(db, root)
+		}
+	}
+	db.pageReset()
+	return err
+}
+
+// writePages copies the new pages into the mapped file, extending it as needed.
+// The pages being written are not referenced by any version that can be read.
+func writePages(db *KV) error {
+	npages := db.page.flushed + db.page.nappend
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	err := extendMmap(db, npages)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for ptr, page := range db.page.updates {
+		db.pageWrite(ptr, page)
+	}
+	return nil
+}
+
+// pageWrite copies a node into its page in the mapped file and seals the page with its checksum.
+func (db *KV) pageWrite(ptr uint64, node []byte) {
+	if db.cache != nil {
+		db.cache.drop(ptr)
+	}
+	page := pageGetMapped(db.mmap.chunks, db.page.size, ptr).data
+	n := copy(page[:db.tree.nodeSize], node)
+	clear(page[n:db.tree.nodeSize]) // the checksum covers the unused space too
+	if db.flags&MASTER_FLAG_CHECKSUM != 0 {
+		pageSeal(page)
+	}
+}
+
+// pageSeal stores the checksum of a page in its trailer.
+func pageSeal(page []byte) {
+	n := len(page) - PAGE_TRAILER
+	binary.LittleEndian.PutUint32(page[n:], crc32.Checksum(page[:n], castagnoli))
+}
+
+// pageVerify checks the checksum in the trailer of a page.
+func pageVerify(page []byte) bool {
+	n := len(page) - PAGE_TRAILER
+	return binary.LittleEndian.Uint32(page[n:]) == crc32.Checksum(page[:n], castagnoli)
+}
+
+// pageGetMapped returns a whole page in the mapped file, including the trailer.
+func pageGetMapped(chunks [][]byte, pageSize int, ptr uint64) BNode {
+	size := uint64(pageSize)
+	start := uint64(0)
+	for _, chunk := range chunks {
+		end := start + uint64(len(chunk))/size
+		if ptr < end {
+			offset := size * (ptr - start)
+			return BNode{data: chunk[offset : offset+size]}
+		}
+		start = end
+	}
+	panic("bad ptr")
+}
+
+// syncPages flushes the written pages to disk, then updates the master page and publishes the
+// new version. The order matters: the master page must never point to pages that are not on disk yet.
+func syncPages(db *KV, root uint64) error {
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	used := db.page.flushed + db.page.nappend
+	if err := masterStore(db, root, used, db.version+1, db.page.freeHead); err != nil {
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	publish(db, root, used)
+	return nil
+}
+
+// publish makes a durable commit the committed tree, so that new transactions see it,
+// and moves the pages freed by the commit to the pending list. The pages of the previous
+// free list are ready, the commit stored a new one.
+func publish(db *KV, root uint64, used uint64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.tree.root = root
+	db.page.flushed = used
+	db.version++
+	// the pages taken from the ready list are in use now, the scrap pages were never committed
+	db.free.ready = append(db.free.ready[:len(db.free.ready)-db.page.nreuse], db.page.scrap...)
+	db.free.ready = append(db.free.ready, db.free.pages...)
+	db.free.head, db.free.pages = db.page.freeHead, db.page.freePages
+	if len(db.page.freed) > 0 {
+		ptrs := append([]uint64(nil), db.page.freed...)
+		db.free.pending = append(db.free.pending, freedPages{version: db.version, ptrs: ptrs})
+	}
+}
+
+// the master page format.
+// it contains the pointer to the root, the number of used pages, the version of the tree,
+// the page size and flags, the format version, the first page of the free list (see freelist.go)
+// and a checksum of all of these if MASTER_FLAG_CHECKSUM is set.
+// | sig | btree_root | page_used | version | page_size | flags | crc32c | format | free |
+// | 16B | 8B         | 8B        | 8B      | 4B        | 4B    | 4B     | 4B     | 8B   |
+// Files written before these fields were added have zeros in them,
+// which means version 0, the default page size, no checksums, format 0 and no free list.
+// The checksum only covers the format if it's not 0, as it didn't before it was added,
+// and the free list from format 2 on.
+
+// masterLoad reads and validates the master page. An empty file is a new database.
+func masterLoad(db *KV) error {
+	if db.mmap.file == 0 {
+		// empty file, the master page will be created on the first write.
+		db.page.flushed = 1 // reserved for the master page
+		size := db.PageSize
+		if size == 0 {
+			size = BTREE_PAGE_SIZE
+		}
+		flags := uint32(MASTER_FLAG_CHECKSUM)
+		if db.PrefixKeys {
+			flags |= MASTER_FLAG_PREFIX
+		}
+		if db.CompressValues {
+			flags |= MASTER_FLAG_VALUES
+		}
+		if db.ValueChecksums {
+			flags |= MASTER_FLAG_VALSUM
+		}
+		if db.ExpiringKeys {
+			flags |= MASTER_FLAG_TTL
+		}
+		db.setPageSize(size, flags)
+		return nil
+	}
+
+	data := db.mmap.chunks[0]
+	root := binary.LittleEndian.Uint64(data[16:])
+	used := binary.LittleEndian.Uint64(data[24:])
+	version := binary.LittleEndian.Uint64(data[32:])
+	pageSize := int(binary.LittleEndian.Uint32(data[40:]))
+	if pageSize == 0 {
+		pageSize = BTREE_PAGE_SIZE
+	}
+	flags := binary.LittleEndian.Uint32(data[44:])
+	format := binary.LittleEndian.Uint32(data[52:])
+	free := binary.LittleEndian.Uint64(data[56:])
+
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		return fmt.Errorf("%w: bad signature, not a database file", ErrFormat)
+	}
+	if flags&MASTER_FLAG_CHECKSUM != 0 && binary.LittleEndian.Uint32(data[48:]) != masterChecksum(data) {
+		return fmt.Errorf("master page: %w", ErrChecksum)
+	}
+	if format > DB_FORMAT {
+		return fmt.Errorf("%w: format version %d, this version supports up to %d", ErrFormat, format, DB_FORMAT)
+	}
+	if flags&^MASTER_FLAGS_KNOWN != 0 {
+		return fmt.Errorf("%w: unknown flags %#x in the master page", ErrFormat, flags)
+	}
+	if err := checkPageSize(pageSize); err != nil {
+		return fmt.Errorf("%w: bad master page: %w", ErrFormat, err)
+	}
+	if db.mmap.file%pageSize != 0 {
+		return errors.New("file size is not a multiple of page size")
+	}
+	bad := !(1 <= used && used <= uint64(db.mmap.file/pageSize))
+	bad = bad || !(root < used) || !(free < used)
+	if bad {
+		return errors.New("bad master page")
+	}
+
+	db.tree.root = root
+	db.page.flushed = used
+	db.version = version
+	db.free.head = free
+	db.setPageSize(pageSize, flags)
+	return nil
+}
+
+// setPageSize sets up the page layout of the database.
+func (db *KV) setPageSize(size int, flags uint32) {
+	db.page.size = size
+	db.flags = flags
+	db.tree.nodeSize = size
+	db.tree.prefixed = flags&MASTER_FLAG_PREFIX != 0
+	db.tree.vals = nil
+	if flags&(MASTER_FLAG_VALUES|MASTER_FLAG_VALSUM|MASTER_FLAG_TTL) != 0 {
+		// the dictionary is loaded by the first transaction, see Tx.loadDict
+		db.tree.vals = &valCodec{
+			tagged: flags&MASTER_FLAG_VALUES != 0,
+			summed: flags&MASTER_FLAG_VALSUM != 0,
+			timed:  flags&MASTER_FLAG_TTL != 0,
+		}
+	}
+	db.cache = nil
+	if flags&MASTER_FLAG_CHECKSUM != 0 {
+		db.tree.nodeSize -= PAGE_TRAILER
+		// without checksums a page read is just a pointer into the mapping
+		db.cache = newPageCache(db.CachePages)
+	}
+}
+
+// masterStore writes the master page.
+func masterStore(db *KV, root uint64, used uint64, version uint64, free uint64) error {
+	data := masterEncode(root, used, version, free, db.page.size, db.flags)
+	// updating the page via mmap is not atomic, use pwrite() instead.
+	_, err := db.fp.WriteAt(data[:], 0)
+	if err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+	return nil
+}
+
+// masterEncode returns the used part of the master page.
+func masterEncode(root uint64, used uint64, version uint64, free uint64, pageSize int, flags uint32) [MASTER_SIZE]byte {
+	var data [MASTER_SIZE]byte
+	copy(data[:16], []byte(DB_SIG))
+	binary.LittleEndian.PutUint64(data[16:], root)
+	binary.LittleEndian.PutUint64(data[24:], used)
+	binary.LittleEndian.PutUint64(data[32:], version)
+	binary.LittleEndian.PutUint32(data[40:], uint32(pageSize))
+	binary.LittleEndian.PutUint32(data[44:], flags)
+	binary.LittleEndian.PutUint32(data[52:], DB_FORMAT)
+	binary.LittleEndian.PutUint64(data[56:], free)
+	binary.LittleEndian.PutUint32(data[48:], masterChecksum(data[:]))
+	return data
+}
+
+// masterChecksum computes the checksum of the master page, see the master page format.
+func masterChecksum(data []byte) uint32 {
+	crc := crc32.Checksum(data[:48], castagnoli)
+	switch format := binary.LittleEndian.Uint32(data[52:]); {
+	case format == 1:
+		crc = crc32.Update(crc, castagnoli, data[52:56])
+	case format >= 2:
+		crc = crc32.Update(crc, castagnoli, data[52:MASTER_SIZE])
+	}
+	return crc
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestPagesSize(t *testing.T) {
+	tests := []struct {
+		npages   uint64
+		pageSize int
+		want     int
+		err      error
+	}{
+		{0, 4096, 0, nil},
+		{1, 4096, 4096, nil},
+		{math.MaxInt / 4096, 4096, math.MaxInt / 4096 * 4096, nil},
+		{math.MaxInt/4096 + 1, 4096, 0, ErrFileTooLarge},
+		{math.MaxInt / BTREE_MAX_PAGE_SIZE, BTREE_MAX_PAGE_SIZE, math.MaxInt / BTREE_MAX_PAGE_SIZE * BTREE_MAX_PAGE_SIZE, nil},
+		{math.MaxInt/BTREE_MAX_PAGE_SIZE + 1, BTREE_MAX_PAGE_SIZE, 0, ErrFileTooLarge},
+		{math.MaxInt, 4096, 0, ErrFileTooLarge},
+		{math.MaxUint64, BTREE_MAX_PAGE_SIZE, 0, ErrFileTooLarge},
+	}
+	for _, test := range tests {
+		got, err := pagesSize(test.npages, test.pageSize)
+		if got != test.want || !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("pagesSize(%d, %d) = %d, %v, want %d, %v", test.npages, test.pageSize, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestIntSize(t *testing.T) {
+	type sizeTest struct {
+		size int64
+		want int
+		err  error
+	}
+	tests := []sizeTest{
+		{0, 0, nil},
+		{4096, 4096, nil},
+		{math.MaxInt, math.MaxInt, nil},
+		{-1, 0, ErrFileTooLarge},
+		{math.MinInt64, 0, ErrFileTooLarge},
+	}
+	if limit := int64(math.MaxInt); limit < math.MaxInt64 {
+		tests = append(tests, sizeTest{limit + 1, 0, ErrFileTooLarge}) // a 32-bit platform
+	}
+	for _, test := range tests {
+		got, err := intSize(test.size)
+		if got != test.want || !errors.Is(err, test.err) || (err == nil) != (test.err == nil) {
+			t.Errorf("intSize(%d) = %d, %v, want %d, %v", test.size, got, err, test.want, test.err)
+		}
+	}
+}
+
+// The free pages are stored with the commits, so updating the same keys across reopens
+// doesn't grow the file.
+func TestFreeListReopen(t *testing.T) {
+	for _, wal := range []bool{false, true} {
+		t.Run(fmt.Sprintf("wal=%v", wal), func(t *testing.T) {
+			path := t.TempDir() + "/db"
+			var pages []uint64
+			for round := 0; round < 5; round++ {
+				db := &KV{Path: path, WAL: wal, FullRecovery: true}
+				if err := db.Open(); err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 200; i++ {
+					if err := db.Set([]byte(fmt.Sprint("key", i%20)), []byte(fmt.Sprint("val", round, i))); err != nil {
+						t.Fatal(err)
+					}
+				}
+				pages = append(pages, db.Stats().Pages)
+				db.Close()
+			}
+			for _, n := range pages[1:] {
+				if n != pages[0] {
+					t.Fatalf("the database grew: %v pages", pages)
+				}
+			}
+		})
+	}
+}
+
+// The pages freed while a snapshot pins them are kept across reopens until it's deleted.
+func TestFreeListSnapshot(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateSnapshot([]byte("snap")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("new")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// the updates reuse the free pages, but not the ones of the snapshot
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("newer")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := db.BeginSnapshot([]byte("snap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	c := tx.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		if string(c.Val()) != "old" {
+			t.Fatalf("%q in the snapshot is %q", c.Key(), c.Val())
+		}
+		n++
+	}
+	tx.Rollback()
+	if c.Err() != nil || n != 1000 {
+		t.Fatalf("%d keys in the snapshot: %v", n, c.Err())
+	}
+
+	if err := db.DeleteSnapshot([]byte("snap")); err != nil {
+		t.Fatal(err)
+	}
+	// the pages of the snapshot are reused now
+	pages := db.Stats().Pages
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("newest")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if after := db.Stats().Pages; after != pages {
+		t.Fatalf("the database grew from %d to %d pages", pages, after)
+	}
+}
+
+// A master page of format 1, without the free list, is still read.
+func TestMasterFormat1(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(data[52:], 1)
+	binary.LittleEndian.PutUint64(data[56:], 0)
+	binary.LittleEndian.PutUint32(data[48:], masterChecksum(data))
+	db = &KV{}
+	if err := db.OpenBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, ok, err := db.Get([]byte("key")); err != nil || !ok || string(val) != "val" {
+		t.Fatalf("got %q, %v, %v", val, ok, err)
+	}
+}
+
+// A flipped bit in a page or in the master page is caught by the checksums.
+func TestPageChecksum(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("key"), []byte("val")); err != nil {
+		t.Fatal(err)
+	}
+	pageSize := db.page.size
+	db.Close()
+	clean, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(clean[44:])&MASTER_FLAG_CHECKSUM == 0 {
+		t.Fatal("a new database has no checksums")
+	}
+	root := int(binary.LittleEndian.Uint64(clean[16:]))
+
+	corrupt := func(off int) *KV {
+		t.Helper()
+		data := bytes.Clone(clean)
+		data[off] ^= 0x10
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return &KV{Path: path, CachePages: -1}
+	}
+	// the unused space of a page is covered too
+	for _, off := range []int{root*pageSize + 20, root*pageSize + pageSize/2, root*pageSize + pageSize - 1} {
+		db := corrupt(off)
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := db.Get([]byte("key"))
+		db.Close()
+		if !errors.Is(err, ErrChecksum) {
+			t.Fatalf("byte %d of the root page flipped: %v", off-root*pageSize, err)
+		}
+	}
+	if err := corrupt(20).Open(); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("master page flipped: %v", err)
+	}
+}
+
+// The keys with long common prefixes take fewer pages in a database with PrefixKeys.
+func TestPrefixKeys(t *testing.T) {
+	pages := map[bool]uint64{}
+	for _, prefixed := range []bool{false, true} {
+		path := t.TempDir() + "/db"
+		db := &KV{Path: path, PrefixKeys: prefixed}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3000; i++ {
+			key := fmt.Sprintf("tenant/0042/collection/orders/document/%08d", i*7%3000)
+			if err := db.Set([]byte(key), []byte("v")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		db.Close()
+
+		// the option only matters when the database is created
+		db = openTest(t, &KV{Path: path, PrefixKeys: !prefixed})
+		if (db.flags&MASTER_FLAG_PREFIX != 0) != prefixed {
+			t.Fatalf("flags %#x", db.flags)
+		}
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for c := tx.Seek([]byte("tenant/0042/collection/orders/document/00001000")); c.Valid(); c.Next() {
+			if want := fmt.Sprintf("tenant/0042/collection/orders/document/%08d", 1000+n); string(c.Key()) != want {
+				t.Fatalf("key %q, want %q", c.Key(), want)
+			}
+			n++
+		}
+		tx.Rollback()
+		if n != 2000 {
+			t.Fatalf("%d keys from 1000", n)
+		}
+		pages[prefixed] = db.Stats().Pages - uint64(db.Stats().FreePages)
+	}
+	if pages[true] >= pages[false]*3/4 {
+		t.Fatalf("%d pages with PrefixKeys, %d without", pages[true], pages[false])
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// benchmark is a benchmark of the bench subcommand. run receives the arguments after the benchmark name.
+type benchmark struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var benchmarks = []benchmark{
+	{"workload", "synthetic read/write/scan workload against a database file", benchWorkload},
+}
+
+// cmdBench implements `scratch-db bench <benchmark> [arguments]`.
+func cmdBench(args []string) error {
+	if len(args) > 0 {
+		for _, b := range benchmarks {
+			if b.name == args[0] {
+				return b.run(args[1:])
+			}
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: scratch-db bench <benchmark> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "benchmarks:")
+	for _, b := range benchmarks {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", b.name, b.summary)
+	}
+	return errors.New("no benchmark selected")
+}
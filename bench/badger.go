@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/adel-habib/scratch-db/workload"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// badgerStore adapts badger to workload.Store. Writes are synced to match KV.Set.
+type badgerStore struct {
+	db *badger.DB
+}
+
+func openBadgerStore(path string) (workload.Store, error) {
+	opts := badger.DefaultOptions(path).WithSyncWrites(true).WithLogger(nil)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &badgerStore{db: db}, nil
+}
+
+// badgerRead reads a value without copying it.
+func badgerRead(v []byte) error {
+	touch(v)
+	return nil
+}
+
+func (s *badgerStore) Get(key []byte) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(badgerRead)
+	})
+}
+
+func (s *badgerStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, val)
+	})
+}
+
+func (s *badgerStore) Scan(start []byte, n int) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(start); it.Valid() && n > 0; it.Next() {
+			if err := it.Item().Value(badgerRead); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *badgerStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/adel-habib/scratch-db/workload"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("bench")
+
+// boltStore adapts bbolt to workload.Store. All keys live in a single bucket.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (workload.Store, error) {
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(key []byte) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		touch(tx.Bucket(boltBucket).Get(key))
+		return nil
+	})
+}
+
+func (s *boltStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, val)
+	})
+}
+
+func (s *boltStore) Scan(start []byte, n int) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && n > 0; k, v = c.Next() {
+			touch(v)
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,38 @@
+// The bench module runs the workloads of `scratch-db bench workload` (see the workload package)
+// against other storage engines, bbolt, badger and pebble, to compare them with scratch-db on
+// the same machine. It's a module of its own, so that scratch-db doesn't depend on them:
+//
+//	cd bench && go run . -engine pebble -records 100000 -ops 100000
+//
+// The flags are the ones of bench workload, and the same seed gives the same workload.
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/adel-habib/scratch-db/workload"
+)
+
+var engines = workload.Engines{
+	"bbolt":  openBoltStore,
+	"badger": openBadgerStore,
+	"pebble": openPebbleStore,
+}
+
+// sink keeps the reads of touch from being optimized away.
+var sink byte
+
+// touch reads a value, so that all the engines have to produce the values they return.
+func touch(val []byte) {
+	if len(val) > 0 {
+		sink = val[0]
+	}
+}
+
+func main() {
+	if err := workload.Command("scratch-db-bench", os.Args[1:], engines); err != nil {
+		fmt.Fprintln(os.Stderr, "scratch-db-bench:", err)
+		os.Exit(1)
+	}
+}
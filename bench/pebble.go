@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/adel-habib/scratch-db/workload"
+	"github.com/cockroachdb/pebble"
+)
+
+// pebbleStore adapts pebble to workload.Store. Writes use pebble.Sync to match KV.Set.
+type pebbleStore struct {
+	db *pebble.DB
+}
+
+func openPebbleStore(path string) (workload.Store, error) {
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		return nil, err
+	}
+	return &pebbleStore{db: db}, nil
+}
+
+func (s *pebbleStore) Get(key []byte) error {
+	val, closer, err := s.db.Get(key)
+	if errors.Is(err, pebble.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	touch(val)
+	return closer.Close()
+}
+
+func (s *pebbleStore) Set(key []byte, val []byte) error {
+	return s.db.Set(key, val, pebble.Sync)
+}
+
+func (s *pebbleStore) Scan(start []byte, n int) error {
+	iter, err := s.db.NewIter(nil)
+	if err != nil {
+		return err
+	}
+	for iter.SeekGE(start); iter.Valid() && n > 0; iter.Next() {
+		touch(iter.Value())
+		n--
+	}
+	return iter.Close()
+}
+
+func (s *pebbleStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,63 @@
+package main
+
+import "github.com/adel-habib/scratch-db/workload"
+
+// benchEngines are the engines of bench workload. The adapters of other storage engines are in
+// the bench module (see bench/), which has its own dependencies, so they stay out of this one.
+var benchEngines = workload.Engines{
+	"scratch-db":     openScratchStore,
+	"scratch-db-wal": openScratchWALStore,
+}
+
+// benchWorkload loads a database and runs a synthetic workload against it, see workload.Command.
+func benchWorkload(args []string) error {
+	return workload.Command("bench workload", args, benchEngines)
+}
+
+// scratchStore adapts a KV to workload.Store.
+type scratchStore struct {
+	db *KV
+}
+
+func openScratchStore(path string) (workload.Store, error) {
+	return openScratch(&KV{Path: path})
+}
+
+func openScratchWALStore(path string) (workload.Store, error) {
+	return openScratch(&KV{Path: path, WAL: true})
+}
+
+func openScratch(db *KV) (workload.Store, error) {
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return &scratchStore{db: db}, nil
+}
+
+func (s *scratchStore) Get(key []byte) error {
+	_, _, err := s.db.Get(key)
+	return err
+}
+
+func (s *scratchStore) Set(key []byte, val []byte) error {
+	return s.db.Set(key, val)
+}
+
+func (s *scratchStore) Scan(start []byte, n int) error {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	c := tx.Seek(start)
+	for ; n > 0 && c.Valid(); n-- {
+		c.Val()
+		c.Next()
+	}
+	return c.Err()
+}
+
+func (s *scratchStore) Close() error {
+	s.db.Close()
+	return nil
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Branches are writable copies of a snapshot in the same file, like to try a migration on the
+// data of a database without touching it. A branch starts with the root of the snapshot and is
+// updated copy-on-write like the main tree, so it only takes the pages it changed.
+//
+// The branches are the SYS_BRANCHES system tree (see bucket.go), which maps the names to
+// | root | version | created | base |
+// | 8B   | 8B      | 8B      | 8B   |
+// where version is the version of the snapshot the branch was created from, and base is its root.
+// A branch pins that version like the snapshot does (see snapshot.go), so the main tree doesn't
+// reuse the pages they share, even if the snapshot is deleted.
+//
+// A transaction on a branch works on the tree of the branch, with its own buckets, and its Commit
+// also updates the root of the branch in the main tree. There is still one writer for the file.
+// The committed pages of a branch may be shared with the snapshot, the main tree and the other
+// branches of the snapshot, so the pages a branch replaces are never freed. DeleteBranch frees
+// the pages of the branch that are not in the version of the base, which it reads in full to tell
+// them apart. The entries written before the base was stored are 24 bytes, and those branches
+// keep their pages. Freeze and ExportSnapshot write copies without them.
+// KV.Trace doesn't know the branches, a replay would apply their updates to the main tree, so the
+// transactions on branches fail while it's set.
+
+// Branch describes a branch, see KV.CreateBranch.
+type Branch struct {
+	Name    []byte
+	Version uint64 // the version of the snapshot it was created from
+	Created time.Time
+	root    uint64
+	base    uint64 // the root of the snapshot, 0 if it's unknown
+}
+
+// CreateBranch creates a branch from a snapshot, or returns ErrBranchExists.
+// A follower in shared mode returns errors.ErrUnsupported.
+func (db *KV) CreateBranch(name []byte, snapshot []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	if err := checkKey(name); err != nil {
+		return fmt.Errorf("branch name: %w", err)
+	}
+	snap, err := tx.snapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = tx.branch(name)
+	if err == nil {
+		return fmt.Errorf("%w: %q", ErrBranchExists, name)
+	}
+	if !errors.Is(err, ErrBranchNotFound) {
+		return err
+	}
+	b := Branch{Name: name, Version: snap.Version, Created: time.Now(), root: snap.root, base: snap.root}
+	if err := tx.branchStore(b); err != nil {
+		return err
+	}
+	tx.pins = map[uint64]int{b.Version: 1}
+	return tx.Commit()
+}
+
+// DeleteBranch deletes a branch, or returns ErrBranchNotFound.
+func (db *KV) DeleteBranch(name []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	b, err := tx.branch(name)
+	if err != nil {
+		return err
+	}
+	if err := tx.branchFree(b); err != nil {
+		return fmt.Errorf("branch %q: %w", name, err)
+	}
+	table, err := tx.branchTable()
+	if err != nil {
+		return err
+	}
+	if _, err := table.Delete(name); err != nil {
+		return err
+	}
+	if err := tx.sysStore(SYS_BRANCHES, table.root); err != nil {
+		return fmt.Errorf("branches: %w", err)
+	}
+	tx.pins = map[uint64]int{b.Version: -1}
+	return tx.Commit()
+}
+
+// Branches returns the branches sorted by name.
+func (db *KV) Branches() ([]Branch, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.branches()
+}
+
+// BeginBranch starts a transaction on a branch, or returns ErrBranchNotFound.
+// It's like Begin: a writable transaction waits for the one in progress, on any branch or on
+// the main tree. A follower in shared mode, or a database with KV.Trace, returns
+// errors.ErrUnsupported.
+func (db *KV) BeginBranch(name []byte, writable bool) (*Tx, error) {
+	if db.lease != nil && !db.lease.leader.Load() {
+		return nil, fmt.Errorf("KV.BeginBranch: the leader doesn't know the readers of a follower: %w", errors.ErrUnsupported)
+	}
+	if db.Trace != nil {
+		return nil, fmt.Errorf("KV.BeginBranch: the trace can't record the branches: %w", errors.ErrUnsupported)
+	}
+	tx, err := db.Begin(writable)
+	if err != nil {
+		return nil, err
+	}
+	b, err := tx.branch(name)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	// the pages of the snapshot are kept while the branch exists, a reader keeps them afterwards
+	if !writable && !tx.readPinned(b.Version) {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: %q", ErrBranchNotFound, name)
+	}
+	tx.onBranch(b)
+	return tx, nil
+}
+
+// onBranch makes a transaction that just began work on a branch instead of the main tree.
+func (tx *Tx) onBranch(b Branch) {
+	tx.branchOf = &b
+	tx.main = tx.root
+	tx.root = b.root
+	tx.tree.root = b.root
+	tx.tree.del = tx.db.branchDel
+	tx.watch = false // only the main tree is watched
+}
+
+// branchDel frees a page of a branch, see above. Only the pages that were allocated by the
+// transaction are reused.
+func (db *KV) branchDel(ptr uint64) {
+	if _, ok := db.page.updates[ptr]; ok {
+		db.pageDel(ptr)
+	}
+}
+
+// branchCommit writes the new root of the branch of the transaction into the main tree,
+// which then becomes the tree of the transaction.
+func (tx *Tx) branchCommit() error {
+	b := *tx.branchOf
+	b.root = tx.tree.root
+	tx.tree.root = tx.main
+	tx.tree.del = tx.db.pageDel
+	return tx.branchStore(b)
+}
+
+// branchFree frees the pages of a branch that is being deleted, except the pages of the version
+// it was created from, see above.
+func (tx *Tx) branchFree(b Branch) error {
+	if b.base == 0 {
+		return nil // the shared pages are unknown
+	}
+	shared := map[uint64]bool{}
+	roots, err := tx.versionTrees(b.base)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		err := treePages(&tx.tree, root, 0, func(ptr uint64) bool {
+			shared[ptr] = true
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var own []uint64
+	if roots, err = tx.versionTrees(b.root); err != nil {
+		return err
+	}
+	for _, root := range roots {
+		// the subtrees of the shared pages are shared too
+		err := treePages(&tx.tree, root, 0, func(ptr uint64) bool {
+			if shared[ptr] {
+				return false
+			}
+			shared[ptr] = true // the page is only freed once
+			own = append(own, ptr)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, ptr := range own {
+		tx.db.pageDel(ptr)
+	}
+	return nil
+}
+
+// versionTrees returns the roots of the trees of a version of the file, from the root of its main
+// tree: the main tree, the catalog, the buckets and the system trees, with the secondary indexes.
+// The entries of the snapshots and the branches point to other versions, only their tables are
+// trees of the version.
+func (tx *Tx) versionTrees(root uint64) ([]uint64, error) {
+	tree := tx.tree
+	tree.vals = nil // the roots are stored as they are
+	tree.root = root
+	roots := []uint64{root}
+	meta, err := tree.meta()
+	if err != nil {
+		return nil, err
+	}
+	if tree.root, _, err = metaDecode(meta); err != nil || tree.root == 0 {
+		return roots, err
+	}
+	roots = append(roots, tree.root)
+	buckets, err := treeRoots(tree)
+	if err != nil {
+		return nil, fmt.Errorf("catalog: %w", err)
+	}
+	roots = append(roots, buckets...)
+	sys, err := tree.meta()
+	if err != nil {
+		return nil, err
+	}
+	if len(sys)%8 != 0 {
+		return nil, fmt.Errorf("catalog: %w: bad system roots", ErrCorruptNode)
+	}
+	for i := 0; i < len(sys)/8; i++ {
+		tree.root = binary.LittleEndian.Uint64(sys[8*i:])
+		roots = append(roots, tree.root)
+		if i == SYS_INDEXES && tree.root != 0 {
+			indexes, err := treeRoots(tree)
+			if err != nil {
+				return nil, fmt.Errorf("indexes: %w", err)
+			}
+			roots = append(roots, indexes...)
+		}
+	}
+	return roots, nil
+}
+
+// treeRoots returns the roots in the values of the catalog or of the index table.
+func treeRoots(tree BTree) ([]uint64, error) {
+	var roots []uint64
+	c := tree.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		if len(c.Val()) != 8 {
+			return nil, fmt.Errorf("%q: %w: bad root entry", c.Key(), ErrCorruptNode)
+		}
+		roots = append(roots, binary.LittleEndian.Uint64(c.Val()))
+	}
+	return roots, c.Err()
+}
+
+// treePages calls fn with the pages of the subtree rooted at ptr, at the given depth, and skips
+// the subtrees of the pages for which it returns false.
+func treePages(tree *BTree, ptr uint64, depth int, fn func(ptr uint64) bool) error {
+	if ptr == 0 || !fn(ptr) {
+		return nil
+	}
+	if err := checkDepth(depth); err != nil {
+		return err
+	}
+	node, err := tree.getNode(ptr)
+	if err != nil {
+		return err
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := treePages(tree, node.getPtr(i), depth+1, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// branchStore sets the entry of a branch.
+func (tx *Tx) branchStore(b Branch) error {
+	table, err := tx.branchTable()
+	if err != nil {
+		return err
+	}
+	val := binary.LittleEndian.AppendUint64(nil, b.root)
+	val = binary.LittleEndian.AppendUint64(val, b.Version)
+	val = binary.LittleEndian.AppendUint64(val, uint64(b.Created.UnixMilli()))
+	if b.base != 0 {
+		val = binary.LittleEndian.AppendUint64(val, b.base)
+	}
+	if err := table.Insert(b.Name, val); err != nil {
+		return err
+	}
+	if err := tx.sysStore(SYS_BRANCHES, table.root); err != nil {
+		return fmt.Errorf("branches: %w", err)
+	}
+	return nil
+}
+
+// branchTable returns the tree of the branches as seen by the transaction.
+func (tx *Tx) branchTable() (BTree, error) {
+	root, err := tx.sysRoot(SYS_BRANCHES)
+	if err != nil {
+		return BTree{}, fmt.Errorf("branches: %w", err)
+	}
+	table := tx.tree
+	table.vals = nil // the entries are stored as they are
+	table.root = root
+	return table, nil
+}
+
+// branch returns the branch with the given name, or ErrBranchNotFound.
+func (tx *Tx) branch(name []byte) (Branch, error) {
+	if err := checkKey(name); err != nil {
+		return Branch{}, fmt.Errorf("branch name: %w", err)
+	}
+	table, err := tx.branchTable()
+	if err != nil {
+		return Branch{}, err
+	}
+	val, ok, err := table.Get(name)
+	if err != nil {
+		return Branch{}, err
+	}
+	if !ok {
+		return Branch{}, fmt.Errorf("%w: %q", ErrBranchNotFound, name)
+	}
+	return branchDecode(name, val)
+}
+
+// branches returns the branches as seen by the transaction.
+func (tx *Tx) branches() ([]Branch, error) {
+	table, err := tx.branchTable()
+	if err != nil {
+		return nil, err
+	}
+	var branches []Branch
+	c := table.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		b, err := branchDecode(c.Key(), c.Val())
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, b)
+	}
+	return branches, c.Err()
+}
+
+// branchDecode decodes an entry of the branch table.
+func branchDecode(name []byte, val []byte) (Branch, error) {
+	if len(val) != 24 && len(val) != 32 {
+		return Branch{}, fmt.Errorf("branch %q: %w: bad entry", name, ErrCorruptNode)
+	}
+	b := Branch{
+		Name:    bytes.Clone(name),
+		root:    binary.LittleEndian.Uint64(val[0:]),
+		Version: binary.LittleEndian.Uint64(val[8:]),
+		Created: time.UnixMilli(int64(binary.LittleEndian.Uint64(val[16:]))),
+	}
+	if len(val) == 32 {
+		b.base = binary.LittleEndian.Uint64(val[24:])
+	}
+	return b, nil
+}
+
+// cmdBranch implements `scratch-db branch -db <file> list|create|delete [name] [snapshot]`.
+func cmdBranch(args []string) error {
+	fs := flag.NewFlagSet("branch", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	fs.Parse(args)
+	op, nargs := fs.Arg(0), map[string]int{"list": 1, "create": 3, "delete": 2}[fs.Arg(0)]
+	if *path == "" || nargs == 0 || fs.NArg() != nargs {
+		return errors.New("usage: scratch-db branch -db <file> list|create|delete [name] [snapshot]")
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	name := []byte(fs.Arg(1))
+	switch op {
+	case "create":
+		return db.CreateBranch(name, []byte(fs.Arg(2)))
+	case "delete":
+		return db.DeleteBranch(name)
+	}
+	branches, err := db.Branches()
+	for _, b := range branches {
+		fmt.Fprintf(os.Stdout, "%s\tfrom version %d\t%s\n", b.Name, b.Version, b.Created.Format(time.RFC3339))
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBranchLifecycle(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err := db.Set([]byte(key), []byte("main")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.CreateSnapshot([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBranch([]byte("br"), []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBranch([]byte("br"), []byte("s")); !errors.Is(err, ErrBranchExists) {
+		t.Fatalf("CreateBranch of an existing branch: %v", err)
+	}
+	if err := db.CreateBranch([]byte("other"), []byte("t")); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("CreateBranch of a missing snapshot: %v", err)
+	}
+	// the branch keeps the version of the snapshot
+	if err := db.DeleteSnapshot([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.BeginBranch([]byte("br"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("a"), []byte("branch")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := tx.Set([]byte(fmt.Sprint("new", i)), make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bk, err := tx.CreateBucket([]byte("bk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bk.Set([]byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Del([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTest(t, &KV{Path: path})
+	branches, err := db.Branches()
+	if err != nil || len(branches) != 1 || string(branches[0].Name) != "br" {
+		t.Fatalf("branches %+v, %v", branches, err)
+	}
+	tx, err = db.BeginBranch([]byte("br"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "a", "branch")
+	wantGet(t, tx, "b", "main")
+	if bk, err := tx.Bucket([]byte("bk")); err != nil {
+		t.Fatal(err)
+	} else if val, _, err := bk.Get([]byte("x")); err != nil || !bytes.Equal(val, []byte("y")) {
+		t.Fatalf("x = %q, %v in the bucket of the branch", val, err)
+	}
+	tx.Rollback()
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "a", "main")
+	wantGet(t, tx, "b", "")
+	wantGet(t, tx, "new0", "")
+	if _, err := tx.Bucket([]byte("bk")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("the bucket of the branch in the main tree: %v", err)
+	}
+	tx.Rollback()
+
+	// the pages the branch wrote are freed
+	free := db.Stats().FreePages
+	if err := db.DeleteBranch([]byte("br")); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.Stats().FreePages; got < free+2000*100/BTREE_PAGE_SIZE {
+		t.Fatalf("%d free pages after deleting the branch, %d before", got, free)
+	}
+	if _, err := db.BeginBranch([]byte("br"), false); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("BeginBranch of a deleted branch: %v", err)
+	}
+	if err := db.DeleteBranch([]byte("br")); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("DeleteBranch of a deleted branch: %v", err)
+	}
+}
+
+func TestBranchTrace(t *testing.T) {
+	db := openTest(t, &KV{})
+	if err := db.CreateSnapshot([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateBranch([]byte("br"), []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	db.Trace = NewTraceWriter(new(bytes.Buffer))
+	if _, err := db.BeginBranch([]byte("br"), true); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("BeginBranch with a trace: %v", err)
+	}
+}
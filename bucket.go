@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Buckets are independent keyspaces in the same file, each one is a BTree of its own.
+// The catalog is another BTree that maps the bucket names to the roots of their trees
+// (8 bytes, 0 for an empty bucket). The root of the catalog is the value of the empty
+// dummy key of the main tree, which is empty while there are no buckets. So the file
+// format doesn't change and the keys of the main tree are not affected.
+// The dictionary of a database with KV.CompressValues follows the root, see dict.go.
+// The value of the dummy key of the catalog holds the roots of the system trees (SYS_*),
+// 8 bytes each, and is empty while they are all empty.
+//
+// The updates of a bucket only change its own tree. The new roots of the buckets that
+// were updated are written into the catalog on Commit.
+
+// Bucket is a keyspace of a transaction, see Tx.Bucket. It's only valid within the
+// transaction.
+type Bucket struct {
+	tx      *Tx
+	name    []byte
+	tree    BTree
+	root    uint64 // the root in the catalog
+	deleted bool
+}
+
+// Bucket returns the bucket with the given name, or ErrBucketNotFound.
+func (tx *Tx) Bucket(name []byte) (*Bucket, error) {
+	if err := tx.check(false); err != nil {
+		return nil, err
+	}
+	if b, ok := tx.buckets[string(name)]; ok {
+		return b, nil
+	}
+	if err := checkKey(name); err != nil {
+		return nil, fmt.Errorf("bucket name: %w", err)
+	}
+	catalog, err := tx.catalog()
+	if err != nil {
+		return nil, err
+	}
+	val, ok, err := catalog.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrBucketNotFound, name)
+	}
+	if len(val) != 8 {
+		return nil, fmt.Errorf("bucket %q: %w: bad catalog entry", name, ErrCorruptNode)
+	}
+	return tx.openBucket(name, binary.LittleEndian.Uint64(val)), nil
+}
+
+// CreateBucket creates an empty bucket, or returns ErrBucketExists.
+func (tx *Tx) CreateBucket(name []byte) (*Bucket, error) {
+	if err := tx.check(true); err != nil {
+		return nil, err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return nil, err
+	}
+	_, err := tx.Bucket(name)
+	if err == nil {
+		return nil, fmt.Errorf("%w: %q", ErrBucketExists, name)
+	}
+	if !errors.Is(err, ErrBucketNotFound) {
+		return nil, err
+	}
+	if err := tx.catalogSet(name, 0); err != nil {
+		return nil, err
+	}
+	if tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_CREATE_BUCKET, name, nil)
+	}
+	return tx.openBucket(name, 0), nil
+}
+
+// CreateBucketIfNotExists returns the bucket with the given name, creating it if needed.
+func (tx *Tx) CreateBucketIfNotExists(name []byte) (*Bucket, error) {
+	if err := tx.check(true); err != nil {
+		return nil, err
+	}
+	b, err := tx.Bucket(name)
+	if errors.Is(err, ErrBucketNotFound) {
+		return tx.CreateBucket(name)
+	}
+	return b, err
+}
+
+// DeleteBucket deletes a bucket and frees all of its pages, or returns ErrBucketNotFound.
+func (tx *Tx) DeleteBucket(name []byte) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	b, err := tx.Bucket(name)
+	if err != nil {
+		return err
+	}
+	if err := treeFree(&b.tree, b.tree.root); err != nil {
+		return err
+	}
+	catalog, err := tx.catalog()
+	if err != nil {
+		return err
+	}
+	if _, err := catalog.Delete(name); err != nil {
+		return err
+	}
+	if err := tx.catalogStore(catalog.root); err != nil {
+		return err
+	}
+	b.deleted = true
+	delete(tx.buckets, string(name))
+	if tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_DELETE_BUCKET, name, nil)
+	}
+	return nil
+}
+
+// Buckets returns the names of the buckets in sorted order.
+func (tx *Tx) Buckets() ([][]byte, error) {
+	if err := tx.check(false); err != nil {
+		return nil, err
+	}
+	catalog, err := tx.catalog()
+	if err != nil {
+		return nil, err
+	}
+	var names [][]byte
+	c := catalog.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		names = append(names, bytes.Clone(c.Key()))
+	}
+	return names, c.Err()
+}
+
+// openBucket returns a handle of a bucket whose tree has the given root.
+// The handles are kept, so that the transaction sees its own updates of the bucket.
+func (tx *Tx) openBucket(name []byte, root uint64) *Bucket {
+	b := &Bucket{tx: tx, name: bytes.Clone(name), tree: tx.tree, root: root}
+	b.tree.root = root
+	if tx.buckets == nil {
+		tx.buckets = map[string]*Bucket{}
+	}
+	tx.buckets[string(name)] = b
+	return b
+}
+
+// catalog returns the catalog tree as seen by the transaction.
+func (tx *Tx) catalog() (BTree, error) {
+	catalog := tx.tree
+	catalog.vals = nil // the roots of the buckets are stored as they are
+	meta, err := tx.tree.meta()
+	if err != nil {
+		return BTree{}, err
+	}
+	catalog.root, _, err = metaDecode(meta)
+	if err != nil {
+		return BTree{}, err
+	}
+	return catalog, nil
+}
+
+// catalogSet sets the root of a bucket in the catalog.
+func (tx *Tx) catalogSet(name []byte, root uint64) error {
+	catalog, err := tx.catalog()
+	if err != nil {
+		return err
+	}
+	var val [8]byte
+	binary.LittleEndian.PutUint64(val[:], root)
+	if err := catalog.Insert(name, val[:]); err != nil {
+		return err
+	}
+	return tx.catalogStore(catalog.root)
+}
+
+// catalogStore points the dummy key to the given root of the catalog, keeping the dictionary.
+func (tx *Tx) catalogStore(root uint64) error {
+	meta, err := tx.tree.meta()
+	if err != nil {
+		return err
+	}
+	_, dict, err := metaDecode(meta)
+	if err != nil {
+		return err
+	}
+	return tx.tree.setMeta(catalogMeta(root, dict))
+}
+
+// catalogMeta returns the value of the dummy key that points to the catalog,
+// followed by the dictionary if there is one.
+func catalogMeta(root uint64, dict []byte) []byte {
+	if root == 0 && len(dict) == 0 {
+		return nil
+	}
+	return append(binary.LittleEndian.AppendUint64(nil, root), dict...)
+}
+
+// the system trees, by their position in the value of the dummy key of the catalog
+const (
+	SYS_EXPIRY    = 0 // the expiry index, see ttl.go
+	SYS_SNAPSHOTS = 1 // the named snapshots, see snapshot.go
+	SYS_BRANCHES  = 2 // the branches, see branch.go
+	SYS_INDEXES   = 3 // the secondary indexes, see index.go
+)
+
+// sysRoot returns the root of a system tree as seen by the transaction, 0 if it's empty.
+func (tx *Tx) sysRoot(sys int) (uint64, error) {
+	catalog, err := tx.catalog()
+	if err != nil {
+		return 0, err
+	}
+	roots, err := catalog.meta()
+	if err != nil {
+		return 0, err
+	}
+	if len(roots)%8 != 0 {
+		return 0, fmt.Errorf("catalog: %w: bad system roots", ErrCorruptNode)
+	}
+	if 8*sys >= len(roots) {
+		return 0, nil
+	}
+	return binary.LittleEndian.Uint64(roots[8*sys:]), nil
+}
+
+// sysStore sets the root of a system tree in the catalog.
+func (tx *Tx) sysStore(sys int, root uint64) error {
+	catalog, err := tx.catalog()
+	if err != nil {
+		return err
+	}
+	meta, err := catalog.meta()
+	if err != nil {
+		return err
+	}
+	roots := make([]byte, max(len(meta), 8*sys+8))
+	copy(roots, meta)
+	binary.LittleEndian.PutUint64(roots[8*sys:], root)
+	for len(roots) > 0 && binary.LittleEndian.Uint64(roots[len(roots)-8:]) == 0 {
+		roots = roots[:len(roots)-8] // the trailing empty trees
+	}
+	if err := catalog.setMeta(roots); err != nil {
+		return err
+	}
+	return tx.catalogStore(catalog.root)
+}
+
+// flushBuckets writes the roots of the buckets updated by the transaction into the catalog.
+func (tx *Tx) flushBuckets() error {
+	names := make([]string, 0, len(tx.buckets))
+	for name, b := range tx.buckets {
+		if b.tree.root != b.root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // the same updates give the same tree
+	for _, name := range names {
+		b := tx.buckets[name]
+		if err := tx.catalogSet(b.name, b.tree.root); err != nil {
+			return fmt.Errorf("bucket %q: %w", name, err)
+		}
+		b.root = b.tree.root
+	}
+	return nil
+}
+
+// check returns an error if the bucket can't be used for the requested operation.
+func (b *Bucket) check(write bool) error {
+	if err := b.tx.check(write); err != nil {
+		return err
+	}
+	if write {
+		if err := b.tx.checkLocal(); err != nil {
+			return err
+		}
+	}
+	if b.deleted {
+		return fmt.Errorf("%w: %q", ErrBucketNotFound, b.name)
+	}
+	return nil
+}
+
+// trace records an operation on a key of the bucket in KV.Trace, see TRACE_BUCKET.
+func (b *Bucket) trace(op byte, key []byte, val []byte) {
+	if b.tx.db.Trace != nil {
+		b.tx.db.Trace.recordBucket(b.name, op, key, val)
+	}
+}
+
+// Name returns the name of the bucket.
+func (b *Bucket) Name() []byte {
+	return b.name
+}
+
+// Get reads a key of the bucket, see Tx.Get.
+func (b *Bucket) Get(key []byte) ([]byte, bool, error) {
+	if err := b.check(false); err != nil {
+		return nil, false, err
+	}
+	b.trace(TRACE_GET, key, nil)
+	return b.tree.Get(key)
+}
+
+// Seek returns a cursor over the bucket positioned at the first key that is greater than
+// or equal to the given key, see Tx.Seek.
+func (b *Bucket) Seek(key []byte) *Cursor {
+	if err := b.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return b.tree.Seek(key)
+}
+
+// SeekLE returns a cursor over the bucket positioned at the last key that is less than
+// or equal to the given key, see Tx.SeekLE.
+func (b *Bucket) SeekLE(key []byte) *Cursor {
+	if err := b.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return b.tree.SeekLE(key)
+}
+
+// Last returns a cursor over the bucket positioned at its last key, see Tx.Last.
+func (b *Bucket) Last() *Cursor {
+	if err := b.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return b.tree.Last()
+}
+
+// Set inserts or updates a key of the bucket, see Tx.Set.
+func (b *Bucket) Set(key []byte, val []byte) error {
+	if err := b.check(true); err != nil {
+		return err
+	}
+	if err := b.tree.Insert(key, val); err != nil {
+		return err
+	}
+	b.trace(TRACE_SET, key, val)
+	return nil
+}
+
+// Del deletes a key of the bucket and reports whether it existed, see Tx.Del.
+func (b *Bucket) Del(key []byte) (bool, error) {
+	if err := b.check(true); err != nil {
+		return false, err
+	}
+	ok, err := b.tree.Delete(key)
+	if err == nil {
+		b.trace(TRACE_DEL, key, nil)
+	}
+	return ok, err
+}
+
+// CompareAndSwap sets a key of the bucket to new if its value is expectedOld,
+// see Tx.CompareAndSwap.
+func (b *Bucket) CompareAndSwap(key []byte, expectedOld []byte, new []byte) (bool, error) {
+	if err := b.check(true); err != nil {
+		return false, err
+	}
+	old, ok, err := b.tree.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if ok != (expectedOld != nil) || !bytes.Equal(old, expectedOld) {
+		return false, nil
+	}
+	if new == nil {
+		_, err = b.tree.Delete(key)
+	} else {
+		err = b.tree.Insert(key, new)
+	}
+	if err != nil {
+		return false, err
+	}
+	if new == nil {
+		b.trace(TRACE_DEL, key, nil)
+	} else {
+		b.trace(TRACE_SET, key, new)
+	}
+	return true, nil
+}
+
+// BulkLoad builds the tree of an empty bucket from KV pairs in ascending key order,
+// see BTree.BulkLoad.
+func (b *Bucket) BulkLoad(iter KVIterator) error {
+	if err := b.check(true); err != nil {
+		return err
+	}
+	if b.tx.db.Trace == nil {
+		return b.tree.BulkLoad(iter)
+	}
+	traced := &traceIter{KVIterator: iter}
+	if err := b.tree.BulkLoad(traced); err != nil {
+		return err
+	}
+	traced.record(b.tx.db.Trace, b.name)
+	return nil
+}
+
+// meta returns the value of the empty dummy key at the start of the tree,
+// which points to the catalog of the buckets in the main tree, and to the system trees
+// in the catalog.
+func (tree *BTree) meta() ([]byte, error) {
+	if tree.root == 0 {
+		return nil, nil
+	}
+	node, err := tree.getNode(tree.root)
+	if err != nil {
+		return nil, err
+	}
+	val, _, err := treeGet(tree, node, nil)
+	return val, err
+}
+
+// setMeta sets the value of the empty dummy key, creating the tree if it's empty.
+func (tree *BTree) setMeta(val []byte) error {
+	if tree.root == 0 {
+		if len(val) == 0 {
+			return nil
+		}
+		root := BNode{data: make([]byte, tree.nodeSize)}
+		root.setHeader(BNODE_LEAF, 1)
+		if tree.prefixed {
+			root.setPrefix(nil)
+		}
+		nodeAppendKV(root, 0, 0, nil, val)
+		tree.root = tree.new(root)
+		return nil
+	}
+	node, err := treeInsert(tree, nil, val)
+	if err != nil {
+		return err
+	}
+	return tree.replaceRoot(node)
+}
+
+// treeFree frees all the pages of the subtree rooted at the given page.
+func treeFree(tree *BTree, ptr uint64) error {
+	if ptr == 0 {
+		return nil
+	}
+	node, err := tree.getNode(ptr)
+	if err != nil {
+		return err
+	}
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			if err := treeFree(tree, node.getPtr(i)); err != nil {
+				return err
+			}
+		}
+	}
+	tree.del(ptr)
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestBuckets(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k"), []byte("main")); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "a"} {
+		b, err := tx.CreateBucket([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := b.Set([]byte(fmt.Sprint("k", i)), []byte(name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := tx.CreateBucket([]byte("a")); !errors.Is(err, ErrBucketExists) {
+		t.Fatalf("CreateBucket of an existing bucket: %v", err)
+	}
+	if _, err := tx.Bucket([]byte("c")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("Bucket of a missing bucket: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTest(t, &KV{Path: path})
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	names, err := tx.Buckets()
+	if err != nil || fmt.Sprintf("%q", names) != `["a" "b"]` {
+		t.Fatalf("buckets %q, %v", names, err)
+	}
+	// the keyspaces are independent
+	wantGet(t, tx, "k", "main")
+	wantGet(t, tx, "k1", "")
+	for _, name := range []string{"a", "b"} {
+		b, err := tx.Bucket([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for c := b.Seek(nil); c.Valid(); c.Next() {
+			if string(c.Val()) != name {
+				t.Fatalf("%s/%s = %q", name, c.Key(), c.Val())
+			}
+			n++
+		}
+		if n != 500 {
+			t.Fatalf("%d keys in %s", n, name)
+		}
+	}
+
+	b, err := tx.Bucket([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.DeleteBucket([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := b.Get([]byte("k1")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("Get in a deleted bucket: %v", err)
+	}
+	if err := tx.DeleteBucket([]byte("a")); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("DeleteBucket of a deleted bucket: %v", err)
+	}
+	// a new bucket of the same name starts empty
+	b, err = tx.CreateBucket([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := b.Get([]byte("k1")); ok || err != nil {
+		t.Fatalf("k1 in the new bucket: %v, %v", ok, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The pages of a deleted bucket are freed and reused.
+func TestBucketDeletePages(t *testing.T) {
+	db := openTest(t, &KV{})
+	fill := func() {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := tx.CreateBucket([]byte("b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2000; i++ {
+			if err := b.Set([]byte(fmt.Sprint("key", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		tx, err = db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.DeleteBucket([]byte("b")); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fill()
+	pages := db.Stats().Pages
+	for i := 0; i < 3; i++ {
+		fill()
+	}
+	if got := db.Stats().Pages; got > pages+pages/10 {
+		t.Fatalf("%d pages after deleting the bucket 3 more times, %d after the first", got, pages)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// BTREE_BULK_FILL is the default fill factor of the nodes built by BulkLoad. Full nodes would
+// be split by the first insert into them, so some room is left for later updates.
+const BTREE_BULK_FILL = 0.9
+
+// KVIterator produces the KV pairs for BulkLoad. It's used like a Cursor, which implements it,
+// so the tree of another transaction can be copied with BulkLoad(src.Seek(nil)).
+type KVIterator interface {
+	Valid() bool // false at the end, or on error
+	Key() []byte
+	Val() []byte
+	Next()
+	Err() error
+}
+
+// BulkLoad builds the tree from KV pairs in ascending key order. The tree must be empty,
+// the buckets of the main tree are kept.
+// Instead of inserting the keys one by one, which splits nodes all the time, the leaves are
+// filled up to the fill factor and written in key order, then each level of internal nodes
+// above them, and finally the root.
+// On error the root is left unchanged, pages allocated before the error are not linked into the tree.
+func (tree *BTree) BulkLoad(iter KVIterator) error {
+	var meta []byte // the value of the dummy key, see bucket.go
+	if tree.root != 0 {
+		// a tree whose keys were all deleted still has a root with the dummy key
+		node, err := tree.getNode(tree.root)
+		if err != nil {
+			return err
+		}
+		if node.btype() != BNODE_LEAF || node.nkeys() > 1 {
+			return ErrNotEmpty
+		}
+		meta = bytes.Clone(node.getVal(0))
+	}
+	fill := tree.fill
+	if fill == 0 {
+		fill = BTREE_BULK_FILL
+	}
+	fill = min(max(fill, 0.5), 1)
+
+	// the leaves, starting with the empty dummy key
+	leaves := &bulkLevel{tree: tree, btype: BNODE_LEAF, limit: int(fill * float64(tree.nodeSize))}
+	leaves.add(bulkEntry{val: meta})
+	var last []byte
+	for ; iter.Valid(); iter.Next() {
+		key, val := iter.Key(), iter.Val()
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		if err := tree.vals.checkVal(val); err != nil {
+			return err
+		}
+		if last != nil && bytes.Compare(last, key) >= 0 {
+			return fmt.Errorf("%w: %q after %q", ErrUnsorted, key, last)
+		}
+		// the iterator may reuse its buffers
+		e := bulkEntry{key: bytes.Clone(key), val: bytes.Clone(tree.vals.encode(val, 0))}
+		leaves.add(e)
+		last = e.key
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if last == nil {
+		return nil // nothing to load, the tree stays empty
+	}
+	links := leaves.finish()
+
+	// then the internal nodes, level by level, until a single node is left
+	for len(links) > 1 {
+		level := &bulkLevel{tree: tree, btype: BNODE_NODE, limit: leaves.limit}
+		for _, e := range links {
+			level.add(e)
+		}
+		links = level.finish()
+	}
+	if tree.root != 0 {
+		tree.del(tree.root)
+	}
+	tree.root = links[0].ptr
+	return nil
+}
+
+// bulkEntry is a KV pair in a leaf, or a link in an internal node.
+type bulkEntry struct {
+	key []byte
+	val []byte
+	ptr uint64
+}
+
+// size returns the size of the entry in a node, including its pointer and offset.
+func (e bulkEntry) size() int {
+	return 8 + 2 + 4 + len(e.key) + len(e.val)
+}
+
+// bulkLevel builds the nodes of one level of the tree from left to right.
+// The key range of a node is [the key of its first entry, the key of the next node's first entry),
+// so the prefix of a prefix-compressed node is only known once the next node is started.
+type bulkLevel struct {
+	tree    *BTree
+	btype   uint16
+	limit   int         // the size to fill the nodes to
+	entries []bulkEntry // entries of the node being built
+	sum     int         // the size of the entries
+	links   []bulkEntry // links to the nodes written
+}
+
+// size returns the size of a node with the first n entries whose key range ends at hi,
+// and its size without prefix compression.
+func (l *bulkLevel) size(n int, hi []byte) (int, int) {
+	expanded := HEADER + l.sum
+	for _, e := range l.entries[n:] {
+		expanded -= e.size()
+	}
+	if !l.tree.prefixed {
+		return expanded, expanded
+	}
+	expanded += 2
+	plen := len(fencePrefix(l.entries[0].key, hi))
+	return expanded + plen - n*plen, expanded
+}
+
+// add appends an entry, which may start a new node. A node always gets at least 2 entries,
+// otherwise the levels above would never shrink to a single root.
+func (l *bulkLevel) add(e bulkEntry) {
+	l.entries = append(l.entries, e)
+	l.sum += e.size()
+	n := len(l.entries)
+	if n <= 2 {
+		return
+	}
+	// the size if the entry was the last one in the node, the prefix can only get shorter
+	nbytes, expanded := l.size(n, e.key)
+	if nbytes > l.limit || expanded > BTREE_MAX_EXPANSION*l.tree.nodeSize {
+		l.write(n-1, e.key)
+	}
+}
+
+// write writes a node with the first n entries that ends at hi, or with fewer entries if they
+// don't fit into a page. The remaining entries are kept for the next node.
+func (l *bulkLevel) write(n int, hi []byte) {
+	for n > 1 {
+		if nbytes, expanded := l.size(n, hi); nodeFits(nbytes, expanded, l.tree.nodeSize) {
+			break
+		}
+		n--
+		hi = l.entries[n].key
+	}
+	node := BNode{data: make([]byte, l.tree.nodeSize)}
+	node.setHeader(l.btype, uint16(n))
+	if l.tree.prefixed {
+		node.setPrefix(fencePrefix(l.entries[0].key, hi))
+	}
+	for i, e := range l.entries[:n] {
+		nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+	}
+	for _, e := range l.entries[:n] {
+		l.sum -= e.size()
+	}
+	l.links = append(l.links, bulkEntry{key: l.entries[0].key, ptr: l.tree.new(node)})
+	l.entries = append(l.entries[:0], l.entries[n:]...)
+}
+
+// finish writes the remaining entries and returns the links to all the nodes of the level.
+func (l *bulkLevel) finish() []bulkEntry {
+	for len(l.entries) > 0 {
+		l.write(len(l.entries), nil)
+	}
+	return l.links
+}
+
+// BulkLoad builds the tree from KV pairs in ascending key order, see BTree.BulkLoad.
+// The transaction must be writable and the tree empty. The pages are kept in memory until Commit.
+func (tx *Tx) BulkLoad(iter KVIterator) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	var traced *traceIter
+	if tx.db.Trace != nil {
+		traced = &traceIter{KVIterator: iter}
+		iter = traced
+	}
+	if len(tx.db.Indexes) > 0 {
+		iter = &indexIter{KVIterator: iter, tx: tx}
+	} else if err := tx.checkUnindexed(); err != nil {
+		return err
+	}
+	var w *watchIter
+	if tx.watch {
+		w = &watchIter{KVIterator: iter}
+		iter = w
+	}
+	if err := tx.tree.BulkLoad(iter); err != nil {
+		return err
+	}
+	if w != nil {
+		tx.changes = append(tx.changes, w.changes...)
+	}
+	if traced != nil {
+		traced.record(tx.db.Trace, nil)
+	}
+	return nil
+}
+
+// traceIter keeps the KV pairs passing through it, so that they are recorded as sets once
+// BulkLoad succeeded. BulkLoad reads each value once.
+type traceIter struct {
+	KVIterator
+	pairs []bulkEntry
+}
+
+func (it *traceIter) Val() []byte {
+	val := it.KVIterator.Val()
+	it.pairs = append(it.pairs, bulkEntry{key: bytes.Clone(it.Key()), val: bytes.Clone(val)})
+	return val
+}
+
+// record writes the pairs into a trace, bucket is nil for the main keyspace.
+func (it *traceIter) record(trace *TraceWriter, bucket []byte) {
+	for _, e := range it.pairs {
+		if bucket != nil {
+			trace.recordBucket(bucket, TRACE_SET, e.key, e.val)
+		} else {
+			trace.record(TRACE_SET, e.key, e.val)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PAGE_CACHE_PAGES is the default number of pages in the page cache
+const PAGE_CACHE_PAGES = 4096
+
+// pageCache keeps the nodes of recently read pages after their checksum was verified, so that
+// the hot pages near the root aren't verified again by every operation. The nodes point into
+// the mapped file (or into the pages read by OpenHTTP), the cache only holds references.
+//
+// Pages are never modified while a version that references them can still be read, so
+// the cached nodes stay valid until their page is written again, see drop. The pages of the
+// writable transaction (db.page.updates) and of the WAL are in memory and are never cached.
+//
+// Eviction uses the clock algorithm instead of an LRU list, so that a hit only takes
+// the read lock and sets the referenced bit of its slot.
+type pageCache struct {
+	mu     sync.RWMutex
+	slots  []cacheSlot
+	index  map[uint64]int // page pointer -> slot
+	used   int            // slots filled so far
+	hand   int            // the next slot to consider for eviction
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type cacheSlot struct {
+	ptr  uint64 // 0 if the slot is empty, the master page is never cached
+	node BNode
+	ref  atomic.Bool // set on a hit, cleared when the hand passes
+}
+
+// newPageCache returns a cache of the given number of pages, or nil if size is negative.
+func newPageCache(size int) *pageCache {
+	if size < 0 {
+		return nil
+	}
+	if size == 0 {
+		size = PAGE_CACHE_PAGES
+	}
+	return &pageCache{slots: make([]cacheSlot, size), index: map[uint64]int{}}
+}
+
+// get returns the node of a cached page.
+func (c *pageCache) get(ptr uint64) (BNode, bool) {
+	c.mu.RLock()
+	i, ok := c.index[ptr]
+	var node BNode
+	if ok {
+		c.slots[i].ref.Store(true)
+		node = c.slots[i].node
+	}
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return node, ok
+}
+
+// put adds the node of a verified page, evicting a page that wasn't used recently.
+func (c *pageCache) put(ptr uint64, node BNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.index[ptr]; ok {
+		return // added by a concurrent reader
+	}
+	i := c.used
+	if c.used < len(c.slots) {
+		c.used++
+	} else {
+		for c.slots[c.hand].ref.Swap(false) {
+			c.hand = (c.hand + 1) % len(c.slots)
+		}
+		i = c.hand
+		c.hand = (c.hand + 1) % len(c.slots)
+		delete(c.index, c.slots[i].ptr)
+	}
+	c.slots[i].ptr = ptr
+	c.slots[i].node = node
+	c.slots[i].ref.Store(false)
+	c.index[ptr] = i
+}
+
+// drop removes a page that is about to be written. No reader can see the page at this point,
+// readers that could see its old content have ended before it was reused.
+func (c *pageCache) drop(ptr uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.index[ptr]
+	if !ok {
+		return
+	}
+	delete(c.index, ptr)
+	// the empty slot is reused when the hand gets to it
+	c.slots[i].ptr = 0
+	c.slots[i].node = BNode{}
+	c.slots[i].ref.Store(false)
+}
@@ -0,0 +1,48 @@
+package main
+
+// The defaults of the options in constrained mode, see KV.Constrained
+const (
+	CONSTRAINED_PAGE_SIZE        = BTREE_MIN_PAGE_SIZE
+	CONSTRAINED_CACHE_PAGES      = 64
+	CONSTRAINED_CHECKPOINT_PAGES = 64
+	CONSTRAINED_MMAP_SIZE        = 1 << 20 // the initial mapping, instead of 64MB
+)
+
+// constrain fills in the options that are not set with the defaults of constrained mode.
+// It's called when the database is opened, options set by the caller are kept.
+//
+// In constrained mode the database uses as little memory and as few goroutines as possible,
+// for embedded devices and short-lived processes like serverless functions:
+//   - new databases use the smallest page size, and the mapping starts at 1MB, which
+//     matters where the address space is small
+//   - the page cache, and the page cache of OpenHTTP, hold 64 pages
+//   - in WAL mode, a commit that brings the WAL to CheckpointPages pages runs the
+//     checkpoint itself, so the WAL and its index in memory stay small and the data is
+//     in the main file soon
+//   - no goroutines are started: jobs run in the goroutine that schedules (or resumes)
+//     them, and OpenHTTP doesn't read ahead
+func (db *KV) constrain() {
+	if !db.Constrained {
+		return
+	}
+	if db.PageSize == 0 {
+		db.PageSize = CONSTRAINED_PAGE_SIZE
+	}
+	if db.CachePages == 0 {
+		db.CachePages = CONSTRAINED_CACHE_PAGES
+	}
+	if db.RemoteCachePages == 0 {
+		db.RemoteCachePages = CONSTRAINED_CACHE_PAGES
+	}
+	if db.CheckpointPages == 0 {
+		db.CheckpointPages = CONSTRAINED_CHECKPOINT_PAGES
+	}
+}
+
+// mmapSize returns the size of the initial mapping of the file.
+func (db *KV) mmapSize() int {
+	if db.Constrained {
+		return CONSTRAINED_MMAP_SIZE
+	}
+	return 64 << 20
+}
@@ -0,0 +1,293 @@
+package main
+
+import "bytes"
+
+// read-ahead policies of a cursor
+const (
+	READAHEAD_AUTO = 0 // read ahead once the cursor moves across leaves
+	READAHEAD_SCAN = 1 // read ahead eagerly and further, see Cursor.WillScanAll
+	READAHEAD_NONE = 2 // never read ahead, see Cursor.PointLookupsOnly
+)
+
+// the number of leaves read ahead by the policies
+const (
+	CURSOR_READAHEAD      = 8
+	CURSOR_READAHEAD_SCAN = 32
+)
+
+// Cursor iterates over the keys of a BTree in sorted order.
+// It keeps the path from the root to the current leaf, so moving to a neighbouring leaf
+// only re-reads the nodes below the lowest common ancestor.
+// A cursor is invalidated by any update of the tree. Expired keys are skipped, see ttl.go.
+// If reading a node fails the cursor becomes invalid and the error is reported by Err.
+//
+// The leaves ahead of the cursor are prefetched according to its read-ahead policy,
+// which can be changed with WillScanAll and PointLookupsOnly.
+type Cursor struct {
+	tree      *BTree
+	path      []BNode  // nodes from the root to the leaf
+	pos       []uint16 // index into each node of the path
+	err       error
+	readAhead int       // READAHEAD_*
+	ahead     [2]uint16 // kids of the leaf's parent that were prefetched, [lo, hi)
+	backward  bool      // the cursor last moved backwards, or was positioned to do so
+}
+
+// Seek returns a cursor positioned at the first key that is greater than or equal to the given key.
+// If there is no such key the cursor is not valid.
+func (tree *BTree) Seek(key []byte) *Cursor {
+	c := tree.SeekLE(key)
+	c.backward = false
+	// SeekLE found the last key <= key, so move forward unless it's an exact match.
+	// this also skips the empty dummy key at the start of the tree,
+	// and an expired exact match that SeekLE skipped.
+	if !c.Valid() || bytes.Compare(c.Key(), key) < 0 {
+		c.Next()
+	}
+	return c
+}
+
+// SeekLE returns a cursor positioned at the last key that is less than or equal to the given key,
+// to iterate backwards with Prev. If there is no such key the cursor is not valid,
+// a following Next moves it to the first key.
+func (tree *BTree) SeekLE(key []byte) *Cursor {
+	c := &Cursor{tree: tree, backward: true}
+	if tree.root == 0 {
+		return c
+	}
+	for ptr := tree.root; ; {
+		if err := checkDepth(len(c.path)); err != nil {
+			c.err = err
+			return c
+		}
+		node, err := tree.getNode(ptr)
+		if err != nil {
+			c.err = err
+			return c
+		}
+		idx := nodeLookupLE(node, key)
+		c.path = append(c.path, node)
+		c.pos = append(c.pos, idx)
+		if node.btype() == BNODE_LEAF {
+			c.skip(true)
+			return c
+		}
+		ptr = node.getPtr(idx)
+	}
+}
+
+// Last returns a cursor positioned at the last key, to iterate backwards with Prev.
+// If the tree is empty the cursor is not valid.
+func (tree *BTree) Last() *Cursor {
+	c := &Cursor{tree: tree, backward: true}
+	if tree.root == 0 {
+		return c
+	}
+	for ptr := tree.root; ; {
+		if err := checkDepth(len(c.path)); err != nil {
+			c.err = err
+			return c
+		}
+		node, err := tree.getNode(ptr)
+		if err != nil {
+			c.err = err
+			return c
+		}
+		idx := node.nkeys() - 1
+		c.path = append(c.path, node)
+		c.pos = append(c.pos, idx)
+		if node.btype() == BNODE_LEAF {
+			c.skip(true)
+			return c
+		}
+		ptr = node.getPtr(idx)
+	}
+}
+
+// Valid reports whether the cursor points at a key.
+// It's false past either end of the tree and for an empty tree.
+func (c *Cursor) Valid() bool {
+	if c.err != nil || len(c.path) == 0 {
+		return false
+	}
+	leaf, idx := c.leaf()
+	// the empty dummy key at the start of the tree isn't a real key
+	return idx < leaf.nkeys() && len(leaf.getKey(idx)) > 0
+}
+
+// Err returns the error that made the cursor invalid, if any.
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Key returns the key at the cursor position. The cursor must be valid.
+func (c *Cursor) Key() []byte {
+	assert(c.Valid())
+	leaf, idx := c.leaf()
+	return leaf.getKey(idx)
+}
+
+// Val returns the value at the cursor position. The cursor must be valid.
+// A value that can't be decoded or fails its checksum (see values.go) makes the cursor invalid
+// and Val returns nil, the error is returned by Err.
+func (c *Cursor) Val() []byte {
+	assert(c.Valid())
+	leaf, idx := c.leaf()
+	val, err := c.tree.vals.decode(leaf.getVal(idx))
+	if err != nil {
+		c.err = err
+	}
+	return val
+}
+
+// Next moves the cursor to the next key. Past the last key the cursor becomes invalid,
+// a following Prev moves it back to the last key.
+func (c *Cursor) Next() {
+	c.next()
+	c.skip(false)
+}
+
+// Prev moves the cursor to the previous key. Before the first key the cursor becomes invalid,
+// a following Next moves it back to the first key.
+func (c *Cursor) Prev() {
+	c.prev()
+	c.skip(true)
+}
+
+// skip moves the cursor past the expired keys, backwards or forwards.
+func (c *Cursor) skip(backward bool) {
+	if c.tree == nil || !c.tree.vals.hasDeadlines() {
+		return // a cursor with an error has no tree
+	}
+	for c.Valid() {
+		leaf, idx := c.leaf()
+		if !c.tree.vals.expired(leaf.getVal(idx), c.tree.now) {
+			return
+		}
+		if backward {
+			c.prev()
+		} else {
+			c.next()
+		}
+	}
+}
+
+// next moves the cursor to the next pair, expired or not.
+func (c *Cursor) next() {
+	if c.err != nil || len(c.path) == 0 {
+		return
+	}
+	c.backward = false
+	last := len(c.path) - 1
+	if c.pos[last]+1 < c.path[last].nkeys() {
+		c.pos[last]++
+		return
+	}
+	// find the lowest ancestor that has a next kid
+	level := last - 1
+	for level >= 0 && c.pos[level]+1 >= c.path[level].nkeys() {
+		level--
+	}
+	if level < 0 {
+		c.pos[last] = c.path[last].nkeys() // past the end
+		return
+	}
+	c.pos[level]++
+	c.descend(level, false)
+}
+
+// prev moves the cursor to the previous pair, expired or not.
+func (c *Cursor) prev() {
+	if c.err != nil || len(c.path) == 0 {
+		return
+	}
+	c.backward = true
+	last := len(c.path) - 1
+	if c.pos[last] > 0 {
+		c.pos[last]--
+		return
+	}
+	// find the lowest ancestor that has a previous kid
+	level := last - 1
+	for level >= 0 && c.pos[level] == 0 {
+		level--
+	}
+	if level < 0 {
+		return // already at the dummy key before the first key
+	}
+	c.pos[level]--
+	c.descend(level, true)
+}
+
+// WillScanAll hints that the cursor will iterate over many keys.
+// The leaves ahead of it are prefetched right away, and further ahead than by default.
+// Ahead is backwards for a cursor returned by Last or SeekLE, or that last moved with Prev.
+func (c *Cursor) WillScanAll() *Cursor {
+	c.readAhead = READAHEAD_SCAN
+	c.prefetch(c.backward)
+	return c
+}
+
+// PointLookupsOnly hints that the cursor only reads a few keys around its position.
+// Nothing is prefetched, not even when the cursor moves across leaves.
+func (c *Cursor) PointLookupsOnly() *Cursor {
+	c.readAhead = READAHEAD_NONE
+	return c
+}
+
+// prefetch hints the pages of the leaves next to the current one in the direction the
+// cursor is moving, unless they were already prefetched. Only the kids of the leaf's parent
+// are considered, the read-ahead continues when the cursor moves on to the next parent.
+func (c *Cursor) prefetch(backward bool) {
+	window := 0
+	switch c.readAhead {
+	case READAHEAD_AUTO:
+		window = CURSOR_READAHEAD
+	case READAHEAD_SCAN:
+		window = CURSOR_READAHEAD_SCAN
+	}
+	if window == 0 || c.err != nil || len(c.path) < 2 || c.tree.prefetch == nil {
+		return
+	}
+	parent, pos := c.path[len(c.path)-2], int(c.pos[len(c.path)-2])
+	lo, hi, next := pos+1, min(pos+1+window, int(parent.nkeys())), pos+1
+	if backward {
+		lo, hi, next = max(pos-window, 0), pos, pos-1
+	}
+	if lo >= hi || (int(c.ahead[0]) <= next && next < int(c.ahead[1])) {
+		return
+	}
+	ptrs := make([]uint64, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		ptrs = append(ptrs, parent.getPtr(uint16(i)))
+	}
+	c.tree.prefetch(ptrs)
+	c.ahead = [2]uint16{uint16(lo), uint16(hi)}
+}
+
+// descend reloads the path below the given level after its position changed.
+// The lower levels are positioned at their first key, or at their last key when moving backwards.
+func (c *Cursor) descend(level int, last bool) {
+	if level < len(c.path)-2 {
+		c.ahead = [2]uint16{} // a new parent
+	}
+	defer c.prefetch(last)
+	for i := level + 1; i < len(c.path); i++ {
+		node, err := c.tree.getNode(c.path[i-1].getPtr(c.pos[i-1]))
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.path[i] = node
+		c.pos[i] = 0
+		if last {
+			c.pos[i] = node.nkeys() - 1
+		}
+	}
+}
+
+// leaf returns the current leaf and the position in it.
+func (c *Cursor) leaf() (BNode, uint16) {
+	last := len(c.path) - 1
+	return c.path[last], c.pos[last]
+}
@@ -0,0 +1,180 @@
+package main
+
+// leafDelete copies the old leaf into the new one while removing the KV pair at the given index.
+func leafDelete(new BNode, old BNode, idx uint16) {
+	new.setHeaderLike(old, BNODE_LEAF, old.nkeys()-1)
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendRange(new, old, idx, idx+1, old.nkeys()-(idx+1))
+}
+
+// treeDelete deletes a key from the tree and returns the updated copy of the root.
+// An empty node (nil data) is returned if the key was not found.
+// The leaf is updated first, then each node on the path up to the root, see treePath.
+func treeDelete(tree *BTree, key []byte) (BNode, error) {
+	path, err := treePath(tree, key)
+	if err != nil {
+		return BNode{}, err
+	}
+	leaf := path[len(path)-1]
+	if leaf.node.cmpKey(leaf.idx, key) != 0 {
+		return BNode{}, nil // not found
+	}
+	updated := BNode{data: make([]byte, tree.nodeSize)}
+	leafDelete(updated, leaf.node, leaf.idx)
+	for i := len(path) - 2; i >= 0; i-- {
+		if updated, err = nodeDelete(tree, path[i], updated); err != nil {
+			return BNode{}, err
+		}
+	}
+	return updated, nil
+}
+
+// nodeDelete links the updated copy of the kid that the path goes on to from an internal node,
+// after a key was deleted from it, and returns the updated copy of the node.
+// If the updated kid became too small it is merged with its left or right sibling.
+// The updated node can be bigger than a page: the keys of the links don't change, but a merged
+// node can get a shorter prefix and be split again. The caller is responsible for splitting it.
+func nodeDelete(tree *BTree, level treeLevel, updated BNode) (BNode, error) {
+	node, idx, lo, hi := level.node, level.idx, level.lo, level.hi
+	kptr := node.getPtr(idx)
+	klo, khi := kidFences(node, idx, lo, hi)
+	mergeDir, sibling, err := shouldMerge(tree, node, idx, updated, lo, hi)
+	if err != nil {
+		return BNode{}, err
+	}
+
+	new := BNode{data: make([]byte, 2*tree.nodeSize)}
+	switch {
+	case mergeDir < 0: // left
+		mlo, _ := kidFences(node, idx-1, lo, hi)
+		merged := BNode{data: make([]byte, 2*tree.nodeSize)}
+		nodeMerge(merged, sibling, updated, fencePrefix(mlo, khi))
+		nsplit, split, err := nodeSplit3(merged, tree.nodeSize, mlo, khi)
+		if err != nil {
+			return BNode{}, err
+		}
+		tree.del(node.getPtr(idx - 1))
+		nodeReplace2Kid(tree, new, node, idx-1, split[:nsplit]...)
+	case mergeDir > 0: // right
+		_, mhi := kidFences(node, idx+1, lo, hi)
+		merged := BNode{data: make([]byte, 2*tree.nodeSize)}
+		nodeMerge(merged, updated, sibling, fencePrefix(klo, mhi))
+		nsplit, split, err := nodeSplit3(merged, tree.nodeSize, klo, mhi)
+		if err != nil {
+			return BNode{}, err
+		}
+		tree.del(node.getPtr(idx + 1))
+		nodeReplace2Kid(tree, new, node, idx, split[:nsplit]...)
+	case updated.nkeys() == 0:
+		// the only kid is empty, so is the node now. it's merged away by the caller.
+		nodeReplaceKidN(tree, new, node, idx)
+	default:
+		nsplit, split, err := nodeSplit3(updated, tree.nodeSize, klo, khi)
+		if err != nil {
+			return BNode{}, err
+		}
+		nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	}
+	tree.del(kptr)
+	return new, nil
+}
+
+// nodeMerge merges two sibling nodes into one. A prefix-compressed node gets the given prefix,
+// which is the prefix of the key range of both siblings.
+func nodeMerge(new BNode, left BNode, right BNode, prefix []byte) {
+	new.setHeader(left.btype(), left.nkeys()+right.nkeys())
+	if left.prefixed() {
+		new.setPrefix(prefix)
+	}
+	nodeAppendRange(new, left, 0, 0, left.nkeys())
+	nodeAppendRange(new, right, left.nkeys(), 0, right.nkeys())
+}
+
+// nodeReplace2Kid replaces the two adjacent links at idx and idx+1 of an internal node
+// with links to the given kids.
+func nodeReplace2Kid(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
+	nodeReplaceKids(tree, new, old, idx, 2, kids...)
+}
+
+// shouldMerge decides whether the updated kid should be merged with a sibling.
+// A kid is merged once it shrinks below a quarter of a page and the merged node fits into a page.
+// An empty kid is always merged, the merged node is split again if its prefix got shorter.
+// It returns -1 for the left sibling, +1 for the right sibling and 0 if no merge is needed.
+func shouldMerge(tree *BTree, node BNode, idx uint16, updated BNode, lo []byte, hi []byte) (int, BNode, error) {
+	empty := updated.nkeys() == 0
+	if !empty && int(updated.nbytes()) > tree.nodeSize/4 {
+		return 0, BNode{}, nil
+	}
+	if idx > 0 {
+		sibling, err := tree.getNode(node.getPtr(idx - 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		mlo, _ := kidFences(node, idx-1, lo, hi)
+		_, mhi := kidFences(node, idx, lo, hi)
+		if empty || mergeFits(sibling, updated, fencePrefix(mlo, mhi), tree.nodeSize) {
+			return -1, sibling, nil
+		}
+	}
+	if idx+1 < node.nkeys() {
+		sibling, err := tree.getNode(node.getPtr(idx + 1))
+		if err != nil {
+			return 0, BNode{}, err
+		}
+		mlo, _ := kidFences(node, idx, lo, hi)
+		_, mhi := kidFences(node, idx+1, lo, hi)
+		if empty || mergeFits(updated, sibling, fencePrefix(mlo, mhi), tree.nodeSize) {
+			return +1, sibling, nil
+		}
+	}
+	return 0, BNode{}, nil
+}
+
+// mergeFits reports whether the node merged from two siblings with the given prefix fits into a page.
+func mergeFits(left BNode, right BNode, prefix []byte, size int) bool {
+	nbytes, expanded := HEADER, HEADER
+	if left.prefixed() {
+		nbytes += 2 + len(prefix)
+		expanded += 2
+	}
+	for _, node := range []BNode{left, right} {
+		n, plen := int(node.nkeys()), len(node.prefix())
+		kvs := 10*n + int(node.getOffset(node.nkeys()))
+		nbytes += kvs + n*(plen-len(prefix))
+		expanded += kvs + n*plen
+	}
+	return nodeFits(nbytes, expanded, size)
+}
+
+// Delete removes a key from the tree and reports whether the key was found.
+// An expired key is removed too, but it's reported as not found.
+// On error the root is left unchanged, pages allocated before the error are not linked into the tree.
+func (tree *BTree) Delete(key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	if tree.root == 0 {
+		return false, nil
+	}
+
+	live := true
+	if tree.vals.hasDeadlines() {
+		stored, ok, err := tree.getStored(key)
+		if err != nil || !ok {
+			return false, err
+		}
+		live = !tree.vals.expired(stored, tree.now)
+	}
+	updated, err := treeDelete(tree, key)
+	if err != nil || len(updated.data) == 0 {
+		return false, err // not found
+	}
+
+	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		// the root has a single kid left, remove a level
+		tree.del(tree.root)
+		tree.root = updated.getPtr(0)
+		return live, nil
+	}
+	return live, tree.replaceRoot(updated)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DeleteRange deletes the keys in [start, end) and returns the number of deleted keys,
+// see BTree.DeleteRange. An empty start or end is unbounded.
+func (tx *Tx) DeleteRange(start []byte, end []byte) (int, error) {
+	if err := tx.check(true); err != nil {
+		return 0, err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return 0, err
+	}
+	if err := checkRange(start, end); err != nil {
+		return 0, err
+	}
+	if err := tx.indexDelRange(start, end); err != nil {
+		return 0, err
+	}
+	keys, err := tx.watchedRange(start, end)
+	if err != nil {
+		return 0, err
+	}
+	n, err := tx.tree.DeleteRange(start, end)
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		tx.watched(key, nil, true)
+	}
+	if tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_DELRANGE, start, end)
+	}
+	return n, nil
+}
+
+// DeleteRange deletes the keys of the bucket in [start, end), see Tx.DeleteRange.
+func (b *Bucket) DeleteRange(start []byte, end []byte) (int, error) {
+	if err := b.check(true); err != nil {
+		return 0, err
+	}
+	if err := checkRange(start, end); err != nil {
+		return 0, err
+	}
+	n, err := b.tree.DeleteRange(start, end)
+	if err == nil {
+		b.trace(TRACE_DELRANGE, start, end)
+	}
+	return n, err
+}
+
+// checkRange validates the bounds of a range passed to the public API, which can be empty.
+func checkRange(start []byte, end []byte) error {
+	if len(start) > 0 {
+		if err := checkKey(start); err != nil {
+			return fmt.Errorf("start: %w", err)
+		}
+	}
+	if len(end) > 0 {
+		if err := checkKey(end); err != nil {
+			return fmt.Errorf("end: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteRange deletes the keys in [start, end) and returns the number of deleted keys.
+// An empty end is unbounded, so DeleteRange(nil, nil) deletes every key.
+// The subtrees that are entirely in the range are dropped as a whole: their pages are freed
+// and their leaves are only read to count the keys. Only the nodes on the paths to both
+// ends of the range are rewritten, along with the edges of the nodes that take over the
+// key ranges of the dropped ones.
+// On error the root is left unchanged and no page is freed.
+func (tree *BTree) DeleteRange(start []byte, end []byte) (int, error) {
+	if len(start) == 0 {
+		start = []byte{0} // the first possible key, the empty dummy key is kept
+	}
+	if len(end) == 0 {
+		end = nil
+	}
+	if tree.root == 0 || (end != nil && bytes.Compare(start, end) >= 0) {
+		return 0, nil
+	}
+	root, err := tree.getNode(tree.root)
+	if err != nil {
+		return 0, err
+	}
+	d := rangeDel{tree: tree, start: start, end: end}
+	updated, err := d.node(root, nil, nil)
+	if err != nil || len(updated.data) == 0 {
+		return 0, err // nothing in the range
+	}
+
+	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
+		// remove the levels that have a single kid left
+		d.freed = append(d.freed, tree.root)
+		ptr := updated.getPtr(0)
+		for {
+			node, err := tree.getNode(ptr)
+			if err != nil {
+				return 0, err
+			}
+			if node.btype() == BNODE_LEAF || node.nkeys() > 1 {
+				break
+			}
+			d.freed = append(d.freed, ptr)
+			ptr = node.getPtr(0)
+		}
+		tree.root = ptr
+	} else if err := tree.replaceRoot(updated); err != nil {
+		return 0, err
+	}
+	for _, ptr := range d.freed {
+		tree.del(ptr)
+	}
+	return d.count, nil
+}
+
+// rangeDel is the state of a DeleteRange.
+type rangeDel struct {
+	tree  *BTree
+	start []byte
+	end   []byte   // nil if unbounded
+	count int      // the number of deleted keys
+	freed []uint64 // the pages to free once the new root is in place
+	depth int      // the level of the node being updated, which is bounded like in treePath
+}
+
+// covers reports whether the key range [lo, hi) is entirely in the range being deleted.
+// The range of the first leaf starts at nil, so the dummy key is never covered.
+func (d *rangeDel) covers(lo []byte, hi []byte) bool {
+	if bytes.Compare(lo, d.start) < 0 {
+		return false
+	}
+	if d.end == nil {
+		return true
+	}
+	return hi != nil && bytes.Compare(hi, d.end) <= 0
+}
+
+// node deletes the range from the subtree of a node with the key range [lo, hi).
+// It returns the updated copy of the node, which can have no keys left or be bigger than a page,
+// or an empty node (nil data) if there was nothing to delete.
+func (d *rangeDel) node(node BNode, lo []byte, hi []byte) (BNode, error) {
+	if node.btype() == BNODE_LEAF {
+		return d.leaf(node), nil
+	}
+	if err := checkDepth(d.depth); err != nil {
+		return BNode{}, err
+	}
+	d.depth++
+	defer func() { d.depth-- }()
+	// the kids that overlap the range
+	first := nodeLookupLE(node, d.start)
+	last := node.nkeys() - 1
+	if d.end != nil {
+		last = nodeLookupLE(node, d.end)
+		if last > first && node.cmpKey(last, d.end) == 0 {
+			last-- // the kid starts at the end of the range
+		}
+	}
+	// the kids in between are entirely in the range
+	for i := first + 1; i < last; i++ {
+		kid, err := d.tree.getNode(node.getPtr(i))
+		if err != nil {
+			return BNode{}, err
+		}
+		if err := d.drop(node.getPtr(i), kid, d.depth); err != nil {
+			return BNode{}, err
+		}
+	}
+
+	a, achanged, err := d.kid(node, first, lo, hi)
+	if err != nil {
+		return BNode{}, err
+	}
+	if first == last {
+		if !achanged {
+			return BNode{}, nil
+		}
+		return d.replace(node, first, last, a, lo, hi)
+	}
+	b, bchanged, err := d.kid(node, last, lo, hi)
+	if err != nil {
+		return BNode{}, err
+	}
+	if !achanged && !bchanged && last == first+1 {
+		return BNode{}, nil
+	}
+	// both links are replaced, an unchanged kid is copied to a new page
+	if !achanged {
+		d.freed = append(d.freed, node.getPtr(first))
+		a = BNode{data: bytes.Clone(a.data)}
+	}
+	if !bchanged {
+		d.freed = append(d.freed, node.getPtr(last))
+		b = BNode{data: bytes.Clone(b.data)}
+	}
+	return d.join(node, first, last, a, b, lo, hi)
+}
+
+// kid deletes the range from the kid at idx of an internal node with the key range [lo, hi).
+// A kid that is entirely in the range is dropped and returned as a node without keys.
+// It returns the kid itself if there was nothing to delete, and whether it changed.
+func (d *rangeDel) kid(node BNode, idx uint16, lo []byte, hi []byte) (BNode, bool, error) {
+	ptr := node.getPtr(idx)
+	kid, err := d.tree.getNode(ptr)
+	if err != nil {
+		return BNode{}, false, err
+	}
+	klo, khi := kidRange(node, idx, lo, hi)
+	if d.covers(klo, khi) {
+		if err := d.drop(ptr, kid, d.depth); err != nil {
+			return BNode{}, false, err
+		}
+		empty := BNode{data: make([]byte, d.tree.nodeSize)}
+		empty.setHeaderLike(kid, kid.btype(), 0)
+		return empty, true, nil
+	}
+	updated, err := d.node(kid, klo, khi)
+	if err != nil || len(updated.data) == 0 {
+		return kid, false, err
+	}
+	d.freed = append(d.freed, ptr)
+	return updated, true, nil
+}
+
+// leaf returns a copy of the leaf without the keys in the range, or an empty node (nil data)
+// if it has none of them.
+func (d *rangeDel) leaf(node BNode) BNode {
+	nkeys := node.nkeys()
+	// [i, j) are the keys in the range
+	i := nodeLookupLE(node, d.start)
+	if node.cmpKey(i, d.start) < 0 {
+		i++
+	}
+	j := nkeys
+	if d.end != nil {
+		j = nodeLookupLE(node, d.end)
+		if node.cmpKey(j, d.end) < 0 {
+			j++
+		}
+	}
+	if i >= j {
+		return BNode{}
+	}
+	new := BNode{data: make([]byte, d.tree.nodeSize)}
+	new.setHeaderLike(node, BNODE_LEAF, nkeys-(j-i))
+	nodeAppendRange(new, node, 0, 0, i)
+	nodeAppendRange(new, node, i, j, nkeys-j)
+	d.count += int(j - i)
+	return new
+}
+
+// drop frees the subtree rooted at the given page at the given depth, which is entirely in the range.
+func (d *rangeDel) drop(ptr uint64, node BNode, depth int) error {
+	d.freed = append(d.freed, ptr)
+	if node.btype() == BNODE_LEAF {
+		d.count += int(node.nkeys())
+		return nil
+	}
+	if err := checkDepth(depth); err != nil {
+		return err
+	}
+	ptrs := make([]uint64, node.nkeys())
+	for i := range ptrs {
+		ptrs[i] = node.getPtr(uint16(i))
+	}
+	if d.tree.prefetch != nil {
+		d.tree.prefetch(ptrs)
+	}
+	for _, ptr := range ptrs {
+		kid, err := d.tree.getNode(ptr)
+		if err != nil {
+			return err
+		}
+		if err := d.drop(ptr, kid, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace replaces the links [a, b] of an internal node with the updated node that covers
+// their key ranges. Like in nodeDelete, the updated node is merged with a sibling if it became
+// too small. If it has no keys left, a sibling takes over its key range instead.
+// An internal node whose only kids are replaced by a node without keys has no keys left either,
+// it's merged away by the caller. The result can be bigger than a page, the caller splits it.
+func (d *rangeDel) replace(node BNode, a uint16, b uint16, updated BNode, lo []byte, hi []byte) (BNode, error) {
+	tree := d.tree
+	rlo, _ := kidRange(node, a, lo, hi)
+	_, rhi := kidRange(node, b, lo, hi)
+	new := BNode{data: make([]byte, 2*tree.nodeSize)}
+	empty := updated.nkeys() == 0
+	if empty || int(updated.nbytes()) <= tree.nodeSize/4 {
+		if a > 0 {
+			sibling, err := tree.getNode(node.getPtr(a - 1))
+			if err != nil {
+				return BNode{}, err
+			}
+			slo, shi := kidRange(node, a-1, lo, hi)
+			var kids []BNode
+			if empty {
+				kids, err = d.widen(BNode{data: bytes.Clone(sibling.data)}, slo, shi, slo, rhi)
+			} else if prefix := rangePrefix(sibling, slo, rhi); mergeFits(sibling, updated, prefix, tree.nodeSize) {
+				merged := BNode{data: make([]byte, tree.nodeSize)}
+				nodeMerge(merged, sibling, updated, prefix)
+				kids = []BNode{merged}
+			}
+			if err != nil {
+				return BNode{}, err
+			}
+			if kids != nil {
+				d.freed = append(d.freed, node.getPtr(a-1))
+				nodeReplaceKids(tree, new, node, a-1, b-a+2, kids...)
+				return new, nil
+			}
+		}
+		if b+1 < node.nkeys() {
+			sibling, err := tree.getNode(node.getPtr(b + 1))
+			if err != nil {
+				return BNode{}, err
+			}
+			slo, shi := kidRange(node, b+1, lo, hi)
+			var kids []BNode
+			if empty {
+				kids, err = d.widen(BNode{data: bytes.Clone(sibling.data)}, slo, shi, rlo, shi)
+			} else if prefix := rangePrefix(sibling, rlo, shi); mergeFits(updated, sibling, prefix, tree.nodeSize) {
+				merged := BNode{data: make([]byte, tree.nodeSize)}
+				nodeMerge(merged, updated, sibling, prefix)
+				kids = []BNode{merged}
+			}
+			if err != nil {
+				return BNode{}, err
+			}
+			if kids != nil {
+				d.freed = append(d.freed, node.getPtr(b+1))
+				nodeReplaceKids(tree, new, node, a, b-a+2, kids...)
+				return new, nil
+			}
+		}
+		if empty {
+			nodeReplaceKids(tree, new, node, a, b-a+1)
+			return new, nil
+		}
+	}
+	nsplit, split, err := nodeSplit3(updated, tree.nodeSize, rlo, rhi)
+	if err != nil {
+		return BNode{}, err
+	}
+	nodeReplaceKids(tree, new, node, a, b-a+1, split[:nsplit]...)
+	return new, nil
+}
+
+// join replaces the links [first, last] of an internal node, whose kids in between were dropped,
+// with the updated first and last kid, which take over the key ranges of the dropped kids:
+// a ends where b begins, or takes over the whole range if b has no keys left, and vice versa.
+func (d *rangeDel) join(node BNode, first uint16, last uint16, a BNode, b BNode, lo []byte, hi []byte) (BNode, error) {
+	if a.nkeys() == 0 && b.nkeys() == 0 {
+		return d.replace(node, first, last, a, lo, hi)
+	}
+	alo, ahi := kidRange(node, first, lo, hi)
+	blo, bhi := kidRange(node, last, lo, hi)
+	var apieces, bpieces []BNode
+	var err error
+	if a.nkeys() > 0 {
+		mid := blo
+		if b.nkeys() == 0 {
+			mid = bhi
+		}
+		if apieces, err = d.widen(a, alo, ahi, alo, mid); err != nil {
+			return BNode{}, err
+		}
+	}
+	if b.nkeys() > 0 {
+		mid := blo
+		if a.nkeys() == 0 {
+			mid = alo
+		}
+		if bpieces, err = d.widen(b, blo, bhi, mid, bhi); err != nil {
+			return BNode{}, err
+		}
+	}
+	if len(apieces) == 1 && len(bpieces) == 1 {
+		prefix := rangePrefix(a, alo, bhi)
+		if mergeFits(apieces[0], bpieces[0], prefix, d.tree.nodeSize) {
+			merged := BNode{data: make([]byte, d.tree.nodeSize)}
+			nodeMerge(merged, apieces[0], bpieces[0], prefix)
+			apieces, bpieces = []BNode{merged}, nil
+		}
+	}
+	kids := append(apieces, bpieces...)
+	if len(kids) == 1 {
+		// a single node might be merged with a sibling
+		return d.replace(node, first, last, kids[0], lo, hi)
+	}
+	// the first kid keeps the key of the first link, which is also the first key of b
+	// if it took over the range of a
+	keys := [][]byte{node.getKey(first)}
+	for i, kid := range kids[1:] {
+		if i+1 == len(apieces) {
+			keys = append(keys, node.getKey(last))
+		} else {
+			keys = append(keys, kid.getKey(0))
+		}
+	}
+	return nodeRelink(d.tree, node, first, last, keys, kids), nil
+}
+
+// widen returns the pages of an updated node with the key range [lo, hi), which can be bigger
+// than a page, for the wider key range [wlo, whi). The node is split first, then the first and
+// the last page are widened by widenPage.
+func (d *rangeDel) widen(node BNode, lo []byte, hi []byte, wlo []byte, whi []byte) ([]BNode, error) {
+	nsplit, split, err := nodeSplit3(node, d.tree.nodeSize, lo, hi)
+	if err != nil {
+		return nil, err
+	}
+	var pieces []BNode
+	for i, piece := range split[:nsplit] {
+		plo, phi := lo, hi
+		if i > 0 {
+			plo = piece.getKey(0)
+		}
+		if i+1 < int(nsplit) {
+			phi = split[i+1].getKey(0)
+		}
+		wplo, wphi := plo, phi
+		if i == 0 {
+			wplo = wlo
+		}
+		if i+1 == int(nsplit) {
+			wphi = whi
+		}
+		widened, _, err := d.widenPage(piece, plo, phi, wplo, wphi)
+		if err != nil {
+			return nil, err
+		}
+		pieces = append(pieces, widened...)
+	}
+	return pieces, nil
+}
+
+// widenPage returns the pages of a node with the key range [lo, hi) for the wider key range
+// [wlo, whi), and whether it changed. The first and the last kid of an internal node get wider
+// with it, and so on down to the leaves, and each of them can need a shorter prefix.
+// The first key of an internal node is the start of its key range, which is the key of its link,
+// so it moves down to wlo. The re-encoded node might not fit into a page, it's split.
+func (d *rangeDel) widenPage(node BNode, lo []byte, hi []byte, wlo []byte, whi []byte) ([]BNode, bool, error) {
+	left := !bytes.Equal(lo, wlo)
+	right := (hi == nil) != (whi == nil) || !bytes.Equal(hi, whi)
+	if !node.prefixed() && (!left || node.btype() == BNODE_LEAF) {
+		return []BNode{node}, false, nil // nothing depends on the key range
+	}
+	if !left && !right {
+		return []BNode{node}, false, nil
+	}
+	nkeys := node.nkeys()
+	size := BTREE_MAX_EXPANSION*d.tree.nodeSize + 8 + 2 + 4 + len(wlo)
+	// the widened first and last kid, nil if unchanged
+	var kids [2][]BNode
+	if node.btype() == BNODE_NODE {
+		for i, idx := range []uint16{0, nkeys - 1} {
+			if i == 1 && idx == 0 {
+				break
+			}
+			klo, khi := kidRange(node, idx, lo, hi)
+			wklo, wkhi := klo, khi
+			if idx == 0 {
+				wklo = wlo
+			}
+			if idx+1 == nkeys {
+				wkhi = whi
+			}
+			kid, err := d.tree.getNode(node.getPtr(idx))
+			if err != nil {
+				return nil, false, err
+			}
+			pieces, changed, err := d.widenPage(kid, klo, khi, wklo, wkhi)
+			if err != nil {
+				return nil, false, err
+			}
+			if changed {
+				d.freed = append(d.freed, node.getPtr(idx))
+				kids[i] = pieces
+				nkeys += uint16(len(pieces)) - 1
+				for _, piece := range pieces[1:] {
+					size += 8 + 2 + 4 + len(piece.getKey(0))
+				}
+			}
+		}
+	}
+
+	wide := BNode{data: make([]byte, size)}
+	wide.setHeader(node.btype(), nkeys)
+	if node.prefixed() {
+		wide.setPrefix(fencePrefix(wlo, whi))
+	}
+	if node.btype() == BNODE_LEAF {
+		nodeAppendRange(wide, node, 0, 0, nkeys)
+	} else {
+		pos := uint16(0)
+		for idx := uint16(0); idx < node.nkeys(); idx++ {
+			key := node.getKey(idx)
+			if idx == 0 {
+				key = wlo
+			}
+			pieces := []BNode(nil)
+			if idx == 0 {
+				pieces = kids[0]
+			} else if idx+1 == node.nkeys() {
+				pieces = kids[1]
+			}
+			if pieces == nil {
+				nodeAppendKV(wide, pos, node.getPtr(idx), key, nil)
+				pos++
+				continue
+			}
+			for i, piece := range pieces {
+				if i > 0 {
+					key = piece.getKey(0)
+				}
+				nodeAppendKV(wide, pos, d.tree.new(piece), key, nil)
+				pos++
+			}
+		}
+	}
+	nsplit, split, err := nodeSplit3(wide, d.tree.nodeSize, wlo, whi)
+	if err != nil {
+		return nil, false, err
+	}
+	return split[:nsplit], true, nil
+}
+
+// nodeRelink replaces the links [a, b] of an internal node with links to the given kids
+// under the given keys. The kids are allocated as new pages. The new node can be bigger
+// than a page, the caller splits it.
+func nodeRelink(tree *BTree, old BNode, a uint16, b uint16, keys [][]byte, kids []BNode) BNode {
+	nbytes := int(old.nbytes())
+	for _, key := range keys {
+		nbytes += 8 + 2 + 4 + len(key)
+	}
+	new := BNode{data: make([]byte, max(nbytes, 2*tree.nodeSize))}
+	new.setHeaderLike(old, BNODE_NODE, old.nkeys()-(b-a+1)+uint16(len(kids)))
+	nodeAppendRange(new, old, 0, 0, a)
+	for i, kid := range kids {
+		nodeAppendKV(new, a+uint16(i), tree.new(kid), keys[i], nil)
+	}
+	nodeAppendRange(new, old, a+uint16(len(kids)), b+1, old.nkeys()-(b+1))
+	return new
+}
+
+// kidRange returns the key range [lo, hi) of the kid at idx of an internal node with the
+// key range [lo, hi), like kidFences but also for nodes without prefix compression.
+func kidRange(node BNode, idx uint16, lo []byte, hi []byte) ([]byte, []byte) {
+	if idx > 0 {
+		lo = node.getKey(idx)
+	}
+	if idx+1 < node.nkeys() {
+		hi = node.getKey(idx + 1)
+	}
+	return lo, hi
+}
+
+// rangePrefix returns the prefix of a node like the given one for the key range [lo, hi),
+// nil if it's not prefix-compressed.
+func rangePrefix(like BNode, lo []byte, hi []byte) []byte {
+	if !like.prefixed() {
+		return nil
+	}
+	return fencePrefix(lo, hi)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/dict"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Value compression for databases created with KV.CompressValues, which are full of small
+// values that look alike, like JSON documents. Each value is too small to be compressed on its
+// own, but they compress well with a dictionary of the strings they have in common.
+//
+// Every value of such a database starts with a tag byte (VAL_*). The first values are stored
+// as they are, and DICT_SAMPLES of the committed ones are sampled, the samples of a transaction
+// that is rolled back are dropped. Then a background job trains a zstd dictionary on the samples
+// and stores it in the value of the empty dummy key, after the root of the bucket catalog (see
+// bucket.go), rather than in the master page: it's committed like any update, and the master
+// page stays a fixed size. The values written after that are compressed with the dictionary,
+// when it makes them smaller. The dictionary never changes once trained, so the values written
+// before it stay readable. The samples are in memory only, a reopened database samples again.
+//
+// The dictionary is a raw zstd dictionary: the content the values are compressed against,
+// without entropy tables. It's at most DICT_MAX_SIZE bytes, so that it fits into a value.
+// The values are encoded by the BTree, so buckets and BulkLoad get the same compression,
+// while the catalog keeps the roots of the buckets as they are.
+
+const (
+	// the dictionary follows the 8-byte catalog root in the value of the dummy key
+	DICT_MAX_SIZE = BTREE_MAX_VAL_SIZE - 8
+	// the number of sampled values that triggers the training
+	DICT_SAMPLES = 1000
+	// only the start of a value is sampled, matches further in rarely make it into a dictionary
+	DICT_SAMPLE_SIZE = 512
+	// shorter values are neither sampled nor compressed, the zstd frame header alone takes 6 bytes
+	DICT_MIN_VAL_SIZE = 32
+)
+
+// newValCodec returns a codec for the given dictionary, with the other options of c.
+func newValCodec(d []byte, c *valCodec) (*valCodec, error) {
+	enc, err := zstd.NewWriter(nil,
+		zstd.WithEncoderDictRaw(0, d),
+		zstd.WithEncoderCRC(false), // the pages have checksums
+		zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("dictionary: %w", err)
+	}
+	dec, err := zstd.NewReader(nil,
+		zstd.WithDecoderDictRaw(0, d),
+		zstd.WithDecoderMaxMemory(BTREE_MAX_VAL_SIZE))
+	if err != nil {
+		return nil, fmt.Errorf("dictionary: %w", err)
+	}
+	return &valCodec{tagged: true, summed: c.summed, timed: c.timed, dict: d, enc: enc, dec: dec}, nil
+}
+
+// loadDict switches the transaction to the trained codec once its tree has a dictionary.
+// The codec is shared with the later transactions, the dictionary never changes.
+func (tx *Tx) loadDict() error {
+	c := tx.tree.vals
+	if c == nil || !c.tagged || c.enc != nil {
+		return nil
+	}
+	meta, err := tx.tree.meta()
+	if err != nil {
+		return err
+	}
+	_, d, err := metaDecode(meta)
+	if err != nil || len(d) == 0 {
+		return err
+	}
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.tree.vals.enc == nil {
+		trained, err := newValCodec(bytes.Clone(d), c)
+		if err != nil {
+			return err
+		}
+		db.tree.vals = trained
+	}
+	tx.tree.vals = db.tree.vals
+	return nil
+}
+
+// TrainDict trains the dictionary of a database with CompressValues on the values sampled so far,
+// instead of waiting for DICT_SAMPLES of them. It returns ErrDictExists if it's already trained.
+func (db *KV) TrainDict() error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	c := tx.tree.vals
+	if c == nil || !c.tagged {
+		return fmt.Errorf("KV.TrainDict: the database was created without CompressValues: %w", errors.ErrUnsupported)
+	}
+	if c.enc != nil {
+		return ErrDictExists
+	}
+	d, err := dict.BuildRawDict(c.samples, dict.Options{MaxDictSize: DICT_MAX_SIZE, HashBytes: 6})
+	if err == nil {
+		var trained *valCodec
+		trained, err = newValCodec(d, c) // loadDict makes the one that is used
+		trained.close()
+	}
+	if err != nil {
+		c.samples = nil // start over with new samples
+		c.ready.Store(false)
+		return fmt.Errorf("KV.TrainDict: %w", err)
+	}
+	meta, err := tx.tree.meta()
+	if err != nil {
+		return err
+	}
+	root, _, err := metaDecode(meta)
+	if err != nil {
+		return err
+	}
+	if err := tx.tree.setMeta(catalogMeta(root, d)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// trainMaybe schedules the training of the dictionary once there are enough samples.
+// It's called after a commit, without holding db.writer, which the job waits for.
+func (db *KV) trainMaybe(c *valCodec) {
+	if c == nil || !c.ready.Load() {
+		return
+	}
+	db.mu.Lock()
+	queued := db.trainer
+	db.trainer = true
+	db.mu.Unlock()
+	if queued {
+		return
+	}
+	// in constrained mode the job runs right away
+	_ = db.Schedule(Job{Name: "train-dict", Run: func(ctx context.Context) error {
+		err := db.TrainDict()
+		db.mu.Lock()
+		db.trainer = false
+		db.mu.Unlock()
+		if errors.Is(err, ErrDictExists) {
+			return nil
+		}
+		return err
+	}})
+}
+
+// metaDecode splits the value of the dummy key into the root of the catalog
+// and the dictionary, either of which can be missing.
+func metaDecode(meta []byte) (uint64, []byte, error) {
+	switch {
+	case len(meta) == 0:
+		return 0, nil, nil
+	case len(meta) < 8:
+		return 0, nil, fmt.Errorf("catalog: %w: bad root pointer", ErrCorruptNode)
+	default:
+		return binary.LittleEndian.Uint64(meta), meta[8:], nil
+	}
+}
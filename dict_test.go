@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// Only the values of committed transactions are sampled for the dictionary.
+func TestDictSamplesCommitted(t *testing.T) {
+	db := &KV{Path: t.TempDir() + "/db", CompressValues: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	write := func(n int, commit bool) {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		for i := 0; i < n; i++ {
+			val := fmt.Sprintf(`{"id": %d, "name": "user %d", "active": true}`, i, i)
+			if err := tx.Set([]byte(fmt.Sprint("key", i)), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if commit {
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	write(DICT_SAMPLES, false)
+	c := db.tree.vals
+	if len(c.samples) != 0 || len(c.pending) != 0 || c.ready.Load() {
+		t.Fatalf("%d samples after a rollback", len(c.samples)+len(c.pending))
+	}
+	write(10, true)
+	if len(c.samples) != 10 || c.ready.Load() {
+		t.Fatalf("%d samples, want 10", len(c.samples))
+	}
+}
+
+// A trained dictionary compresses the values, also after a reopen.
+func TestDictCompress(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path, CompressValues: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	val := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id": %d, "name": "user %d", "email": "user%d@example.com", "active": true}`, i, i, i))
+	}
+	for i := 0; i < 200; i++ {
+		if err := db.Set([]byte(fmt.Sprint("key", i)), val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.TrainDict(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TrainDict(); !errors.Is(err, ErrDictExists) {
+		t.Fatal(err)
+	}
+	for i := 200; i < 400; i++ {
+		if err := db.Set([]byte(fmt.Sprint("key", i)), val(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	compressed := 0
+	for i := 0; i < 400; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		got, ok, err := tx.Get(key)
+		if err != nil || !ok || string(got) != string(val(i)) {
+			t.Fatalf("%s = %q, %v, %v", key, got, ok, err)
+		}
+		stored, _, err := tx.tree.getStored(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored[0] != VAL_ZSTD {
+			continue
+		}
+		if i < 200 {
+			t.Fatalf("%s was compressed before the dictionary was trained", key)
+		}
+		compressed++
+	}
+	if compressed < 150 {
+		t.Fatalf("%d of the 200 values written with the dictionary are compressed", compressed)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the BTree and the KV. They are wrapped with more context,
+// so use errors.Is to check for them.
+var (
+	ErrEmptyKey         = errors.New("empty key")
+	ErrKeyTooLarge      = errors.New("key too large")
+	ErrValTooLarge      = errors.New("value too large")
+	ErrCorruptNode      = errors.New("corrupt node")
+	ErrChecksum         = errors.New("checksum mismatch")
+	ErrPageOverflow     = errors.New("page overflow")
+	ErrTxClosed         = errors.New("transaction is closed")
+	ErrTxReadOnly       = errors.New("transaction is read-only")
+	ErrClosed           = errors.New("database is closed")
+	ErrReadOnly         = errors.New("database is read-only")
+	ErrNotEmpty         = errors.New("tree is not empty")
+	ErrUnsorted         = errors.New("keys are not sorted")
+	ErrFormat           = errors.New("unsupported file format")
+	ErrBucketNotFound   = errors.New("bucket not found")
+	ErrBucketExists     = errors.New("bucket already exists")
+	ErrLeaseExpired     = errors.New("writer lease expired")
+	ErrDictExists       = errors.New("dictionary already trained")
+	ErrValueChecksum    = errors.New("value checksum mismatch")
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	ErrSnapshotExists   = errors.New("snapshot already exists")
+	ErrBranchNotFound   = errors.New("branch not found")
+	ErrBranchExists     = errors.New("branch already exists")
+	ErrIndexNotFound    = errors.New("index not found")
+	ErrIndexesUnknown   = errors.New("the database has indexes, KV.Indexes is not set")
+	ErrMergeConflict    = errors.New("merge conflict")
+	ErrTableNotFound    = errors.New("table not found")
+	ErrTableExists      = errors.New("table already exists")
+	ErrBadRecord        = errors.New("record doesn't match the table")
+	ErrBadTuple         = errors.New("bad tuple")
+	ErrRowExists        = errors.New("row already exists")
+	ErrSyntax           = errors.New("syntax error")
+	ErrFileTooLarge     = errors.New("file too large")
+)
+
+// checkKey validates a key passed to the public API.
+func checkKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrKeyTooLarge, len(key), BTREE_MAX_KEY_SIZE)
+	}
+	return nil
+}
+
+// checkVal validates a value passed to the public API.
+func checkVal(val []byte) error {
+	if len(val) > BTREE_MAX_VAL_SIZE {
+		return fmt.Errorf("%w: %d bytes, the limit is %d", ErrValTooLarge, len(val), BTREE_MAX_VAL_SIZE)
+	}
+	return nil
+}
+
+// nodeCheck validates the structure of a node read from a page: the node type, that the
+// prefix, pointers and offsets fit into the page, and that the offsets agree with the KV pair lengths.
+// A node that passes can be accessed with getKey/getVal/getPtr without going out of bounds.
+func nodeCheck(node BNode) error {
+	if len(node.data) < HEADER {
+		return fmt.Errorf("%w: truncated header", ErrCorruptNode)
+	}
+	btype, nkeys := node.btype(), node.nkeys()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fmt.Errorf("%w: bad node type %d", ErrCorruptNode, btype)
+	}
+	if btype == BNODE_NODE && nkeys == 0 {
+		return fmt.Errorf("%w: internal node without keys", ErrCorruptNode)
+	}
+	base := HEADER
+	if node.prefixed() {
+		if HEADER+2 > len(node.data) {
+			return fmt.Errorf("%w: truncated header", ErrCorruptNode)
+		}
+		base += 2 + int(binary.LittleEndian.Uint16(node.data[HEADER:]))
+	}
+	kvStart := base + 10*int(nkeys)
+	if kvStart > len(node.data) {
+		return fmt.Errorf("%w: %d keys do not fit into a page", ErrCorruptNode, nkeys)
+	}
+	pos := kvStart
+	for i := uint16(0); i < nkeys; i++ {
+		if int(node.getOffset(i)) != pos-kvStart {
+			return fmt.Errorf("%w: bad offset of key %d", ErrCorruptNode, i)
+		}
+		if pos+4 > len(node.data) {
+			return fmt.Errorf("%w: key %d is out of bounds", ErrCorruptNode, i)
+		}
+		klen := binary.LittleEndian.Uint16(node.data[pos:])
+		vlen := binary.LittleEndian.Uint16(node.data[pos+2:])
+		pos += 4 + int(klen) + int(vlen)
+		if pos > len(node.data) {
+			return fmt.Errorf("%w: key %d is out of bounds", ErrCorruptNode, i)
+		}
+	}
+	if nkeys > 0 && int(node.getOffset(nkeys)) != pos-kvStart {
+		return fmt.Errorf("%w: bad end offset", ErrCorruptNode)
+	}
+	return nil
+}
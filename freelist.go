@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The free list is stored in the file, so that the pages freed in a session are reused after
+// the database is reopened. It's a chain of pages whose first page is in the master page, or
+// in the WAL record of the commit in WAL mode:
+// | type | count | next | entries              |
+// | 2B   | 2B    | 8B   | count * (8B + 8B)    |
+// where type is BNODE_FREE, next is the following page of the chain (0 for the last one) and
+// each entry is a version and a free page. A page freed by a version is referenced by the older
+// versions, which matters for the snapshots that pin them, see freeRelease. Version 0 is a page
+// that no version references anymore.
+//
+// Every commit writes the whole list into new pages, taken from the free pages themselves,
+// before the master page points to it. The pages of the previous list are free once the new
+// one is in place, they are in the list of the next commit.
+const FREE_HEADER = 4 + 8
+
+// freeStore writes the free list as it will be once the writable transaction is committed,
+// see publish, into pages allocated by the transaction.
+func freeStore(db *KV) {
+	perPage := (db.tree.nodeSize - FREE_HEADER) / 16
+	var pages []uint64
+	for len(pages)*perPage < freeCount(db) {
+		// a page taken from the free pages leaves one entry less
+		pages = append(pages, db.pageNew(BNode{}))
+	}
+	db.page.freeHead, db.page.freePages = 0, pages
+	if len(pages) == 0 {
+		return
+	}
+	db.page.freeHead = pages[0]
+
+	var entries []byte
+	add := func(version uint64, ptrs []uint64) {
+		for _, ptr := range ptrs {
+			entries = binary.LittleEndian.AppendUint64(entries, version)
+			entries = binary.LittleEndian.AppendUint64(entries, ptr)
+		}
+	}
+	add(0, db.free.ready[:len(db.free.ready)-db.page.nreuse])
+	add(0, db.page.scrap)
+	add(0, db.free.pages)
+	for _, f := range db.free.pending {
+		add(f.version, f.ptrs)
+	}
+	add(db.version+1, db.page.freed)
+	for i, ptr := range pages {
+		node := make([]byte, db.tree.nodeSize)
+		n := min(len(entries)/16, perPage)
+		binary.LittleEndian.PutUint16(node[0:], BNODE_FREE)
+		binary.LittleEndian.PutUint16(node[2:], uint16(n))
+		if i+1 < len(pages) {
+			binary.LittleEndian.PutUint64(node[4:], pages[i+1])
+		}
+		copy(node[FREE_HEADER:], entries[:16*n])
+		entries = entries[16*n:]
+		db.page.updates[ptr] = node
+	}
+}
+
+// freeCount returns the number of entries of the free list written by freeStore.
+func freeCount(db *KV) int {
+	n := len(db.free.ready) - db.page.nreuse + len(db.page.scrap) + len(db.free.pages) + len(db.page.freed)
+	for _, f := range db.free.pending {
+		n += len(f.ptrs)
+	}
+	return n
+}
+
+// freeLoad reads the free list of the committed version, starting at db.free.head.
+// The caller holds db.mu or is opening the database.
+func freeLoad(db *KV) error {
+	db.free.ready, db.free.pending, db.free.pages = nil, nil, nil
+	// read like a transaction on the committed version
+	tx := &Tx{db: db, chunks: db.mmap.chunks, flushed: db.page.flushed}
+	if db.wal.fp != nil {
+		tx.flushed = db.wal.base
+		tx.wal = db.wal.index
+	}
+	perPage := (db.tree.nodeSize - FREE_HEADER) / 16
+	for ptr := db.free.head; ptr != 0; {
+		if uint64(len(db.free.pages)) >= db.page.flushed || ptr >= db.page.flushed {
+			return fmt.Errorf("free list: page %d: %w", ptr, ErrCorruptNode)
+		}
+		node, err := tx.pageGet(ptr)
+		if err != nil {
+			return fmt.Errorf("free list: %w", err)
+		}
+		data := node.data
+		count := int(binary.LittleEndian.Uint16(data[2:]))
+		if len(data) < FREE_HEADER || binary.LittleEndian.Uint16(data) != BNODE_FREE || count > perPage {
+			return fmt.Errorf("free list: page %d: %w: not a page of the free list", ptr, ErrCorruptNode)
+		}
+		db.free.pages = append(db.free.pages, ptr)
+		for i := 0; i < count; i++ {
+			entry := data[FREE_HEADER+16*i:]
+			version, free := binary.LittleEndian.Uint64(entry), binary.LittleEndian.Uint64(entry[8:])
+			if !(1 <= free && free < db.page.flushed) || version > db.version {
+				return fmt.Errorf("free list: page %d: %w: bad entry %d", ptr, ErrCorruptNode, i)
+			}
+			if version == 0 {
+				db.free.ready = append(db.free.ready, free)
+				continue
+			}
+			// the entries of a version are next to each other, in the order of the versions
+			n := len(db.free.pending)
+			if n == 0 || db.free.pending[n-1].version != version {
+				if n > 0 && db.free.pending[n-1].version > version {
+					return fmt.Errorf("free list: page %d: %w: unordered versions", ptr, ErrCorruptNode)
+				}
+				db.free.pending = append(db.free.pending, freedPages{version: version})
+				n++
+			}
+			db.free.pending[n-1].ptrs = append(db.free.pending[n-1].ptrs, free)
+		}
+		ptr = binary.LittleEndian.Uint64(data[4:])
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// cmdFreeze implements `scratch-db freeze -db <file> <out>`.
+func cmdFreeze(args []string) error {
+	fs := flag.NewFlagSet("freeze", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 1 {
+		return errors.New("usage: scratch-db freeze -db <file> <out>")
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Freeze(fs.Arg(0))
+}
+
+// Freeze writes a compacted, read-only copy of the committed tree to a new file.
+// The copy is built bottom-up: the leaves are filled completely and written in key order,
+// followed by each level of internal nodes and finally the root. So a scan reads the file
+// sequentially and there is no free space at all. Every page is checksummed.
+// The copy has MASTER_FLAG_FROZEN set and can only be opened for reading.
+func (db *KV) Freeze(path string) error {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return tx.freeze(path)
+}
+
+// freeze writes the tree of a read-only transaction to a new file, see KV.Freeze.
+func (tx *Tx) freeze(path string) error {
+	db := tx.db
+	tx.tree.vals = nil // the values are copied as they are stored, see values.go
+
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("freeze: %w", err)
+	}
+	defer fp.Close()
+	f := &freezer{
+		w:        bufio.NewWriterSize(fp, 1<<20),
+		pageSize: db.page.size,
+		nodeSize: db.page.size - PAGE_TRAILER,
+		prefixed: db.flags&MASTER_FLAG_PREFIX != 0,
+		next:     1, // page 0 is the master page
+	}
+	f.page = make([]byte, f.pageSize)
+	if _, err := f.w.Write(f.page); err != nil { // reserve the master page
+		return fmt.Errorf("freeze: %w", err)
+	}
+
+	var root uint64
+	if tx.root != 0 {
+		meta, err := f.buckets(tx)
+		if err == nil {
+			root, err = f.build(tx.Seek(nil).WillScanAll(), meta)
+		}
+		if err != nil {
+			return fmt.Errorf("freeze: %w", err)
+		}
+	}
+	if err := f.w.Flush(); err != nil {
+		return fmt.Errorf("freeze: %w", err)
+	}
+	flags := uint32(MASTER_FLAG_CHECKSUM | MASTER_FLAG_FROZEN)
+	if f.prefixed {
+		flags |= MASTER_FLAG_PREFIX
+	}
+	flags |= db.flags & (MASTER_FLAG_VALUES | MASTER_FLAG_VALSUM | MASTER_FLAG_TTL)
+	master := masterEncode(root, f.next, tx.version, 0, f.pageSize, flags)
+	if _, err := fp.WriteAt(master[:], 0); err != nil {
+		return fmt.Errorf("freeze: write master page: %w", err)
+	}
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("freeze: fsync: %w", err)
+	}
+	return fp.Close()
+}
+
+// freezer writes the nodes of a frozen tree sequentially.
+type freezer struct {
+	w        *bufio.Writer
+	pageSize int
+	nodeSize int
+	prefixed bool // prefix-compress the nodes like the source
+	page     []byte
+	next     uint64 // the pointer of the next page to write
+}
+
+// freezeEntry is a KV pair in a leaf, or a link in an internal node.
+type freezeEntry struct {
+	key []byte
+	val []byte
+	ptr uint64
+}
+
+// buckets writes the trees of the buckets, the system trees and their catalog, and returns
+// the value of the dummy key of the main tree that points to the catalog. See bucket.go.
+func (f *freezer) buckets(tx *Tx) ([]byte, error) {
+	meta, err := tx.tree.meta()
+	if err != nil {
+		return nil, err
+	}
+	_, dict, err := metaDecode(meta)
+	if err != nil {
+		return nil, err
+	}
+	catalog, err := tx.catalog()
+	if err != nil || catalog.root == 0 {
+		return catalogMeta(0, dict), err
+	}
+	// the system trees: the expiry index and the secondary indexes are copied, but not the
+	// snapshots and the branches (see snapshot.go and branch.go), the copy only has the tree of
+	// the transaction.
+	sys, err := f.sysTrees(tx)
+	if err != nil {
+		return nil, err
+	}
+	var entries []freezeEntry
+	c := catalog.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		if len(c.Val()) != 8 {
+			return nil, fmt.Errorf("bucket %q: %w: bad catalog entry", c.Key(), ErrCorruptNode)
+		}
+		bucket := tx.tree
+		bucket.root = binary.LittleEndian.Uint64(c.Val())
+		var root uint64
+		if bucket.root != 0 {
+			if root, err = f.build(bucket.Seek(nil).WillScanAll(), nil); err != nil {
+				return nil, fmt.Errorf("bucket %q: %w", c.Key(), err)
+			}
+		}
+		entries = append(entries, freezeEntry{key: c.Key(), val: binary.LittleEndian.AppendUint64(nil, root)})
+	}
+	if err := c.Err(); err != nil || (len(entries) == 0 && sys == nil) {
+		return catalogMeta(0, dict), err
+	}
+	root, err := f.build(&freezeIter{entries: entries}, sys)
+	if err != nil {
+		return nil, err
+	}
+	return catalogMeta(root, dict), nil
+}
+
+// sysTrees writes the system trees that are copied and returns the value of the dummy key of
+// the catalog, with their roots at their positions. See bucket.go.
+func (f *freezer) sysTrees(tx *Tx) ([]byte, error) {
+	roots := make([]uint64, SYS_INDEXES+1)
+	index, err := tx.expiryIndex()
+	if err != nil {
+		return nil, err
+	}
+	if index.root != 0 {
+		if roots[SYS_EXPIRY], err = f.build(index.tree.Seek(nil).WillScanAll(), nil); err != nil {
+			return nil, fmt.Errorf("expiry index: %w", err)
+		}
+	}
+	table, err := tx.indexTable()
+	if err != nil {
+		return nil, err
+	}
+	var entries []freezeEntry
+	c := table.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		if len(c.Val()) != 8 {
+			return nil, fmt.Errorf("index %q: %w: bad entry", c.Key(), ErrCorruptNode)
+		}
+		ix := table
+		ix.root = binary.LittleEndian.Uint64(c.Val())
+		var root uint64
+		if ix.root != 0 {
+			if root, err = f.build(ix.Seek(nil).WillScanAll(), nil); err != nil {
+				return nil, fmt.Errorf("index %q: %w", c.Key(), err)
+			}
+		}
+		entries = append(entries, freezeEntry{key: c.Key(), val: binary.LittleEndian.AppendUint64(nil, root)})
+	}
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) > 0 {
+		if roots[SYS_INDEXES], err = f.build(&freezeIter{entries: entries}, nil); err != nil {
+			return nil, fmt.Errorf("indexes: %w", err)
+		}
+	}
+	for len(roots) > 0 && roots[len(roots)-1] == 0 {
+		roots = roots[:len(roots)-1] // the trailing empty trees
+	}
+	var sys []byte
+	for _, root := range roots {
+		sys = binary.LittleEndian.AppendUint64(sys, root)
+	}
+	return sys, nil
+}
+
+// freezeIter iterates over the entries of a catalog being frozen.
+type freezeIter struct {
+	entries []freezeEntry
+}
+
+func (it *freezeIter) Valid() bool { return len(it.entries) > 0 }
+func (it *freezeIter) Key() []byte { return it.entries[0].key }
+func (it *freezeIter) Val() []byte { return it.entries[0].val }
+func (it *freezeIter) Next()       { it.entries = it.entries[1:] }
+func (it *freezeIter) Err() error  { return nil }
+
+// build writes all the nodes of a tree with the KV pairs of the iterator and returns the root.
+// meta is the value of the dummy key.
+func (f *freezer) build(c KVIterator, meta []byte) (uint64, error) {
+	// the leaves, starting with the empty dummy key
+	var links []freezeEntry
+	level := []freezeEntry{{val: meta}}
+	size := HEADER + 10 + 4 + len(meta)
+	for ; c.Valid(); c.Next() {
+		e := freezeEntry{key: c.Key(), val: c.Val()}
+		esize := 10 + 4 + len(e.key) + len(e.val)
+		if f.nodeBytes(level, size+esize, e.key) > f.nodeSize {
+			links = append(links, f.write(BNODE_LEAF, level))
+			level, size = level[:0], HEADER
+		}
+		level = append(level, e)
+		size += esize
+	}
+	if err := c.Err(); err != nil {
+		return 0, err
+	}
+	links = append(links, f.write(BNODE_LEAF, level))
+
+	// then the internal nodes, level by level, until a single node is left
+	for len(links) > 1 {
+		var parents []freezeEntry
+		level, size = level[:0], HEADER
+		for _, e := range links {
+			esize := 10 + 4 + len(e.key)
+			if f.nodeBytes(level, size+esize, e.key) > f.nodeSize {
+				parents = append(parents, f.write(BNODE_NODE, level))
+				level, size = level[:0], HEADER
+			}
+			level = append(level, e)
+			size += esize
+		}
+		links = append(parents, f.write(BNODE_NODE, level))
+	}
+	return links[0].ptr, nil
+}
+
+// nodeBytes returns the size of a node with the entries followed by one more entry with the given key,
+// where size is the size of that node without prefix compression.
+// A frozen tree is never modified, so the prefix of a node is just the common prefix of its first
+// and last keys, not of its key range.
+func (f *freezer) nodeBytes(entries []freezeEntry, size int, last []byte) int {
+	if !f.prefixed {
+		return size
+	}
+	if len(entries) == 0 {
+		return size + 2
+	}
+	plen := len(commonPrefix(entries[0].key, last))
+	return size + 2 + plen - (len(entries)+1)*plen
+}
+
+// write writes a node with the given entries and returns the link to it.
+// The key of the link is copied since the entries point into pages of the source.
+func (f *freezer) write(btype uint16, entries []freezeEntry) freezeEntry {
+	clear(f.page)
+	node := BNode{data: f.page[:f.nodeSize]}
+	node.setHeader(btype, uint16(len(entries)))
+	if f.prefixed {
+		node.setPrefix(commonPrefix(entries[0].key, entries[len(entries)-1].key))
+	}
+	for i, e := range entries {
+		nodeAppendKV(node, uint16(i), e.ptr, e.key, e.val)
+	}
+	pageSeal(f.page)
+	ptr := f.next
+	f.next++
+	_, _ = f.w.Write(f.page) // the error is sticky and returned by Flush
+	return freezeEntry{key: append([]byte(nil), entries[0].key...), ptr: ptr}
+}
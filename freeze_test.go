@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	dir := t.TempDir()
+	db := openTest(t, &KV{Path: dir + "/db"})
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprint("val", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := tx.CreateBucket([]byte("bk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("x"), []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// most of the pages are free, the copy leaves them out
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.DeleteRange([]byte("key00100"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Freeze(dir + "/frozen"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Freeze(dir + "/frozen"); err == nil {
+		t.Fatal("Freeze overwrote a file")
+	}
+
+	src, err := os.Stat(dir + "/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, err := os.Stat(dir + "/frozen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.Size() >= src.Size()/4 {
+		t.Fatalf("the copy has %d bytes, the database %d", dst.Size(), src.Size())
+	}
+
+	frozen := openTest(t, &KV{Path: dir + "/frozen"})
+	if err := frozen.Set([]byte("a"), nil); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Set on a frozen database: %v", err)
+	}
+	ro, err := frozen.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Rollback()
+	n := 0
+	for c := ro.Seek(nil); c.Valid(); c.Next() {
+		if want := fmt.Sprintf("key%05d", n); string(c.Key()) != want {
+			t.Fatalf("key %d is %q, want %q", n, c.Key(), want)
+		}
+		n++
+	}
+	if n != 100 {
+		t.Fatalf("%d keys, want 100", n)
+	}
+	fb, err := ro.Bucket([]byte("bk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val, ok, err := fb.Get([]byte("x")); err != nil || !ok || string(val) != "y" {
+		t.Fatalf("x = %q, %v, %v", val, ok, err)
+	}
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Secondary indexes of the main keyspace, see KV.Indexes. An index is a BTree whose keys are the
+// indexed attribute of a KV pair followed by its key, with empty values, so the keys with the same
+// attribute are next to each other and sorted. The attribute is escaped, 0x00 as 0x00 0xff, and
+// ends with 0x00 0x01, so that the entries are sorted by attribute even if one is a prefix of another.
+//
+// The indexes are the SYS_INDEXES system tree (see bucket.go), which maps their names to their
+// roots (8 bytes). Tx.Set, Tx.Del and the other updates of the main keyspace update the indexes
+// in the same transaction, by computing the attribute of the old value and of the new one. The
+// updates of the buckets don't, and neither do the updates of a follower in shared mode until the
+// leader applies them. Expired keys keep their entries until they are purged, IndexScan skips them.
+//
+// Index functions can't be stored, so the indexes are only maintained by a KV opened with them.
+// Open builds the indexes of KV.Indexes that don't exist yet and drops the ones that are not in
+// KV.Indexes anymore, unless it's nil, like for the command line tools. Their updates of the main
+// keyspace would leave the indexes stale, so they return ErrIndexesUnknown if the database has
+// indexes. Changing the function of an index needs a new name.
+
+// Index defines a secondary index, see KV.Indexes.
+type Index struct {
+	Name string
+	// Attr returns the indexed attribute of a KV pair of the main keyspace, or false to leave the
+	// pair out of the index. It must always return the same for the same pair. The attributes
+	// sort as bytes, AppendTuple encodes typed ones that sort by their values.
+	Attr func(key, val []byte) ([]byte, bool)
+}
+
+// secondaryIndex is a secondary index as seen by a transaction.
+type secondaryIndex struct {
+	def  *Index
+	tree BTree
+	root uint64 // the root in the index table
+}
+
+// IndexScan calls fn for each KV pair of the main keyspace whose attribute in the given index is
+// in [lo, hi], in the order of the attributes and then of the keys, so lo == hi looks up the pairs
+// with that attribute. A nil lo or hi is unbounded. It stops at the first error returned by fn and
+// returns it. The key and the value are only valid during the call, and fn must not update the
+// transaction. An index that is not in KV.Indexes or doesn't exist returns ErrIndexNotFound.
+func (tx *Tx) IndexScan(name string, lo []byte, hi []byte, fn func(key, val []byte) error) error {
+	if err := tx.check(false); err != nil {
+		return err
+	}
+	ix, err := tx.index(name)
+	if err != nil {
+		return err
+	}
+	var start []byte
+	if lo != nil {
+		start = indexEntry(lo, nil)
+	}
+	c := ix.tree.Seek(start)
+	for ; c.Valid(); c.Next() {
+		attr, key, err := indexDecode(c.Key())
+		if err != nil {
+			return fmt.Errorf("index %q: %w", name, err)
+		}
+		if hi != nil && bytes.Compare(attr, hi) > 0 {
+			break
+		}
+		val, ok, err := tx.tree.Get(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue // expired
+		}
+		if err := fn(key, val); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// indexUpdate updates the indexes for a key of the main keyspace that is about to be set to val,
+// or deleted unless set. It's called before the update, since it reads the old value.
+func (tx *Tx) indexUpdate(key []byte, val []byte, set bool) error {
+	if len(tx.db.Indexes) == 0 {
+		return tx.checkUnindexed()
+	}
+	// validate the update first, so that a failing one leaves the indexes alone
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if set {
+		if err := tx.tree.vals.checkVal(val); err != nil {
+			return err
+		}
+	}
+	// the expired keys still have their entries
+	stored, ok, err := tx.tree.getStored(key)
+	if err != nil {
+		return err
+	}
+	var old []byte
+	if ok {
+		if old, err = tx.tree.vals.decode(stored); err != nil {
+			return err
+		}
+	}
+	type change struct {
+		ix       *secondaryIndex
+		del, ins []byte
+	}
+	var changes []change
+	for i := range tx.db.Indexes {
+		ix, err := tx.index(tx.db.Indexes[i].Name)
+		if errors.Is(err, ErrIndexNotFound) {
+			continue // like in a branch created before the index
+		}
+		if err != nil {
+			return err
+		}
+		var ch change
+		if ok {
+			if attr, ok := ix.def.Attr(key, old); ok {
+				ch.del = indexEntry(attr, key)
+			}
+		}
+		if set {
+			if attr, ok := ix.def.Attr(key, val); ok {
+				ch.ins = indexEntry(attr, key)
+				if len(ch.ins) > BTREE_MAX_KEY_SIZE {
+					return fmt.Errorf("index %q: %w: the entry is %d bytes, the limit is %d",
+						ix.def.Name, ErrKeyTooLarge, len(ch.ins), BTREE_MAX_KEY_SIZE)
+				}
+			}
+		}
+		if !bytes.Equal(ch.del, ch.ins) {
+			ch.ix = ix
+			changes = append(changes, ch)
+		}
+	}
+	for _, ch := range changes {
+		if ch.del != nil {
+			if _, err := ch.ix.tree.Delete(ch.del); err != nil {
+				return fmt.Errorf("index %q: %w", ch.ix.def.Name, err)
+			}
+		}
+		if ch.ins != nil {
+			if err := ch.ix.tree.Insert(ch.ins, nil); err != nil {
+				return fmt.Errorf("index %q: %w", ch.ix.def.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// indexDelRange removes the entries of the keys in [start, end) from the indexes,
+// before Tx.DeleteRange deletes them.
+func (tx *Tx) indexDelRange(start []byte, end []byte) error {
+	if len(tx.db.Indexes) == 0 {
+		return tx.checkUnindexed()
+	}
+	var keys [][]byte
+	raw := tx.tree
+	raw.vals = nil // the expired keys too
+	c := raw.Seek(start)
+	for ; c.Valid() && (len(end) == 0 || bytes.Compare(c.Key(), end) < 0); c.Next() {
+		keys = append(keys, bytes.Clone(c.Key()))
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.indexUpdate(key, nil, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexIter adds the KV pairs passing through it to the indexes, for Tx.BulkLoad.
+// BulkLoad reads each value once.
+type indexIter struct {
+	KVIterator
+	tx  *Tx
+	err error
+}
+
+func (it *indexIter) Val() []byte {
+	val := it.KVIterator.Val()
+	if it.err == nil {
+		it.err = it.tx.indexUpdate(it.Key(), val, true)
+	}
+	return val
+}
+
+func (it *indexIter) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.KVIterator.Err()
+}
+
+// index returns a secondary index of KV.Indexes as seen by the transaction, or ErrIndexNotFound.
+// The handles are kept, so that the transaction sees its own updates of the indexes.
+func (tx *Tx) index(name string) (*secondaryIndex, error) {
+	if ix, ok := tx.indexes[name]; ok {
+		if ix == nil {
+			return nil, fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+		}
+		return ix, nil
+	}
+	var def *Index
+	for i := range tx.db.Indexes {
+		if tx.db.Indexes[i].Name == name {
+			def = &tx.db.Indexes[i]
+		}
+	}
+	if def == nil {
+		return nil, fmt.Errorf("%w: %q is not in KV.Indexes", ErrIndexNotFound, name)
+	}
+	table, err := tx.indexTable()
+	if err != nil {
+		return nil, err
+	}
+	val, ok, err := table.Get([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if tx.indexes == nil {
+		tx.indexes = map[string]*secondaryIndex{}
+	}
+	if !ok {
+		tx.indexes[name] = nil
+		return nil, fmt.Errorf("%w: %q", ErrIndexNotFound, name)
+	}
+	if len(val) != 8 {
+		return nil, fmt.Errorf("index %q: %w: bad entry", name, ErrCorruptNode)
+	}
+	ix := &secondaryIndex{def: def, tree: tx.tree, root: binary.LittleEndian.Uint64(val)}
+	ix.tree.vals = nil // the entries have empty values
+	ix.tree.root = ix.root
+	tx.indexes[name] = ix
+	return ix, nil
+}
+
+// checkUnindexed returns ErrIndexesUnknown for an update of the main keyspace by a KV without
+// KV.Indexes, if the database has indexes.
+func (tx *Tx) checkUnindexed() error {
+	if tx.db.Indexes != nil || tx.noIndex {
+		return nil
+	}
+	table, err := tx.indexTable()
+	if err != nil {
+		return err
+	}
+	if table.root != 0 {
+		c := table.Seek(nil)
+		if c.Valid() {
+			return fmt.Errorf("%w: index %q", ErrIndexesUnknown, c.Key())
+		}
+		if err := c.Err(); err != nil {
+			return fmt.Errorf("indexes: %w", err)
+		}
+	}
+	tx.noIndex = true
+	return nil
+}
+
+// indexTable returns the tree of the secondary indexes as seen by the transaction.
+func (tx *Tx) indexTable() (BTree, error) {
+	root, err := tx.sysRoot(SYS_INDEXES)
+	if err != nil {
+		return BTree{}, fmt.Errorf("indexes: %w", err)
+	}
+	table := tx.tree
+	table.vals = nil // the roots are stored as they are
+	table.root = root
+	return table, nil
+}
+
+// indexStore sets the root of an index in the index table.
+func (tx *Tx) indexStore(name string, root uint64) error {
+	table, err := tx.indexTable()
+	if err != nil {
+		return err
+	}
+	if err := table.Insert([]byte(name), binary.LittleEndian.AppendUint64(nil, root)); err != nil {
+		return fmt.Errorf("index %q: %w", name, err)
+	}
+	if err := tx.sysStore(SYS_INDEXES, table.root); err != nil {
+		return fmt.Errorf("indexes: %w", err)
+	}
+	return nil
+}
+
+// flushIndexes writes the roots of the indexes updated by the transaction into the index table.
+func (tx *Tx) flushIndexes() error {
+	names := make([]string, 0, len(tx.indexes))
+	for name, ix := range tx.indexes {
+		if ix != nil && ix.tree.root != ix.root {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names) // the same updates give the same tree
+	for _, name := range names {
+		ix := tx.indexes[name]
+		if err := tx.indexStore(name, ix.tree.root); err != nil {
+			return err
+		}
+		ix.root = ix.tree.root
+	}
+	return nil
+}
+
+// indexOpen builds the indexes of KV.Indexes that don't exist yet and drops the others, see above.
+func indexOpen(db *KV) error {
+	if db.Indexes == nil || db.flags&MASTER_FLAG_FROZEN != 0 {
+		return nil
+	}
+	if db.lease != nil && !db.lease.leader.Load() {
+		return nil // the leader does
+	}
+	defs := map[string]bool{}
+	for _, def := range db.Indexes {
+		if def.Name == "" || def.Attr == nil || defs[def.Name] {
+			return fmt.Errorf("index %q: the names must be unique and not empty, and Attr set", def.Name)
+		}
+		defs[def.Name] = true
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	table, err := tx.indexTable()
+	if err != nil {
+		return err
+	}
+	stored := map[string]uint64{}
+	c := table.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		if len(c.Val()) != 8 {
+			return fmt.Errorf("index %q: %w: bad entry", c.Key(), ErrCorruptNode)
+		}
+		stored[string(c.Key())] = binary.LittleEndian.Uint64(c.Val())
+	}
+	if err := c.Err(); err != nil {
+		return err
+	}
+	for name, root := range stored {
+		if !defs[name] {
+			if err := tx.indexDrop(name, root); err != nil {
+				return err
+			}
+		}
+	}
+	for _, def := range db.Indexes {
+		if _, ok := stored[def.Name]; !ok {
+			if err := tx.indexBuild(def.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// indexBuild creates an index and adds the KV pairs of the main keyspace to it.
+func (tx *Tx) indexBuild(name string) error {
+	if err := tx.indexStore(name, 0); err != nil {
+		return err
+	}
+	ix, err := tx.index(name)
+	if err != nil {
+		return err
+	}
+	raw := tx.tree
+	raw.vals = nil // the expired keys too
+	c := raw.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		val, err := tx.tree.vals.decode(c.Val())
+		if err != nil {
+			return fmt.Errorf("index %q: key %q: %w", name, c.Key(), err)
+		}
+		attr, ok := ix.def.Attr(c.Key(), val)
+		if !ok {
+			continue
+		}
+		entry := indexEntry(attr, c.Key())
+		if len(entry) > BTREE_MAX_KEY_SIZE {
+			return fmt.Errorf("index %q: key %q: %w: the entry is %d bytes, the limit is %d",
+				name, c.Key(), ErrKeyTooLarge, len(entry), BTREE_MAX_KEY_SIZE)
+		}
+		if err := ix.tree.Insert(entry, nil); err != nil {
+			return fmt.Errorf("index %q: %w", name, err)
+		}
+	}
+	return c.Err()
+}
+
+// indexDrop frees the tree of an index and removes it from the index table.
+func (tx *Tx) indexDrop(name string, root uint64) error {
+	table, err := tx.indexTable()
+	if err != nil {
+		return err
+	}
+	if err := treeFree(&table, root); err != nil {
+		return fmt.Errorf("index %q: %w", name, err)
+	}
+	if _, err := table.Delete([]byte(name)); err != nil {
+		return err
+	}
+	if err := tx.sysStore(SYS_INDEXES, table.root); err != nil {
+		return fmt.Errorf("indexes: %w", err)
+	}
+	return nil
+}
+
+// indexEntry returns the key of the index entry of a key with the given attribute, see above.
+func indexEntry(attr []byte, key []byte) []byte {
+	entry := appendEscaped(make([]byte, 0, len(attr)+2+len(key)), attr)
+	return append(entry, key...)
+}
+
+// indexDecode splits the key of an index entry into the attribute and the key.
+func indexDecode(entry []byte) ([]byte, []byte, error) {
+	attr, key, ok := cutEscaped(entry)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: bad index entry", ErrCorruptNode)
+	}
+	return attr, key, nil
+}
+
+// appendEscaped appends bytes that sort like they do on their own when followed by anything,
+// see above.
+func appendEscaped(dst []byte, b []byte) []byte {
+	for _, c := range b {
+		dst = append(dst, c)
+		if c == 0 {
+			dst = append(dst, 0xff)
+		}
+	}
+	return append(dst, 0, 1)
+}
+
+// cutEscaped decodes the bytes at the start of src written by appendEscaped, and returns them
+// with the rest of src.
+func cutEscaped(src []byte) ([]byte, []byte, bool) {
+	var b []byte
+	for i := 0; i+1 < len(src); i++ {
+		if src[i] != 0 {
+			b = append(b, src[i])
+			continue
+		}
+		switch src[i+1] {
+		case 0xff:
+			b = append(b, 0)
+			i++
+		case 1:
+			return b, src[i+2:], true
+		default:
+			return nil, nil, false
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// the attribute of a value "attr:rest", pairs without a colon are not indexed
+func testAttr(key, val []byte) ([]byte, bool) {
+	attr, _, ok := bytes.Cut(val, []byte(":"))
+	return attr, ok
+}
+
+// indexScan returns the keys that IndexScan finds in [lo, hi].
+func indexScan(t *testing.T, tx *Tx, name string, lo, hi []byte) []string {
+	t.Helper()
+	var keys []string
+	err := tx.IndexScan(name, lo, hi, func(key, val []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestIndexScan(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path, Indexes: []Index{{Name: "attr", Attr: testAttr}}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	// the attributes are prefixes of each other and have zero bytes
+	attrs := []string{"", "a", "a\x00", "a\x00b", "a\x01", "ab", "b"}
+	model := map[string]string{}
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		committed := map[string]string{}
+		for k, v := range model {
+			committed[k] = v
+		}
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprint("key", rng.Intn(300))
+			switch rng.Intn(6) {
+			case 0:
+				_, err = tx.Del([]byte(key))
+				delete(model, key)
+			case 1:
+				end := fmt.Sprint("key", rng.Intn(300))
+				_, err = tx.DeleteRange([]byte(key), []byte(end))
+				for k := range model {
+					if k >= key && k < end {
+						delete(model, k)
+					}
+				}
+			case 2:
+				err = tx.Set([]byte(key), []byte("unindexed"))
+				model[key] = "unindexed"
+			default:
+				val := attrs[rng.Intn(len(attrs))] + ":" + fmt.Sprint(i)
+				err = tx.Set([]byte(key), []byte(val))
+				model[key] = val
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if round%5 == 4 {
+			tx.Rollback()
+			model = committed
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(db *KV) {
+		t.Helper()
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		for i, lo := range attrs {
+			for _, hi := range attrs[i:] {
+				var want []string
+				for key, val := range model {
+					if attr, ok := testAttr(nil, []byte(val)); ok && string(attr) >= lo && string(attr) <= hi {
+						want = append(want, key)
+					}
+				}
+				sort.Slice(want, func(i, j int) bool {
+					ai, _ := testAttr(nil, []byte(model[want[i]]))
+					aj, _ := testAttr(nil, []byte(model[want[j]]))
+					if c := bytes.Compare(ai, aj); c != 0 {
+						return c < 0
+					}
+					return want[i] < want[j]
+				})
+				got := indexScan(t, tx, "attr", []byte(lo), []byte(hi))
+				if fmt.Sprint(got) != fmt.Sprint(want) {
+					t.Fatalf("[%q, %q]: %q, want %q", lo, hi, got, want)
+				}
+			}
+		}
+		if got := indexScan(t, tx, "attr", nil, nil); len(got) != len(indexScan(t, tx, "attr", []byte(""), nil)) {
+			t.Fatalf("%d pairs in the unbounded scan", len(got))
+		}
+	}
+	check(db)
+	db.Close()
+
+	// a new index is built by Open
+	db = &KV{Path: path, Indexes: []Index{{Name: "attr", Attr: testAttr}, {Name: "copy", Attr: testAttr}}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, b := indexScan(t, tx, "attr", nil, nil), indexScan(t, tx, "copy", nil, nil); fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Fatalf("the built index has %q, the maintained one %q", b, a)
+	}
+	tx.Rollback()
+	db.Close()
+
+	// a KV that doesn't know the indexes can't update the main keyspace
+	db = &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("k"), []byte("a:1")); !errors.Is(err, ErrIndexesUnknown) {
+		t.Fatalf("Set without KV.Indexes: %v", err)
+	}
+	db.Close()
+
+	// the indexes that are not in KV.Indexes are dropped
+	db = openTest(t, &KV{Path: path, Indexes: []Index{}})
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := tx.IndexScan("attr", nil, nil, nil); !errors.Is(err, ErrIndexNotFound) {
+		t.Fatalf("IndexScan of a dropped index: %v", err)
+	}
+}
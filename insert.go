@@ -0,0 +1,217 @@
+package main
+
+import "fmt"
+
+// leafInsert copies the old leaf into the new one while inserting a new KV pair at the given index.
+func leafInsert(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+	new.setHeaderLike(old, BNODE_LEAF, old.nkeys()+1)
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendRange(new, old, idx+1, idx, old.nkeys()-idx)
+}
+
+// leafUpdate copies the old leaf into the new one while replacing the value of the KV pair at the given index.
+func leafUpdate(new BNode, old BNode, idx uint16, key []byte, val []byte) {
+	new.setHeaderLike(old, BNODE_LEAF, old.nkeys())
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, 0, key, val)
+	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-(idx+1))
+}
+
+// treeInsert inserts a KV pair into the tree and returns the updated copy of the root.
+// The returned node is allowed to be bigger than a page, the caller is responsible for splitting it.
+// The leaf is updated first, then each node on the path up to the root links the updated
+// (possibly split) kid, see treePath.
+func treeInsert(tree *BTree, key []byte, val []byte) (BNode, error) {
+	path, err := treePath(tree, key)
+	if err != nil {
+		return BNode{}, err
+	}
+	leaf := path[len(path)-1]
+	updated := BNode{data: make([]byte, 2*tree.nodeSize)}
+	switch cmp := leaf.node.cmpKey(leaf.idx, key); {
+	case cmp == 0:
+		leafUpdate(updated, leaf.node, leaf.idx, key, val)
+	case cmp > 0:
+		// the first key was deleted, the key goes before the new first key
+		leafInsert(updated, leaf.node, leaf.idx, key, val)
+	default:
+		leafInsert(updated, leaf.node, leaf.idx+1, key, val)
+	}
+	for i := len(path) - 2; i >= 0; i-- {
+		new := BNode{data: make([]byte, 2*tree.nodeSize)}
+		if err := nodeInsert(tree, new, path[i], updated); err != nil {
+			return BNode{}, err
+		}
+		updated = new
+	}
+	return updated, nil
+}
+
+// nodeInsert links the updated copy of the kid that the path goes on to from an internal node
+// into the new node, splitting the kid if it's bigger than a page.
+func nodeInsert(tree *BTree, new BNode, level treeLevel, knode BNode) error {
+	node, idx := level.node, level.idx
+	klo, khi := kidFences(node, idx, level.lo, level.hi)
+	nsplit, split, err := nodeSplit3(knode, tree.nodeSize, klo, khi)
+	if err != nil {
+		return err
+	}
+	tree.del(node.getPtr(idx))
+	nodeReplaceKidN(tree, new, node, idx, split[:nsplit]...)
+	return nil
+}
+
+// nodeSplit2 splits an oversized node with the key range [lo, hi) into two. The right node always
+// fits into a page, the left node might still be too big and is split again by nodeSplit3.
+// The halves of a prefix-compressed node get the (longer) prefixes of their own key ranges.
+func nodeSplit2(left BNode, right BNode, old BNode, size int, lo []byte, hi []byte) error {
+	if old.nkeys() < 2 {
+		return fmt.Errorf("%w: cannot split a node with %d keys", ErrPageOverflow, old.nkeys())
+	}
+	// the sizes of the halves with the prefix of the old node, which is an upper bound
+	fits := func(begin uint16, end uint16) bool {
+		n, plen := int(end-begin), len(old.prefix())
+		nbytes := int(old.base()) + 10*n + int(old.getOffset(end)) - int(old.getOffset(begin))
+		return nodeFits(nbytes, nbytes+(n-1)*plen, size)
+	}
+	// start in the middle and move the split point until the left half fits
+	nleft := old.nkeys() / 2
+	for nleft > 1 && !fits(0, nleft) {
+		nleft--
+	}
+	// then make sure the right half fits
+	for nleft < old.nkeys()-1 && !fits(nleft, old.nkeys()) {
+		nleft++
+	}
+	if !fits(nleft, old.nkeys()) {
+		return fmt.Errorf("%w: cannot split a node of %d bytes", ErrPageOverflow, old.nbytes())
+	}
+	nright := old.nkeys() - nleft
+
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	if old.prefixed() {
+		mid := old.getKey(nleft)
+		left.setPrefix(fencePrefix(lo, mid))
+		right.setPrefix(fencePrefix(mid, hi))
+	}
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	return nil
+}
+
+// nodeSplit3 splits a node with the key range [lo, hi) into up to 3 nodes that each fit into a page.
+// It returns the number of resulting nodes and the nodes themselves.
+func nodeSplit3(old BNode, size int, lo []byte, hi []byte) (uint16, [3]BNode, error) {
+	if nodeFits(int(old.nbytes()), old.expanded(), size) {
+		old.data = old.data[:size]
+		return 1, [3]BNode{old}, nil
+	}
+	left := BNode{data: make([]byte, 2*size)} // might be split later
+	right := BNode{data: make([]byte, size)}
+	if err := nodeSplit2(left, right, old, size, lo, hi); err != nil {
+		return 0, [3]BNode{}, err
+	}
+	if nodeFits(int(left.nbytes()), left.expanded(), size) {
+		left.data = left.data[:size]
+		return 2, [3]BNode{left, right}, nil
+	}
+	// the left node is still too large
+	leftleft := BNode{data: make([]byte, size)}
+	middle := BNode{data: make([]byte, size)}
+	if err := nodeSplit2(leftleft, middle, left, size, lo, right.getKey(0)); err != nil {
+		return 0, [3]BNode{}, err
+	}
+	if !nodeFits(int(leftleft.nbytes()), leftleft.expanded(), size) {
+		return 0, [3]BNode{}, fmt.Errorf("%w: node needs more than 3 pages", ErrPageOverflow)
+	}
+	return 3, [3]BNode{leftleft, middle, right}, nil
+}
+
+// nodeReplaceKidN replaces the link at the given index of an internal node with links to the given kids.
+func nodeReplaceKidN(tree *BTree, new BNode, old BNode, idx uint16, kids ...BNode) {
+	nodeReplaceKids(tree, new, old, idx, 1, kids...)
+}
+
+// nodeReplaceKids replaces n links starting at the given index of an internal node with links
+// to the given kids, which are allocated as new pages. The first kid keeps the key of the first
+// replaced link and the first keys of the other kids become the keys of their links.
+// Keeping the key leaves the key ranges of the other kids, and so their prefixes, unchanged.
+func nodeReplaceKids(tree *BTree, new BNode, old BNode, idx uint16, n uint16, kids ...BNode) {
+	inc := uint16(len(kids))
+	new.setHeaderLike(old, BNODE_NODE, old.nkeys()+inc-n)
+	nodeAppendRange(new, old, 0, 0, idx)
+	for i, node := range kids {
+		key := old.getKey(idx)
+		if i > 0 {
+			key = node.getKey(0)
+		}
+		nodeAppendKV(new, idx+uint16(i), tree.new(node), key, nil)
+	}
+	nodeAppendRange(new, old, idx+inc, idx+n, old.nkeys()-(idx+n))
+}
+
+// Insert inserts a new key or updates the value of an existing key.
+// On error the root is left unchanged, pages allocated before the error are not linked into the tree.
+func (tree *BTree) Insert(key []byte, val []byte) error {
+	return tree.insert(key, val, 0)
+}
+
+// insert inserts a key that expires at the given deadline, 0 for never, see ttl.go.
+func (tree *BTree) insert(key []byte, val []byte, deadline int64) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	if err := tree.vals.checkVal(val); err != nil {
+		return err
+	}
+	val = tree.vals.encode(val, deadline)
+
+	if tree.root == 0 {
+		// create the first node
+		root := BNode{data: make([]byte, tree.nodeSize)}
+		root.setHeader(BNODE_LEAF, 2)
+		if tree.prefixed {
+			root.setPrefix(nil) // the root covers the whole key space
+		}
+		// a dummy key, this makes the tree cover the whole key space.
+		// thus a lookup can always find a containing node.
+		nodeAppendKV(root, 0, 0, nil, nil)
+		nodeAppendKV(root, 1, 0, key, val)
+		tree.root = tree.new(root)
+		return nil
+	}
+
+	node, err := treeInsert(tree, key, val)
+	if err != nil {
+		return err
+	}
+	return tree.replaceRoot(node)
+}
+
+// replaceRoot makes the updated copy of the root node the new root.
+// It adds a level if the node has to be split.
+func (tree *BTree) replaceRoot(node BNode) error {
+	nsplit, split, err := nodeSplit3(node, tree.nodeSize, nil, nil)
+	if err != nil {
+		return err
+	}
+	tree.del(tree.root)
+	if nsplit > 1 {
+		// the root was split, add a new level.
+		root := BNode{data: make([]byte, tree.nodeSize)}
+		root.setHeader(BNODE_NODE, nsplit)
+		if node.prefixed() {
+			root.setPrefix(nil)
+		}
+		for i, knode := range split[:nsplit] {
+			ptr, key := tree.new(knode), knode.getKey(0)
+			nodeAppendKV(root, uint16(i), ptr, key, nil)
+		}
+		tree.root = tree.new(root)
+	} else {
+		tree.root = tree.new(split[0])
+	}
+	return nil
+}
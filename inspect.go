@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+)
+
+// cmdPage implements `scratch-db page -db <file> <pgno>`.
+// The page is read straight from the file without opening the KV,
+// so that it also works on files with a broken master page.
+func cmdPage(args []string) error {
+	fs := flag.NewFlagSet("page", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	full := fs.Bool("full", false, "hexdump the whole page instead of the used bytes")
+	pageSize := fs.Int("pagesize", 0, "page size, read from the master page if not set")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 1 {
+		return errors.New("usage: scratch-db page -db <file> [-full] [-pagesize n] <pgno>")
+	}
+	pgno, err := strconv.ParseUint(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad page number: %w", err)
+	}
+
+	fp, err := os.Open(*path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	size, flags := readLayout(fp)
+	if *pageSize != 0 {
+		if err := checkPageSize(*pageSize); err != nil {
+			return err
+		}
+		size = *pageSize
+	}
+	page := make([]byte, size)
+	if pgno > math.MaxInt64/uint64(size) {
+		return fmt.Errorf("page %d is beyond the end of the file", pgno)
+	}
+	if _, err := fp.ReadAt(page, int64(pgno)*int64(size)); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("page %d is beyond the end of the file", pgno)
+		}
+		return err
+	}
+
+	var used int
+	if pgno == 0 {
+		used = printMaster(os.Stdout, page)
+	} else if flags&MASTER_FLAG_CHECKSUM != 0 {
+		used = printNode(os.Stdout, BNode{data: page[:size-PAGE_TRAILER]})
+		checksum := "ok"
+		if !pageVerify(page) {
+			checksum = "mismatch"
+		}
+		fmt.Printf("checksum: %s\n", checksum)
+	} else {
+		used = printNode(os.Stdout, BNode{data: page})
+	}
+	if *full {
+		used = len(page)
+	}
+	fmt.Println()
+	fmt.Print(hex.Dump(page[:used]))
+	return nil
+}
+
+// readLayout returns the page size and the flags recorded in the master page,
+// or the default page size and no flags if the master page can't be read or is damaged.
+func readLayout(fp *os.File) (int, uint32) {
+	var data [48]byte
+	if _, err := fp.ReadAt(data[:], 0); err != nil || string(data[:16]) != DB_SIG {
+		return BTREE_PAGE_SIZE, 0
+	}
+	size := int(binary.LittleEndian.Uint32(data[40:]))
+	if size == 0 {
+		size = BTREE_PAGE_SIZE
+	}
+	if checkPageSize(size) != nil {
+		return BTREE_PAGE_SIZE, 0
+	}
+	return size, binary.LittleEndian.Uint32(data[44:])
+}
+
+// printMaster decodes the master page and returns the number of bytes in use.
+func printMaster(w io.Writer, page []byte) int {
+	fmt.Fprintf(w, "master page\n")
+	fmt.Fprintf(w, "signature: %q\n", page[:16])
+	fmt.Fprintf(w, "root:      %d\n", binary.LittleEndian.Uint64(page[16:]))
+	fmt.Fprintf(w, "used:      %d pages\n", binary.LittleEndian.Uint64(page[24:]))
+	fmt.Fprintf(w, "version:   %d\n", binary.LittleEndian.Uint64(page[32:]))
+	fmt.Fprintf(w, "page size: %d\n", binary.LittleEndian.Uint32(page[40:]))
+	flags := binary.LittleEndian.Uint32(page[44:])
+	fmt.Fprintf(w, "flags:     %#x\n", flags)
+	fmt.Fprintf(w, "format:    %d\n", binary.LittleEndian.Uint32(page[52:]))
+	fmt.Fprintf(w, "free list: %d\n", binary.LittleEndian.Uint64(page[56:]))
+	if flags&MASTER_FLAG_CHECKSUM != 0 {
+		checksum := "ok"
+		if binary.LittleEndian.Uint32(page[48:]) != masterChecksum(page) {
+			checksum = "mismatch"
+		}
+		fmt.Fprintf(w, "checksum:  %s\n", checksum)
+	}
+	return MASTER_SIZE
+}
+
+// printNode decodes a BTree node and returns the number of bytes in use.
+// Every position is bounds-checked before it's read since the page may be corrupted.
+func printNode(w io.Writer, node BNode) int {
+	btype, nkeys := node.btype(), node.nkeys()
+	if btype == BNODE_FREE {
+		return printFree(w, node.data)
+	}
+	name := "unknown"
+	switch btype {
+	case BNODE_NODE:
+		name = "internal"
+	case BNODE_LEAF:
+		name = "leaf"
+	}
+	fmt.Fprintf(w, "type:  %d (%s)\n", btype, name)
+	fmt.Fprintf(w, "nkeys: %d\n", nkeys)
+	if err := nodeCheck(node); err != nil {
+		fmt.Fprintf(w, "check: %v\n", err)
+	} else {
+		fmt.Fprintf(w, "check: ok\n")
+	}
+
+	// the prefix, the pointers and the offsets must fit into the page
+	var prefix []byte
+	base := HEADER
+	if node.prefixed() {
+		if HEADER+2 > len(node.data) {
+			fmt.Fprintf(w, "corrupt: truncated header\n")
+			return len(node.data)
+		}
+		base += 2 + int(binary.LittleEndian.Uint16(node.data[HEADER:]))
+		if base > len(node.data) {
+			fmt.Fprintf(w, "corrupt: the prefix does not fit into a page\n")
+			return len(node.data)
+		}
+		prefix = node.prefix()
+		fmt.Fprintf(w, "prefix: %q\n", prefix)
+	}
+	kvStart := base + 10*int(nkeys)
+	if kvStart > len(node.data) {
+		fmt.Fprintf(w, "corrupt: %d keys do not fit into a page\n", nkeys)
+		return len(node.data)
+	}
+	fmt.Fprintf(w, "bytes: %d\n\n", kvStart+int(node.getOffset(nkeys)))
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "idx\tptr\toffset\tkey\tval")
+	end := kvStart
+	for i := uint16(0); i < nkeys; i++ {
+		ptr, offset := node.getPtr(i), node.getOffset(i)
+		pos := kvStart + int(offset)
+		if pos+4 > len(node.data) {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t<corrupt offset>\t\n", i, ptr, offset)
+			continue
+		}
+		klen := int(binary.LittleEndian.Uint16(node.data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.data[pos+2:]))
+		if pos+4+klen+vlen > len(node.data) {
+			fmt.Fprintf(tw, "%d\t%d\t%d\t<corrupt length>\t\n", i, ptr, offset)
+			continue
+		}
+		key := append(prefix[:len(prefix):len(prefix)], node.data[pos+4:][:klen]...)
+		val := node.data[pos+4+klen:][:vlen]
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%q\t%q\n", i, ptr, offset, key, val)
+		if pos+4+klen+vlen > end {
+			end = pos + 4 + klen + vlen
+		}
+	}
+	return end
+}
+
+// printFree decodes a page of the free list, see freelist.go, and returns the number of bytes in use.
+func printFree(w io.Writer, data []byte) int {
+	count := int(binary.LittleEndian.Uint16(data[2:]))
+	fmt.Fprintf(w, "type:  %d (free list)\n", BNODE_FREE)
+	fmt.Fprintf(w, "count: %d\n", count)
+	fmt.Fprintf(w, "next:  %d\n", binary.LittleEndian.Uint64(data[4:]))
+	if FREE_HEADER+16*count > len(data) {
+		fmt.Fprintf(w, "corrupt: %d entries do not fit into a page\n", count)
+		return len(data)
+	}
+	for i := 0; i < count; i++ {
+		entry := data[FREE_HEADER+16*i:]
+		fmt.Fprintf(w, "  page %d, freed by version %d\n", binary.LittleEndian.Uint64(entry[8:]), binary.LittleEndian.Uint64(entry))
+	}
+	return FREE_HEADER + 16*count
+}
+
+// cmdWALDump implements `scratch-db wal-dump -db <file> [-from lsn] [-to lsn] [-prefix key] [-keys]`.
+// Like page, it reads the WAL next to the database file without opening the KV.
+func cmdWALDump(args []string) error {
+	fs := flag.NewFlagSet("wal-dump", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	from := fs.Int64("from", 0, "the first LSN to list")
+	to := fs.Int64("to", math.MaxInt64, "the last LSN to list")
+	prefix := fs.String("prefix", "", "only list the commits that wrote leaves with keys with this prefix, and those keys")
+	keys := fs.Bool("keys", false, "list the keys of the leaves written by each commit")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 0 {
+		return errors.New("usage: scratch-db wal-dump -db <file> [-from lsn] [-to lsn] [-prefix key] [-keys]")
+	}
+	fp, err := os.Open(*path + "-wal")
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	opts := walDumpOptions{from: *from, to: *to, keys: *keys || *prefix != ""}
+	if *prefix != "" {
+		opts.prefix = []byte(*prefix)
+	}
+	if db, err := os.Open(*path); err == nil {
+		_, opts.flags = readLayout(db)
+		db.Close()
+	}
+	return walDump(os.Stdout, io.NewSectionReader(fp, 0, fi.Size()), opts)
+}
+
+// walDumpOptions selects the records printed by walDump.
+type walDumpOptions struct {
+	from, to int64  // the range of LSNs, inclusive
+	prefix   []byte // only the records with leaf keys with the prefix, nil for all of them
+	keys     bool   // print the keys of the leaves
+	flags    uint32 // of the database, MASTER_FLAG_CHECKSUM tells the size of the nodes
+}
+
+// walDump prints the commit records of a WAL (see wal.go). The LSN of a record is its offset
+// in the WAL, and the version it commits identifies the transaction. A commit writes whole
+// pages, so the keys of a record are those of the leaves it wrote, which include the keys
+// that the transaction didn't change. It stops at the first incomplete or corrupted record,
+// where the recovery stops too.
+func walDump(w io.Writer, r *io.SectionReader, opts walDumpOptions) error {
+	var header [WAL_RECORD_HEADER]byte
+	if _, err := io.ReadFull(r, header[:WAL_HEADER]); err != nil {
+		return errors.New("WAL: bad signature")
+	}
+	recordHeader := WAL_RECORD_HEADER
+	switch string(header[:8]) {
+	case WAL_SIG:
+	case WAL_SIG_V2:
+		recordHeader = WAL_RECORD_HEADER_V2
+	default:
+		return errors.New("WAL: bad signature")
+	}
+	pageSize := int(binary.LittleEndian.Uint32(header[8:]))
+	if err := checkPageSize(pageSize); err != nil {
+		return fmt.Errorf("WAL: %w", err)
+	}
+	nodeSize := pageSize
+	if opts.flags&MASTER_FLAG_CHECKSUM != 0 {
+		nodeSize -= PAGE_TRAILER
+	}
+	fmt.Fprintf(w, "signature: %q, page size %d\n", header[:8], pageSize)
+
+	walPageSize := 8 + pageSize
+	lsn := int64(WAL_HEADER)
+	for {
+		if _, err := io.ReadFull(r, header[:recordHeader]); err != nil {
+			if lsn < r.Size() {
+				fmt.Fprintf(w, "lsn %d: incomplete record header\n", lsn)
+			}
+			return nil
+		}
+		npages := int64(binary.LittleEndian.Uint32(header[0:]))
+		end := lsn + int64(recordHeader) + npages*int64(walPageSize) + 4
+		if end > r.Size() {
+			fmt.Fprintf(w, "lsn %d: incomplete record of %d pages\n", lsn, npages)
+			return nil
+		}
+		body := make([]byte, end-lsn-int64(recordHeader))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		crc := crc32.Update(crc32.Checksum(header[:recordHeader], castagnoli), castagnoli, body[:len(body)-4])
+		if crc != binary.LittleEndian.Uint32(body[len(body)-4:]) {
+			fmt.Fprintf(w, "lsn %d: checksum mismatch\n", lsn)
+			return nil
+		}
+		if opts.from <= lsn && lsn <= opts.to {
+			walDumpRecord(w, lsn, header[:recordHeader], body, nodeSize, walPageSize, opts)
+		}
+		lsn = end
+	}
+}
+
+// walDumpRecord prints a commit record, unless none of its leaves have keys with opts.prefix.
+func walDumpRecord(w io.Writer, lsn int64, header []byte, body []byte, nodeSize int, walPageSize int, opts walDumpOptions) {
+	type walPage struct {
+		ptr  uint64
+		node BNode
+	}
+	npages := int(binary.LittleEndian.Uint32(header))
+	pages := make([]walPage, npages)
+	for i := range pages {
+		page := body[i*walPageSize:]
+		pages[i] = walPage{binary.LittleEndian.Uint64(page), BNode{data: page[8:][:nodeSize]}}
+	}
+	// the order of the pages in the record is random
+	sort.Slice(pages, func(i, j int) bool { return pages[i].ptr < pages[j].ptr })
+
+	var out bytes.Buffer
+	for _, p := range pages {
+		var keys [][]byte
+		desc := "unknown"
+		switch err := nodeCheck(p.node); {
+		case p.node.btype() == BNODE_FREE:
+			desc = fmt.Sprintf("free list, %d entries", binary.LittleEndian.Uint16(p.node.data[2:]))
+		case err != nil:
+			desc = err.Error()
+		case p.node.btype() == BNODE_NODE:
+			desc = fmt.Sprintf("internal, %d keys", p.node.nkeys())
+		default:
+			desc = fmt.Sprintf("leaf, %d keys", p.node.nkeys())
+			for i := uint16(0); i < p.node.nkeys(); i++ {
+				if key := p.node.getKey(i); bytes.HasPrefix(key, opts.prefix) && len(key) > 0 {
+					keys = append(keys, key)
+				}
+			}
+		}
+		if opts.prefix != nil && len(keys) == 0 {
+			continue
+		}
+		fmt.Fprintf(&out, "  page %d: %s\n", p.ptr, desc)
+		if opts.keys {
+			for _, key := range keys {
+				fmt.Fprintf(&out, "    %q\n", key)
+			}
+		}
+	}
+	if opts.prefix != nil && out.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(w, "lsn %d: commit version %d, root %d, used %d", lsn,
+		binary.LittleEndian.Uint64(header[20:]), binary.LittleEndian.Uint64(header[4:]), binary.LittleEndian.Uint64(header[12:]))
+	if len(header) == WAL_RECORD_HEADER {
+		fmt.Fprintf(w, ", free list %d", binary.LittleEndian.Uint64(header[28:]))
+	}
+	fmt.Fprintf(w, ", %d pages\n", npages)
+	out.WriteTo(w)
+}
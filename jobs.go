@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of page I/O of background jobs. Tokens accumulate at rate per second
+// up to one second worth of them. A request can take more tokens than there are, the debt is paid
+// by waiting, so large requests work without a large burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate <= 0 {
+		return nil // unlimited
+	}
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// take takes n tokens and waits until the bucket is out of debt or ctx is canceled.
+// A nil bucket doesn't limit anything.
+func (b *tokenBucket) take(ctx context.Context, n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Job is a unit of background work, such as a checkpoint or a backup, run by the scheduler of a KV.
+// Run should return soon after ctx is canceled, which happens when the KV is closed.
+type Job struct {
+	Name     string
+	Priority int // jobs with a higher priority are started first
+	Run      func(ctx context.Context) error
+}
+
+// JobInfo describes a queued or running job.
+type JobInfo struct {
+	Name     string
+	Priority int
+	Running  bool
+	Queued   time.Time
+	Started  time.Time // zero while queued
+}
+
+// jobEntry is a job in the scheduler.
+type jobEntry struct {
+	job  Job
+	info JobInfo
+}
+
+// scheduler runs background jobs on their own goroutines, at most limit at a time.
+// Queued jobs are started by priority and then in submission order.
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	inline  bool // run the jobs in the goroutine that starts them, in constrained mode
+	paused  bool
+	closed  bool
+	queue   []*jobEntry // ordered by priority, highest first
+	running []*jobEntry
+	done    int // number of jobs that returned nil
+	failed  int // number of jobs that returned an error
+	lastErr error
+	io      *tokenBucket // page I/O budget shared by all jobs, nil if unlimited
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+func newScheduler(limit int, pageRate int, inline bool) *scheduler {
+	if limit < 1 {
+		limit = 1
+	}
+	s := &scheduler{limit: limit, inline: inline, io: newTokenBucket(pageRate)}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// submit queues a job and starts it if a slot is free.
+func (s *scheduler) submit(job Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	e := &jobEntry{job: job, info: JobInfo{Name: job.Name, Priority: job.Priority, Queued: time.Now()}}
+	i := len(s.queue)
+	for i > 0 && s.queue[i-1].job.Priority < job.Priority {
+		i--
+	}
+	s.queue = append(s.queue, nil)
+	copy(s.queue[i+1:], s.queue[i:])
+	s.queue[i] = e
+	s.dispatch()
+	return nil
+}
+
+// dispatch starts queued jobs while there are free slots. Must hold s.mu.
+func (s *scheduler) dispatch() {
+	for !s.paused && len(s.running) < s.limit && len(s.queue) > 0 {
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		e.info.Running = true
+		e.info.Started = time.Now()
+		s.running = append(s.running, e)
+		s.wg.Add(1)
+		if s.inline {
+			s.mu.Unlock()
+			s.run(e)
+			s.mu.Lock()
+			continue
+		}
+		go s.run(e)
+	}
+}
+
+func (s *scheduler) run(e *jobEntry) {
+	defer s.wg.Done()
+	err := e.job.Run(s.ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.running {
+		if r == e {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+	if err != nil {
+		s.failed++
+		s.lastErr = err
+	} else {
+		s.done++
+	}
+	if !s.closed {
+		s.dispatch()
+	}
+}
+
+// pause stops starting queued jobs. Running jobs are not interrupted.
+func (s *scheduler) pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = true
+}
+
+// resume starts queued jobs again.
+func (s *scheduler) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = false
+	s.dispatch()
+}
+
+// close drops the queued jobs, cancels the running ones and waits for them to return.
+func (s *scheduler) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.queue = nil
+	s.mu.Unlock()
+	s.cancel()
+	s.wg.Wait()
+}
+
+// stats fills in the job fields of st.
+func (s *scheduler) stats(st *Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range s.running {
+		st.Jobs = append(st.Jobs, e.info)
+	}
+	for _, e := range s.queue {
+		st.Jobs = append(st.Jobs, e.info)
+	}
+	st.JobsPaused = s.paused
+	st.JobsDone = s.done
+	st.JobsFailed = s.failed
+	st.JobsLastErr = s.lastErr
+}
+
+// Schedule queues a background job. Jobs run concurrently with transactions,
+// at most MaxJobs at a time. Queued jobs are dropped when the KV is closed.
+// In constrained mode the job runs before Schedule returns, unless the jobs are paused.
+func (db *KV) Schedule(job Job) error {
+	return db.jobs.submit(job)
+}
+
+// JobIO accounts for npages pages that a background job is about to read or write and waits
+// as long as needed to stay within JobPageRate. Jobs should call it before each batch of I/O,
+// outside of any transaction, so that they don't compete with the foreground for the disk.
+func (db *KV) JobIO(ctx context.Context, npages int) error {
+	return db.jobs.io.take(ctx, npages)
+}
+
+// PauseJobs stops starting background jobs until ResumeJobs is called.
+// Jobs that are already running are not interrupted.
+func (db *KV) PauseJobs() {
+	db.jobs.pause()
+}
+
+// ResumeJobs starts the queued background jobs again after PauseJobs.
+func (db *KV) ResumeJobs() {
+	db.jobs.resume()
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// In shared mode (KV.Shared) several processes can open the same database read-write.
+// The process that locks the lease file (db.Path + "-lock") is the leader, the only one
+// that writes to the database. It writes its pid, the path of a unix socket and a
+// heartbeat into the lease file, renews the heartbeat every LEASE_HEARTBEAT, and serves
+// the other processes, the followers, on the socket. The OS releases the lock when the
+// leader exits, and the next follower that can't reach it takes the lease over.
+//
+// A follower reads the pages from its own mapping of the file. A transaction of a follower
+// registers with the leader when it begins, so the pages of its version are not reused
+// until it's closed, just like a read-only transaction of the leader. The updates of a
+// writable transaction are buffered and sent to the leader by Commit, which applies them
+// in one transaction. So a writable transaction of a follower is not isolated from the
+// other writers: the keys it read may have been updated by the time it commits. Its Get
+// sees its own updates, Seek doesn't. Buckets can't be updated and BulkLoad can't be used.
+//
+// A follower is only served if it could write the database file itself, see peerCheck.
+//
+// The WAL is in the memory of the leader, so WAL mode can't be used in shared mode.
+
+const (
+	LEASE_HEARTBEAT = time.Second
+	LEASE_TIMEOUT   = 5 * time.Second // a lease that is not renewed for that long is dead
+	LEASE_RETRY     = 10 * time.Millisecond
+	LEASE_FILE_SIZE = 512 // the lease is written at once, padded to that size
+)
+
+// requests of the followers
+const (
+	LEASE_OP_BEGIN  = 1 // begin a transaction, the reply is its root, version, size and page layout
+	LEASE_OP_END    = 2 // close the transaction of the version in the request
+	LEASE_OP_COMMIT = 3 // apply the updates in the request
+)
+
+// lease is the state of a process in shared mode, see above.
+type lease struct {
+	fp     *os.File // the lease file, locked by the leader
+	sock   string   // the socket of the leader, if this process is the leader
+	leader atomic.Bool
+	// leader
+	ln    net.Listener
+	stop  chan struct{}
+	wg    sync.WaitGroup
+	cmu   sync.Mutex // protects conns
+	conns map[net.Conn]struct{}
+	// follower
+	mu   sync.Mutex // one request at a time, and the takeover
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// leaseBatch is the updates of a writable transaction of a follower.
+type leaseBatch struct {
+	ops  []leaseUpdate
+	keys map[string]int // the last update of each key
+}
+
+type leaseUpdate struct {
+	del bool
+	key []byte
+	val []byte
+}
+
+// leaseOpen takes the lease of the database, or connects to the leader.
+func leaseOpen(db *KV) error {
+	fp, err := os.OpenFile(db.Path+"-lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("lease: %w", err)
+	}
+	db.lease = &lease{fp: fp, sock: db.Path + "-sock"}
+	return db.lease.acquire(db)
+}
+
+// acquire takes the lease if it's free, or connects to the leader. The leader may be
+// starting or exiting, so it retries for up to LEASE_TIMEOUT.
+func (l *lease) acquire(db *KV) error {
+	deadline := time.Now().Add(LEASE_TIMEOUT)
+	for {
+		ok, err := tryLock(l.fp)
+		if err != nil {
+			return fmt.Errorf("lease: %w", err)
+		}
+		if ok {
+			return l.lead(db)
+		}
+		err = l.dial()
+		if err == nil {
+			db.cache = nil // the pages are updated by another process
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("lease: %w", err)
+		}
+		time.Sleep(LEASE_RETRY)
+	}
+}
+
+// lead makes this process the leader once it holds the lock.
+func (l *lease) lead(db *KV) error {
+	// the database may have been updated by the previous leader
+	db.mu.Lock()
+	err := leaseReload(db)
+	db.mu.Unlock()
+	if err == nil {
+		_ = os.Remove(l.sock) // left by a leader that died
+		l.ln, err = net.Listen("unix", l.sock)
+	}
+	if err == nil {
+		err = l.renew()
+		if err != nil {
+			_ = l.ln.Close()
+		}
+	}
+	if err != nil {
+		_ = unlock(l.fp)
+		return fmt.Errorf("lease: %w", err)
+	}
+	if l.conn != nil {
+		_ = l.conn.Close()
+		l.conn = nil
+	}
+	l.stop = make(chan struct{})
+	l.conns = map[net.Conn]struct{}{}
+	l.leader.Store(true)
+	l.wg.Add(2)
+	go l.heartbeat()
+	go l.serve(db)
+	return nil
+}
+
+// leaseReload loads the master page written by another process. The caller holds db.mu.
+func leaseReload(db *KV) error {
+	db.pins = nil // another process may have created or deleted snapshots
+	fi, err := db.fp.(*os.File).Stat()
+	if err != nil {
+		return fmt.Errorf("stat: %w", err)
+	}
+	if db.mmap.file, err = intSize(fi.Size()); err != nil {
+		return err
+	}
+	if db.mmap.file == 0 {
+		return nil
+	}
+	// the page size is in the master page, the first chunk covers it
+	if err := masterLoad(db); err != nil {
+		return err
+	}
+	if err := extendMmap(db, uint64(db.mmap.file/db.page.size)); err != nil {
+		return err
+	}
+	return freeLoad(db)
+}
+
+// renew writes the lease with the current time.
+func (l *lease) renew() error {
+	buf := make([]byte, LEASE_FILE_SIZE)
+	line := fmt.Sprintf("%d %d %s\n", os.Getpid(), time.Now().UnixNano(), l.sock)
+	if len(line) > len(buf) {
+		return fmt.Errorf("socket path too long: %s", l.sock)
+	}
+	copy(buf, line)
+	_, err := l.fp.WriteAt(buf, 0)
+	return err
+}
+
+// heartbeat renews the lease until the leader is closed.
+func (l *lease) heartbeat() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(LEASE_HEARTBEAT)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			_ = l.renew()
+		}
+	}
+}
+
+// dial reads the lease and connects to the leader.
+func (l *lease) dial() error {
+	buf := make([]byte, LEASE_FILE_SIZE)
+	n, err := l.fp.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	line, _, ok := bytes.Cut(buf[:n], []byte("\n"))
+	fields := strings.SplitN(string(line), " ", 3)
+	if !ok || len(fields) != 3 {
+		return errors.New("no lease") // the leader hasn't written it yet
+	}
+	nanos, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad lease: %w", err)
+	}
+	if since := time.Since(time.Unix(0, nanos)); since > LEASE_TIMEOUT {
+		return fmt.Errorf("%w: held by pid %s, renewed %v ago", ErrLeaseExpired, fields[0], since.Round(time.Second))
+	}
+	conn, err := net.DialTimeout("unix", fields[2], LEASE_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	l.conn, l.rd = conn, bufio.NewReader(conn)
+	return nil
+}
+
+// close stops serving or disconnects from the leader, and releases the lease.
+func (l *lease) close() {
+	if l.leader.Load() {
+		close(l.stop)
+		_ = l.ln.Close()
+		l.cmu.Lock()
+		for conn := range l.conns {
+			_ = conn.Close()
+		}
+		l.cmu.Unlock()
+		l.wg.Wait()
+		// before unlocking, the next leader creates a new one
+		_ = os.Remove(l.sock)
+	}
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+	_ = l.fp.Close()
+}
+
+// serve accepts the connections of the followers.
+func (l *lease) serve(db *KV) {
+	defer l.wg.Done()
+	for {
+		conn, err := l.ln.Accept()
+		if err != nil {
+			return // closed
+		}
+		l.cmu.Lock()
+		select {
+		case <-l.stop:
+			l.cmu.Unlock()
+			_ = conn.Close()
+			return
+		default:
+		}
+		l.conns[conn] = struct{}{}
+		l.cmu.Unlock()
+		l.wg.Add(1)
+		go l.serveConn(db, conn)
+	}
+}
+
+// serveConn answers the requests of a follower. The transactions that the follower
+// didn't close are closed when it disconnects. A follower that fails peerCheck gets
+// the error as the reply of its first request.
+func (l *lease) serveConn(db *KV, conn net.Conn) {
+	defer l.wg.Done()
+	versions := map[uint64]int{}
+	defer func() {
+		_ = conn.Close()
+		l.cmu.Lock()
+		delete(l.conns, conn)
+		l.cmu.Unlock()
+		db.mu.Lock()
+		for version, n := range versions {
+			db.readersAdd(version, -n)
+		}
+		db.mu.Unlock()
+	}()
+	fi, err := db.fp.(*os.File).Stat()
+	if err == nil {
+		err = peerCheck(conn, fi)
+	}
+	if err != nil {
+		_ = leaseSend(conn, 1, []byte(err.Error()))
+		return
+	}
+	rd := bufio.NewReader(conn)
+	for {
+		op, req, err := leaseRecv(rd)
+		if err != nil {
+			return
+		}
+		reply, err := l.handle(db, op, req, versions)
+		status := byte(0)
+		if err != nil {
+			status, reply = 1, []byte(err.Error())
+		}
+		if err := leaseSend(conn, status, reply); err != nil {
+			return
+		}
+	}
+}
+
+// handle executes a request of a follower, or of this process once it took the lease over.
+// versions counts the transactions of a follower, nil for this process.
+func (l *lease) handle(db *KV, op byte, req []byte, versions map[uint64]int) ([]byte, error) {
+	switch op {
+	case LEASE_OP_BEGIN:
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if db.wal.fp != nil {
+			return nil, fmt.Errorf("WAL mode: %w", errors.ErrUnsupported)
+		}
+		reply := binary.LittleEndian.AppendUint64(nil, db.tree.root)
+		reply = binary.LittleEndian.AppendUint64(reply, db.version)
+		reply = binary.LittleEndian.AppendUint64(reply, db.page.flushed)
+		reply = binary.LittleEndian.AppendUint32(reply, uint32(db.page.size))
+		reply = binary.LittleEndian.AppendUint32(reply, db.flags)
+		db.readersAdd(db.version, 1)
+		if versions != nil {
+			versions[db.version]++
+		}
+		return reply, nil
+	case LEASE_OP_END:
+		if len(req) != 8 {
+			return nil, errors.New("bad request")
+		}
+		version := binary.LittleEndian.Uint64(req)
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		if versions != nil {
+			if versions[version] == 0 {
+				return nil, nil
+			}
+			if versions[version]--; versions[version] == 0 {
+				delete(versions, version)
+			}
+		}
+		db.readersAdd(version, -1)
+		return nil, nil
+	case LEASE_OP_COMMIT:
+		return nil, leaseApply(db, req)
+	default:
+		return nil, fmt.Errorf("bad request %d", op)
+	}
+}
+
+// leaseApply applies the updates of a follower in a transaction.
+func leaseApply(db *KV, req []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for len(req) > 0 {
+		if len(req) < 9 {
+			return errors.New("bad request")
+		}
+		del := req[0] != 0
+		klen := int(binary.LittleEndian.Uint32(req[1:]))
+		vlen := int(binary.LittleEndian.Uint32(req[5:]))
+		req = req[9:]
+		if klen+vlen > len(req) {
+			return errors.New("bad request")
+		}
+		key, val := req[:klen], req[klen:klen+vlen]
+		req = req[klen+vlen:]
+		if del {
+			_, err = tx.Del(key)
+		} else {
+			err = tx.Set(key, val)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// call sends a request to the leader and returns the reply. If the leader is gone, the
+// lease is taken over or the new leader is dialed, and a BEGIN is sent again. A COMMIT
+// is not, the leader may have applied it.
+// The transactions of a follower are also counted in its own db.readers, so that their
+// pages stay in use if it takes the lease over.
+func (l *lease) call(db *KV, op byte, req []byte) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for retry := op == LEASE_OP_BEGIN; ; retry = false {
+		if l.leader.Load() {
+			return l.handle(db, op, req, nil)
+		}
+		status, reply, err := l.roundTrip(op, req)
+		if err == nil && status != 0 {
+			return nil, fmt.Errorf("leader: %s", reply)
+		}
+		if err == nil || op == LEASE_OP_END {
+			// on a lost connection, the leader closed the transactions of this process
+			db.mu.Lock()
+			if op == LEASE_OP_BEGIN {
+				db.readersAdd(binary.LittleEndian.Uint64(reply[8:]), 1)
+			}
+			if op == LEASE_OP_END {
+				db.readersAdd(binary.LittleEndian.Uint64(req), -1)
+			}
+			db.mu.Unlock()
+			return reply, nil
+		}
+		if l.conn != nil {
+			_ = l.conn.Close()
+			l.conn = nil
+		}
+		if err := l.acquire(db); err != nil {
+			return nil, err
+		}
+		if !retry {
+			return nil, fmt.Errorf("leader: %w", err)
+		}
+	}
+}
+
+// roundTrip sends a request on the connection to the leader and reads the reply.
+func (l *lease) roundTrip(op byte, req []byte) (byte, []byte, error) {
+	if l.conn == nil {
+		return 0, nil, net.ErrClosed
+	}
+	if op != LEASE_OP_COMMIT {
+		// a commit takes as long as it takes
+		_ = l.conn.SetDeadline(time.Now().Add(LEASE_TIMEOUT))
+	} else {
+		_ = l.conn.SetDeadline(time.Time{})
+	}
+	if err := leaseSend(l.conn, op, req); err != nil {
+		return 0, nil, err
+	}
+	status, reply, err := leaseRecv(l.rd)
+	if err == nil && op == LEASE_OP_BEGIN && status == 0 && len(reply) != 32 {
+		err = errors.New("bad reply")
+	}
+	return status, reply, err
+}
+
+// leaseSend writes a message: | type 1B | length 4B | payload |.
+// The type is the op of a request, or the status of a reply, 0 on success.
+func leaseSend(w io.Writer, typ byte, payload []byte) error {
+	msg := make([]byte, 5, 5+len(payload))
+	msg[0] = typ
+	binary.LittleEndian.PutUint32(msg[1:], uint32(len(payload)))
+	_, err := w.Write(append(msg, payload...))
+	return err
+}
+
+// leaseRecv reads a message written by leaseSend.
+func leaseRecv(r *bufio.Reader) (byte, []byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// begin starts a transaction of a follower on the version committed by the leader.
+func (l *lease) begin(db *KV, writable bool) (*Tx, error) {
+	reply, err := l.call(db, LEASE_OP_BEGIN, nil)
+	if err != nil {
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	tx := &Tx{
+		db:       db,
+		root:     binary.LittleEndian.Uint64(reply[0:]),
+		version:  binary.LittleEndian.Uint64(reply[8:]),
+		flushed:  binary.LittleEndian.Uint64(reply[16:]),
+		writable: writable,
+		shared:   true,
+	}
+	pageSize := int(binary.LittleEndian.Uint32(reply[24:]))
+	flags := binary.LittleEndian.Uint32(reply[28:])
+
+	db.mu.Lock()
+	if pageSize != db.page.size || flags != db.flags {
+		// the database was created by the leader
+		err = checkPageSize(pageSize)
+		if err == nil {
+			db.setPageSize(pageSize, flags)
+			db.cache = nil
+		}
+	}
+	if err == nil {
+		err = extendMmap(db, tx.flushed)
+	}
+	tx.tree = db.tree
+	tx.chunks = db.mmap.chunks
+	db.mu.Unlock()
+	if err != nil {
+		tx.done = true
+		l.end(db, tx)
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+
+	tx.tree.root = tx.root
+	tx.tree.get = tx.pageGet
+	tx.tree.prefetch = tx.pagePrefetch
+	tx.tree.now = time.Now().UnixMilli()
+	if writable {
+		tx.batch = &leaseBatch{keys: map[string]int{}}
+	}
+	if err := tx.loadDict(); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("begin: %w", err)
+	}
+	return tx, nil
+}
+
+// end closes a transaction of a follower.
+func (l *lease) end(db *KV, tx *Tx) {
+	_, _ = l.call(db, LEASE_OP_END, binary.LittleEndian.AppendUint64(nil, tx.version))
+}
+
+// commit sends the updates of a transaction of a follower to the leader.
+func (l *lease) commit(db *KV, tx *Tx) error {
+	defer l.end(db, tx)
+	if len(tx.batch.ops) == 0 {
+		if db.Trace != nil {
+			db.Trace.record(TRACE_COMMIT, nil, nil)
+		}
+		return nil
+	}
+	var req []byte
+	for _, op := range tx.batch.ops {
+		del := byte(0)
+		if op.del {
+			del = 1
+		}
+		req = append(req, del)
+		req = binary.LittleEndian.AppendUint32(req, uint32(len(op.key)))
+		req = binary.LittleEndian.AppendUint32(req, uint32(len(op.val)))
+		req = append(req, op.key...)
+		req = append(req, op.val...)
+	}
+	if _, err := l.call(db, LEASE_OP_COMMIT, req); err != nil {
+		if db.Trace != nil {
+			db.Trace.record(TRACE_ROLLBACK, nil, nil)
+		}
+		return fmt.Errorf("commit: %w", err)
+	}
+	if db.Trace != nil {
+		db.Trace.record(TRACE_COMMIT, nil, nil)
+	}
+	return nil
+}
+
+// add buffers an update. The key and the value are copied.
+func (b *leaseBatch) add(del bool, key []byte, val []byte) {
+	b.keys[string(key)] = len(b.ops)
+	b.ops = append(b.ops, leaseUpdate{del: del, key: bytes.Clone(key), val: bytes.Clone(val)})
+}
+
+// get returns the last buffered update of a key.
+func (b *leaseBatch) get(key []byte) (leaseUpdate, bool) {
+	i, ok := b.keys[string(key)]
+	if !ok {
+		return leaseUpdate{}, false
+	}
+	return b.ops[i], true
+}
+
+// del buffers a deletion and reports whether the key existed.
+func (b *leaseBatch) del(tree *BTree, key []byte) (bool, error) {
+	if err := checkKey(key); err != nil {
+		return false, err
+	}
+	u, ok := b.get(key)
+	exists := ok && !u.del
+	if !ok {
+		var err error
+		if _, exists, err = tree.Get(key); err != nil {
+			return false, err
+		}
+	}
+	b.add(true, key, nil)
+	return exists, nil
+}
+
+// checkLocal returns an error for the updates that can't be sent to the leader.
+func (tx *Tx) checkLocal() error {
+	if tx.batch != nil {
+		return fmt.Errorf("follower in shared mode: %w", errors.ErrUnsupported)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix || aix || solaris
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Shared mode needs file locks, see lease.go. The syscall package has no Flock on Solaris and AIX.
+
+// tryLock is not supported on this platform.
+func tryLock(fp *os.File) (bool, error) {
+	return false, fmt.Errorf("file locks: %w on %s/%s", errors.ErrUnsupported, runtime.GOOS, runtime.GOARCH)
+}
+
+// unlock is never called since tryLock doesn't lock anything.
+func unlock(fp *os.File) error {
+	return nil
+}
@@ -0,0 +1,137 @@
+//go:build unix && !aix && !solaris
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// openShared opens a database in shared mode, the first one is the leader.
+func openShared(t *testing.T, db *KV) *KV {
+	t.Helper()
+	db.Shared = true
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// A follower's commit is traced once the leader applied it, and as a rollback if it failed.
+func TestLeaseTraceCommit(t *testing.T) {
+	path := t.TempDir() + "/db"
+	leader := openShared(t, &KV{Path: path})
+	leaderOpen := true
+	defer func() {
+		if leaderOpen {
+			leader.Close()
+		}
+	}()
+	var buf bytes.Buffer
+	follower := openShared(t, &KV{Path: path, Trace: NewTraceWriter(&buf)})
+	defer follower.Close()
+	if follower.lease.leader.Load() {
+		t.Fatal("the second process is the leader")
+	}
+	if err := follower.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := follower.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	leader.Close() // the follower takes the lease over, but the updates were sent to the old leader
+	leaderOpen = false
+	if err := tx.Commit(); err == nil {
+		t.Fatal("the commit didn't fail")
+	}
+
+	got := traceOps(t, buf.Bytes())
+	want := []byte{TRACE_SET, TRACE_COMMIT, TRACE_SET, TRACE_ROLLBACK}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("recorded %v, want %v", got, want)
+	}
+	if val, ok, err := follower.Get([]byte("a")); err != nil || !ok || string(val) != "1" {
+		t.Fatalf("a = %q, %v, %v", val, ok, err)
+	}
+	if _, ok, err := follower.Get([]byte("b")); err != nil || ok {
+		t.Fatalf("b: %v, %v", ok, err)
+	}
+}
+
+// The writes of a follower are applied by the leader, and each sees the commits of the other.
+// When the leader exits, the follower takes the lease over.
+func TestLeaseFollower(t *testing.T) {
+	path := t.TempDir() + "/db"
+	leader := openShared(t, &KV{Path: path})
+	leaderOpen := true
+	defer func() {
+		if leaderOpen {
+			leader.Close()
+		}
+	}()
+	follower := openShared(t, &KV{Path: path})
+	defer follower.Close()
+	if !leader.lease.leader.Load() || follower.lease.leader.Load() {
+		t.Fatal("the first process isn't the leader")
+	}
+
+	tx, err := follower.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("f"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "f", "1") // its own update
+	if _, err := tx.CompareAndSwap([]byte("f"), nil, []byte("2")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CompareAndSwap of a follower: %v", err)
+	}
+	if _, err := tx.CreateBucket([]byte("b")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CreateBucket of a follower: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Set([]byte("l"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []*KV{leader, follower} {
+		for key, want := range map[string]string{"f": "1", "l": "2"} {
+			if val, _, err := db.Get([]byte(key)); err != nil || string(val) != want {
+				t.Fatalf("%s = %q, %v, want %q", key, val, err, want)
+			}
+		}
+	}
+
+	// a reader of the follower keeps its version while the leader writes
+	ro, err := follower.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := leader.Set([]byte("l"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantGet(t, ro, "l", "2")
+	ro.Rollback()
+
+	leader.Close()
+	leaderOpen = false
+	if err := follower.Set([]byte("after"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if !follower.lease.leader.Load() {
+		t.Fatal("the follower didn't take the lease over")
+	}
+	if val, _, err := follower.Get([]byte("l")); err != nil || string(val) != "99" {
+		t.Fatalf("l = %q, %v", val, err)
+	}
+}
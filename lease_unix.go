@@ -0,0 +1,24 @@
+//go:build unix && !aix && !solaris
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock of the file without waiting, and reports whether it got it.
+// The lock is released when the file is closed, or when the process exits.
+func tryLock(fp *os.File) (bool, error) {
+	err := syscall.Flock(int(fp.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlock releases the lock taken by tryLock.
+func unlock(fp *os.File) error {
+	return syscall.Flock(int(fp.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "syscall"
+
+// madvise tells the OS that the pages will be read soon.
+func madvise(data []byte) {
+	_ = syscall.Madvise(data, syscall.MADV_WILLNEED)
+}
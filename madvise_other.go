@@ -0,0 +1,7 @@
+//go:build !linux
+
+package main
+
+// madvise does nothing. The syscall package only has Madvise on Linux, and without mmap the
+// pages are in memory.
+func madvise(data []byte) {}
@@ -1,5 +1,70 @@
 package main
 
-func main() {
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// command is a subcommand of the scratch-db binary. run receives the arguments after the command name.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+// exitError makes main exit with the given status instead of 1.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
 
+var commands = []command{
+	{"page", "decode and print a single page", cmdPage},
+	{"wal-dump", "list the commit records of the write-ahead log", cmdWALDump},
+	{"replay", "replay a trace against a fresh database", cmdReplay},
+	{"bench", "run a benchmark", cmdBench},
+	{"freeze", "write a compacted read-only copy of a database", cmdFreeze},
+	{"snapshot", "list, create, delete or export named snapshots", cmdSnapshot},
+	{"branch", "list, create or delete branches", cmdBranch},
+	{"merge", "merge the changes of a branch into another one or the main tree", cmdMerge},
+	{"sql", "execute a SQL statement on the tables", cmdSQL},
+	{"exec", "execute a SQL script in one transaction", cmdExec},
+	{"shell", "open an interactive shell on a database", cmdShell},
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: scratch-db <command> [arguments]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name != os.Args[1] {
+			continue
+		}
+		if err := cmd.run(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "scratch-db:", err)
+			var exit *exitError
+			if errors.As(err, &exit) {
+				os.Exit(exit.code)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "scratch-db: unknown command %q\n", os.Args[1])
+	usage()
+	os.Exit(2)
 }
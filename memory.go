@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OpenMemory opens a new, empty database that only lives in memory. It supports everything
+// a database opened with Open does, except WAL mode, and it's gone when the KV is closed.
+// Use it where there is no file system or no mmap, like in a browser with GOOS=js
+// GOARCH=wasm, or for temporary data. db.Freeze can save a copy of it to a file, and
+// OpenBytes can read such a copy back from memory. db.Path is not used.
+func (db *KV) OpenMemory() error {
+	db.constrain()
+	if db.WAL {
+		return fmt.Errorf("KV.OpenMemory: WAL mode: %w", errors.ErrUnsupported)
+	}
+	if db.PageSize != 0 {
+		if err := checkPageSize(db.PageSize); err != nil {
+			return fmt.Errorf("KV.OpenMemory: %w", err)
+		}
+	}
+	db.fp = &memFile{}
+	db.jobs = newScheduler(db.MaxJobs, db.JobPageRate, db.Constrained)
+	// memory is allocated as the database grows, starting small
+	if err := openMapped(db, 0, CONSTRAINED_MMAP_SIZE); err != nil {
+		db.Close()
+		return fmt.Errorf("KV.OpenMemory: %w", err)
+	}
+	db.wal.base = db.page.flushed
+	return nil
+}
+
+// memFile is the storage of a database in memory. The pages are in the chunks allocated
+// for the mapping, which are never freed or moved while the database is open.
+type memFile struct {
+	chunks [][]byte // like KV.mmap.chunks, each at the offset that is the size of the ones before it
+}
+
+// alloc allocates a chunk of memory at the given offset, in place of a mapping of the file.
+func (m *memFile) alloc(offset int64, size int) []byte {
+	total := 0
+	for _, chunk := range m.chunks {
+		total += len(chunk)
+	}
+	assert(int64(total) == offset)
+	chunk := make([]byte, size)
+	m.chunks = append(m.chunks, chunk)
+	return chunk
+}
+
+// WriteAt writes into the chunks, which is only used for the master page.
+func (m *memFile) WriteAt(data []byte, offset int64) (int, error) {
+	n := 0
+	for _, chunk := range m.chunks {
+		if offset < int64(len(chunk)) {
+			n += copy(chunk[offset:], data[n:])
+			offset = 0
+			if n == len(data) {
+				break
+			}
+		} else {
+			offset -= int64(len(chunk))
+		}
+	}
+	if n < len(data) {
+		return n, fmt.Errorf("memFile: write beyond the allocated memory")
+	}
+	return n, nil
+}
+
+// Truncate does nothing, the memory is allocated by alloc.
+func (m *memFile) Truncate(size int64) error { return nil }
+
+// Sync does nothing, there is nothing to persist.
+func (m *memFile) Sync() error { return nil }
+
+// Close releases the memory.
+func (m *memFile) Close() error {
+	m.chunks = nil
+	return nil
+}
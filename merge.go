@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// Three-way merges of branches (see branch.go). The changes of theirs since the base snapshot are
+// applied to ours: the KV pairs of the base and of theirs are compared in key order, and each key
+// that theirs changed is set in ours, or deleted, unless ours changed it too. Then it's a conflict,
+// unless both made the same change, and the resolver decides. Only the main keyspace is merged,
+// not the buckets.
+//
+// The merge is a single writable transaction on ours, which sees the base and theirs as committed,
+// so a failing merge changes nothing.
+
+// MergeConflict is a key that both sides of a merge changed differently, see KV.Merge.
+// A value is nil if the key doesn't exist on that side.
+type MergeConflict struct {
+	Key    []byte
+	Base   []byte
+	Ours   []byte
+	Theirs []byte
+}
+
+// MergeResolver returns the merged value of a conflicting key, and false to delete it.
+// The slices of the conflict are only valid during the call.
+type MergeResolver func(c MergeConflict) ([]byte, bool, error)
+
+// Merge applies the changes of the branch theirs since the snapshot base to the branch ours,
+// or to the main tree if ours is nil, and returns the number of keys it changed. The conflicts
+// are passed to resolve, a nil resolve fails the merge with ErrMergeConflict instead.
+// A follower in shared mode returns errors.ErrUnsupported, and so does a merge into a branch
+// while KV.Trace is set, see branch.go.
+func (db *KV) Merge(base []byte, ours []byte, theirs []byte, resolve MergeResolver) (int, error) {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return 0, err
+	}
+	snap, err := tx.snapshot(base)
+	if err != nil {
+		return 0, err
+	}
+	their, err := tx.branch(theirs)
+	if err != nil {
+		return 0, err
+	}
+	if ours != nil {
+		if db.Trace != nil {
+			return 0, fmt.Errorf("KV.Merge: the trace can't record the branches: %w", errors.ErrUnsupported)
+		}
+		our, err := tx.branch(ours)
+		if err != nil {
+			return 0, err
+		}
+		tx.onBranch(our)
+	}
+	baseTree, theirTree := tx.tree, tx.tree
+	baseTree.root, theirTree.root = snap.root, their.root
+	n, err := tx.merge(&baseTree, &theirTree, resolve)
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// merge applies the changes from base to theirs to the tree of the transaction, see above.
+func (tx *Tx) merge(base *BTree, theirs *BTree, resolve MergeResolver) (int, error) {
+	n := 0
+	cb, ct := base.Seek(nil), theirs.Seek(nil)
+	for cb.Valid() || ct.Valid() {
+		var key, bval, tval []byte
+		cmp := 0
+		switch {
+		case !cb.Valid():
+			cmp = 1
+		case !ct.Valid():
+			cmp = -1
+		default:
+			cmp = bytes.Compare(cb.Key(), ct.Key())
+		}
+		if cmp <= 0 {
+			key, bval = cb.Key(), cb.Val()
+			cb.Next()
+		}
+		if cmp >= 0 {
+			key, tval = ct.Key(), ct.Val()
+			ct.Next()
+		}
+		if cmp == 0 && bytes.Equal(bval, tval) {
+			continue // unchanged
+		}
+		if cb.Err() != nil || ct.Err() != nil {
+			break
+		}
+		changed, err := tx.mergeKey(key, bval, cmp <= 0, tval, cmp >= 0, resolve)
+		if err != nil {
+			return 0, err
+		}
+		if changed {
+			n++
+		}
+	}
+	if err := errors.Join(cb.Err(), ct.Err()); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// mergeKey applies the change of a key from base to theirs, where inBase and inTheirs tell
+// whether the key exists on each side, and reports whether it changed ours.
+func (tx *Tx) mergeKey(key []byte, base []byte, inBase bool, theirs []byte, inTheirs bool, resolve MergeResolver) (bool, error) {
+	ours, inOurs, err := tx.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if inOurs == inTheirs && bytes.Equal(ours, theirs) {
+		return false, nil // the same change
+	}
+	val, set := theirs, inTheirs
+	if inOurs != inBase || !bytes.Equal(ours, base) {
+		if resolve == nil {
+			return false, fmt.Errorf("%w: %q", ErrMergeConflict, key)
+		}
+		c := MergeConflict{Key: key}
+		if inBase {
+			c.Base = nonNil(base)
+		}
+		if inOurs {
+			c.Ours = nonNil(ours)
+		}
+		if inTheirs {
+			c.Theirs = nonNil(theirs)
+		}
+		if val, set, err = resolve(c); err != nil {
+			return false, fmt.Errorf("merge %q: %w", key, err)
+		}
+		if set == inOurs && bytes.Equal(val, ours) {
+			return false, nil
+		}
+	}
+	if !set {
+		return tx.Del(key)
+	}
+	return true, tx.Set(key, val)
+}
+
+// nonNil returns an empty value as an empty slice rather than nil, which means a missing key.
+func nonNil(val []byte) []byte {
+	if val == nil {
+		return []byte{}
+	}
+	return val
+}
+
+// cmdMerge implements `scratch-db merge -db <file> [-into branch] [-prefer ours|theirs] <base> <theirs>`.
+func cmdMerge(args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	into := fs.String("into", "", "the branch to merge into, the main tree if not set")
+	prefer := fs.String("prefer", "", "resolve the conflicts with the value of ours or theirs, fail if not set")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 2 || (*prefer != "" && *prefer != "ours" && *prefer != "theirs") {
+		return errors.New("usage: scratch-db merge -db <file> [-into branch] [-prefer ours|theirs] <base> <theirs>")
+	}
+	var resolve MergeResolver
+	if *prefer != "" {
+		resolve = func(c MergeConflict) ([]byte, bool, error) {
+			if *prefer == "ours" {
+				return c.Ours, c.Ours != nil, nil
+			}
+			return c.Theirs, c.Theirs != nil, nil
+		}
+	}
+	var ours []byte
+	if *into != "" {
+		ours = []byte(*into)
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	n, err := db.Merge([]byte(fs.Arg(0)), ours, []byte(fs.Arg(1)), resolve)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d keys changed\n", n)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMergeBranches(t *testing.T) {
+	db := openTest(t, &KV{})
+	update := func(tx *Tx, err error, sets map[string]string, dels ...string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, val := range sets {
+			if err := tx.Set([]byte(key), []byte(val)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, key := range dels {
+			if _, err := tx.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the main keyspace as seen by a read-only transaction
+	contents := func(tx *Tx, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer tx.Rollback()
+		var kvs []string
+		c := tx.Seek(nil)
+		for ; c.Valid(); c.Next() {
+			kvs = append(kvs, fmt.Sprintf("%s=%s", c.Key(), c.Val()))
+		}
+		if err := c.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(kvs)
+	}
+
+	tx, err := db.Begin(true)
+	update(tx, err, map[string]string{"a": "1", "b": "1", "c": "1", "d": "1", "g": "1"})
+	if err := db.CreateSnapshot([]byte("base")); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"theirs", "ours"} {
+		if err := db.CreateBranch([]byte(name), []byte("base")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err = db.BeginBranch([]byte("theirs"), true)
+	update(tx, err, map[string]string{"a": "2", "c": "3", "d": "5", "e": "1", "g": "2"}, "b")
+	tx, err = db.Begin(true)
+	update(tx, err, map[string]string{"c": "4", "d": "5", "f": "1"}, "g")
+
+	// a conflict without a resolver fails the whole merge
+	before := contents(db.Begin(false))
+	if _, err := db.Merge([]byte("base"), nil, []byte("theirs"), nil); !errors.Is(err, ErrMergeConflict) {
+		t.Fatalf("Merge with conflicts: %v", err)
+	}
+	if got := contents(db.Begin(false)); got != before {
+		t.Fatalf("the failed merge changed the main tree to %s", got)
+	}
+
+	var conflicts []string
+	side := func(val []byte) string {
+		if val == nil {
+			return "-"
+		}
+		return string(val)
+	}
+	n, err := db.Merge([]byte("base"), nil, []byte("theirs"), func(c MergeConflict) ([]byte, bool, error) {
+		conflicts = append(conflicts, fmt.Sprintf("%s:%s,%s,%s", c.Key, side(c.Base), side(c.Ours), side(c.Theirs)))
+		if c.Ours == nil {
+			return nil, false, nil
+		}
+		return append(append([]byte{}, c.Ours...), c.Theirs...), true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// d got the same change on both sides
+	if got, want := fmt.Sprint(conflicts), "[c:1,4,3 g:1,-,2]"; got != want {
+		t.Fatalf("conflicts %s, want %s", got, want)
+	}
+	// a, b and e from theirs and c resolved, g stays deleted
+	if n != 4 {
+		t.Fatalf("%d keys changed by the merge", n)
+	}
+	if got, want := contents(db.Begin(false)), "[a=2 c=43 d=5 e=1 f=1]"; got != want {
+		t.Fatalf("merged %s, want %s", got, want)
+	}
+
+	// into a branch that didn't change, without conflicts
+	if _, err := db.Merge([]byte("base"), []byte("ours"), []byte("theirs"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(db.BeginBranch([]byte("ours"), false)), "[a=2 c=3 d=5 e=1 g=2]"; got != want {
+		t.Fatalf("merged into the branch %s, want %s", got, want)
+	}
+	if _, err := db.Merge([]byte("base"), nil, []byte("nope"), nil); !errors.Is(err, ErrBranchNotFound) {
+		t.Fatalf("Merge of a missing branch: %v", err)
+	}
+}
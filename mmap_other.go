@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Without mmap (js/wasm, wasip1, windows) database files can't be opened with Open.
+// Databases are opened with OpenMemory, or read-only with OpenBytes, OpenFS or OpenHTTP.
+
+// mmapFile is not supported on this platform.
+func mmapFile(fp *os.File, offset int64, size int) ([]byte, error) {
+	return nil, fmt.Errorf("%w on %s/%s, use OpenMemory or OpenBytes", errors.ErrUnsupported, runtime.GOOS, runtime.GOARCH)
+}
+
+// munmap is never called since mmapFile doesn't map anything.
+func munmap(chunk []byte) error {
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapFile maps size bytes of the file at the given offset, shared with the file.
+func mmapFile(fp *os.File, offset int64, size int) ([]byte, error) {
+	return syscall.Mmap(
+		int(fp.Fd()), offset, size,
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
+	)
+}
+
+// munmap unmaps a chunk returned by mmapFile.
+func munmap(chunk []byte) error {
+	return syscall.Munmap(chunk)
+}
@@ -0,0 +1,44 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerCheck accepts a follower on the lease socket only if its process could write the
+// database file itself, judging by the uid and the primary gid it connected with (SO_PEERCRED).
+func peerCheck(conn net.Conn, fi os.FileInfo) error {
+	uc, ok := conn.(*net.UnixConn)
+	st, ok2 := fi.Sys().(*syscall.Stat_t)
+	if !ok || !ok2 {
+		return nil
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	cerr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		return fmt.Errorf("peer credentials: %w", err)
+	}
+	perm := fi.Mode().Perm()
+	switch {
+	case cred.Uid == 0:
+	case cred.Uid == st.Uid && perm&0200 != 0:
+	case cred.Gid == st.Gid && perm&0020 != 0:
+	case perm&0002 != 0:
+	default:
+		return fmt.Errorf("%w: pid %d, uid %d can't write the database file", os.ErrPermission, cred.Pid, cred.Uid)
+	}
+	return nil
+}
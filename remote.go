@@ -0,0 +1,204 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// REMOTE_CACHE_PAGES is the default number of pages cached by a database opened with OpenHTTP
+const REMOTE_CACHE_PAGES = 1024
+
+// OpenHTTP opens a database file hosted on a static HTTP server without downloading it.
+// Pages are read on demand with Range requests and the most recently used ones are cached,
+// see RemoteCachePages. The leaves ahead of a cursor are read ahead in one request when
+// they are next to each other, which they are in a file written by Freeze.
+//
+// The database is read-only like one opened with OpenBytes. The server must support Range
+// requests, and the file must not change while it's open: the requests are pinned to the
+// ETag (or Last-Modified) of the first response, so a change is reported as an error
+// rather than read.
+// db.Path is not used.
+func (db *KV) OpenHTTP(url string) error {
+	if db.WAL {
+		return fmt.Errorf("KV.OpenHTTP: WAL mode: %w", ErrReadOnly)
+	}
+	db.constrain()
+	r := &remotePages{
+		client: http.DefaultClient,
+		url:    url,
+		limit:  db.RemoteCachePages,
+		cache:  map[uint64]*list.Element{},
+		lru:    list.New(),
+	}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	if r.limit <= 0 {
+		r.limit = REMOTE_CACHE_PAGES
+	}
+	// the page size is in the master page, which is within the smallest page
+	head, hdr, err := r.fetch(0, BTREE_MIN_PAGE_SIZE)
+	if err == nil {
+		r.etag, r.modified = hdr.Get("ETag"), hdr.Get("Last-Modified")
+		// Content-Range: bytes <first>-<last>/<size>
+		_, total, _ := strings.Cut(hdr.Get("Content-Range"), "/")
+		size, perr := strconv.ParseInt(total, 10, 64)
+		if perr != nil || size < 0 {
+			err = fmt.Errorf("bad Content-Range %q", hdr.Get("Content-Range"))
+		} else if fileSize, serr := intSize(size); serr != nil {
+			err = serr
+		} else {
+			err = openStatic(db, head, fileSize)
+		}
+	}
+	if err != nil {
+		r.close()
+		db.Close()
+		return fmt.Errorf("KV.OpenHTTP: %w", err)
+	}
+	r.pageSize = db.page.size
+	db.remote = r
+	db.mmap.chunks = nil
+	db.mmap.total = 0
+	return nil
+}
+
+// remotePages reads the pages of a database file over HTTP and caches them.
+type remotePages struct {
+	client   *http.Client
+	url      string
+	pageSize int
+	etag     string          // of the first response, empty if the server didn't send one
+	modified string          // Last-Modified of the first response, used if there is no ETag
+	ctx      context.Context // canceled by close, which stops the reads ahead
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup // the reads ahead started by prefetch
+
+	mu     sync.Mutex
+	limit  int                      // the maximum number of cached pages
+	cache  map[uint64]*list.Element // page pointer -> element of lru
+	lru    *list.List               // remotePage, the most recently used first
+	closed bool                     // no more reads ahead are started
+}
+
+type remotePage struct {
+	ptr  uint64
+	data []byte
+}
+
+// get returns a page from the cache, or reads it.
+func (r *remotePages) get(ptr uint64) ([]byte, error) {
+	r.mu.Lock()
+	if e, ok := r.cache[ptr]; ok {
+		r.lru.MoveToFront(e)
+		r.mu.Unlock()
+		return e.Value.(remotePage).data, nil
+	}
+	r.mu.Unlock()
+	// concurrent readers may read the same page, the last one is cached.
+	// the page can be evicted again before this returns, so it's not looked up in the cache.
+	return r.read(ptr, 1)
+}
+
+// prefetch reads the pages that are not cached in the background,
+// with one request for each run of consecutive pages.
+func (r *remotePages) prefetch(ptrs []uint64) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	var missing []uint64
+	for _, ptr := range ptrs {
+		if _, ok := r.cache[ptr]; !ok {
+			missing = append(missing, ptr)
+		}
+	}
+	for i := 0; i < len(missing); {
+		j := i + 1
+		for j < len(missing) && missing[j] == missing[j-1]+1 {
+			j++
+		}
+		r.wg.Add(1) // with r.mu held, so close waits for it
+		go func(ptr uint64, n int) {
+			defer r.wg.Done()
+			_, _ = r.read(ptr, n) // only a hint, get reads the page again on error
+		}(missing[i], j-i)
+		i = j
+	}
+	r.mu.Unlock()
+}
+
+// close cancels the reads ahead and waits for them.
+func (r *remotePages) close() {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	r.cancel()
+	r.wg.Wait()
+}
+
+// read reads n consecutive pages into the cache and returns the first one.
+func (r *remotePages) read(ptr uint64, n int) ([]byte, error) {
+	data, _, err := r.fetch(int64(ptr)*int64(r.pageSize), n*r.pageSize)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < n; i++ {
+		page := remotePage{ptr: ptr + uint64(i), data: data[i*r.pageSize:][:r.pageSize:r.pageSize]}
+		if e, ok := r.cache[page.ptr]; ok {
+			e.Value = page
+			r.lru.MoveToFront(e)
+			continue
+		}
+		r.cache[page.ptr] = r.lru.PushFront(page)
+	}
+	for r.lru.Len() > max(r.limit, n) {
+		e := r.lru.Back()
+		r.lru.Remove(e)
+		delete(r.cache, e.Value.(remotePage).ptr)
+	}
+	return data[:r.pageSize:r.pageSize], nil
+}
+
+// fetch reads size bytes at the given offset and returns them with the response header.
+func (r *remotePages) fetch(offset int64, size int) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(size)-1))
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	} else if r.modified != "" {
+		req.Header.Set("If-Unmodified-Since", r.modified)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusPreconditionFailed:
+		return nil, nil, errors.New("the remote file has changed")
+	case http.StatusRequestedRangeNotSatisfiable:
+		return nil, nil, fmt.Errorf("bytes %d to %d are beyond the end of the remote file", offset, offset+int64(size))
+	case http.StatusOK:
+		return nil, nil, fmt.Errorf("GET %s: the server does not support Range requests", r.url)
+	default:
+		return nil, nil, fmt.Errorf("GET %s: %s", r.url, resp.Status)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, nil, fmt.Errorf("GET %s: %w", r.url, err)
+	}
+	return data, resp.Header, nil
+}
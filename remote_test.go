@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// remoteServer serves a frozen database with n keys.
+func remoteServer(t *testing.T, n int, handler func(http.Handler) http.Handler) *httptest.Server {
+	dir := t.TempDir()
+	db := &KV{Path: dir + "/src.db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("k%05d", i)), []byte(fmt.Sprint("v", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Freeze(dir + "/r.db"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	os.Remove(dir + "/src.db")
+	srv := httptest.NewServer(handler(http.FileServer(http.Dir(dir))))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// A page read by get can be evicted by a concurrent reader before get returns.
+func TestRemoteConcurrentGet(t *testing.T) {
+	srv := remoteServer(t, 5000, func(h http.Handler) http.Handler { return h })
+	db := &KV{RemoteCachePages: 1, CachePages: -1}
+	if err := db.OpenHTTP(srv.URL + "/r.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for g := 0; g < 64; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < 5000; i += 97 {
+				key := fmt.Sprintf("k%05d", i)
+				val, ok, err := db.Get([]byte(key))
+				if err != nil || !ok || string(val) != fmt.Sprint("v", i) {
+					errs <- fmt.Errorf("Get(%s) = %q, %v, %v", key, val, ok, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Close cancels the reads ahead and no more are started after it.
+func TestRemoteClose(t *testing.T) {
+	var block atomic.Bool
+	var requests atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	srv := remoteServer(t, 5000, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if block.Load() {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	db := &KV{CachePages: -1}
+	if err := db.OpenHTTP(srv.URL + "/r.db"); err != nil {
+		t.Fatal(err)
+	}
+	block.Store(true)
+	n := requests.Load()
+	r := db.remote
+	r.prefetch([]uint64{1, 2, 3, 5}) // two requests
+	for requests.Load() < n+2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		db.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close waits for the blocked reads ahead")
+	}
+	n = requests.Load()
+	r.prefetch([]uint64{7})
+	time.Sleep(10 * time.Millisecond)
+	if requests.Load() != n {
+		t.Fatal("a read ahead was started after Close")
+	}
+}
+
+// A remote file that changed after it was opened fails the reads instead of mixing versions.
+func TestRemoteChanged(t *testing.T) {
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	srv := remoteServer(t, 5000, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("ETag", etag.Load().(string))
+			h.ServeHTTP(w, r)
+		})
+	})
+	db := &KV{RemoteCachePages: 1, CachePages: -1}
+	if err := db.OpenHTTP(srv.URL + "/r.db"); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if val, _, err := db.Get([]byte("k00001")); err != nil || string(val) != "v1" {
+		t.Fatalf("k00001 = %q, %v", val, err)
+	}
+	etag.Store(`"v2"`)
+	if _, _, err := db.Get([]byte("k04999")); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Fatalf("Get after the file changed: %v", err)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The shell is an interactive prompt for a database, to debug it by hand, see shellHelp.
+// Each command runs in its own transaction, unless one was opened with begin. The lines that
+// start with a SQL statement are passed to Tx.Exec (see sql.go).
+//
+// On a terminal the line can be edited, and the previous lines are recalled with the up and down
+// arrows. They are kept in a history file, SHELL_HISTORY_FILE in the home directory by default.
+// Raw terminal mode is only implemented on Linux, elsewhere the lines are read as they are.
+
+const (
+	SHELL_HISTORY_FILE = ".scratch-db_history"
+	SHELL_HISTORY_SIZE = 1000 // lines kept in the history file
+	SHELL_SCAN_LIMIT   = 100  // keys printed by scan if no limit is given
+)
+
+const shellHelp = `commands:
+  get <key>                  print the value of a key
+  set <key> <value>          set a key
+  del <key>                  delete a key
+  scan [prefix] [limit]      print the keys with a prefix and their values, 100 by default
+  begin [read]               begin a writable, or read-only, transaction
+  commit                     commit the transaction opened by begin
+  rollback                   roll the transaction back
+  stats                      print the statistics of the database
+  history                    print the previous lines
+  help                       print this
+  quit                       leave the shell, rolling back an open transaction
+  CREATE, INSERT, SELECT, UPDATE or DELETE ...   a SQL statement
+keys and values with spaces or binary bytes are written as Go strings: "a b\x00"`
+
+// shell is the state of a shell session.
+type shell struct {
+	db  *KV
+	tx  *Tx // the transaction opened by begin, nil if each command runs in its own
+	out io.Writer
+	ed  *lineEditor
+}
+
+// cmdShell implements `scratch-db shell -db <file> [-history file]`.
+func cmdShell(args []string) error {
+	fs := flag.NewFlagSet("shell", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	history := fs.String("history", shellHistoryPath(), "the history file, none if empty")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 0 {
+		return errors.New("usage: scratch-db shell -db <file> [-history file]")
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	sh := &shell{db: db, out: os.Stdout, ed: newLineEditor(os.Stdin, os.Stdout, *history)}
+	return sh.loop()
+}
+
+// shellHistoryPath returns the default history file.
+func shellHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, SHELL_HISTORY_FILE)
+}
+
+// loop reads and runs the commands until quit or the end of the input.
+func (sh *shell) loop() error {
+	defer func() {
+		if sh.tx != nil {
+			sh.tx.Rollback()
+			fmt.Fprintln(sh.out, "the open transaction was rolled back")
+		}
+	}()
+	for {
+		prompt := "scratch-db> "
+		if sh.tx != nil {
+			prompt = "scratch-db*> "
+		}
+		line, err := sh.ed.readLine(prompt)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sh.ed.remember(line)
+		if line == "quit" || line == "exit" {
+			return nil
+		}
+		if err := sh.run(line); err != nil {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+}
+
+// run runs a command line.
+func (sh *shell) run(line string) error {
+	verb, _, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(verb) {
+	case "CREATE", "INSERT", "SELECT", "UPDATE", "DELETE":
+		stmt, err := sqlParse(line)
+		if err != nil {
+			return err
+		}
+		var res *SQLResult
+		err = sh.do(!stmt.readOnly(), func(tx *Tx) error {
+			res, err = tx.exec(stmt)
+			return err
+		})
+		if err == nil {
+			printSQL(sh.out, stmt, res) // once it's committed
+		}
+		return err
+	}
+	args, err := shellArgs(line)
+	if err != nil {
+		return err
+	}
+	usage := errors.New("bad arguments, see help")
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return usage
+		}
+		return sh.do(false, func(tx *Tx) error {
+			val, ok, err := tx.Get([]byte(args[1]))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				fmt.Fprintln(sh.out, "(not found)")
+			} else {
+				fmt.Fprintln(sh.out, shellQuote(val))
+			}
+			return nil
+		})
+	case "set":
+		if len(args) != 3 {
+			return usage
+		}
+		return sh.do(true, func(tx *Tx) error {
+			return tx.Set([]byte(args[1]), []byte(args[2]))
+		})
+	case "del":
+		if len(args) != 2 {
+			return usage
+		}
+		return sh.do(true, func(tx *Tx) error {
+			ok, err := tx.Del([]byte(args[1]))
+			if err == nil && !ok {
+				fmt.Fprintln(sh.out, "(not found)")
+			}
+			return err
+		})
+	case "scan":
+		if len(args) > 3 {
+			return usage
+		}
+		var prefix []byte
+		if len(args) > 1 {
+			prefix = []byte(args[1])
+		}
+		limit := SHELL_SCAN_LIMIT
+		if len(args) > 2 {
+			if limit, err = strconv.Atoi(args[2]); err != nil || limit < 0 {
+				return usage
+			}
+		}
+		return sh.do(false, func(tx *Tx) error {
+			return sh.scan(tx, prefix, limit)
+		})
+	case "begin":
+		if sh.tx != nil {
+			return errors.New("a transaction is open already")
+		}
+		if len(args) > 2 || len(args) == 2 && args[1] != "read" {
+			return usage
+		}
+		sh.tx, err = sh.db.Begin(len(args) == 1)
+		return err
+	case "commit", "rollback":
+		if sh.tx == nil {
+			return errors.New("no transaction is open")
+		}
+		tx := sh.tx
+		sh.tx = nil
+		if args[0] == "rollback" || !tx.writable {
+			tx.Rollback() // a read-only transaction has nothing to commit
+			return nil
+		}
+		return tx.Commit()
+	case "stats":
+		st := sh.db.Stats()
+		fmt.Fprintf(sh.out, "version %d, %d pages, %d free, %d readers, %d in the WAL\n",
+			st.Version, st.Pages, st.FreePages, st.Readers, st.WALPages)
+		return nil
+	case "history":
+		for i, line := range sh.ed.history {
+			fmt.Fprintf(sh.out, "%5d  %s\n", i+1, line)
+		}
+		return nil
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+		return nil
+	}
+	return fmt.Errorf("unknown command %q, see help", args[0])
+}
+
+// do runs fn in the transaction opened by begin, or in a transaction of its own that is
+// committed if fn succeeds.
+func (sh *shell) do(writable bool, fn func(tx *Tx) error) error {
+	if sh.tx != nil {
+		return fn(sh.tx)
+	}
+	tx, err := sh.db.Begin(writable)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if writable {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// scan prints at most limit keys with a prefix and their values.
+func (sh *shell) scan(tx *Tx, prefix []byte, limit int) error {
+	n := 0
+	c := tx.Seek(prefix)
+	for ; c.Valid() && bytes.HasPrefix(c.Key(), prefix); c.Next() {
+		if n == limit {
+			fmt.Fprintln(sh.out, "(more keys)")
+			break
+		}
+		fmt.Fprintf(sh.out, "%s\t%s\n", shellQuote(c.Key()), shellQuote(c.Val()))
+		n++
+	}
+	return c.Err()
+}
+
+// shellArgs splits a command line at the spaces. An argument that starts with a double quote
+// is a Go string.
+func shellArgs(line string) ([]string, error) {
+	var args []string
+	for line = strings.TrimLeft(line, " \t"); line != ""; line = strings.TrimLeft(line, " \t") {
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("bad string %s", line)
+			}
+			arg, _ := strconv.Unquote(quoted)
+			args, line = append(args, arg), line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		args, line = append(args, line[:end]), line[end:]
+	}
+	return args, nil
+}
+
+// shellQuote returns a key or a value as it's typed in the shell: as it is if it's printable
+// text without spaces, as a Go string otherwise.
+func shellQuote(b []byte) string {
+	s := string(b)
+	if s == "" || !utf8.ValidString(s) || s[0] == '"' || strings.IndexFunc(s, func(r rune) bool {
+		return !unicode.IsPrint(r) || unicode.IsSpace(r)
+	}) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// lineEditor reads the lines of the shell, with editing and history on a terminal.
+type lineEditor struct {
+	in      *bufio.Reader
+	fd      int
+	out     io.Writer
+	tty     bool
+	path    string   // the history file, "" if none
+	history []string // the previous lines, the oldest first
+}
+
+func newLineEditor(in *os.File, out io.Writer, path string) *lineEditor {
+	e := &lineEditor{in: bufio.NewReader(in), fd: int(in.Fd()), out: out, path: path}
+	if fi, err := in.Stat(); err == nil {
+		e.tty = fi.Mode()&os.ModeCharDevice != 0
+	}
+	if data, err := os.ReadFile(path); path != "" && err == nil {
+		e.history = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(e.history) > SHELL_HISTORY_SIZE {
+			e.history = e.history[len(e.history)-SHELL_HISTORY_SIZE:]
+			if e.tty {
+				e.save()
+			}
+		}
+	}
+	return e
+}
+
+// remember adds a line to the history, unless it repeats the previous one.
+func (e *lineEditor) remember(line string) {
+	if !e.tty {
+		return // the lines of a script are not kept
+	}
+	if n := len(e.history); n > 0 && e.history[n-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > 2*SHELL_HISTORY_SIZE {
+		e.history = e.history[len(e.history)-SHELL_HISTORY_SIZE:]
+		e.save()
+		return
+	}
+	if e.path == "" {
+		return
+	}
+	fp, err := os.OpenFile(e.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err == nil {
+		fmt.Fprintln(fp, line)
+		fp.Close()
+	}
+}
+
+// save rewrites the history file with the lines in memory.
+func (e *lineEditor) save() {
+	if e.path != "" {
+		_ = os.WriteFile(e.path, []byte(strings.Join(e.history, "\n")+"\n"), 0600)
+	}
+}
+
+// readLine reads a line, or returns io.EOF at the end of the input.
+// The prompt is only printed on a terminal.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	if !e.tty {
+		line, err := e.in.ReadString('\n')
+		if err == io.EOF && line != "" {
+			err = nil
+		}
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	restore, err := termRaw(e.fd)
+	if err != nil {
+		fmt.Fprint(e.out, prompt)
+		e.tty = false
+		line, err := e.readLine(prompt)
+		e.tty = true
+		return line, err
+	}
+	defer restore()
+	return e.edit(prompt)
+}
+
+// edit reads the keys of a line in raw mode and echoes the line. It knows the arrows, home,
+// end and delete, and the control keys of Emacs: A, E, B, F, P, N, K, U, C and D.
+func (e *lineEditor) edit(prompt string) (string, error) {
+	var buf []rune
+	pos, hist := 0, len(e.history)
+	saved := "" // the line being typed while browsing the history
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r%s%s\x1b[K", prompt, string(buf))
+		if back := len(buf) - pos; back > 0 {
+			fmt.Fprintf(e.out, "\x1b[%dD", back)
+		}
+	}
+	recall := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if hist == len(e.history) {
+			saved = string(buf)
+		}
+		hist = i
+		line := saved
+		if i < len(e.history) {
+			line = e.history[i]
+		}
+		buf = []rune(line)
+		pos = len(buf)
+	}
+	redraw()
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(buf), nil
+		case 3: // ^C drops the line
+			fmt.Fprint(e.out, "^C\r\n")
+			buf, pos, hist = buf[:0], 0, len(e.history)
+		case 4: // ^D ends the input on an empty line, or deletes
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // ^A
+			pos = 0
+		case 5: // ^E
+			pos = len(buf)
+		case 2: // ^B
+			pos = max(pos-1, 0)
+		case 6: // ^F
+			pos = min(pos+1, len(buf))
+		case 11: // ^K
+			buf = buf[:pos]
+		case 21: // ^U
+			buf, pos = append(buf[:0], buf[pos:]...), 0
+		case 16: // ^P
+			recall(hist - 1)
+		case 14: // ^N
+			recall(hist + 1)
+		case 27: // escape sequences: ESC [ <key> or ESC [ <n> ~
+			if b, _ := e.in.ReadByte(); b != '[' && b != 'O' {
+				break
+			}
+			b, _ := e.in.ReadByte()
+			if '0' <= b && b <= '9' {
+				if t, _ := e.in.ReadByte(); t != '~' {
+					break
+				}
+			}
+			switch b {
+			case 'A':
+				recall(hist - 1)
+			case 'B':
+				recall(hist + 1)
+			case 'C':
+				pos = min(pos+1, len(buf))
+			case 'D':
+				pos = max(pos-1, 0)
+			case 'H', '1':
+				pos = 0
+			case 'F', '4':
+				pos = len(buf)
+			case '3':
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+				pos++
+			}
+		}
+		redraw()
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestShellSQL(t *testing.T) {
+	db := &KV{Path: t.TempDir() + "/db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var out bytes.Buffer
+	sh := &shell{db: db, out: &out}
+	run := func(line string, want string) {
+		t.Helper()
+		out.Reset()
+		if err := sh.run(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if out.String() != want {
+			t.Fatalf("%s: printed %q, want %q", line, out.String(), want)
+		}
+	}
+	run("CREATE TABLE t (a INT64 PRIMARY KEY, b STRING)", "table t created\n")
+	run("INSERT INTO t VALUES (1, 'x'), (2, 'y')", "2 rows\n")
+	run("SELECT b, a FROM t WHERE a > 1", "b\ta\n'y'\t2\n")
+
+	// nothing is printed if the commit fails
+	fp := db.fp
+	db.fp = failSync{fp.(*os.File)}
+	out.Reset()
+	err := sh.run("INSERT INTO t VALUES (3, 'z')")
+	db.fp = fp
+	if err == nil || out.Len() != 0 {
+		t.Fatalf("printed %q, %v", out.String(), err)
+	}
+	run("SELECT * FROM t WHERE a = 3", "a\tb\n")
+}
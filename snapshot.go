@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Named snapshots keep a version of the tree readable, across restarts, until they are deleted.
+// Since the pages are copy-on-write, a version stays intact as long as its pages are not reused,
+// so a snapshot is just the root of a version that is pinned like a reader that never ends.
+//
+// The snapshots are the SYS_SNAPSHOTS system tree (see bucket.go), which maps the names to
+// | root | version | created |
+// | 8B   | 8B      | 8B      |
+// where created is in unix milliseconds. The versions of the snapshots are kept in db.pins, and
+// freeRelease doesn't reuse the pages they still reference, like for db.readers. The pins are loaded
+// by the first writable transaction, since only writers reuse pages, and updated by the commits
+// that create or delete snapshots.
+//
+// The free list is stored with the versions that freed the pages (see freelist.go), so the pages
+// that only a deleted snapshot referenced are reused, also after the database was reopened.
+
+// Snapshot describes a named snapshot, see KV.CreateSnapshot.
+type Snapshot struct {
+	Name    []byte
+	Version uint64 // the version of the tree
+	Created time.Time
+	root    uint64
+}
+
+// CreateSnapshot pins the committed version of the tree under the given name,
+// or returns ErrSnapshotExists. A follower in shared mode returns errors.ErrUnsupported.
+func (db *KV) CreateSnapshot(name []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	if err := checkKey(name); err != nil {
+		return fmt.Errorf("snapshot name: %w", err)
+	}
+	table, err := tx.snapshotTable()
+	if err != nil {
+		return err
+	}
+	_, ok, err := table.Get(name)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return fmt.Errorf("%w: %q", ErrSnapshotExists, name)
+	}
+	val := binary.LittleEndian.AppendUint64(nil, tx.root)
+	val = binary.LittleEndian.AppendUint64(val, tx.version)
+	val = binary.LittleEndian.AppendUint64(val, uint64(time.Now().UnixMilli()))
+	if err := table.Insert(name, val); err != nil {
+		return err
+	}
+	if err := tx.sysStore(SYS_SNAPSHOTS, table.root); err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+	tx.pins = map[uint64]int{tx.version: 1}
+	return tx.Commit()
+}
+
+// DeleteSnapshot deletes a snapshot, or returns ErrSnapshotNotFound. Its pages are reused
+// once no transaction reads it.
+func (db *KV) DeleteSnapshot(name []byte) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	snap, err := tx.snapshot(name)
+	if err != nil {
+		return err
+	}
+	table, err := tx.snapshotTable()
+	if err != nil {
+		return err
+	}
+	if _, err := table.Delete(name); err != nil {
+		return err
+	}
+	if err := tx.sysStore(SYS_SNAPSHOTS, table.root); err != nil {
+		return fmt.Errorf("snapshots: %w", err)
+	}
+	tx.pins = map[uint64]int{snap.Version: -1}
+	return tx.Commit()
+}
+
+// Snapshots returns the snapshots sorted by name.
+func (db *KV) Snapshots() ([]Snapshot, error) {
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return tx.snapshots()
+}
+
+// BeginSnapshot starts a read-only transaction on the version of a snapshot, or returns
+// ErrSnapshotNotFound. The version stays readable until the transaction is closed, even if the
+// snapshot is deleted meanwhile. A follower in shared mode returns errors.ErrUnsupported.
+func (db *KV) BeginSnapshot(name []byte) (*Tx, error) {
+	if db.lease != nil && !db.lease.leader.Load() {
+		return nil, fmt.Errorf("KV.BeginSnapshot: the leader doesn't know the readers of a follower: %w", errors.ErrUnsupported)
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := tx.snapshot(name)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if !tx.readPinned(snap.Version) {
+		tx.Rollback()
+		return nil, fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	tx.root = snap.root
+	tx.tree.root = snap.root
+	return tx, nil
+}
+
+// ExportSnapshot writes a snapshot to a new file, like Freeze writes the committed tree.
+func (db *KV) ExportSnapshot(name []byte, path string) error {
+	tx, err := db.BeginSnapshot(name)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	return tx.freeze(path)
+}
+
+// snapshotTable returns the tree of the snapshots as seen by the transaction.
+func (tx *Tx) snapshotTable() (BTree, error) {
+	root, err := tx.sysRoot(SYS_SNAPSHOTS)
+	if err != nil {
+		return BTree{}, fmt.Errorf("snapshots: %w", err)
+	}
+	table := tx.tree
+	table.vals = nil // the entries are stored as they are
+	table.root = root
+	return table, nil
+}
+
+// snapshot returns the snapshot with the given name, or ErrSnapshotNotFound.
+func (tx *Tx) snapshot(name []byte) (Snapshot, error) {
+	if err := checkKey(name); err != nil {
+		return Snapshot{}, fmt.Errorf("snapshot name: %w", err)
+	}
+	table, err := tx.snapshotTable()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	val, ok, err := table.Get(name)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if !ok {
+		return Snapshot{}, fmt.Errorf("%w: %q", ErrSnapshotNotFound, name)
+	}
+	return snapshotDecode(name, val)
+}
+
+// snapshots returns the snapshots as seen by the transaction.
+func (tx *Tx) snapshots() ([]Snapshot, error) {
+	table, err := tx.snapshotTable()
+	if err != nil {
+		return nil, err
+	}
+	var snaps []Snapshot
+	c := table.Seek(nil)
+	for ; c.Valid(); c.Next() {
+		snap, err := snapshotDecode(c.Key(), c.Val())
+		if err != nil {
+			return nil, err
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, c.Err()
+}
+
+// snapshotDecode decodes an entry of the snapshot table.
+func snapshotDecode(name []byte, val []byte) (Snapshot, error) {
+	if len(val) != 24 {
+		return Snapshot{}, fmt.Errorf("snapshot %q: %w: bad entry", name, ErrCorruptNode)
+	}
+	return Snapshot{
+		Name:    bytes.Clone(name),
+		root:    binary.LittleEndian.Uint64(val[0:]),
+		Version: binary.LittleEndian.Uint64(val[8:]),
+		Created: time.UnixMilli(int64(binary.LittleEndian.Uint64(val[16:]))),
+	}, nil
+}
+
+// readPinned registers a read-only transaction as a reader of a pinned version instead of the
+// version it began on, so that the pages of that version are kept until it's closed. The version
+// was pinned since the transaction began, unless it was unpinned meanwhile, and its pages may be
+// reused already if the pins were updated. Then it reports false.
+func (tx *Tx) readPinned(version uint64) bool {
+	db := tx.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pins != nil && db.pins[version] == 0 {
+		return false
+	}
+	db.readersAdd(tx.version, -1)
+	db.readersAdd(version, 1)
+	tx.version = version
+	return true
+}
+
+// pinsLoad loads the versions of the snapshots and the branches into db.pins, unless they are loaded already.
+// It's called by a writable transaction before freeRelease, holding db.writer.
+func (db *KV) pinsLoad() error {
+	db.mu.Lock()
+	loaded := db.pins != nil
+	db.mu.Unlock()
+	if loaded {
+		return nil
+	}
+	snaps, err := db.Snapshots()
+	if err != nil {
+		return err
+	}
+	branches, err := db.Branches()
+	if err != nil {
+		return err
+	}
+	pins := map[uint64]int{}
+	for _, snap := range snaps {
+		pins[snap.Version]++
+	}
+	for _, b := range branches {
+		pins[b.Version]++
+	}
+	db.mu.Lock()
+	db.pins = pins
+	db.mu.Unlock()
+	return nil
+}
+
+// pinsAdd applies the pins of a committed transaction.
+func (db *KV) pinsAdd(pins map[uint64]int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.pins == nil {
+		return // reloaded by the next writer
+	}
+	for v, n := range pins {
+		if db.pins[v] += n; db.pins[v] == 0 {
+			delete(db.pins, v)
+		}
+	}
+}
+
+// cmdSnapshot implements `scratch-db snapshot -db <file> list|create|delete|export [name] [out]`.
+func cmdSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	fs.Parse(args)
+	op, nargs := fs.Arg(0), map[string]int{"list": 1, "create": 2, "delete": 2, "export": 3}[fs.Arg(0)]
+	if *path == "" || nargs == 0 || fs.NArg() != nargs {
+		return errors.New("usage: scratch-db snapshot -db <file> list|create|delete|export [name] [out]")
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	name := []byte(fs.Arg(1))
+	switch op {
+	case "create":
+		return db.CreateSnapshot(name)
+	case "delete":
+		return db.DeleteSnapshot(name)
+	case "export":
+		return db.ExportSnapshot(name, fs.Arg(2))
+	}
+	snaps, err := db.Snapshots()
+	for _, snap := range snaps {
+		fmt.Fprintf(os.Stdout, "%s\tversion %d\t%s\n", snap.Name, snap.Version, snap.Created.Format(time.RFC3339))
+	}
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSnapshotLifecycle(t *testing.T) {
+	dir := t.TempDir()
+	db := &KV{Path: dir + "/db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	const keys = 300
+	write := func(round int) {
+		t.Helper()
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < keys; i++ {
+			if err := tx.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprintf("%0100d", round))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// checks that a transaction sees the values of a round
+	check := func(tx *Tx, round int) {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			wantGet(t, tx, fmt.Sprint("key", i), fmt.Sprintf("%0100d", round))
+		}
+	}
+	write(0)
+	if err := db.CreateSnapshot([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateSnapshot([]byte("s")); !errors.Is(err, ErrSnapshotExists) {
+		t.Fatalf("CreateSnapshot of an existing snapshot: %v", err)
+	}
+	// the pages of the snapshot are not reused by the updates
+	for round := 1; round <= 20; round++ {
+		write(round)
+	}
+	db.Close()
+
+	db = openTest(t, &KV{Path: dir + "/db"})
+	snaps, err := db.Snapshots()
+	if err != nil || len(snaps) != 1 || string(snaps[0].Name) != "s" || snaps[0].Created.IsZero() {
+		t.Fatalf("snapshots %+v, %v", snaps, err)
+	}
+	stx, err := db.BeginSnapshot([]byte("s"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(stx, 0)
+	if err := stx.Set([]byte("key0"), nil); !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("Set on a snapshot: %v", err)
+	}
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tx, 20)
+	tx.Rollback()
+	if _, err := db.BeginSnapshot([]byte("t")); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("BeginSnapshot of a missing snapshot: %v", err)
+	}
+
+	if err := db.ExportSnapshot([]byte("s"), dir+"/export"); err != nil {
+		t.Fatal(err)
+	}
+	export := openTest(t, &KV{Path: dir + "/export"})
+	tx, err = export.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(tx, 0)
+	tx.Rollback()
+
+	// the open transaction keeps the version after the snapshot is deleted
+	if err := db.DeleteSnapshot([]byte("s")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteSnapshot([]byte("s")); !errors.Is(err, ErrSnapshotNotFound) {
+		t.Fatalf("DeleteSnapshot of a deleted snapshot: %v", err)
+	}
+	for round := 21; round <= 25; round++ {
+		write(round)
+	}
+	check(stx, 0)
+	stx.Rollback()
+
+	// then its pages are reused
+	write(26)
+	pages := db.Stats().Pages
+	for round := 27; round <= 50; round++ {
+		write(round)
+	}
+	if got := db.Stats().Pages; got != pages {
+		t.Fatalf("%d pages after the snapshot was deleted, then %d", pages, got)
+	}
+}
@@ -0,0 +1,961 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A small SQL front end for the tables (see table.go). It knows one statement at a time:
+//
+//	CREATE TABLE t (a INT64, b STRING, c BYTES, d BOOL, PRIMARY KEY (a, b))
+//	CREATE TABLE t (a INT64 PRIMARY KEY, b STRING)
+//	INSERT INTO t [(a, b, ...)] VALUES (1, 'x', ...), ...
+//	SELECT * | a, b, ... FROM t [WHERE ...] [LIMIT n]
+//	UPDATE t SET b = 'y', ... [WHERE ...]
+//	DELETE FROM t [WHERE ...]
+//
+// A WHERE clause is comparisons of columns with literals, =, !=, <>, <, <=, > and >=, joined
+// with AND. The literals are integers, 'strings' with '' for a quote, x'hex' bytes, and TRUE and
+// FALSE, and a string is also accepted for a BYTES column. The keywords and the types are case
+// insensitive, INT, INTEGER and BIGINT are INT64, TEXT and VARCHAR are STRING, BLOB is BYTES.
+//
+// The primary key is the index of a table, so the rows are scanned in its order: the equalities
+// on its first columns and the comparisons on the column after them narrow the scan to a range
+// of keys, like a prefix of a composite index. The other conditions filter the scanned rows.
+// UPDATE can't change the primary key, and the rows of UPDATE and DELETE are read before any
+// of them is written.
+
+// the kinds of SQL tokens
+const (
+	SQL_EOF    = iota
+	SQL_IDENT  // identifiers and keywords
+	SQL_NUMBER // integers
+	SQL_STRING // 'quoted'
+	SQL_BYTES  // x'hex'
+	SQL_PUNCT  // ( ) , * ; and the comparisons
+)
+
+// sqlTypes are the names of the column types
+var sqlTypes = map[string]ColumnType{
+	"INT64": TYPE_INT64, "INT": TYPE_INT64, "INTEGER": TYPE_INT64, "BIGINT": TYPE_INT64,
+	"BYTES": TYPE_BYTES, "BLOB": TYPE_BYTES,
+	"STRING": TYPE_STRING, "TEXT": TYPE_STRING, "VARCHAR": TYPE_STRING,
+	"BOOL": TYPE_BOOL, "BOOLEAN": TYPE_BOOL,
+}
+
+// SQLResult is the result of a statement, see Tx.Exec.
+type SQLResult struct {
+	Columns  []string  // the columns selected by SELECT
+	Rows     [][]Value // the rows selected by SELECT, in the order of the primary key
+	Affected int       // the number of rows inserted, updated or deleted
+}
+
+type sqlToken struct {
+	kind int
+	text string // the bytes of SQL_BYTES and the unquoted SQL_STRING
+}
+
+// sqlCond is a comparison of a column with a literal in a WHERE or SET clause.
+type sqlCond struct {
+	col string
+	op  string
+	lit sqlToken
+}
+
+// sqlStmt is a parsed statement.
+type sqlStmt struct {
+	verb  string // CREATE, INSERT, SELECT, UPDATE or DELETE
+	table string
+	def   *TableDef    // CREATE
+	cols  []string     // INSERT and SELECT, nil for all of them
+	rows  [][]sqlToken // INSERT
+	set   []sqlCond    // UPDATE, with op =
+	where []sqlCond
+	limit int // SELECT, -1 if there is none
+}
+
+// sqlFilter is a condition of a WHERE clause, for the columns of a table.
+type sqlFilter struct {
+	pos int
+	op  string
+	val Value
+}
+
+// Exec parses a statement and executes it in the transaction, see above.
+// Only SELECT works in a read-only transaction.
+func (tx *Tx) Exec(query string) (*SQLResult, error) {
+	stmt, err := sqlParse(query)
+	if err != nil {
+		return nil, err
+	}
+	return tx.exec(stmt)
+}
+
+func (tx *Tx) exec(stmt *sqlStmt) (*SQLResult, error) {
+	if stmt.verb == "CREATE" {
+		_, err := tx.CreateTable(stmt.def)
+		return &SQLResult{}, err
+	}
+	t, err := tx.Table(stmt.table)
+	if err != nil {
+		return nil, err
+	}
+	switch stmt.verb {
+	case "INSERT":
+		return tx.sqlInsert(t, stmt)
+	case "SELECT":
+		return tx.sqlSelect(t, stmt)
+	case "UPDATE":
+		return tx.sqlUpdate(t, stmt)
+	}
+	return tx.sqlDelete(t, stmt)
+}
+
+func (tx *Tx) sqlInsert(t *Table, stmt *sqlStmt) (*SQLResult, error) {
+	cols := stmt.cols
+	if cols == nil {
+		for _, col := range t.def.Columns {
+			cols = append(cols, col.Name)
+		}
+	}
+	pos, err := sqlColumns(t.def, cols)
+	if err != nil {
+		return nil, err
+	}
+	res := &SQLResult{}
+	for _, lits := range stmt.rows {
+		if len(lits) != len(cols) {
+			return nil, fmt.Errorf("%w: %d values for %d columns", ErrBadRecord, len(lits), len(cols))
+		}
+		var rec Record
+		for i, lit := range lits {
+			v, err := sqlValue(t.def.Columns[pos[i]], lit)
+			if err != nil {
+				return nil, err
+			}
+			rec.Add(cols[i], v)
+		}
+		ok, err := t.Insert(rec)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: table %q, row %d", ErrRowExists, t.def.Name, res.Affected+1)
+		}
+		res.Affected++
+	}
+	return res, nil
+}
+
+func (tx *Tx) sqlSelect(t *Table, stmt *sqlStmt) (*SQLResult, error) {
+	res := &SQLResult{Columns: stmt.cols}
+	if res.Columns == nil {
+		for _, col := range t.def.Columns {
+			res.Columns = append(res.Columns, col.Name)
+		}
+	}
+	pos, err := sqlColumns(t.def, res.Columns)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := sqlRows(t, stmt.where, stmt.limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		out := make([]Value, len(pos))
+		for i, p := range pos {
+			out[i] = row[p]
+		}
+		res.Rows = append(res.Rows, out)
+	}
+	return res, nil
+}
+
+func (tx *Tx) sqlUpdate(t *Table, stmt *sqlStmt) (*SQLResult, error) {
+	sets := make([]sqlFilter, len(stmt.set))
+	for i, set := range stmt.set {
+		f, err := sqlFilterOf(t.def, set)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range t.def.pkey {
+			if p == f.pos {
+				return nil, fmt.Errorf("%w: can't update %q of the primary key", ErrBadRecord, set.col)
+			}
+		}
+		sets[i] = f
+	}
+	rows, err := sqlRows(t, stmt.where, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for _, set := range sets {
+			row[set.pos] = set.val
+		}
+		if _, err := t.Update(t.def.record(row)); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLResult{Affected: len(rows)}, nil
+}
+
+func (tx *Tx) sqlDelete(t *Table, stmt *sqlStmt) (*SQLResult, error) {
+	rows, err := sqlRows(t, stmt.where, -1)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if _, err := t.Delete(t.def.record(row)); err != nil {
+			return nil, err
+		}
+	}
+	return &SQLResult{Affected: len(rows)}, nil
+}
+
+// sqlRows returns the rows of a table that match a WHERE clause, at most limit unless it's -1.
+func sqlRows(t *Table, where []sqlCond, limit int) ([][]Value, error) {
+	filters := make([]sqlFilter, len(where))
+	for i, cond := range where {
+		f, err := sqlFilterOf(t.def, cond)
+		if err != nil {
+			return nil, err
+		}
+		filters[i] = f
+	}
+	lo, hi, err := sqlRange(t.def, filters)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]Value
+	err = t.scan(lo, hi, func(row []Value) bool {
+		if limit >= 0 && len(rows) >= limit {
+			return false
+		}
+		for _, f := range filters {
+			if !f.match(row) {
+				return true
+			}
+		}
+		rows = append(rows, row)
+		return true
+	})
+	return rows, err
+}
+
+// sqlRange returns the range of keys [lo, hi) that holds all the rows that can match the
+// filters, see above. The longer keys that start with a tuple go on with the tag of another
+// element, which is less than 0xff, so the tuple and 0xff is after all of them.
+func sqlRange(def *TableDef, filters []sqlFilter) ([]byte, []byte, error) {
+	var prefix []any
+	for _, pos := range def.pkey {
+		n := len(prefix)
+		for _, f := range filters {
+			if f.pos == pos && f.op == "=" {
+				prefix = append(prefix, f.val.elem())
+				break
+			}
+		}
+		if len(prefix) == n {
+			break
+		}
+	}
+	key, err := AppendTuple(nil, prefix...)
+	if err != nil {
+		return nil, nil, err
+	}
+	lo, hi := key, append(bytes.Clone(key), 0xff)
+	if len(prefix) == len(def.pkey) {
+		return lo, hi, nil
+	}
+	next := def.pkey[len(prefix)]
+	for _, f := range filters {
+		if f.pos != next {
+			continue
+		}
+		bound, err := AppendTuple(bytes.Clone(key), f.val.elem())
+		if err != nil {
+			return nil, nil, err
+		}
+		switch f.op {
+		case ">":
+			bound = append(bound, 0xff)
+			fallthrough
+		case ">=":
+			if bytes.Compare(bound, lo) > 0 {
+				lo = bound
+			}
+		case "<=":
+			bound = append(bound, 0xff)
+			fallthrough
+		case "<":
+			if bytes.Compare(bound, hi) < 0 {
+				hi = bound
+			}
+		}
+	}
+	return lo, hi, nil
+}
+
+// sqlFilterOf checks a condition against the columns of a table.
+func sqlFilterOf(def *TableDef, cond sqlCond) (sqlFilter, error) {
+	pos := def.column(cond.col)
+	if pos < 0 {
+		return sqlFilter{}, fmt.Errorf("%w: table %q has no column %q", ErrBadRecord, def.Name, cond.col)
+	}
+	val, err := sqlValue(def.Columns[pos], cond.lit)
+	return sqlFilter{pos: pos, op: cond.op, val: val}, err
+}
+
+// match reports whether a row matches the filter.
+func (f sqlFilter) match(row []Value) bool {
+	v := row[f.pos]
+	cmp := bytes.Compare(v.Bytes, f.val.Bytes)
+	if v.Type == TYPE_INT64 || v.Type == TYPE_BOOL {
+		cmp = 0
+		if v.Int < f.val.Int {
+			cmp = -1
+		} else if v.Int > f.val.Int {
+			cmp = 1
+		}
+	}
+	switch f.op {
+	case "=":
+		return cmp == 0
+	case "!=", "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// sqlColumns returns the positions of the named columns of a table.
+func sqlColumns(def *TableDef, cols []string) ([]int, error) {
+	pos := make([]int, len(cols))
+	for i, col := range cols {
+		if pos[i] = def.column(col); pos[i] < 0 {
+			return nil, fmt.Errorf("%w: table %q has no column %q", ErrBadRecord, def.Name, col)
+		}
+	}
+	return pos, nil
+}
+
+// sqlValue converts a literal to a value of the type of a column.
+func sqlValue(col Column, lit sqlToken) (Value, error) {
+	switch {
+	case col.Type == TYPE_INT64 && lit.kind == SQL_NUMBER:
+		v, err := strconv.ParseInt(lit.text, 10, 64)
+		if err == nil {
+			return Int64Value(v), nil
+		}
+	case col.Type == TYPE_BOOL && lit.kind == SQL_IDENT && (strings.EqualFold(lit.text, "TRUE") || strings.EqualFold(lit.text, "FALSE")):
+		return BoolValue(strings.EqualFold(lit.text, "TRUE")), nil
+	case col.Type == TYPE_STRING && lit.kind == SQL_STRING:
+		return StringValue(lit.text), nil
+	case col.Type == TYPE_BYTES && (lit.kind == SQL_STRING || lit.kind == SQL_BYTES):
+		return BytesValue([]byte(lit.text)), nil
+	}
+	return Value{}, fmt.Errorf("%w: %q is not a valid %v for column %q", ErrBadRecord, lit.text, col.Type, col.Name)
+}
+
+// jsonValue returns the value as encoded by encoding/json: a number, a boolean,
+// a string, or base64 for TYPE_BYTES.
+func (v Value) jsonValue() any {
+	switch v.Type {
+	case TYPE_INT64:
+		return v.Int
+	case TYPE_BOOL:
+		return v.Int != 0
+	case TYPE_STRING:
+		return string(v.Bytes)
+	}
+	return v.Bytes
+}
+
+// String returns the value as a SQL literal.
+func (v Value) String() string {
+	switch v.Type {
+	case TYPE_INT64:
+		return strconv.FormatInt(v.Int, 10)
+	case TYPE_BOOL:
+		if v.Int != 0 {
+			return "TRUE"
+		}
+		return "FALSE"
+	case TYPE_STRING:
+		return "'" + strings.ReplaceAll(string(v.Bytes), "'", "''") + "'"
+	}
+	return "x'" + hex.EncodeToString(v.Bytes) + "'"
+}
+
+// sqlLex splits a statement into tokens.
+func sqlLex(src string) ([]sqlToken, error) {
+	isIdent := func(c byte) bool {
+		return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+	}
+	isDigit := func(c byte) bool { return '0' <= c && c <= '9' }
+	var toks []sqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || (c == 'x' || c == 'X') && i+1 < len(src) && src[i+1] == '\'':
+			kind := SQL_STRING
+			if c != '\'' {
+				kind, i = SQL_BYTES, i+1
+			}
+			var text strings.Builder
+			j := i + 1
+			for ; j < len(src); j++ {
+				if src[j] == '\'' {
+					if j+1 < len(src) && src[j+1] == '\'' {
+						j++
+					} else {
+						break
+					}
+				}
+				text.WriteByte(src[j])
+			}
+			if j == len(src) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrSyntax)
+			}
+			tok := sqlToken{kind: kind, text: text.String()}
+			if kind == SQL_BYTES {
+				b, err := hex.DecodeString(tok.text)
+				if err != nil {
+					return nil, fmt.Errorf("%w: bad hex literal x'%s'", ErrSyntax, tok.text)
+				}
+				tok.text = string(b)
+			}
+			toks = append(toks, tok)
+			i = j + 1
+		case isDigit(c) || c == '-' && i+1 < len(src) && isDigit(src[i+1]):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{kind: SQL_NUMBER, text: src[i:j]})
+			i = j
+		case isIdent(c):
+			j := i
+			for j < len(src) && isIdent(src[j]) {
+				j++
+			}
+			toks = append(toks, sqlToken{kind: SQL_IDENT, text: src[i:j]})
+			i = j
+		default:
+			n := 0
+			for _, p := range []string{"<=", ">=", "!=", "<>", "(", ")", ",", "*", ";", "=", "<", ">"} {
+				if strings.HasPrefix(src[i:], p) {
+					n = len(p)
+					break
+				}
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("%w: unexpected %q", ErrSyntax, c)
+			}
+			toks = append(toks, sqlToken{kind: SQL_PUNCT, text: src[i : i+n]})
+			i += n
+		}
+	}
+	return toks, nil
+}
+
+// sqlParser is a recursive descent parser of the statements, see above.
+type sqlParser struct {
+	toks []sqlToken
+	pos  int
+}
+
+// sqlParse parses a statement, which can end with a semicolon.
+func sqlParse(query string) (*sqlStmt, error) {
+	toks, err := sqlLex(query)
+	if err != nil {
+		return nil, err
+	}
+	return sqlParseTokens(toks)
+}
+
+// sqlParseScript parses the statements of a script, separated by semicolons.
+func sqlParseScript(src string) ([]*sqlStmt, error) {
+	toks, err := sqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	var stmts []*sqlStmt
+	for len(toks) > 0 {
+		n := 0
+		for n < len(toks) && !(toks[n].kind == SQL_PUNCT && toks[n].text == ";") {
+			n++
+		}
+		if n > 0 {
+			stmt, err := sqlParseTokens(toks[:n])
+			if err != nil {
+				return nil, fmt.Errorf("statement %d: %w", len(stmts)+1, err)
+			}
+			stmts = append(stmts, stmt)
+		}
+		toks = toks[min(n+1, len(toks)):]
+	}
+	return stmts, nil
+}
+
+// sqlParseTokens parses the tokens of a statement.
+func sqlParseTokens(toks []sqlToken) (*sqlStmt, error) {
+	var err error
+	p := &sqlParser{toks: toks}
+	stmt := &sqlStmt{limit: -1}
+	switch {
+	case p.accept("CREATE"):
+		err = p.create(stmt)
+	case p.accept("INSERT"):
+		err = p.insert(stmt)
+	case p.accept("SELECT"):
+		err = p.selectFrom(stmt)
+	case p.accept("UPDATE"):
+		err = p.update(stmt)
+	case p.accept("DELETE"):
+		err = p.deleteFrom(stmt)
+	default:
+		err = p.fail("CREATE, INSERT, SELECT, UPDATE or DELETE")
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.accept(";")
+	if p.peek().kind != SQL_EOF {
+		return nil, p.fail("the end of the statement")
+	}
+	return stmt, nil
+}
+
+func (p *sqlParser) peek() sqlToken {
+	if p.pos == len(p.toks) {
+		return sqlToken{kind: SQL_EOF}
+	}
+	return p.toks[p.pos]
+}
+
+// accept consumes the next token if it's the given keyword or punctuation.
+func (p *sqlParser) accept(text string) bool {
+	tok := p.peek()
+	if tok.kind == SQL_IDENT && strings.EqualFold(tok.text, text) || tok.kind == SQL_PUNCT && tok.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *sqlParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.fail(text)
+	}
+	return nil
+}
+
+func (p *sqlParser) fail(expected string) error {
+	tok := p.peek()
+	if tok.kind == SQL_EOF {
+		return fmt.Errorf("%w: expected %s at the end of the statement", ErrSyntax, expected)
+	}
+	return fmt.Errorf("%w: expected %s, found %q", ErrSyntax, expected, tok.text)
+}
+
+func (p *sqlParser) ident() (string, error) {
+	tok := p.peek()
+	if tok.kind != SQL_IDENT {
+		return "", p.fail("a name")
+	}
+	p.pos++
+	return tok.text, nil
+}
+
+// idents parses a list of names separated by commas.
+func (p *sqlParser) idents() ([]string, error) {
+	var names []string
+	for {
+		name, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+		if !p.accept(",") {
+			return names, nil
+		}
+	}
+}
+
+func (p *sqlParser) literal() (sqlToken, error) {
+	tok := p.peek()
+	if tok.kind == SQL_EOF || tok.kind == SQL_PUNCT || tok.kind == SQL_IDENT &&
+		!strings.EqualFold(tok.text, "TRUE") && !strings.EqualFold(tok.text, "FALSE") {
+		return sqlToken{}, p.fail("a value")
+	}
+	p.pos++
+	return tok, nil
+}
+
+// CREATE TABLE t (col type [PRIMARY KEY], ..., [PRIMARY KEY (col, ...)])
+func (p *sqlParser) create(stmt *sqlStmt) error {
+	stmt.verb = "CREATE"
+	if err := p.expect("TABLE"); err != nil {
+		return err
+	}
+	def := &TableDef{}
+	name, err := p.ident()
+	if err != nil {
+		return err
+	}
+	def.Name = name
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for {
+		if p.accept("PRIMARY") {
+			if err := p.expect("KEY"); err != nil {
+				return err
+			}
+			if err := p.expect("("); err != nil {
+				return err
+			}
+			if def.PKey, err = p.idents(); err != nil {
+				return err
+			}
+			if err := p.expect(")"); err != nil {
+				return err
+			}
+		} else {
+			col, err := p.ident()
+			if err != nil {
+				return err
+			}
+			typ := p.peek()
+			if typ.kind != SQL_IDENT || sqlTypes[strings.ToUpper(typ.text)] == 0 {
+				return p.fail("a column type")
+			}
+			p.pos++
+			def.Columns = append(def.Columns, Column{Name: col, Type: sqlTypes[strings.ToUpper(typ.text)]})
+			if p.accept("PRIMARY") {
+				if err := p.expect("KEY"); err != nil {
+					return err
+				}
+				def.PKey = append(def.PKey, col)
+			}
+		}
+		if !p.accept(",") {
+			break
+		}
+	}
+	stmt.def, stmt.table = def, def.Name
+	return p.expect(")")
+}
+
+// INSERT INTO t [(col, ...)] VALUES (val, ...), ...
+func (p *sqlParser) insert(stmt *sqlStmt) error {
+	stmt.verb = "INSERT"
+	if err := p.expect("INTO"); err != nil {
+		return err
+	}
+	var err error
+	if stmt.table, err = p.ident(); err != nil {
+		return err
+	}
+	if p.accept("(") {
+		if stmt.cols, err = p.idents(); err != nil {
+			return err
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+	}
+	if err := p.expect("VALUES"); err != nil {
+		return err
+	}
+	for {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		var row []sqlToken
+		for {
+			lit, err := p.literal()
+			if err != nil {
+				return err
+			}
+			row = append(row, lit)
+			if !p.accept(",") {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return err
+		}
+		stmt.rows = append(stmt.rows, row)
+		if !p.accept(",") {
+			return nil
+		}
+	}
+}
+
+// SELECT * | col, ... FROM t [WHERE ...] [LIMIT n]
+func (p *sqlParser) selectFrom(stmt *sqlStmt) error {
+	stmt.verb = "SELECT"
+	var err error
+	if !p.accept("*") {
+		if stmt.cols, err = p.idents(); err != nil {
+			return err
+		}
+	}
+	if err := p.expect("FROM"); err != nil {
+		return err
+	}
+	if stmt.table, err = p.ident(); err != nil {
+		return err
+	}
+	if err := p.where(stmt); err != nil {
+		return err
+	}
+	if p.accept("LIMIT") {
+		tok := p.peek()
+		n, err := strconv.Atoi(tok.text)
+		if tok.kind != SQL_NUMBER || err != nil || n < 0 {
+			return p.fail("a limit")
+		}
+		p.pos++
+		stmt.limit = n
+	}
+	return nil
+}
+
+// UPDATE t SET col = val, ... [WHERE ...]
+func (p *sqlParser) update(stmt *sqlStmt) error {
+	stmt.verb = "UPDATE"
+	var err error
+	if stmt.table, err = p.ident(); err != nil {
+		return err
+	}
+	if err := p.expect("SET"); err != nil {
+		return err
+	}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return err
+		}
+		if err := p.expect("="); err != nil {
+			return err
+		}
+		lit, err := p.literal()
+		if err != nil {
+			return err
+		}
+		stmt.set = append(stmt.set, sqlCond{col: col, op: "=", lit: lit})
+		if !p.accept(",") {
+			break
+		}
+	}
+	return p.where(stmt)
+}
+
+// DELETE FROM t [WHERE ...]
+func (p *sqlParser) deleteFrom(stmt *sqlStmt) error {
+	stmt.verb = "DELETE"
+	if err := p.expect("FROM"); err != nil {
+		return err
+	}
+	var err error
+	if stmt.table, err = p.ident(); err != nil {
+		return err
+	}
+	return p.where(stmt)
+}
+
+// [WHERE col op val [AND ...]]
+func (p *sqlParser) where(stmt *sqlStmt) error {
+	if !p.accept("WHERE") {
+		return nil
+	}
+	for {
+		col, err := p.ident()
+		if err != nil {
+			return err
+		}
+		op := p.peek()
+		if op.kind != SQL_PUNCT || !strings.Contains(" = != <> < <= > >= ", " "+op.text+" ") {
+			return p.fail("a comparison")
+		}
+		p.pos++
+		lit, err := p.literal()
+		if err != nil {
+			return err
+		}
+		stmt.where = append(stmt.where, sqlCond{col: col, op: op.text, lit: lit})
+		if !p.accept("AND") {
+			return nil
+		}
+	}
+}
+
+// readOnly reports whether a statement only reads, so it can run in a read-only transaction.
+func (stmt *sqlStmt) readOnly() bool {
+	return stmt.verb == "SELECT"
+}
+
+// printSQL prints the result of a statement, the rows of SELECT as tab separated literals.
+func printSQL(w io.Writer, stmt *sqlStmt, res *SQLResult) {
+	switch stmt.verb {
+	case "SELECT":
+		fmt.Fprintln(w, strings.Join(res.Columns, "\t"))
+		for _, row := range res.Rows {
+			vals := make([]string, len(row))
+			for i, v := range row {
+				vals[i] = v.String()
+			}
+			fmt.Fprintln(w, strings.Join(vals, "\t"))
+		}
+	case "CREATE":
+		fmt.Fprintf(w, "table %s created\n", stmt.table)
+	default:
+		fmt.Fprintf(w, "%d rows\n", res.Affected)
+	}
+}
+
+// cmdSQL implements `scratch-db sql -db <file> <statement>`.
+func cmdSQL(args []string) error {
+	fs := flag.NewFlagSet("sql", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 1 {
+		return errors.New("usage: scratch-db sql -db <file> <statement>")
+	}
+	stmt, err := sqlParse(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin(!stmt.readOnly())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.exec(stmt)
+	if err != nil {
+		return err
+	}
+	if !stmt.readOnly() {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	printSQL(os.Stdout, stmt, res)
+	return nil
+}
+
+// cmdExec implements `scratch-db exec -db <file> [-f script.sql] [-json]`, for scripts and cron jobs.
+// The script is read from stdin without -f or with -f -. Its statements run in one transaction,
+// see execScript. The exit status is 0 on success, 1 if a statement failed or the database can't
+// be opened, and 2 for bad arguments or a script that doesn't parse, when nothing ran.
+func cmdExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	path := fs.String("db", "", "database file")
+	file := fs.String("f", "-", "the script, - for stdin")
+	asJSON := fs.Bool("json", false, "print the results as a JSON array")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 0 {
+		return &exitError{2, errors.New("usage: scratch-db exec -db <file> [-f script.sql] [-json]")}
+	}
+	var src []byte
+	var err error
+	if *file == "-" {
+		src, err = io.ReadAll(os.Stdin)
+	} else {
+		src, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return &exitError{2, err}
+	}
+	stmts, err := sqlParseScript(string(src))
+	if err != nil {
+		return &exitError{2, err}
+	}
+	db := &KV{Path: *path}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+	return execScript(db, stmts, os.Stdout, *asJSON)
+}
+
+// execScript runs statements in one transaction, which is only committed if all of them
+// succeed, and then prints their results like sql, or as a JSON array of sqlJSON.
+func execScript(db *KV, stmts []*sqlStmt, w io.Writer, asJSON bool) error {
+	writable := false
+	for _, stmt := range stmts {
+		writable = writable || !stmt.readOnly()
+	}
+	tx, err := db.Begin(writable)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	results := make([]*SQLResult, len(stmts))
+	for i, stmt := range stmts {
+		if results[i], err = tx.exec(stmt); err != nil {
+			return fmt.Errorf("statement %d: %w", i+1, err)
+		}
+	}
+	if writable {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	if !asJSON {
+		for i, stmt := range stmts {
+			printSQL(w, stmt, results[i])
+		}
+		return nil
+	}
+	out := make([]sqlJSON, len(stmts))
+	for i, stmt := range stmts {
+		out[i] = sqlJSON{Verb: stmt.verb, Table: stmt.table, Affected: results[i].Affected}
+		if stmt.verb == "SELECT" {
+			out[i].Columns = results[i].Columns
+			out[i].Rows = make([][]any, len(results[i].Rows))
+			for j, row := range results[i].Rows {
+				out[i].Rows[j] = make([]any, len(row))
+				for k, v := range row {
+					out[i].Rows[j][k] = v.jsonValue()
+				}
+			}
+		}
+	}
+	return json.NewEncoder(w).Encode(out)
+}
+
+// sqlJSON is the result of a statement printed by exec -json.
+// Columns and Rows are null for the statements other than SELECT.
+type sqlJSON struct {
+	Verb     string   `json:"verb"`
+	Table    string   `json:"table"`
+	Columns  []string `json:"columns"`
+	Rows     [][]any  `json:"rows"`
+	Affected int      `json:"affected"`
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestSQLParseScript(t *testing.T) {
+	stmts, err := sqlParseScript("CREATE TABLE t (a INT64 PRIMARY KEY, b STRING);\n\nINSERT INTO t VALUES (1, 'a;b');;SELECT * FROM t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verbs []string
+	for _, stmt := range stmts {
+		verbs = append(verbs, stmt.verb)
+	}
+	if len(verbs) != 3 || verbs[0] != "CREATE" || verbs[1] != "INSERT" || verbs[2] != "SELECT" {
+		t.Fatalf("parsed %v", verbs)
+	}
+	if _, err := sqlParseScript("SELECT * FROM t; SELECT FROM t"); !errors.Is(err, ErrSyntax) {
+		t.Fatal(err)
+	}
+}
+
+func TestExecScript(t *testing.T) {
+	db := &KV{Path: t.TempDir() + "/db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	exec := func(src string, asJSON bool) (string, error) {
+		t.Helper()
+		stmts, err := sqlParseScript(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = execScript(db, stmts, &out, asJSON)
+		return out.String(), err
+	}
+
+	out, err := exec("CREATE TABLE t (a INT64 PRIMARY KEY, b STRING, c BOOL, d BYTES); INSERT INTO t VALUES (1, 'x', TRUE, x'00ff')", false)
+	if err != nil || out != "table t created\n1 rows\n" {
+		t.Fatalf("printed %q, %v", out, err)
+	}
+	// a failed statement rolls the script back, and nothing is printed
+	out, err = exec("INSERT INTO t VALUES (2, 'y', FALSE, 'z'); INSERT INTO t VALUES (1, 'x', TRUE, 'z')", false)
+	if !errors.Is(err, ErrRowExists) || out != "" {
+		t.Fatalf("printed %q, %v", out, err)
+	}
+
+	out, err = exec("SELECT * FROM t; UPDATE t SET b = 'w' WHERE a = 1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []sqlJSON
+	if err := json.Unmarshal([]byte(out), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := `[{"verb":"SELECT","table":"t","columns":["a","b","c","d"],"rows":[[1,"x",true,"AP8="]],"affected":0},` +
+		`{"verb":"UPDATE","table":"t","columns":null,"rows":null,"affected":1}]` + "\n"
+	if len(got) != 2 || out != want {
+		t.Fatalf("printed %s, want %s", out, want)
+	}
+}
+
+// The conditions on the primary key narrow the scan to the rows that can match,
+// the others filter the scanned rows.
+func TestSQLRange(t *testing.T) {
+	db := openTest(t, &KV{})
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("CREATE TABLE t (a INT64, b STRING, c INT64, PRIMARY KEY (a, b))"); err != nil {
+		t.Fatal(err)
+	}
+	type row struct {
+		a int
+		b string
+		c int
+	}
+	var rows []row
+	for a := -2; a < 8; a++ {
+		for _, b := range []string{"", "a", "ab", "b", "c"} {
+			r := row{a, b, len(rows) % 3}
+			rows = append(rows, r)
+			if _, err := tx.Exec(fmt.Sprintf("INSERT INTO t VALUES (%d, '%s', %d)", r.a, r.b, r.c)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	table, err := tx.Table("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		where   string
+		match   func(r row) bool
+		scanned int // the rows in the range of keys
+	}{
+		{"", func(r row) bool { return true }, 50},
+		{"a = 3", func(r row) bool { return r.a == 3 }, 5},
+		{"a = -1", func(r row) bool { return r.a == -1 }, 5},
+		{"a = 3 AND b = 'ab'", func(r row) bool { return r.a == 3 && r.b == "ab" }, 1},
+		{"b = 'ab' AND a = 3", func(r row) bool { return r.a == 3 && r.b == "ab" }, 1},
+		{"a = 3 AND b > 'a'", func(r row) bool { return r.a == 3 && r.b > "a" }, 3},
+		{"a = 3 AND b >= 'a' AND b < 'b'", func(r row) bool { return r.a == 3 && r.b >= "a" && r.b < "b" }, 2},
+		{"a = 3 AND b <= 'a'", func(r row) bool { return r.a == 3 && r.b <= "a" }, 2},
+		{"a > 5", func(r row) bool { return r.a > 5 }, 10},
+		{"a >= 0 AND a < 2", func(r row) bool { return r.a >= 0 && r.a < 2 }, 10},
+		{"a <= -1", func(r row) bool { return r.a <= -1 }, 10},
+		{"a > 5 AND a < 5", func(r row) bool { return false }, 0},
+		// b is not narrowed without an equality on a, c and != never are
+		{"b = 'a'", func(r row) bool { return r.b == "a" }, 50},
+		{"a = 3 AND c = 1", func(r row) bool { return r.a == 3 && r.c == 1 }, 5},
+		{"a = 3 AND b != 'a'", func(r row) bool { return r.a == 3 && r.b != "a" }, 5},
+		{"a != 3 AND a > 4", func(r row) bool { return r.a != 3 && r.a > 4 }, 15},
+	}
+	for _, test := range tests {
+		query := "SELECT a, b FROM t"
+		if test.where != "" {
+			query += " WHERE " + test.where
+		}
+		res, err := tx.Exec(query)
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		var got, want []string
+		for _, r := range res.Rows {
+			got = append(got, fmt.Sprintf("%d/%s", r[0].Int, r[1].Bytes))
+		}
+		for _, r := range rows {
+			if test.match(r) {
+				want = append(want, fmt.Sprintf("%d/%s", r.a, r.b))
+			}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: %v, want %v", query, got, want)
+		}
+
+		stmt, err := sqlParse(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var filters []sqlFilter
+		for _, cond := range stmt.where {
+			f, err := sqlFilterOf(table.def, cond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filters = append(filters, f)
+		}
+		lo, hi, err := sqlRange(table.def, filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned := 0
+		if err := table.scan(lo, hi, func([]Value) bool { scanned++; return true }); err != nil {
+			t.Fatal(err)
+		}
+		if scanned != test.scanned {
+			t.Fatalf("%s: scanned %d rows, want %d", query, scanned, test.scanned)
+		}
+	}
+
+	if res, err := tx.Exec("SELECT * FROM t WHERE a = 1 LIMIT 2"); err != nil || len(res.Rows) != 2 || len(res.Columns) != 3 {
+		t.Fatalf("LIMIT: %+v, %v", res, err)
+	}
+	if res, err := tx.Exec("UPDATE t SET c = 9 WHERE a = 1 AND b > ''"); err != nil || res.Affected != 4 {
+		t.Fatalf("UPDATE: %+v, %v", res, err)
+	}
+	if res, err := tx.Exec("DELETE FROM t WHERE c = 9"); err != nil || res.Affected != 4 {
+		t.Fatalf("DELETE: %+v, %v", res, err)
+	}
+	if res, err := tx.Exec("SELECT * FROM t WHERE a = 1"); err != nil || len(res.Rows) != 1 {
+		t.Fatalf("after the DELETE: %+v, %v", res, err)
+	}
+	if _, err := tx.Exec("SELECT * FROM t WHERE d = 1"); !errors.Is(err, ErrBadRecord) {
+		t.Fatalf("a condition on a missing column: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// OpenBytes opens a database from the contents of its file in memory, such as a dataset
+// shipped inside the binary with go:embed:
+//
+//	//go:embed cities.db
+//	var cities []byte
+//
+//	db := &KV{}
+//	err := db.OpenBytes(cities)
+//
+// The database is read-only, Begin(true) returns ErrReadOnly. The data is used in place,
+// it must not be modified until the KV is closed. Only the main file is read, so a
+// database in WAL mode must be checkpointed before it's copied. db.Path is not used.
+func (db *KV) OpenBytes(data []byte) error {
+	if db.WAL {
+		return fmt.Errorf("KV.OpenBytes: WAL mode: %w", ErrReadOnly)
+	}
+	if len(data) > 0 && len(data) < BTREE_MIN_PAGE_SIZE {
+		return fmt.Errorf("KV.OpenBytes: %d bytes are too short for a database", len(data))
+	}
+	// an empty database stays empty since it can't be written
+	if err := openStatic(db, data, len(data)); err != nil {
+		db.Close()
+		return fmt.Errorf("KV.OpenBytes: %w", err)
+	}
+	return nil
+}
+
+// openStatic sets up a read-only database of the given file size whose file starts with data,
+// which must contain at least the master page.
+func openStatic(db *KV, data []byte, size int) error {
+	db.static = true
+	db.constrain()
+	db.jobs = newScheduler(db.MaxJobs, db.JobPageRate, db.Constrained)
+	db.mmap.file = size
+	db.mmap.total = len(data)
+	db.mmap.chunks = [][]byte{data}
+	db.readers = map[uint64]int{}
+	db.page.updates = map[uint64][]byte{}
+	return masterLoad(db)
+}
+
+// OpenFS opens the named database file in fsys like OpenBytes, for example from an embed.FS.
+// The file is read into memory.
+func (db *KV) OpenFS(fsys fs.FS, name string) error {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return fmt.Errorf("KV.OpenFS: %w", err)
+	}
+	return db.OpenBytes(data)
+}
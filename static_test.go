@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOpenBytes(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *KV) {
+		t.Helper()
+		defer db.Close()
+		val, ok, err := db.Get([]byte("key0999"))
+		if err != nil || !ok || string(val) != "999" {
+			t.Fatalf("key0999 = %q, %v, %v", val, ok, err)
+		}
+		if err := db.Set([]byte("a"), nil); !errors.Is(err, ErrReadOnly) {
+			t.Fatalf("Set: %v", err)
+		}
+	}
+	db = &KV{}
+	if err := db.OpenBytes(data); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+	db = &KV{}
+	if err := db.OpenFS(fstest.MapFS{"data/cities.db": {Data: data}}, "data/cities.db"); err != nil {
+		t.Fatal(err)
+	}
+	check(db)
+
+	if err := (&KV{}).OpenBytes(data[:100]); err == nil {
+		t.Fatal("OpenBytes accepted 100 bytes")
+	}
+	if err := (&KV{}).OpenFS(fstest.MapFS{}, "missing.db"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("OpenFS of a missing file: %v", err)
+	}
+	empty := &KV{}
+	if err := empty.OpenBytes(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if _, ok, err := empty.Get([]byte("a")); ok || err != nil {
+		t.Fatalf("Get on an empty database: %v, %v", ok, err)
+	}
+}
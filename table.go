@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Tables are a typed layer on top of the buckets (see bucket.go), like the storage engine of a
+// relational database. A table has named columns of the TYPE_* types, and some of them are the
+// primary key. Each row is a KV pair in the bucket of the table, TABLE_BUCKET_PREFIX and the name:
+// the key is the primary key, the value the other columns in the order of the definition.
+//
+// The primary key is encoded as a tuple (see tuple.go), so that the rows sort by it, column by
+// column. In the value, an int64 is a varint, a bool a byte, and bytes and strings are a uvarint
+// length and the bytes.
+//
+// The definitions are in the TABLE_DEFS_BUCKET bucket, by name:
+// | ncols | type | nlen | name | ... | npkey | pkey ... |
+// | uvar  | 1B   | uvar | ...  | ... | uvar  | uvar ... |
+// where pkey are the positions of the columns of the primary key.
+
+const (
+	TABLE_DEFS_BUCKET   = "@tables"
+	TABLE_BUCKET_PREFIX = "@table:"
+)
+
+// ColumnType is the type of a column, TYPE_*.
+type ColumnType uint8
+
+const (
+	TYPE_INT64  ColumnType = 1
+	TYPE_BYTES  ColumnType = 2
+	TYPE_STRING ColumnType = 3
+	TYPE_BOOL   ColumnType = 4
+)
+
+// String returns the name of the type, as in SQL (see sql.go).
+func (typ ColumnType) String() string {
+	switch typ {
+	case TYPE_INT64:
+		return "INT64"
+	case TYPE_BYTES:
+		return "BYTES"
+	case TYPE_STRING:
+		return "STRING"
+	case TYPE_BOOL:
+		return "BOOL"
+	}
+	return fmt.Sprintf("ColumnType(%d)", uint8(typ))
+}
+
+// Column is a column of a TableDef.
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// TableDef defines a table, see Tx.CreateTable.
+type TableDef struct {
+	Name    string
+	Columns []Column
+	PKey    []string // the names of the columns of the primary key, in order
+	pkey    []int    // their positions in Columns
+}
+
+// Value is the value of a column in a Record.
+type Value struct {
+	Type  ColumnType
+	Int   int64  // TYPE_INT64, and TYPE_BOOL as 0 or 1
+	Bytes []byte // TYPE_BYTES and TYPE_STRING
+}
+
+// Int64Value returns a TYPE_INT64 value.
+func Int64Value(v int64) Value { return Value{Type: TYPE_INT64, Int: v} }
+
+// BytesValue returns a TYPE_BYTES value.
+func BytesValue(v []byte) Value { return Value{Type: TYPE_BYTES, Bytes: v} }
+
+// StringValue returns a TYPE_STRING value.
+func StringValue(v string) Value { return Value{Type: TYPE_STRING, Bytes: []byte(v)} }
+
+// BoolValue returns a TYPE_BOOL value.
+func BoolValue(v bool) Value {
+	if v {
+		return Value{Type: TYPE_BOOL, Int: 1}
+	}
+	return Value{Type: TYPE_BOOL}
+}
+
+// elem returns the value as an element of a tuple, see tuple.go.
+func (v Value) elem() any {
+	switch v.Type {
+	case TYPE_INT64:
+		return v.Int
+	case TYPE_BOOL:
+		return v.Int != 0
+	case TYPE_STRING:
+		return string(v.Bytes)
+	}
+	return v.Bytes
+}
+
+// Record is a row of a table, or a part of it, as columns and their values.
+type Record struct {
+	Cols []string
+	Vals []Value
+}
+
+// Add appends a column to the record and returns it, to chain the calls.
+func (rec *Record) Add(col string, val Value) *Record {
+	rec.Cols = append(rec.Cols, col)
+	rec.Vals = append(rec.Vals, val)
+	return rec
+}
+
+// Get returns the value of a column, nil if the record doesn't have it.
+func (rec *Record) Get(col string) *Value {
+	for i, c := range rec.Cols {
+		if c == col {
+			return &rec.Vals[i]
+		}
+	}
+	return nil
+}
+
+// Table is a table of a transaction, see Tx.Table. It's only valid within the transaction.
+type Table struct {
+	def    *TableDef
+	bucket *Bucket
+}
+
+// CreateTable creates a table and its bucket, or returns ErrTableExists.
+func (tx *Tx) CreateTable(def *TableDef) (*Table, error) {
+	if err := tx.check(true); err != nil {
+		return nil, err
+	}
+	if err := def.validate(); err != nil {
+		return nil, err
+	}
+	defs, err := tx.CreateBucketIfNotExists([]byte(TABLE_DEFS_BUCKET))
+	if err != nil {
+		return nil, err
+	}
+	_, ok, err := defs.Get([]byte(def.Name))
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, fmt.Errorf("%w: %q", ErrTableExists, def.Name)
+	}
+	if err := defs.Set([]byte(def.Name), def.encode()); err != nil {
+		return nil, err
+	}
+	bucket, err := tx.CreateBucket([]byte(TABLE_BUCKET_PREFIX + def.Name))
+	if err != nil {
+		return nil, err
+	}
+	return &Table{def: def, bucket: bucket}, nil
+}
+
+// Table returns the table with the given name, or ErrTableNotFound.
+func (tx *Tx) Table(name string) (*Table, error) {
+	defs, err := tx.Bucket([]byte(TABLE_DEFS_BUCKET))
+	if errors.Is(err, ErrBucketNotFound) {
+		return nil, fmt.Errorf("%w: %q", ErrTableNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, ok, err := defs.Get([]byte(name))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrTableNotFound, name)
+	}
+	def, err := tableDecode(name, val)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := tx.Bucket([]byte(TABLE_BUCKET_PREFIX + name))
+	if err != nil {
+		return nil, fmt.Errorf("table %q: %w", name, err)
+	}
+	return &Table{def: def, bucket: bucket}, nil
+}
+
+// Def returns the definition of the table.
+func (t *Table) Def() *TableDef {
+	return t.def
+}
+
+// Get looks up the row with the primary key of the record, and sets the other columns of the
+// record to the values of the row. It reports whether the row exists.
+func (t *Table) Get(rec *Record) (bool, error) {
+	key, err := t.def.encodeKey(rec)
+	if err != nil {
+		return false, err
+	}
+	val, ok, err := t.bucket.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	vals, err := t.def.decodeVal(val)
+	if err != nil {
+		return false, err
+	}
+	for i, pos := range t.def.others() {
+		col := t.def.Columns[pos]
+		if v := rec.Get(col.Name); v != nil {
+			*v = vals[i]
+		} else {
+			rec.Add(col.Name, vals[i])
+		}
+	}
+	return true, nil
+}
+
+// Insert adds a row with all the columns of the table, unless there is one with the same
+// primary key already, and reports whether it did.
+func (t *Table) Insert(rec Record) (bool, error) {
+	return t.set(rec, false)
+}
+
+// Update replaces the row with the primary key of the record, which has all the columns of
+// the table, if there is one, and reports whether it did.
+func (t *Table) Update(rec Record) (bool, error) {
+	return t.set(rec, true)
+}
+
+// Delete deletes the row with the primary key of the record and reports whether it existed.
+func (t *Table) Delete(rec Record) (bool, error) {
+	key, err := t.def.encodeKey(&rec)
+	if err != nil {
+		return false, err
+	}
+	return t.bucket.Del(key)
+}
+
+// scan calls fn with the values of the columns of each row whose key is in [lo, hi), in the
+// order of the definition, until fn returns false. The values are copied.
+func (t *Table) scan(lo []byte, hi []byte, fn func(row []Value) bool) error {
+	c := t.bucket.Seek(lo)
+	for ; c.Valid() && bytes.Compare(c.Key(), hi) < 0; c.Next() {
+		row, err := t.def.decodeRow(c.Key(), c.Val())
+		if err != nil {
+			return err
+		}
+		if !fn(row) {
+			break
+		}
+	}
+	return c.Err()
+}
+
+// set writes a complete row if it exists already, for an update, or if it doesn't.
+func (t *Table) set(rec Record, exists bool) (bool, error) {
+	if len(rec.Cols) != len(t.def.Columns) {
+		return false, fmt.Errorf("%w: %d columns, table %q has %d", ErrBadRecord, len(rec.Cols), t.def.Name, len(t.def.Columns))
+	}
+	key, err := t.def.encodeKey(&rec)
+	if err != nil {
+		return false, err
+	}
+	val, err := t.def.encodeVal(&rec)
+	if err != nil {
+		return false, err
+	}
+	_, ok, err := t.bucket.Get(key)
+	if err != nil || ok != exists {
+		return false, err
+	}
+	return true, t.bucket.Set(key, val)
+}
+
+// validate checks a new definition and sets the positions of the primary key.
+func (def *TableDef) validate() error {
+	if def.Name == "" || len(def.Columns) == 0 || len(def.PKey) == 0 {
+		return fmt.Errorf("table %q: a table needs a name, columns and a primary key", def.Name)
+	}
+	def.pkey = def.pkey[:0]
+	for i, col := range def.Columns {
+		if col.Name == "" || col.Type < TYPE_INT64 || col.Type > TYPE_BOOL {
+			return fmt.Errorf("table %q: column %d: bad name or type", def.Name, i)
+		}
+		for _, other := range def.Columns[:i] {
+			if other.Name == col.Name {
+				return fmt.Errorf("table %q: duplicate column %q", def.Name, col.Name)
+			}
+		}
+	}
+	for _, name := range def.PKey {
+		pos := def.column(name)
+		if pos < 0 {
+			return fmt.Errorf("table %q: the primary key has an unknown column %q", def.Name, name)
+		}
+		for _, p := range def.pkey {
+			if p == pos {
+				return fmt.Errorf("table %q: the primary key has column %q twice", def.Name, name)
+			}
+		}
+		def.pkey = append(def.pkey, pos)
+	}
+	return nil
+}
+
+// column returns the position of a column, -1 if there is none.
+func (def *TableDef) column(name string) int {
+	for i, col := range def.Columns {
+		if col.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// others returns the positions of the columns that are not in the primary key.
+func (def *TableDef) others() []int {
+	var pos []int
+	for i := range def.Columns {
+		inKey := false
+		for _, p := range def.pkey {
+			inKey = inKey || p == i
+		}
+		if !inKey {
+			pos = append(pos, i)
+		}
+	}
+	return pos
+}
+
+// value returns the value of a column in a record, checking its type.
+func (def *TableDef) value(rec *Record, pos int) (Value, error) {
+	col := def.Columns[pos]
+	v := rec.Get(col.Name)
+	if v == nil {
+		return Value{}, fmt.Errorf("%w: missing column %q", ErrBadRecord, col.Name)
+	}
+	if v.Type != col.Type {
+		return Value{}, fmt.Errorf("%w: column %q has type %d, not %d", ErrBadRecord, col.Name, v.Type, col.Type)
+	}
+	return *v, nil
+}
+
+// encodeKey returns the key of the row with the primary key of the record, see above.
+func (def *TableDef) encodeKey(rec *Record) ([]byte, error) {
+	elems := make([]any, len(def.pkey))
+	for i, pos := range def.pkey {
+		v, err := def.value(rec, pos)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = v.elem()
+	}
+	key, err := AppendTuple(nil, elems...)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE {
+		return nil, fmt.Errorf("table %q: %w: the primary key is %d bytes, the limit is %d",
+			def.Name, ErrKeyTooLarge, len(key), BTREE_MAX_KEY_SIZE)
+	}
+	return key, nil
+}
+
+// encodeVal returns the value of the row of the record, see above.
+func (def *TableDef) encodeVal(rec *Record) ([]byte, error) {
+	var val []byte
+	for _, pos := range def.others() {
+		v, err := def.value(rec, pos)
+		if err != nil {
+			return nil, err
+		}
+		switch v.Type {
+		case TYPE_INT64:
+			val = binary.AppendVarint(val, v.Int)
+		case TYPE_BOOL:
+			val = append(val, byte(v.Int&1))
+		default:
+			val = binary.AppendUvarint(val, uint64(len(v.Bytes)))
+			val = append(val, v.Bytes...)
+		}
+	}
+	return val, nil
+}
+
+// decodeVal decodes the value of a row into the values of the columns that are not in the
+// primary key. The values are copied.
+func (def *TableDef) decodeVal(val []byte) ([]Value, error) {
+	bad := fmt.Errorf("table %q: %w: bad row", def.Name, ErrCorruptNode)
+	var vals []Value
+	for _, pos := range def.others() {
+		v := Value{Type: def.Columns[pos].Type}
+		switch v.Type {
+		case TYPE_INT64:
+			i, n := binary.Varint(val)
+			if n <= 0 {
+				return nil, bad
+			}
+			v.Int, val = i, val[n:]
+		case TYPE_BOOL:
+			if len(val) < 1 {
+				return nil, bad
+			}
+			v.Int, val = int64(val[0]), val[1:]
+		default:
+			l, n := binary.Uvarint(val)
+			if n <= 0 || uint64(len(val)-n) < l {
+				return nil, bad
+			}
+			v.Bytes, val = bytes.Clone(val[n:n+int(l)]), val[n+int(l):]
+		}
+		vals = append(vals, v)
+	}
+	if len(val) != 0 {
+		return nil, bad
+	}
+	return vals, nil
+}
+
+// decodeRow decodes the key and the value of a row into the values of all the columns,
+// in the order of the definition. The values are copied.
+func (def *TableDef) decodeRow(key []byte, val []byte) ([]Value, error) {
+	bad := fmt.Errorf("table %q: %w: bad row", def.Name, ErrCorruptNode)
+	elems, err := DecodeTuple(key)
+	if err != nil || len(elems) != len(def.pkey) {
+		return nil, bad
+	}
+	others, err := def.decodeVal(val)
+	if err != nil {
+		return nil, err
+	}
+	row := make([]Value, len(def.Columns))
+	for i, pos := range def.pkey {
+		switch e := elems[i].(type) {
+		case int64:
+			row[pos] = Int64Value(e)
+		case bool:
+			row[pos] = BoolValue(e)
+		case string:
+			row[pos] = StringValue(e)
+		case []byte:
+			row[pos] = BytesValue(e)
+		}
+		if row[pos].Type != def.Columns[pos].Type {
+			return nil, bad
+		}
+	}
+	for i, pos := range def.others() {
+		row[pos] = others[i]
+	}
+	return row, nil
+}
+
+// record returns a decoded row as a record with all the columns.
+func (def *TableDef) record(row []Value) Record {
+	var rec Record
+	for i, col := range def.Columns {
+		rec.Add(col.Name, row[i])
+	}
+	return rec
+}
+
+// encode returns the stored definition, see above.
+func (def *TableDef) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(def.Columns)))
+	for _, col := range def.Columns {
+		buf = append(buf, byte(col.Type))
+		buf = binary.AppendUvarint(buf, uint64(len(col.Name)))
+		buf = append(buf, col.Name...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(def.pkey)))
+	for _, pos := range def.pkey {
+		buf = binary.AppendUvarint(buf, uint64(pos))
+	}
+	return buf
+}
+
+// tableDecode decodes a stored definition.
+func tableDecode(name string, buf []byte) (*TableDef, error) {
+	bad := fmt.Errorf("table %q: %w: bad definition", name, ErrCorruptNode)
+	uvarint := func() (int, bool) {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 || v > BTREE_PAGE_SIZE {
+			return 0, false
+		}
+		buf = buf[n:]
+		return int(v), true
+	}
+	def := &TableDef{Name: name}
+	ncols, ok := uvarint()
+	if !ok {
+		return nil, bad
+	}
+	for i := 0; i < ncols; i++ {
+		if len(buf) < 1 {
+			return nil, bad
+		}
+		typ := ColumnType(buf[0])
+		buf = buf[1:]
+		l, ok := uvarint()
+		if !ok || l > len(buf) {
+			return nil, bad
+		}
+		def.Columns = append(def.Columns, Column{Name: string(buf[:l]), Type: typ})
+		buf = buf[l:]
+	}
+	npkey, ok := uvarint()
+	if !ok || npkey > ncols {
+		return nil, bad
+	}
+	for i := 0; i < npkey; i++ {
+		pos, ok := uvarint()
+		if !ok || pos >= ncols {
+			return nil, bad
+		}
+		def.PKey = append(def.PKey, def.Columns[pos].Name)
+	}
+	if len(buf) != 0 || def.validate() != nil {
+		return nil, bad
+	}
+	return def, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func testUsersDef() *TableDef {
+	return &TableDef{
+		Name: "users",
+		Columns: []Column{
+			{"id", TYPE_INT64},
+			{"region", TYPE_STRING},
+			{"name", TYPE_STRING},
+			{"admin", TYPE_BOOL},
+			{"avatar", TYPE_BYTES},
+		},
+		PKey: []string{"region", "id"},
+	}
+}
+
+func testUser(region string, id int64, name string) Record {
+	var rec Record
+	rec.Add("id", Int64Value(id)).Add("region", StringValue(region)).Add("name", StringValue(name)).
+		Add("admin", BoolValue(id < 0)).Add("avatar", BytesValue([]byte{0, byte(id)}))
+	return rec
+}
+
+func TestTableRows(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := tx.CreateTable(testUsersDef())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.CreateTable(testUsersDef()); !errors.Is(err, ErrTableExists) {
+		t.Fatalf("CreateTable of an existing table: %v", err)
+	}
+	for _, u := range []struct {
+		region string
+		id     int64
+	}{{"eu", 2}, {"us", 1}, {"eu", -1}, {"eu", 10}, {"", 5}} {
+		if ok, err := table.Insert(testUser(u.region, u.id, fmt.Sprint(u.region, u.id))); !ok || err != nil {
+			t.Fatalf("Insert %s/%d: %v, %v", u.region, u.id, ok, err)
+		}
+	}
+	if ok, err := table.Insert(testUser("eu", 2, "again")); ok || err != nil {
+		t.Fatalf("Insert of an existing row: %v, %v", ok, err)
+	}
+	if ok, err := table.Update(testUser("us", 2, "missing")); ok || err != nil {
+		t.Fatalf("Update of a missing row: %v, %v", ok, err)
+	}
+	if ok, err := table.Update(testUser("us", 1, "updated")); !ok || err != nil {
+		t.Fatalf("Update: %v, %v", ok, err)
+	}
+	if ok, err := table.Delete(*new(Record).Add("id", Int64Value(10)).Add("region", StringValue("eu"))); !ok || err != nil {
+		t.Fatalf("Delete: %v, %v", ok, err)
+	}
+
+	// records that don't match the definition
+	short := testUser("eu", 3, "x")
+	short.Cols, short.Vals = short.Cols[:4], short.Vals[:4]
+	typed := testUser("eu", 3, "x")
+	typed.Vals[2] = Int64Value(1)
+	for _, rec := range []Record{short, typed, *new(Record).Add("id", Int64Value(1))} {
+		if _, err := table.Insert(rec); !errors.Is(err, ErrBadRecord) {
+			t.Fatalf("Insert of %v: %v", rec.Cols, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db = openTest(t, &KV{Path: path})
+	tx, err = db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Table("orders"); !errors.Is(err, ErrTableNotFound) {
+		t.Fatalf("Table of a missing table: %v", err)
+	}
+	table, err = tx.Table("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := new(Record).Add("region", StringValue("us")).Add("id", Int64Value(1))
+	if ok, err := table.Get(rec); !ok || err != nil {
+		t.Fatalf("Get: %v, %v", ok, err)
+	}
+	if got := rec.Get("name"); got == nil || string(got.Bytes) != "updated" {
+		t.Fatalf("name %v", got)
+	}
+	if got := rec.Get("avatar"); got == nil || !bytes.Equal(got.Bytes, []byte{0, 1}) {
+		t.Fatalf("avatar %v", got)
+	}
+
+	// the rows sort by the primary key, column by column
+	var rows []string
+	err = table.scan(nil, []byte{0xff}, func(row []Value) bool {
+		rows = append(rows, fmt.Sprintf("%s/%d:%s:%d", row[1].Bytes, row[0].Int, row[2].Bytes, row[3].Int))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[/5:5:0 eu/-1:eu-1:1 eu/2:eu2:0 us/1:updated:0]"; got != want {
+		t.Fatalf("rows %s, want %s", got, want)
+	}
+}
+
+func TestTableDefValidate(t *testing.T) {
+	for _, def := range []*TableDef{
+		{Name: "", Columns: []Column{{"a", TYPE_INT64}}, PKey: []string{"a"}},
+		{Name: "t", Columns: []Column{{"a", TYPE_INT64}}},
+		{Name: "t", Columns: []Column{{"a", TYPE_INT64}, {"a", TYPE_BOOL}}, PKey: []string{"a"}},
+		{Name: "t", Columns: []Column{{"a", 9}}, PKey: []string{"a"}},
+		{Name: "t", Columns: []Column{{"a", TYPE_INT64}}, PKey: []string{"b"}},
+		{Name: "t", Columns: []Column{{"a", TYPE_INT64}}, PKey: []string{"a", "a"}},
+	} {
+		if err := def.validate(); err == nil {
+			t.Fatalf("%+v is valid", def)
+		}
+	}
+	// the definition survives the encoding
+	def := testUsersDef()
+	if err := def.validate(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tableDecode(def.Name, def.encode())
+	if err != nil || fmt.Sprint(got) != fmt.Sprint(def) {
+		t.Fatalf("decoded %+v, %v, want %+v", got, err, def)
+	}
+}
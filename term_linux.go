@@ -0,0 +1,34 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// termRaw puts the terminal into raw mode for the line editor of the shell: the keys are read
+// one by one, without echo and without signals. It returns a function that restores the mode.
+// The output is still processed, so a newline still starts a new line.
+func termRaw(fd int) (func(), error) {
+	var old syscall.Termios
+	if err := termIoctl(fd, syscall.TCGETS, &old); err != nil {
+		return nil, err
+	}
+	raw := old
+	raw.Iflag &^= syscall.ICRNL | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN], raw.Cc[syscall.VTIME] = 1, 0
+	if err := termIoctl(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return func() { _ = termIoctl(fd, syscall.TCSETS, &old) }, nil
+}
+
+func termIoctl(fd int, req uintptr, t *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(t)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
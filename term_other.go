@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// termRaw is only implemented on Linux, elsewhere the shell reads whole lines without editing.
+func termRaw(fd int) (func(), error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TRACE_SIG is the signature at the start of a trace file
+const TRACE_SIG = "SDBTRC02"
+
+// logical operations recorded in a trace
+const (
+	TRACE_GET           = 1
+	TRACE_SET           = 2
+	TRACE_DEL           = 3
+	TRACE_COMMIT        = 4 // commit of a writable transaction
+	TRACE_ROLLBACK      = 5 // rollback of a writable transaction
+	TRACE_DELRANGE      = 6 // the key is the start and the value is the end of the range
+	TRACE_CREATE_BUCKET = 7 // the key is the name of the bucket
+	TRACE_DELETE_BUCKET = 8 // the key is the name of the bucket
+	TRACE_SET_TTL       = 9 // the value starts with the TTL in nanoseconds, 8 bytes, see Tx.SetWithTTL
+
+	// set in the operations on the keys of a bucket, whose key starts with the name of the bucket:
+	// | nlen | name | key |
+	// | 2B   | ...  | ... |
+	TRACE_BUCKET = 0x80
+)
+
+// traceUpdates are the operations that replayTrace runs in a writable transaction.
+var traceUpdates = map[byte]bool{
+	TRACE_SET: true, TRACE_DEL: true, TRACE_DELRANGE: true,
+	TRACE_CREATE_BUCKET: true, TRACE_DELETE_BUCKET: true, TRACE_SET_TTL: true,
+}
+
+// TraceWriter records the logical operations of a KV, including transaction boundaries,
+// so they can be replayed later. The updates are recorded once they succeeded. The operations
+// on buckets are recorded with the name of the bucket, see TRACE_BUCKET.
+// Each record is written with a single Write call:
+// | op | time | klen | vlen | key | val |
+// | 1B | 8B   | 2B   | 2B   | ... | ... |
+// where time is the number of nanoseconds since the trace was started.
+type TraceWriter struct {
+	mu    sync.Mutex // read-only transactions record concurrently
+	w     io.Writer
+	start time.Time
+	buf   []byte
+	err   error // the first write error, tracing stops after it
+}
+
+// NewTraceWriter starts a new trace and writes the trace header to w.
+func NewTraceWriter(w io.Writer) *TraceWriter {
+	t := &TraceWriter{w: w, start: time.Now()}
+	_, t.err = io.WriteString(w, TRACE_SIG)
+	return t
+}
+
+// Err returns the first error encountered while writing the trace.
+func (t *TraceWriter) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// record appends a single operation to the trace.
+func (t *TraceWriter) record(op byte, key []byte, val []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	t.buf = append(t.buf[:0], op)
+	t.buf = binary.LittleEndian.AppendUint64(t.buf, uint64(time.Since(t.start)))
+	t.buf = binary.LittleEndian.AppendUint16(t.buf, uint16(len(key)))
+	t.buf = binary.LittleEndian.AppendUint16(t.buf, uint16(len(val)))
+	t.buf = append(t.buf, key...)
+	t.buf = append(t.buf, val...)
+	_, t.err = t.w.Write(t.buf)
+}
+
+// recordBucket appends an operation on the keys of a bucket to the trace, see TRACE_BUCKET.
+func (t *TraceWriter) recordBucket(name []byte, op byte, key []byte, val []byte) {
+	bkey := make([]byte, 0, 2+len(name)+len(key))
+	bkey = binary.LittleEndian.AppendUint16(bkey, uint16(len(name)))
+	bkey = append(append(bkey, name...), key...)
+	t.record(op|TRACE_BUCKET, bkey, val)
+}
+
+// traceBucketKey splits the key of an operation on a bucket into the name of the bucket and the key.
+func traceBucketKey(bkey []byte) ([]byte, []byte, bool) {
+	if len(bkey) < 2 {
+		return nil, nil, false
+	}
+	n := 2 + int(binary.LittleEndian.Uint16(bkey))
+	if len(bkey) < n {
+		return nil, nil, false
+	}
+	return bkey[2:n], bkey[n:], true
+}
+
+// traceKeyspace is the main keyspace of a transaction or a bucket, for replayTrace.
+type traceKeyspace interface {
+	Get(key []byte) ([]byte, bool, error)
+	Set(key []byte, val []byte) error
+	Del(key []byte) (bool, error)
+	DeleteRange(start []byte, end []byte) (int, error)
+}
+
+// replayTrace applies the operations of a trace to the database and returns the number of operations.
+// Writes are grouped into transactions the same way they were recorded; a transaction that was
+// still open at the end of the trace is rolled back.
+// With realtime set the original timing is reproduced, otherwise operations run as fast as possible.
+func replayTrace(r io.Reader, db *KV, realtime bool) (int, error) {
+	br := bufio.NewReader(r)
+	sig := make([]byte, len(TRACE_SIG))
+	if _, err := io.ReadFull(br, sig); err != nil || string(sig[:6]) != TRACE_SIG[:6] {
+		return 0, errors.New("not a trace file")
+	}
+	if string(sig) != TRACE_SIG {
+		return 0, fmt.Errorf("unsupported trace version %q", sig[6:])
+	}
+
+	var tx *Tx
+	defer func() {
+		if tx != nil {
+			tx.Rollback()
+		}
+	}()
+	start := time.Now()
+	var head [13]byte
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(br, head[:]); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, fmt.Errorf("record %d: %w", n, err)
+		}
+		op := head[0]
+		ts := time.Duration(binary.LittleEndian.Uint64(head[1:]))
+		klen := binary.LittleEndian.Uint16(head[9:])
+		vlen := binary.LittleEndian.Uint16(head[11:])
+		kv := make([]byte, int(klen)+int(vlen))
+		if _, err := io.ReadFull(br, kv); err != nil {
+			return n, fmt.Errorf("record %d: %w", n, err)
+		}
+		key, val := kv[:klen], kv[klen:]
+		var bucket []byte // nil for the main keyspace
+		if op&TRACE_BUCKET != 0 {
+			op &^= TRACE_BUCKET
+			var ok bool
+			if bucket, key, ok = traceBucketKey(key); !ok {
+				return n, fmt.Errorf("record %d: bad bucket key", n)
+			}
+		}
+
+		if realtime {
+			time.Sleep(time.Until(start.Add(ts)))
+		}
+		var err error
+		if tx == nil && traceUpdates[op] {
+			tx, err = db.Begin(true)
+		}
+		on := tx // the reads out of a writable transaction have one of their own
+		if err == nil && on == nil && op == TRACE_GET {
+			on, err = db.Begin(false)
+		}
+		var ks traceKeyspace = on
+		if err == nil && on != nil && bucket != nil {
+			ks, err = on.Bucket(bucket)
+		}
+		switch {
+		case err != nil:
+		case op == TRACE_GET:
+			_, _, err = ks.Get(key)
+		case op == TRACE_SET:
+			err = ks.Set(key, val)
+		case op == TRACE_DEL:
+			_, err = ks.Del(key)
+		case op == TRACE_DELRANGE:
+			_, err = ks.DeleteRange(key, val)
+		case op == TRACE_SET_TTL && len(val) < 8:
+			err = errors.New("bad TTL")
+		case op == TRACE_SET_TTL:
+			err = tx.SetWithTTL(key, val[8:], time.Duration(binary.LittleEndian.Uint64(val)))
+		case op == TRACE_CREATE_BUCKET:
+			_, err = tx.CreateBucket(key)
+		case op == TRACE_DELETE_BUCKET:
+			err = tx.DeleteBucket(key)
+		case op == TRACE_COMMIT && tx != nil:
+			err = tx.Commit()
+			tx = nil
+		case op == TRACE_ROLLBACK && tx != nil:
+			tx.Rollback()
+			tx = nil
+		case op == TRACE_COMMIT || op == TRACE_ROLLBACK:
+			// a transaction without writes
+		default:
+			err = fmt.Errorf("bad operation %d", op)
+		}
+		if on != nil && on != tx {
+			on.Rollback()
+		}
+		if err != nil {
+			return n, fmt.Errorf("record %d: %w", n, err)
+		}
+	}
+}
+
+// cmdReplay implements `scratch-db replay -db <file> [-realtime] [-expiring] <trace>`.
+func cmdReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	path := fs.String("db", "", "database file to create")
+	realtime := fs.Bool("realtime", false, "reproduce the original timing instead of replaying at max speed")
+	expiring := fs.Bool("expiring", false, "create the database with ExpiringKeys, for a trace of SetWithTTL")
+	fs.Parse(args)
+	if *path == "" || fs.NArg() != 1 {
+		return errors.New("usage: scratch-db replay -db <file> [-realtime] [-expiring] <trace>")
+	}
+	// a trace only makes sense against the state it was recorded from, which is an empty database
+	if _, err := os.Stat(*path); err == nil {
+		return fmt.Errorf("%s already exists, replay needs a fresh database", *path)
+	}
+
+	fp, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	db := &KV{Path: *path, ExpiringKeys: *expiring}
+	if err := db.Open(); err != nil {
+		return err
+	}
+	defer db.Close()
+
+	begin := time.Now()
+	n, err := replayTrace(fp, db, *realtime)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replayed %d operations in %v\n", n, time.Since(begin))
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// traceOps returns the operations recorded in a trace.
+func traceOps(t *testing.T, trace []byte) []byte {
+	t.Helper()
+	if !bytes.HasPrefix(trace, []byte(TRACE_SIG)) {
+		t.Fatal("not a trace")
+	}
+	var ops []byte
+	for data := trace[len(TRACE_SIG):]; len(data) > 0; {
+		if len(data) < 13 {
+			t.Fatal("truncated record")
+		}
+		n := 13 + int(binary.LittleEndian.Uint16(data[9:])) + int(binary.LittleEndian.Uint16(data[11:]))
+		ops = append(ops, data[0])
+		data = data[n:]
+	}
+	return ops
+}
+
+// failSync is a database file whose Sync fails.
+type failSync struct{ *os.File }
+
+func (f failSync) Sync() error { return errors.New("sync failed") }
+
+func TestTraceCommitFailed(t *testing.T) {
+	var buf bytes.Buffer
+	db := &KV{Path: t.TempDir() + "/db", Trace: NewTraceWriter(&buf)}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commit fails once the pages are written, so it's not recorded
+	fp := db.fp
+	db.fp = failSync{fp.(*os.File)}
+	err := db.Set([]byte("b"), []byte("2"))
+	db.fp = fp
+	if err == nil {
+		t.Fatal("the commit didn't fail")
+	}
+	if err := db.Trace.Err(); err != nil {
+		t.Fatal(err)
+	}
+	got := traceOps(t, buf.Bytes())
+	want := []byte{TRACE_SET, TRACE_COMMIT, TRACE_SET, TRACE_ROLLBACK}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("recorded %v, want %v", got, want)
+	}
+
+	db2 := &KV{Path: t.TempDir() + "/db"}
+	if err := db2.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := replayTrace(&buf, db2, false); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"a": "1", "b": ""} {
+		val, ok, err := db2.Get([]byte(key))
+		if err != nil || string(val) != want || ok != (want != "") {
+			t.Fatalf("replayed %s = %q, %v, %v, want %q", key, val, ok, err, want)
+		}
+	}
+}
+
+// The pairs of a bulk load are only traced once it succeeded.
+func TestTraceBulkLoad(t *testing.T) {
+	var buf bytes.Buffer
+	db := &KV{Path: t.TempDir() + "/db", Trace: NewTraceWriter(&buf)}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	pairs := func(keys ...string) KVIterator {
+		it := &freezeIter{}
+		for _, key := range keys {
+			it.entries = append(it.entries, freezeEntry{key: []byte(key), val: []byte("v" + key)})
+		}
+		return it
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := tx.BulkLoad(pairs("a", "c", "b")); !errors.Is(err, ErrUnsorted) {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("bk"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BulkLoad(pairs("x", "x")); !errors.Is(err, ErrUnsorted) {
+		t.Fatal(err)
+	}
+	if err := tx.BulkLoad(pairs("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.BulkLoad(pairs("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := traceOps(t, buf.Bytes())
+	want := []byte{TRACE_CREATE_BUCKET, TRACE_SET, TRACE_SET, TRACE_BUCKET | TRACE_SET, TRACE_COMMIT}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("recorded %v, want %v", got, want)
+	}
+	db2 := &KV{Path: t.TempDir() + "/db"}
+	if err := db2.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if _, err := replayTrace(&buf, db2, false); err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := db2.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx2.Rollback()
+	n := 0
+	for c := tx2.Seek(nil); c.Valid(); c.Next() {
+		n++
+	}
+	if val, ok, err := tx2.Get([]byte("b")); err != nil || !ok || string(val) != "vb" || n != 2 {
+		t.Fatalf("replayed %d keys, b = %q, %v, %v", n, val, ok, err)
+	}
+}
+
+// contents returns the keys of the main keyspace and of the buckets, bucket/key for the latter.
+func contents(t *testing.T, db *KV) map[string]string {
+	t.Helper()
+	tx, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	kvs := map[string]string{}
+	for c := tx.Seek(nil); c.Valid(); c.Next() {
+		kvs[string(c.Key())] = string(c.Val())
+	}
+	names, err := tx.Buckets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		b, err := tx.Bucket(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for c := b.Seek(nil); c.Valid(); c.Next() {
+			kvs[string(name)+"/"+string(c.Key())] = string(c.Val())
+		}
+	}
+	return kvs
+}
+
+// Replaying a trace into an empty database gives the same contents as the recorded one.
+func TestTraceReplay(t *testing.T) {
+	var buf bytes.Buffer
+	db := openTest(t, &KV{ExpiringKeys: true, Trace: NewTraceWriter(&buf)})
+	rng := rand.New(rand.NewSource(1))
+	key := func() []byte { return []byte(fmt.Sprint("key", rng.Intn(200))) }
+	for round := 0; round < 100; round++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(fmt.Sprint("bucket", round%3)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			val := []byte(fmt.Sprint(round, "-", i))
+			switch rng.Intn(8) {
+			case 0:
+				_, err = tx.Del(key())
+			case 1:
+				_, err = tx.DeleteRange(key(), key())
+			case 2:
+				err = tx.SetWithTTL(key(), val, time.Hour)
+			case 3:
+				_, err = tx.CompareAndSwap(key(), nil, val)
+			case 4:
+				err = b.Set(key(), val)
+			case 5:
+				_, err = b.Del(key())
+			case 6:
+				_, _, err = tx.Get(key())
+			default:
+				err = tx.Set(key(), val)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		switch {
+		case round%10 == 9:
+			err = tx.DeleteBucket([]byte("bucket0"))
+		case round%7 == 3:
+			tx.Rollback()
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Trace.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	db2 := openTest(t, &KV{ExpiringKeys: true})
+	n, err := replayTrace(bytes.NewReader(buf.Bytes()), db2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(traceOps(t, buf.Bytes())); n != want {
+		t.Fatalf("replayed %d operations, want %d", n, want)
+	}
+	want, got := contents(t, db), contents(t, db2)
+	if len(want) == 0 || len(got) != len(want) {
+		t.Fatalf("%d keys after the replay, want %d", len(got), len(want))
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("replayed %s = %q, want %q", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Keys with a TTL, in databases created with KV.ExpiringKeys. Such a key has a deadline in unix
+// milliseconds, which is stored before its value (see values.go), so a read can tell that the key
+// expired without a second lookup. Expired keys are not removed right away: Get doesn't find them,
+// cursors skip them and Del reports them as not found. The time is taken when the transaction
+// begins, so the keys don't expire in the middle of a transaction.
+//
+// The expiry index is a BTree of the deadlines of the keys (8 bytes, big-endian) followed by the
+// keys, with empty values, so it's sorted by deadline. It's the SYS_EXPIRY system tree, its root
+// is in the bucket catalog (see bucket.go). A sweeper goroutine purges the keys at the start of
+// the index whose deadline passed, TTL_PURGE_BATCH of them per transaction.
+//
+// Set and Del don't update the index, so it can have entries of keys that were updated, deleted
+// or given a later deadline since. The sweeper only deletes a key if its value still has the
+// deadline of the entry, and drops the entry either way. Only the keys of the main keyspace can
+// have a TTL, the index doesn't know the buckets.
+
+const (
+	// how often the sweeper looks for expired keys
+	TTL_SWEEP_INTERVAL = time.Second
+	// the number of index entries handled by a transaction of the sweeper
+	TTL_PURGE_BATCH = 1000
+)
+
+// expiryIndex is the expiry index as seen by a transaction.
+type expiryIndex struct {
+	tree BTree
+	root uint64 // the root in the catalog
+}
+
+// SetWithTTL inserts or updates a key that expires after ttl, rounded up to a millisecond,
+// from the time the transaction began. Setting the key again with Set keeps it forever.
+// The database must have been created with KV.ExpiringKeys. A follower in shared mode returns
+// errors.ErrUnsupported, like for CompareAndSwap. KV.Trace records the TTL, see TRACE_SET_TTL.
+func (tx *Tx) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return err
+	}
+	if !tx.tree.vals.hasDeadlines() {
+		return fmt.Errorf("Tx.SetWithTTL: the database was created without ExpiringKeys: %w", errors.ErrUnsupported)
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("Tx.SetWithTTL: the TTL must be positive, not %v", ttl)
+	}
+	if len(key) > BTREE_MAX_KEY_SIZE-8 {
+		// the index needs room for the deadline
+		return fmt.Errorf("%w: %d bytes, the limit is %d with a TTL", ErrKeyTooLarge, len(key), BTREE_MAX_KEY_SIZE-8)
+	}
+	ms := int64(ttl / time.Millisecond)
+	if ttl%time.Millisecond != 0 {
+		ms++ // ttl+time.Millisecond-1 would overflow for the largest durations
+	}
+	deadline := tx.tree.now + ms
+	if err := tx.indexUpdate(key, val, true); err != nil {
+		return err
+	}
+	if err := tx.tree.insert(key, val, deadline); err != nil {
+		return err
+	}
+	tx.watched(key, val, false)
+	index, err := tx.expiryIndex()
+	if err != nil {
+		return err
+	}
+	if err := index.tree.Insert(expiryKey(deadline, key), nil); err != nil {
+		return err
+	}
+	if tx.db.Trace != nil {
+		rec := binary.LittleEndian.AppendUint64(make([]byte, 0, 8+len(val)), uint64(ttl))
+		tx.db.Trace.record(TRACE_SET_TTL, key, append(rec, val...))
+	}
+	return nil
+}
+
+// SetWithTTL inserts or updates a key that expires after ttl in its own transaction,
+// see Tx.SetWithTTL.
+func (db *KV) SetWithTTL(key []byte, val []byte, ttl time.Duration) error {
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	if err := tx.SetWithTTL(key, val, ttl); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// PurgeExpired deletes the keys that expired and returns how many, which the sweeper also does
+// every TTL_SWEEP_INTERVAL. It's useful without the sweeper, in constrained mode.
+func (db *KV) PurgeExpired() (int, error) {
+	total := 0
+	for {
+		n, more, err := db.purgeBatch()
+		total += n
+		if err != nil || !more {
+			return total, err
+		}
+	}
+}
+
+// purgeBatch handles up to TTL_PURGE_BATCH expired entries of the index in a transaction.
+// It returns the number of keys deleted and whether there may be more expired entries.
+func (db *KV) purgeBatch() (int, bool, error) {
+	// look in a read-only transaction first, so that an idle sweeper doesn't take the writer
+	rtx, err := db.Begin(false)
+	if err != nil {
+		return 0, false, err
+	}
+	entries, err := rtx.expiredEntries(1)
+	rtx.Rollback()
+	if err != nil || len(entries) == 0 {
+		return 0, false, err
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	if err := tx.checkLocal(); err != nil {
+		return 0, false, err
+	}
+	if entries, err = tx.expiredEntries(TTL_PURGE_BATCH); err != nil {
+		return 0, false, err
+	}
+	index, err := tx.expiryIndex()
+	if err != nil {
+		return 0, false, err
+	}
+	n := 0
+	for _, entry := range entries {
+		deadline, key := int64(binary.BigEndian.Uint64(entry)), entry[8:]
+		stored, ok, err := tx.tree.getStored(key)
+		if err != nil {
+			return 0, false, err
+		}
+		if ok && tx.tree.vals.deadline(stored) == deadline {
+			if err := tx.indexUpdate(key, nil, false); err != nil {
+				return 0, false, err
+			}
+			if _, err := tx.tree.Delete(key); err != nil {
+				return 0, false, err
+			}
+			tx.watched(key, nil, true)
+			n++
+		}
+		if _, err := index.tree.Delete(entry); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+	return n, len(entries) == TTL_PURGE_BATCH, nil
+}
+
+// expiredEntries returns up to limit entries at the start of the expiry index whose deadline
+// passed. They are copied, since the cursor is invalidated by the updates.
+func (tx *Tx) expiredEntries(limit int) ([][]byte, error) {
+	if !tx.tree.vals.hasDeadlines() {
+		return nil, fmt.Errorf("KV.PurgeExpired: the database was created without ExpiringKeys: %w", errors.ErrUnsupported)
+	}
+	index, err := tx.expiryIndex()
+	if err != nil {
+		return nil, err
+	}
+	var entries [][]byte
+	c := index.tree.Seek(nil)
+	for ; c.Valid() && len(entries) < limit; c.Next() {
+		if len(c.Key()) <= 8 {
+			return nil, fmt.Errorf("expiry index: %w: bad entry", ErrCorruptNode)
+		}
+		if int64(binary.BigEndian.Uint64(c.Key())) > tx.tree.now {
+			break
+		}
+		entries = append(entries, append([]byte(nil), c.Key()...))
+	}
+	return entries, c.Err()
+}
+
+// expiryIndex returns the expiry index as seen by the transaction. The handle is kept,
+// so that the transaction sees its own updates of the index.
+func (tx *Tx) expiryIndex() (*expiryIndex, error) {
+	if tx.expiry != nil {
+		return tx.expiry, nil
+	}
+	root, err := tx.sysRoot(SYS_EXPIRY)
+	if err != nil {
+		return nil, fmt.Errorf("expiry index: %w", err)
+	}
+	index := &expiryIndex{tree: tx.tree, root: root}
+	index.tree.vals = nil // the entries have empty values
+	index.tree.root = root
+	tx.expiry = index
+	return index, nil
+}
+
+// flushExpiry writes the root of the expiry index into the catalog if the transaction updated it.
+func (tx *Tx) flushExpiry() error {
+	index := tx.expiry
+	if index == nil || index.tree.root == index.root {
+		return nil
+	}
+	if err := tx.sysStore(SYS_EXPIRY, index.tree.root); err != nil {
+		return fmt.Errorf("expiry index: %w", err)
+	}
+	index.root = index.tree.root
+	return nil
+}
+
+// expiryKey returns the key of the entry of the expiry index for a key with the given deadline.
+func expiryKey(deadline int64, key []byte) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, uint64(deadline)), key...)
+}
+
+// sweeper purges the expired keys in the background, see KV.PurgeExpired.
+type sweeper struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// sweepStart starts the sweeper of a database with KV.ExpiringKeys that can be written.
+// No goroutine is started in constrained mode.
+func (db *KV) sweepStart() {
+	if db.flags&MASTER_FLAG_TTL == 0 || db.flags&MASTER_FLAG_FROZEN != 0 || db.static || db.Constrained {
+		return
+	}
+	s := &sweeper{stop: make(chan struct{})}
+	s.wg.Add(1)
+	go s.run(db)
+	db.sweeper = s
+}
+
+func (s *sweeper) run(db *KV) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(TTL_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		if db.lease != nil && !db.lease.leader.Load() {
+			continue // the leader purges
+		}
+		// a batch at a time, so that closing the database doesn't wait for all of them.
+		// the errors show up again on the next tick.
+		for {
+			_, more, err := db.purgeBatch()
+			if err != nil || !more {
+				break
+			}
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// close stops the sweeper and waits for it.
+func (s *sweeper) close() {
+	close(s.stop)
+	s.wg.Wait()
+}
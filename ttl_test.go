@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestTTLExpiry(t *testing.T) {
+	db := openTest(t, &KV{ExpiringKeys: true, Constrained: true}) // no sweeper
+	const ttl = 200 * time.Millisecond
+	start := time.Now()
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than a batch of the purge
+	const expiring = TTL_PURGE_BATCH + 500
+	for i := 0; i < expiring; i++ {
+		if err := tx.SetWithTTL([]byte(fmt.Sprint("exp", i)), []byte("v"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"forever", "later"} {
+		if err := tx.SetWithTTL([]byte(key), []byte("v"), ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Set([]byte("forever"), []byte("set")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.SetWithTTL([]byte("later"), []byte("ttl"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Rollback()
+	if time.Since(start) > ttl/2 {
+		t.Skip("the keys may have expired before the transaction began")
+	}
+	time.Sleep(time.Until(start.Add(ttl + 10*time.Millisecond)))
+
+	// a transaction that began before the deadline still sees the keys
+	wantGet(t, old, "exp0", "v")
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "exp0", "")
+	wantGet(t, tx, "forever", "set")
+	wantGet(t, tx, "later", "ttl")
+	var keys []string
+	for c := tx.Seek(nil); c.Valid(); c.Next() {
+		keys = append(keys, string(c.Key()))
+	}
+	if fmt.Sprint(keys) != "[forever later]" {
+		t.Fatalf("keys %v", keys)
+	}
+	if deleted, err := tx.Del([]byte("exp1")); deleted || err != nil {
+		t.Fatalf("Del of an expired key: %v, %v", deleted, err)
+	}
+	tx.Rollback()
+
+	// only the keys that still have the deadline of their entry are purged
+	if n, err := db.PurgeExpired(); n != expiring || err != nil {
+		t.Fatalf("purged %d, %v, want %d", n, err, expiring)
+	}
+	if n, err := db.PurgeExpired(); n != 0 || err != nil {
+		t.Fatalf("purged %d, %v again", n, err)
+	}
+	wantGet(t, old, "exp0", "v") // the old version is intact
+	for _, key := range []string{"forever", "later"} {
+		if _, ok, err := db.Get([]byte(key)); !ok || err != nil {
+			t.Fatalf("%s after the purge: %v, %v", key, ok, err)
+		}
+	}
+}
+
+func TestTTLUnsupported(t *testing.T) {
+	db := openTest(t, &KV{})
+	if err := db.SetWithTTL([]byte("k"), []byte("v"), time.Hour); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("SetWithTTL without ExpiringKeys: %v", err)
+	}
+}
+
+// The sweeper purges the expired keys in the background.
+func TestTTLSweeper(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the sweeper")
+	}
+	db := openTest(t, &KV{ExpiringKeys: true})
+	if err := db.SetWithTTL([]byte("k"), []byte("v"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(TTL_SWEEP_INTERVAL * 5)
+	for {
+		tx, err := db.Begin(false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok, err := tx.tree.getStored([]byte("k"))
+		tx.Rollback()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the expired key wasn't purged")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Tuples are encoded into keys whose byte order is the order of the tuples, so that composite
+// keys sort by their first element, then by the second and so on. Each element is a tag followed
+// by its value:
+//
+//	TUPLE_NULL                 nil
+//	TUPLE_FALSE, TUPLE_TRUE    bool
+//	TUPLE_INT    8 bytes       int64, big-endian with the sign bit flipped
+//	TUPLE_FLOAT  8 bytes       float64, the bits big-endian, all flipped if negative, else the sign bit
+//	TUPLE_STRING escaped bytes string
+//	TUPLE_BYTES  escaped bytes []byte
+//
+// The escaped bytes are written by appendEscaped (see index.go), 0x00 as 0x00 0xff followed by
+// 0x00 0x01, so a string sorts before the longer ones it's a prefix of. The elements of different
+// types sort by their tags, in the order above, an int64 and a float64 don't compare as numbers.
+// No element is a prefix of another, so a tuple sorts before the longer tuples it's a prefix of.
+//
+// An element wrapped in Desc sorts in descending order: all its bytes are flipped, including
+// the tag, so it still can't be a prefix of another element.
+
+// the tags of the elements of a tuple, see above
+const (
+	TUPLE_NULL   = 0x10
+	TUPLE_FALSE  = 0x20
+	TUPLE_TRUE   = 0x21
+	TUPLE_INT    = 0x30
+	TUPLE_FLOAT  = 0x40
+	TUPLE_STRING = 0x50
+	TUPLE_BYTES  = 0x60
+)
+
+// Desc wraps an element of a tuple that sorts in descending order, see AppendTuple.
+type Desc struct {
+	V any
+}
+
+// AppendTuple appends the encoding of a tuple to dst, see above. The elements can be nil, bool,
+// int, int64, float64, string, []byte or one of them wrapped in Desc.
+func AppendTuple(dst []byte, elems ...any) ([]byte, error) {
+	for i, elem := range elems {
+		desc, ok := elem.(Desc)
+		if ok {
+			elem = desc.V
+		}
+		start := len(dst)
+		switch v := elem.(type) {
+		case nil:
+			dst = append(dst, TUPLE_NULL)
+		case bool:
+			if v {
+				dst = append(dst, TUPLE_TRUE)
+			} else {
+				dst = append(dst, TUPLE_FALSE)
+			}
+		case int:
+			dst = binary.BigEndian.AppendUint64(append(dst, TUPLE_INT), uint64(v)^(1<<63))
+		case int64:
+			dst = binary.BigEndian.AppendUint64(append(dst, TUPLE_INT), uint64(v)^(1<<63))
+		case float64:
+			bits := math.Float64bits(v)
+			if bits&(1<<63) != 0 {
+				bits = ^bits
+			} else {
+				bits |= 1 << 63
+			}
+			dst = binary.BigEndian.AppendUint64(append(dst, TUPLE_FLOAT), bits)
+		case string:
+			dst = appendEscaped(append(dst, TUPLE_STRING), []byte(v))
+		case []byte:
+			dst = appendEscaped(append(dst, TUPLE_BYTES), v)
+		default:
+			return nil, fmt.Errorf("%w: element %d has type %T", ErrBadTuple, i, elem)
+		}
+		if ok {
+			for j := start; j < len(dst); j++ {
+				dst[j] = ^dst[j]
+			}
+		}
+	}
+	return dst, nil
+}
+
+// DecodeTuple decodes a tuple encoded by AppendTuple. The integers are returned as int64, and
+// the elements that were wrapped in Desc as they are, without the wrapper.
+func DecodeTuple(src []byte) ([]any, error) {
+	var elems []any
+	for len(src) > 0 {
+		buf, desc := src, src[0] >= 0x80
+		if desc {
+			buf = make([]byte, len(src))
+			for i, b := range src {
+				buf[i] = ^b
+			}
+		}
+		elem, rest, err := tupleElem(buf)
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", len(elems), err)
+		}
+		elems = append(elems, elem)
+		src = src[len(src)-len(rest):]
+	}
+	return elems, nil
+}
+
+// tupleElem decodes the first element of an ascending tuple and returns the rest.
+func tupleElem(src []byte) (any, []byte, error) {
+	tag, src := src[0], src[1:]
+	switch tag {
+	case TUPLE_NULL:
+		return nil, src, nil
+	case TUPLE_FALSE, TUPLE_TRUE:
+		return tag == TUPLE_TRUE, src, nil
+	case TUPLE_INT, TUPLE_FLOAT:
+		if len(src) < 8 {
+			return nil, nil, fmt.Errorf("%w: truncated number", ErrBadTuple)
+		}
+		bits := binary.BigEndian.Uint64(src)
+		if tag == TUPLE_INT {
+			return int64(bits ^ (1 << 63)), src[8:], nil
+		}
+		if bits&(1<<63) != 0 {
+			bits &^= 1 << 63
+		} else {
+			bits = ^bits
+		}
+		return math.Float64frombits(bits), src[8:], nil
+	case TUPLE_STRING, TUPLE_BYTES:
+		b, rest, ok := cutEscaped(src)
+		if !ok {
+			return nil, nil, fmt.Errorf("%w: bad escaped bytes", ErrBadTuple)
+		}
+		if tag == TUPLE_STRING {
+			return string(b), rest, nil
+		}
+		if b == nil {
+			b = []byte{}
+		}
+		return b, rest, nil
+	}
+	return nil, nil, fmt.Errorf("%w: bad tag 0x%02x", ErrBadTuple, tag)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// single elements in ascending order
+var tupleOrder = []any{
+	nil, false, true,
+	int64(math.MinInt64), -1, 0, 1, int64(math.MaxInt64),
+	math.Inf(-1), -1.5, -math.SmallestNonzeroFloat64, 0.0, 1.5, math.Inf(1),
+	"", "a", "a\x00", "a\x00b", "a\x01", "ab", "b",
+	[]byte{}, []byte{0}, []byte{0, 0}, []byte{1}, []byte{0xff},
+}
+
+func mustTuple(t *testing.T, elems ...any) []byte {
+	t.Helper()
+	key, err := AppendTuple(nil, elems...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestTupleOrder(t *testing.T) {
+	for i := 1; i < len(tupleOrder); i++ {
+		a, b := tupleOrder[i-1], tupleOrder[i]
+		if bytes.Compare(mustTuple(t, a), mustTuple(t, b)) >= 0 {
+			t.Fatalf("%#v doesn't sort before %#v", a, b)
+		}
+		if bytes.Compare(mustTuple(t, Desc{a}), mustTuple(t, Desc{b})) <= 0 {
+			t.Fatalf("Desc %#v doesn't sort after Desc %#v", a, b)
+		}
+	}
+	// composite keys sort by element, a prefix sorts first
+	tuples := [][]any{
+		{"a"},
+		{"a", nil},
+		{"a", 2},
+		{"a", 10},
+		{"a", 10, "x"},
+		{"a\x00", 1},
+		{"ab", 1},
+	}
+	for i := 1; i < len(tuples); i++ {
+		if bytes.Compare(mustTuple(t, tuples[i-1]...), mustTuple(t, tuples[i]...)) >= 0 {
+			t.Fatalf("%#v doesn't sort before %#v", tuples[i-1], tuples[i])
+		}
+	}
+	// the elements after a descending one still ascend
+	tuples = [][]any{
+		{Desc{"b"}, 1},
+		{Desc{"b"}, 2},
+		{Desc{"ab"}, 1},
+		{Desc{"a"}, 1},
+		{Desc{"a"}, 1, Desc{2}},
+		{Desc{"a"}, 1, Desc{1}},
+		{Desc{"a"}, 2},
+	}
+	for i := 1; i < len(tuples); i++ {
+		if bytes.Compare(mustTuple(t, tuples[i-1]...), mustTuple(t, tuples[i]...)) >= 0 {
+			t.Fatalf("%#v doesn't sort before %#v", tuples[i-1], tuples[i])
+		}
+	}
+}
+
+func TestTupleDecode(t *testing.T) {
+	elems := append([]any{}, tupleOrder...)
+	for _, elem := range tupleOrder {
+		elems = append(elems, Desc{elem})
+	}
+	got, err := DecodeTuple(mustTuple(t, elems...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, elem := range elems {
+		if desc, ok := elem.(Desc); ok {
+			elem = desc.V
+		}
+		if n, ok := elem.(int); ok {
+			elem = int64(n)
+		}
+		if !reflect.DeepEqual(got[i], elem) {
+			t.Fatalf("element %d: %#v, want %#v", i, got[i], elem)
+		}
+	}
+
+	if _, err := AppendTuple(nil, float32(1)); !errors.Is(err, ErrBadTuple) {
+		t.Fatalf("AppendTuple of a float32: %v", err)
+	}
+	for _, bad := range [][]byte{{TUPLE_INT, 1, 2}, {TUPLE_STRING, 'a'}, {0x77}, {^byte(TUPLE_INT)}} {
+		if _, err := DecodeTuple(bad); !errors.Is(err, ErrBadTuple) {
+			t.Fatalf("DecodeTuple(%x): %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// Tx is a transaction on a KV. A transaction works on its own copy of the root pointer:
+// updates copy the touched nodes into freshly allocated pages (copy-on-write), so the
+// committed tree is never modified. Commit writes the new pages and then flips the master
+// page to the new root, Rollback simply drops the new pages.
+//
+// There can be one writable transaction at a time. A read-only transaction sees the version
+// of the tree that was committed when it began, no matter what is committed meanwhile, and
+// can run concurrently with other transactions. The pages of that version are not reused
+// until the transaction is closed, so read-only transactions should not be left open.
+type Tx struct {
+	db       *KV
+	tree     BTree // a copy of the tree with the root of this transaction
+	root     uint64
+	version  uint64                     // the version of the committed tree the transaction began on
+	chunks   [][]byte                   // the chunks mapped when the transaction began
+	flushed  uint64                     // the number of pages in the main file when the transaction began
+	wal      *walIndex                  // the pages in the WAL when the transaction began, in WAL mode
+	buckets  map[string]*Bucket         // the buckets opened by the transaction, see bucket.go
+	expiry   *expiryIndex               // the expiry index, if the transaction used it, see ttl.go
+	indexes  map[string]*secondaryIndex // the secondary indexes used by the transaction, see index.go
+	noIndex  bool                       // the database has no indexes, see checkUnindexed
+	pins     map[uint64]int             // the versions pinned (1) and unpinned (-1) by the transaction, see snapshot.go
+	branchOf *Branch                    // the branch the transaction works on, see branch.go
+	main     uint64                     // the root of the main tree, in a transaction on a branch
+	watch    bool                       // record the changes for the watchers, see watch.go
+	changes  []Event                    // the changes recorded for the watchers
+	shared   bool                       // began by a follower in shared mode, see lease.go
+	batch    *leaseBatch                // the updates of a writable transaction of a follower
+	writable bool
+	done     bool
+}
+
+// Begin starts a new transaction. Read-only transactions never block. A writable transaction
+// waits for the one in progress to finish, so a goroutine must not begin a writable transaction
+// (or call KV.Set/KV.Del) while it has another one open.
+// A frozen database or one opened from memory can't be written, Begin(true) returns ErrReadOnly.
+func (db *KV) Begin(writable bool) (*Tx, error) {
+	if writable && (db.static || db.flags&MASTER_FLAG_FROZEN != 0) {
+		return nil, ErrReadOnly
+	}
+	if db.lease != nil && !db.lease.leader.Load() {
+		return db.lease.begin(db, writable)
+	}
+	if writable {
+		db.writer.Lock()
+		// freeRelease needs them
+		if err := db.pinsLoad(); err != nil {
+			db.writer.Unlock()
+			return nil, err
+		}
+	}
+	db.mu.Lock()
+	tx := &Tx{
+		db:       db,
+		tree:     db.tree,
+		root:     db.tree.root,
+		version:  db.version,
+		chunks:   db.mmap.chunks,
+		flushed:  db.page.flushed,
+		writable: writable,
+	}
+	if db.wal.fp != nil {
+		tx.flushed = db.wal.base
+		tx.wal = db.wal.index
+	}
+	tx.tree.get = tx.pageGet
+	tx.tree.prefetch = tx.pagePrefetch
+	tx.tree.now = time.Now().UnixMilli()
+	if writable {
+		db.freeRelease()
+	} else {
+		db.readers[tx.version]++
+	}
+	db.mu.Unlock()
+	if writable {
+		tx.watch = db.watching()
+	}
+	if err := tx.loadDict(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return tx, nil
+}
+
+// pageGet dereferences a pointer to a page of the transaction's tree.
+// A writable transaction also sees the pages it allocated.
+func (tx *Tx) pageGet(ptr uint64) (BNode, error) {
+	if tx.writable {
+		if data, ok := tx.db.page.updates[ptr]; ok {
+			return BNode{data: data}, nil
+		}
+	}
+	if tx.wal != nil {
+		data, ok, err := tx.wal.get(ptr)
+		if err != nil {
+			return BNode{}, fmt.Errorf("page %d: %w", ptr, err)
+		}
+		if ok {
+			return BNode{data: data}, nil
+		}
+	}
+	return tx.db.pageGet(tx.chunks, tx.flushed, ptr)
+}
+
+// pagePrefetch asks the OS to read the given pages of the mapped file in the background,
+// or reads them from the server for a remote database.
+// Pages that are in memory anyway, and invalid pointers, are skipped.
+func (tx *Tx) pagePrefetch(ptrs []uint64) {
+	if tx.db.remote != nil {
+		if tx.db.Constrained {
+			return // reading ahead needs goroutines
+		}
+		valid := ptrs[:0:0]
+		for _, ptr := range ptrs {
+			if ptr < tx.flushed {
+				valid = append(valid, ptr)
+			}
+		}
+		tx.db.remote.prefetch(valid)
+		return
+	}
+	for _, ptr := range ptrs {
+		if ptr >= tx.flushed {
+			continue
+		}
+		if tx.wal != nil {
+			if tx.wal.has(ptr) {
+				continue
+			}
+		}
+		page := pageGetMapped(tx.chunks, tx.db.page.size, ptr)
+		madvise(page.data) // only a hint
+	}
+}
+
+// check returns an error if the transaction can't be used for the requested operation.
+func (tx *Tx) check(write bool) error {
+	if tx.done {
+		return ErrTxClosed
+	}
+	if write && !tx.writable {
+		return ErrTxReadOnly
+	}
+	return nil
+}
+
+// Get reads a key as seen by the transaction, including its own uncommitted updates.
+// The returned value points into the mapped file and is only valid until the transaction is closed.
+func (tx *Tx) Get(key []byte) ([]byte, bool, error) {
+	if err := tx.check(false); err != nil {
+		return nil, false, err
+	}
+	if tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_GET, key, nil)
+	}
+	if tx.batch != nil {
+		if u, ok := tx.batch.get(key); ok {
+			return u.val, !u.del, nil
+		}
+	}
+	return tx.tree.Get(key)
+}
+
+// Seek returns a cursor positioned at the first key that is greater than or equal to the given key.
+// The cursor must not be used after the next Set or Del in this transaction.
+func (tx *Tx) Seek(key []byte) *Cursor {
+	if err := tx.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return tx.tree.Seek(key)
+}
+
+// SeekLE returns a cursor positioned at the last key that is less than or equal to the given key,
+// to iterate in descending order with Prev. The cursor must not be used after the next Set or Del.
+func (tx *Tx) SeekLE(key []byte) *Cursor {
+	if err := tx.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return tx.tree.SeekLE(key)
+}
+
+// Last returns a cursor positioned at the last key, to iterate in descending order with Prev.
+// The cursor must not be used after the next Set or Del in this transaction.
+func (tx *Tx) Last() *Cursor {
+	if err := tx.check(false); err != nil {
+		return &Cursor{err: err}
+	}
+	return tx.tree.Last()
+}
+
+// ScanPrefix calls fn for each key that starts with prefix, in ascending order. It stops at the
+// first error returned by fn and returns it. The key and the value point into the mapped file
+// and are only valid during the call, and fn must not update the transaction.
+func (tx *Tx) ScanPrefix(prefix []byte, fn func(k, v []byte) error) error {
+	end := prefixEnd(prefix)
+	c := tx.Seek(prefix)
+	for ; c.Valid(); c.Next() {
+		if end != nil && bytes.Compare(c.Key(), end) >= 0 {
+			break
+		}
+		if err := fn(c.Key(), c.Val()); err != nil {
+			return err
+		}
+	}
+	return c.Err()
+}
+
+// prefixEnd returns the first key after all the keys that start with prefix: the prefix with
+// its last byte incremented, after dropping the trailing 0xff bytes that can't be.
+// It's nil if there is no such key, for an empty prefix or one of only 0xff bytes.
+func prefixEnd(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			end := bytes.Clone(prefix[:i+1])
+			end[i]++
+			return end
+		}
+	}
+	return nil
+}
+
+// Set inserts or updates a key. The change becomes visible to others on Commit.
+func (tx *Tx) Set(key []byte, val []byte) error {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	if tx.batch != nil {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		if err := tx.tree.vals.checkVal(val); err != nil {
+			return err
+		}
+		tx.batch.add(false, key, val)
+	} else {
+		if err := tx.indexUpdate(key, val, true); err != nil {
+			return err
+		}
+		if err := tx.tree.Insert(key, val); err != nil {
+			return err
+		}
+		tx.watched(key, val, false)
+	}
+	// recorded once it succeeded, the application may go on after an error
+	if tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_SET, key, val)
+	}
+	return nil
+}
+
+// Del deletes a key and reports whether it existed. The change becomes visible to others on Commit.
+func (tx *Tx) Del(key []byte) (bool, error) {
+	if err := tx.check(true); err != nil {
+		return false, err
+	}
+	var ok bool
+	var err error
+	if tx.batch != nil {
+		ok, err = tx.batch.del(&tx.tree, key)
+	} else {
+		if err := tx.indexUpdate(key, nil, false); err != nil {
+			return false, err
+		}
+		ok, err = tx.tree.Delete(key)
+		if ok {
+			tx.watched(key, nil, true)
+		}
+	}
+	if err == nil && tx.db.Trace != nil {
+		tx.db.Trace.record(TRACE_DEL, key, nil)
+	}
+	return ok, err
+}
+
+// CompareAndSwap sets the key to new if its value is expectedOld, and reports whether it did.
+// A nil expectedOld means that the key must not exist, a nil new deletes the key.
+// Nothing else writes while a writable transaction is open, so the check and the update are
+// atomic. A follower in shared mode returns errors.ErrUnsupported, its updates are only
+// applied by the leader on Commit (see lease.go).
+func (tx *Tx) CompareAndSwap(key []byte, expectedOld []byte, new []byte) (bool, error) {
+	if err := tx.check(true); err != nil {
+		return false, err
+	}
+	if err := tx.checkLocal(); err != nil {
+		return false, err
+	}
+	old, ok, err := tx.Get(key)
+	if err != nil {
+		return false, err
+	}
+	if ok != (expectedOld != nil) || !bytes.Equal(old, expectedOld) {
+		return false, nil
+	}
+	if new == nil {
+		_, err = tx.Del(key)
+	} else {
+		err = tx.Set(key, new)
+	}
+	return err == nil, err
+}
+
+// Commit persists the updates of a writable transaction. The master page is only updated after
+// all new pages are on disk, so a crash leaves either the old or the new tree.
+// The transaction is closed afterwards, even on error, in which case nothing was committed.
+func (tx *Tx) Commit() (err error) {
+	if err := tx.check(true); err != nil {
+		return err
+	}
+	db := tx.db
+	tx.done = true
+	if tx.shared {
+		return db.lease.commit(db, tx)
+	}
+	defer db.trainMaybe(tx.tree.vals) // after the writer is unlocked, the job waits for it
+	defer db.writer.Unlock()
+	defer func() { tx.tree.vals.keepSamples(err == nil) }()
+	if db.Trace != nil {
+		// once the outcome is known, before the next writer records anything
+		defer func() {
+			if err != nil {
+				db.Trace.record(TRACE_ROLLBACK, nil, nil)
+			} else {
+				db.Trace.record(TRACE_COMMIT, nil, nil)
+			}
+		}()
+	}
+	err = tx.flushBuckets()
+	if err == nil {
+		err = tx.flushExpiry()
+	}
+	if err == nil {
+		err = tx.flushIndexes()
+	}
+	if err != nil {
+		db.pageReset()
+		return fmt.Errorf("commit: %w", err)
+	}
+	if tx.tree.root == tx.root {
+		db.pageReset()
+		return nil // nothing changed
+	}
+	if tx.branchOf != nil {
+		if err := tx.branchCommit(); err != nil {
+			db.pageReset()
+			return fmt.Errorf("commit: %w", err)
+		}
+	}
+	if err := flushPages(db, tx.tree.root); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	if tx.changes != nil {
+		db.watchSend(tx.changes, tx.version+1)
+	}
+	if tx.pins != nil {
+		db.pinsAdd(tx.pins)
+	}
+	return nil
+}
+
+// Rollback discards the updates of the transaction and closes it.
+// Calling Rollback on a closed transaction is a no-op, so it can be deferred.
+func (tx *Tx) Rollback() {
+	if tx.done {
+		return
+	}
+	tx.done = true
+	db := tx.db
+	if tx.shared {
+		db.lease.end(db, tx)
+		return
+	}
+	if !tx.writable {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.readersAdd(tx.version, -1)
+		return
+	}
+	defer db.writer.Unlock()
+	tx.tree.vals.keepSamples(false)
+	if db.Trace != nil {
+		db.Trace.record(TRACE_ROLLBACK, nil, nil)
+	}
+	// the pages allocated by the transaction were never linked into the committed tree
+	db.pageReset()
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// openTest opens a database in a temporary directory unless db.Path is set,
+// and closes it when the test ends.
+func openTest(t *testing.T, db *KV) *KV {
+	t.Helper()
+	if db.Path == "" {
+		db.Path = t.TempDir() + "/db"
+	}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+// wantGet checks the value of a key as seen by a transaction, "" for a missing key.
+func wantGet(t *testing.T, tx *Tx, key string, want string) {
+	t.Helper()
+	val, ok, err := tx.Get([]byte(key))
+	if err != nil || ok != (want != "") || string(val) != want {
+		t.Fatalf("%s = %q, %v, %v, want %q", key, val, ok, err, want)
+	}
+}
+
+func TestTxCommitRollback(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Del([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "a", "")
+	wantGet(t, tx, "b", "2")
+	tx.Rollback()
+	if err := tx.Set([]byte("c"), nil); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("Set on a closed transaction: %v", err)
+	}
+
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGet(t, tx, "a", "1")
+	wantGet(t, tx, "b", "")
+	for i := 0; i < 1000; i++ {
+		if err := tx.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxClosed) {
+		t.Fatalf("second Commit: %v", err)
+	}
+	db.Close()
+
+	db = openTest(t, &KV{Path: path})
+	ro, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Rollback()
+	wantGet(t, ro, "a", "1")
+	wantGet(t, ro, "k0999", "999")
+	if err := ro.Set([]byte("a"), nil); !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("Set on a read-only transaction: %v", err)
+	}
+	if err := ro.Commit(); !errors.Is(err, ErrTxReadOnly) {
+		t.Fatalf("Commit of a read-only transaction: %v", err)
+	}
+}
+
+// The pages of a rolled back transaction are reused, the file doesn't grow.
+func TestTxRollbackPages(t *testing.T) {
+	db := openTest(t, &KV{})
+	if err := db.Set([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	pages := db.Stats().Pages
+	for round := 0; round < 10; round++ {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 500; i++ {
+			if err := tx.Set([]byte(fmt.Sprint("key", i)), make([]byte, 100)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tx.Rollback()
+	}
+	if got := db.Stats().Pages; got != pages {
+		t.Fatalf("%d pages after the rollbacks, want %d", got, pages)
+	}
+}
+
+// A read-only transaction sees the version committed when it began, while writers commit
+// concurrently and reuse the pages freed by the versions that are not read anymore.
+func TestTxSnapshotIsolation(t *testing.T) {
+	db := openTest(t, &KV{})
+	const keys, commits = 50, 200
+	write := func(round int) {
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer tx.Rollback()
+		for i := 0; i < keys; i++ {
+			// large values, so that each commit touches several pages
+			val := fmt.Sprintf("%0200d", round)
+			if err := tx.Set([]byte(fmt.Sprint("key", i)), []byte(val)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Error(err)
+		}
+	}
+	write(0)
+	old, err := db.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Rollback()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for round := 1; round <= commits; round++ {
+			write(round)
+		}
+	}()
+	defer func() { <-done }() // before the database is closed
+	readers := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					readers <- nil
+					return
+				default:
+				}
+				tx, err := db.Begin(false)
+				if err != nil {
+					readers <- err
+					return
+				}
+				var first string
+				n := 0
+				c := tx.Seek(nil)
+				for ; c.Valid(); c.Next() {
+					if n == 0 {
+						first = string(c.Val())
+					}
+					if string(c.Val()) != first {
+						err = fmt.Errorf("%s = %.8q... in the version of %.8q...", c.Key(), c.Val(), first)
+						break
+					}
+					n++
+				}
+				if err == nil && c.Err() != nil {
+					err = c.Err()
+				}
+				if err == nil && n != keys {
+					err = fmt.Errorf("%d keys, want %d", n, keys)
+				}
+				tx.Rollback()
+				if err != nil {
+					readers <- err
+					return
+				}
+			}
+		}()
+	}
+	for r := 0; r < 4; r++ {
+		if err := <-readers; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < keys; i++ {
+		wantGet(t, old, fmt.Sprint("key", i), fmt.Sprintf("%0200d", 0))
+	}
+}
+
+func TestTxCompareAndSwap(t *testing.T) {
+	db := openTest(t, &KV{})
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	tests := []struct {
+		old, new string // "" for nil
+		swapped  bool
+		want     string
+	}{
+		{"1", "2", false, ""}, // the key doesn't exist
+		{"", "1", true, "1"},
+		{"", "2", false, "1"}, // the key exists
+		{"2", "3", false, "1"},
+		{"1", "2", true, "2"},
+		{"2", "", true, ""}, // deleted
+		{"", "", true, ""},  // nothing to delete
+	}
+	bytesOf := func(s string) []byte {
+		if s == "" {
+			return nil
+		}
+		return []byte(s)
+	}
+	for i, test := range tests {
+		swapped, err := tx.CompareAndSwap([]byte("k"), bytesOf(test.old), bytesOf(test.new))
+		if err != nil || swapped != test.swapped {
+			t.Fatalf("%d: swapped %v, %v", i, swapped, err)
+		}
+		wantGet(t, tx, "k", test.want)
+	}
+}
+
+// Concurrent increments with KV.CompareAndSwap that retry on a mismatch don't lose updates.
+func TestKVCompareAndSwap(t *testing.T) {
+	db := openTest(t, &KV{})
+	const workers, increments = 4, 50
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := 0; i < increments; {
+				old, ok, err := db.Get([]byte("counter"))
+				if err != nil {
+					errs <- err
+					return
+				}
+				n := 0
+				if ok {
+					fmt.Sscan(string(old), &n)
+				}
+				swapped, err := db.CompareAndSwap([]byte("counter"), old, []byte(fmt.Sprint(n+1)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if swapped {
+					i++
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < workers; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	val, _, err := db.Get([]byte("counter"))
+	if err != nil || string(val) != fmt.Sprint(workers*increments) {
+		t.Fatalf("counter = %q, %v, want %d", val, err, workers*increments)
+	}
+}
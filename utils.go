@@ -1,5 +1,7 @@
 package main
 
+// assert panics if the condition doesn't hold. It is only meant for internal invariants,
+// invalid input and corrupted pages are reported as errors (see errors.go).
 func assert(condition bool) {
 	if !condition {
 		panic("Assertion failed!")
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The values are stored as they are, unless the database was created with KV.CompressValues,
+// KV.ValueChecksums or KV.ExpiringKeys:
+// | deadline | tag | value | crc32c |
+// | uvarint  | 1B  | ...   | 4B     |
+// The deadline is only there with ExpiringKeys, it's when the key expires in unix milliseconds,
+// 0 if it doesn't, see ttl.go. The tag (VAL_*) is only there with CompressValues, the value may
+// then be compressed, see dict.go. The checksum is only there with ValueChecksums. It's the
+// CRC32C of the value as it was passed to Set, before the compression. So unlike the page
+// checksums it also catches a value that was corrupted before it was written, like by bad memory
+// during the compression or by a bug in the codec. A mismatch is reported as ErrValueChecksum.
+
+// tags at the start of the values of a database with KV.CompressValues
+const (
+	VAL_RAW  = 0 // the value follows as is
+	VAL_ZSTD = 1 // a zstd frame compressed with the dictionary of the database
+)
+
+const (
+	// the size of the checksum at the end of the values of a database with KV.ValueChecksums
+	VAL_CHECKSUM = 4
+	// the maximum size of the deadline of the values of a database with KV.ExpiringKeys,
+	// 8 bytes of uvarint last for a million years
+	VAL_DEADLINE = 8
+)
+
+// valCodec encodes the values of a database with KV.CompressValues, KV.ValueChecksums
+// or KV.ExpiringKeys.
+// With CompressValues it has no encoder and decoder until the dictionary is trained.
+// A trained codec is immutable and shared by all transactions, an untrained one collects
+// samples from the writable transaction, which are kept if it's committed, see keepSamples.
+type valCodec struct {
+	tagged  bool // KV.CompressValues
+	summed  bool // KV.ValueChecksums
+	timed   bool // KV.ExpiringKeys
+	dict    []byte
+	enc     *zstd.Encoder
+	dec     *zstd.Decoder
+	samples [][]byte    // of the committed values, only accessed while holding db.writer
+	pending [][]byte    // of the values of the writable transaction
+	ready   atomic.Bool // DICT_SAMPLES values were sampled
+}
+
+// checkVal validates a value for the codec, the deadline, the tag and the checksum take bytes
+// of the value size limit. A nil codec stores the values as they are.
+func (c *valCodec) checkVal(val []byte) error {
+	if err := checkVal(val); err != nil {
+		return err
+	}
+	limit := BTREE_MAX_VAL_SIZE
+	if c != nil && c.timed {
+		limit -= VAL_DEADLINE
+	}
+	if c != nil && c.tagged {
+		limit--
+	}
+	if c != nil && c.summed {
+		limit -= VAL_CHECKSUM
+	}
+	if len(val) > limit {
+		return fmt.Errorf("%w: %d bytes, the limit is %d in this database", ErrValTooLarge, len(val), limit)
+	}
+	return nil
+}
+
+// encode returns the value as it's stored, with the given deadline (0 for none), and samples it
+// if there is no dictionary yet. A nil codec returns the value itself.
+func (c *valCodec) encode(val []byte, deadline int64) []byte {
+	if c == nil {
+		return val
+	}
+	var stored []byte
+	if c.timed {
+		stored = binary.AppendUvarint(stored, uint64(deadline))
+	}
+	if c.tagged {
+		stored = c.compress(stored, val)
+	} else {
+		stored = append(stored, val...)
+	}
+	if c.summed {
+		stored = binary.LittleEndian.AppendUint32(stored, crc32.Checksum(val, castagnoli))
+	}
+	return stored
+}
+
+// compress appends the tagged value to dst, compressed if there is a dictionary and it gets smaller.
+func (c *valCodec) compress(dst []byte, val []byte) []byte {
+	if len(val) >= DICT_MIN_VAL_SIZE {
+		if c.enc == nil && len(c.samples)+len(c.pending) < DICT_SAMPLES {
+			c.pending = append(c.pending, bytes.Clone(val[:min(len(val), DICT_SAMPLE_SIZE)]))
+		}
+		if c.enc != nil {
+			if z := c.enc.EncodeAll(val, append(dst, VAL_ZSTD)); len(z)-len(dst) <= len(val) {
+				return z
+			}
+		}
+	}
+	return append(append(dst, VAL_RAW), val...)
+}
+
+// keepSamples ends the writable transaction for the samples: they are kept if it was
+// committed and dropped otherwise. A nil codec does nothing.
+func (c *valCodec) keepSamples(committed bool) {
+	if c == nil || len(c.pending) == 0 {
+		return
+	}
+	if committed {
+		c.samples = append(c.samples, c.pending...)
+		c.ready.Store(len(c.samples) >= DICT_SAMPLES)
+	}
+	c.pending = nil
+}
+
+// close releases the encoder and the decoder of a trained codec. A nil codec does nothing.
+func (c *valCodec) close() {
+	if c == nil || c.enc == nil {
+		return
+	}
+	_ = c.enc.Close()
+	c.dec.Close()
+}
+
+// decode returns the value stored as the given bytes. A nil codec returns them as they are.
+func (c *valCodec) decode(stored []byte) ([]byte, error) {
+	if c == nil {
+		return stored, nil
+	}
+	if c.timed {
+		_, n := binary.Uvarint(stored)
+		if n <= 0 {
+			return nil, fmt.Errorf("%w: bad value deadline", ErrCorruptNode)
+		}
+		stored = stored[n:]
+	}
+	var sum uint32
+	if c.summed {
+		if len(stored) < VAL_CHECKSUM {
+			return nil, fmt.Errorf("%w: value without a checksum", ErrCorruptNode)
+		}
+		n := len(stored) - VAL_CHECKSUM
+		stored, sum = stored[:n], binary.LittleEndian.Uint32(stored[n:])
+	}
+	val := stored
+	if c.tagged {
+		var err error
+		if val, err = c.decompress(stored); err != nil {
+			return nil, err
+		}
+	}
+	if c.summed && crc32.Checksum(val, castagnoli) != sum {
+		return nil, ErrValueChecksum
+	}
+	return val, nil
+}
+
+// hasDeadlines reports whether the values have a deadline, with KV.ExpiringKeys.
+func (c *valCodec) hasDeadlines() bool {
+	return c != nil && c.timed
+}
+
+// deadline returns the deadline of a stored value, 0 if it doesn't expire.
+func (c *valCodec) deadline(stored []byte) int64 {
+	if !c.hasDeadlines() {
+		return 0
+	}
+	d, n := binary.Uvarint(stored)
+	if n <= 0 {
+		return 0 // reported by decode
+	}
+	return int64(d)
+}
+
+// expired reports whether a stored value expired at the given time, in unix milliseconds.
+func (c *valCodec) expired(stored []byte, now int64) bool {
+	d := c.deadline(stored)
+	return d != 0 && d <= now
+}
+
+// decompress returns the value of a tagged value.
+func (c *valCodec) decompress(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("%w: value without a tag", ErrCorruptNode)
+	}
+	switch {
+	case stored[0] == VAL_RAW:
+		return stored[1:], nil
+	case stored[0] == VAL_ZSTD && c.dec != nil:
+		val, err := c.dec.DecodeAll(stored[1:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: compressed value: %w", ErrCorruptNode, err)
+		}
+		return val, nil
+	case stored[0] == VAL_ZSTD:
+		return nil, fmt.Errorf("%w: compressed value without a dictionary", ErrCorruptNode)
+	default:
+		return nil, fmt.Errorf("%w: bad value tag %d", ErrCorruptNode, stored[0])
+	}
+}
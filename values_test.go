@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// A value that doesn't match its checksum is reported instead of being returned,
+// even when the page around it is intact.
+func TestValueChecksumMismatch(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path, ValueChecksums: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("good"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set([]byte("big"), make([]byte, BTREE_MAX_VAL_SIZE-VAL_CHECKSUM+1)); !errors.Is(err, ErrValTooLarge) {
+		t.Fatalf("Set of a value without room for the checksum: %v", err)
+	}
+	db.Close()
+
+	// the option is kept in the file
+	db = openTest(t, &KV{Path: path})
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	wantGet(t, tx, "good", "value")
+	// store a value whose checksum is of another one, past the codec
+	stored := tx.tree.vals.encode([]byte("value"), 0)
+	stored[0] = 'V'
+	vals := tx.tree.vals
+	tx.tree.vals = nil
+	err = tx.tree.Insert([]byte("bad"), stored)
+	tx.tree.vals = vals
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tx.Get([]byte("bad")); !errors.Is(err, ErrValueChecksum) {
+		t.Fatalf("Get of a corrupted value: %v", err)
+	}
+	wantGet(t, tx, "good", "value")
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"sync"
+)
+
+// WAL_SIG is the signature at the start of a write-ahead log
+const WAL_SIG = "SDBWAL03"
+
+// WAL_SIG_V2 is the signature of a log whose records don't have the free list. It's still
+// replayed, without the free list, and then started over with WAL_SIG.
+const WAL_SIG_V2 = "SDBWAL02"
+
+// WAL_CHECKPOINT_PAGES is the default number of page images in the WAL that triggers a checkpoint
+const WAL_CHECKPOINT_PAGES = 1024
+
+// In WAL mode a commit doesn't write its pages into the main file, which means random writes
+// all over the file. Instead it appends the page images and the new master page to the WAL
+// and syncs the WAL only. A checkpoint later copies the pages into the main file, updates
+// the master page and empties the WAL.
+//
+// The WAL starts with a header:
+// | sig | page_size |
+// | 8B  | 4B        |
+// followed by a sequence of commit records:
+// | npages | btree_root | page_used | version | free | pages                     | crc32c |
+// | 4B     | 8B         | 8B        | 8B      | 8B   | npages * (8B + page_size) | 4B     |
+// each page is the page pointer (8B) followed by the page image, free is the first page of
+// the free list (see freelist.go). The checksum covers the whole record, so a record that was
+// only partly written before a crash is detected and dropped together with everything after it.
+const (
+	WAL_HEADER           = 8 + 4
+	WAL_RECORD_HEADER    = 4 + 8 + 8 + 8 + 8
+	WAL_RECORD_HEADER_V2 = 4 + 8 + 8 + 8 // without the free list, see WAL_SIG_V2
+)
+
+// walZero pads the page images in the WAL to the page size
+var walZero [BTREE_MAX_PAGE_SIZE]byte
+
+// walIndex maps page pointers to the latest page images committed to the WAL.
+// A transaction keeps the index it began with, a checkpoint starts a new one.
+// After a lazy replay the images are only read from the WAL when they are used.
+type walIndex struct {
+	mu       sync.RWMutex
+	pages    map[uint64][]byte
+	lazy     map[uint64]int64 // page pointer -> offset of the image in the WAL, not read yet
+	fp       *os.File
+	pageSize int
+}
+
+func newWalIndex(db *KV) *walIndex {
+	return &walIndex{pages: map[uint64][]byte{}, lazy: map[uint64]int64{}, fp: db.wal.fp, pageSize: db.page.size}
+}
+
+// get returns the image of a page, reading it from the WAL if needed.
+func (idx *walIndex) get(ptr uint64) ([]byte, bool, error) {
+	idx.mu.RLock()
+	data, ok := idx.pages[ptr]
+	off, lazy := idx.lazy[ptr]
+	idx.mu.RUnlock()
+	if ok || !lazy {
+		return data, ok, nil
+	}
+	data = make([]byte, idx.pageSize)
+	if _, err := idx.fp.ReadAt(data, off); err != nil {
+		return nil, false, fmt.Errorf("read WAL: %w", err)
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if _, ok := idx.lazy[ptr]; ok { // unless another reader was faster
+		idx.pages[ptr] = data
+		delete(idx.lazy, ptr)
+	}
+	return idx.pages[ptr], true, nil
+}
+
+// has reports whether the WAL has an image of the page, without reading it.
+func (idx *walIndex) has(ptr uint64) bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	_, ok := idx.pages[ptr]
+	_, lazy := idx.lazy[ptr]
+	return ok || lazy
+}
+
+// set records the latest image of a page. The caller holds idx.mu for writing, or is replaying.
+func (idx *walIndex) set(ptr uint64, data []byte) {
+	idx.pages[ptr] = data
+	delete(idx.lazy, ptr)
+}
+
+// load reads all the images that were not read yet, so that the transactions using
+// the index don't need the WAL anymore.
+func (idx *walIndex) load() error {
+	idx.mu.RLock()
+	lazy := maps.Clone(idx.lazy)
+	idx.mu.RUnlock()
+	for ptr := range lazy {
+		if _, _, err := idx.get(ptr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walOpen opens the WAL next to the database file and replays the commits in it into the
+// main file. The WAL is kept open for the following commits if db.WAL is set.
+// A database that isn't in WAL mode still replays a WAL left over from an earlier session.
+//
+// In WAL mode the recovery is lazy unless db.FullRecovery is set, so that Open returns
+// quickly: the replay only reads the page pointers of the commits (see walReplay), and the
+// checkpoint that copies the pages into the main file runs in the background. Until then
+// the pages are read from the WAL, like the pages of the commits that follow.
+func walOpen(db *KV) error {
+	path := db.Path + "-wal"
+	flags := os.O_RDWR
+	if db.WAL {
+		flags |= os.O_CREATE
+	}
+	fp, err := os.OpenFile(path, flags, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	db.wal.fp = fp
+	db.wal.index = newWalIndex(db)
+	lazy := db.WAL && !db.FullRecovery
+	legacy, err := walReplay(db, lazy)
+	if err != nil {
+		return fmt.Errorf("WAL: %w", err)
+	}
+	if lazy && !legacy {
+		if db.wal.npages > 0 {
+			scheduleCheckpoint(db)
+		}
+		return nil
+	}
+	if err := walCheckpoint(db); err != nil {
+		return fmt.Errorf("WAL: %w", err)
+	}
+	if legacy && db.WAL {
+		if err := walStart(db); err != nil {
+			return fmt.Errorf("WAL: %w", err)
+		}
+	}
+	if !db.WAL {
+		db.wal.fp = nil
+		db.wal.index = nil
+		_ = fp.Close()
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// walReplay reads the complete records of the WAL into the index and makes the last one
+// the committed tree. An incomplete record at the end is truncated. It reports whether the WAL
+// has the WAL_SIG_V2 format, which is replayed in full. Its records don't have the free list,
+// so the pages that were free when it was written are lost.
+//
+// A lazy replay only reads the header and the page pointers of the records, not the page
+// images, and doesn't verify their checksums. Only the last record can be incomplete, since
+// each record is synced before the next one is appended, so the last record (or any record
+// that doesn't follow the previous version) is still read and verified completely.
+func walReplay(db *KV, lazy bool) (bool, error) {
+	fi, err := db.wal.fp.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat: %w", err)
+	}
+	if fi.Size() == 0 {
+		return false, walStart(db)
+	}
+
+	r := io.NewSectionReader(db.wal.fp, 0, fi.Size())
+	var header [WAL_RECORD_HEADER]byte
+	if _, err := io.ReadFull(r, header[:WAL_HEADER]); err != nil {
+		return false, errors.New("bad signature")
+	}
+	legacy := string(header[:8]) == WAL_SIG_V2
+	if !legacy && string(header[:8]) != WAL_SIG {
+		return false, errors.New("bad signature")
+	}
+	recordHeader := WAL_RECORD_HEADER
+	if legacy {
+		recordHeader, lazy = WAL_RECORD_HEADER_V2, false
+		db.free.head = 0
+	}
+	// the master page is only written by a checkpoint, so a new database
+	// takes the page size from the WAL
+	pageSize := int(binary.LittleEndian.Uint32(header[8:]))
+	if db.mmap.file == 0 {
+		if err := checkPageSize(pageSize); err != nil {
+			return false, err
+		}
+		db.setPageSize(pageSize, db.flags)
+		db.wal.index.pageSize = pageSize
+	}
+	if pageSize != db.page.size {
+		return false, fmt.Errorf("page size %d does not match the database page size %d", pageSize, db.page.size)
+	}
+	walPageSize := 8 + pageSize
+	db.wal.size = WAL_HEADER
+	for {
+		if _, err := io.ReadFull(r, header[:recordHeader]); err != nil {
+			break
+		}
+		npages := int64(binary.LittleEndian.Uint32(header[0:]))
+		end := db.wal.size + int64(recordHeader) + npages*int64(walPageSize) + 4
+		if end > fi.Size() {
+			break // a torn record, or a corrupted count that must not be allocated
+		}
+		if version := binary.LittleEndian.Uint64(header[20:]); lazy && end < fi.Size() && version == db.version+1 {
+			if err := walReplayLazy(db, header[:], npages); err != nil {
+				return false, err
+			}
+			if _, err := r.Seek(end, io.SeekStart); err != nil {
+				break
+			}
+			continue
+		}
+		body := make([]byte, end-db.wal.size-int64(recordHeader))
+		if _, err := io.ReadFull(r, body); err != nil {
+			break
+		}
+		crc := crc32.Update(crc32.Checksum(header[:recordHeader], castagnoli), castagnoli, body[:len(body)-4])
+		if crc != binary.LittleEndian.Uint32(body[len(body)-4:]) {
+			break
+		}
+		root := binary.LittleEndian.Uint64(header[4:])
+		used := binary.LittleEndian.Uint64(header[12:])
+		version := binary.LittleEndian.Uint64(header[20:])
+		var free uint64
+		if !legacy {
+			free = binary.LittleEndian.Uint64(header[28:])
+		}
+		if !(root < used) || !(free < used) {
+			return false, fmt.Errorf("bad commit record at offset %d", db.wal.size)
+		}
+		for i := 0; i < int(npages); i++ {
+			page := body[i*walPageSize:]
+			ptr := binary.LittleEndian.Uint64(page)
+			if !(1 <= ptr && ptr < used) {
+				return false, fmt.Errorf("bad page pointer %d at offset %d", ptr, db.wal.size)
+			}
+			db.wal.index.set(ptr, page[8:walPageSize])
+		}
+		db.wal.npages += int(npages)
+		db.wal.size = end
+		db.tree.root = root
+		db.page.flushed = used
+		db.version = version
+		db.free.head = free
+	}
+	// drop the torn record so the next commit doesn't end up behind it
+	if db.wal.size < fi.Size() {
+		if err := db.wal.fp.Truncate(db.wal.size); err != nil {
+			return false, fmt.Errorf("truncate: %w", err)
+		}
+	}
+	return legacy, nil
+}
+
+// walStart writes the header of an empty WAL.
+func walStart(db *KV) error {
+	var header [WAL_HEADER]byte
+	copy(header[:], WAL_SIG)
+	binary.LittleEndian.PutUint32(header[8:], uint32(db.page.size))
+	if _, err := db.wal.fp.WriteAt(header[:], 0); err != nil {
+		return fmt.Errorf("write header: %w", err)
+	}
+	db.wal.size = WAL_HEADER
+	return db.wal.fp.Sync()
+}
+
+// walReplayLazy indexes the pages of the record at db.wal.size whose header was read,
+// without reading the page images.
+func walReplayLazy(db *KV, header []byte, npages int64) error {
+	root := binary.LittleEndian.Uint64(header[4:])
+	used := binary.LittleEndian.Uint64(header[12:])
+	free := binary.LittleEndian.Uint64(header[28:])
+	if !(root < used) || !(free < used) {
+		return fmt.Errorf("bad commit record at offset %d", db.wal.size)
+	}
+	walPageSize := 8 + db.page.size
+	var buf [8]byte
+	for i := int64(0); i < npages; i++ {
+		off := db.wal.size + WAL_RECORD_HEADER + i*int64(walPageSize)
+		if _, err := db.wal.fp.ReadAt(buf[:], off); err != nil {
+			return fmt.Errorf("read WAL: %w", err)
+		}
+		ptr := binary.LittleEndian.Uint64(buf[:])
+		if !(1 <= ptr && ptr < used) {
+			return fmt.Errorf("bad page pointer %d at offset %d", ptr, db.wal.size)
+		}
+		delete(db.wal.index.pages, ptr)
+		db.wal.index.lazy[ptr] = off + 8
+	}
+	db.wal.npages += int(npages)
+	db.wal.size += WAL_RECORD_HEADER + npages*int64(walPageSize) + 4
+	db.tree.root = root
+	db.page.flushed = used
+	db.version = binary.LittleEndian.Uint64(header[20:])
+	db.free.head = free
+	return nil
+}
+
+// walAppend commits the pages allocated by the writable transaction to the WAL and publishes
+// the new version. The main file is not touched.
+func walAppend(db *KV, root uint64) error {
+	if uint64(len(db.page.updates)) > math.MaxUint32 {
+		return fmt.Errorf("write WAL: %w: %d pages in a commit", ErrFileTooLarge, len(db.page.updates))
+	}
+	used := db.page.flushed + db.page.nappend
+	rec := db.wal.buf[:0]
+	rec = binary.LittleEndian.AppendUint32(rec, uint32(len(db.page.updates)))
+	rec = binary.LittleEndian.AppendUint64(rec, root)
+	rec = binary.LittleEndian.AppendUint64(rec, used)
+	rec = binary.LittleEndian.AppendUint64(rec, db.version+1)
+	rec = binary.LittleEndian.AppendUint64(rec, db.page.freeHead)
+	for ptr, page := range db.page.updates {
+		rec = binary.LittleEndian.AppendUint64(rec, ptr)
+		rec = append(rec, page...)
+		rec = append(rec, walZero[:db.page.size-len(page)]...)
+	}
+	rec = binary.LittleEndian.AppendUint32(rec, crc32.Checksum(rec, castagnoli))
+	db.wal.buf = rec
+
+	// on failure the size is not advanced, so the next commit overwrites the partial record
+	if _, err := db.wal.fp.WriteAt(rec, db.wal.size); err != nil {
+		return fmt.Errorf("write WAL: %w", err)
+	}
+	if err := db.wal.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	db.wal.size += int64(len(rec))
+
+	// the pages must be in the index before the new root is visible
+	db.wal.index.mu.Lock()
+	for ptr, page := range db.page.updates {
+		db.wal.index.set(ptr, page)
+	}
+	db.wal.index.mu.Unlock()
+
+	db.mu.Lock()
+	db.wal.npages += len(db.page.updates)
+	db.mu.Unlock()
+	publish(db, root, used)
+
+	if db.wal.npages >= db.checkpointPages() && db.Constrained {
+		// the caller holds db.writer, which the checkpoint job would wait for.
+		// the commit is in the WAL already, a failed checkpoint is retried by the next one.
+		_ = walCheckpoint(db)
+		return nil
+	}
+	if db.wal.npages >= db.checkpointPages() && !db.wal.scheduled {
+		scheduleCheckpoint(db)
+	}
+	return nil
+}
+
+// scheduleCheckpoint queues a checkpoint job. The caller holds db.writer, or is opening the database.
+func scheduleCheckpoint(db *KV) {
+	db.wal.scheduled = true
+	_ = db.Schedule(Job{Name: "checkpoint", Priority: 1, Run: func(ctx context.Context) error {
+		// wait for the I/O budget before blocking the writers, not while doing so
+		db.mu.Lock()
+		npages := db.wal.npages
+		db.mu.Unlock()
+		if err := db.JobIO(ctx, npages); err != nil {
+			return err
+		}
+		db.writer.Lock()
+		defer db.writer.Unlock()
+		db.wal.scheduled = false
+		return walCheckpoint(db)
+	}})
+}
+
+// checkpointPages returns the number of page images in the WAL that triggers a checkpoint.
+func (db *KV) checkpointPages() int {
+	if db.CheckpointPages > 0 {
+		return db.CheckpointPages
+	}
+	return WAL_CHECKPOINT_PAGES
+}
+
+// Checkpoint copies the pages committed to the WAL into the main file and empties the WAL.
+// It waits for the writable transaction in progress. Checkpoints also run in the background
+// once the WAL holds CheckpointPages pages.
+func (db *KV) Checkpoint() error {
+	if db.wal.fp == nil {
+		return nil
+	}
+	db.writer.Lock()
+	defer db.writer.Unlock()
+	if err := walCheckpoint(db); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+	return nil
+}
+
+// walCheckpoint moves the pages of the WAL into the main file. The caller holds db.writer.
+// The WAL is only emptied after the main file and its master page are on disk,
+// so a crash in between just replays the WAL again.
+func walCheckpoint(db *KV) error {
+	idx := db.wal.index
+	if db.wal.size == WAL_HEADER {
+		return nil
+	}
+	// the transactions using the index can't read from the WAL after it's emptied.
+	// afterwards the readers don't modify the index anymore.
+	if err := idx.load(); err != nil {
+		return err
+	}
+	npages := db.page.flushed
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	err := extendMmap(db, npages)
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// the index is not modified without db.writer, so it can be read without its lock
+	for ptr, page := range idx.pages {
+		db.pageWrite(ptr, page)
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	if err := masterStore(db, db.tree.root, db.page.flushed, db.version, db.free.head); err != nil {
+		return err
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+
+	if err := db.wal.fp.Truncate(WAL_HEADER); err != nil {
+		return fmt.Errorf("truncate WAL: %w", err)
+	}
+	if err := db.wal.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync WAL: %w", err)
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.wal.size = WAL_HEADER
+	db.wal.npages = 0
+	db.wal.base = db.page.flushed
+	db.wal.index = newWalIndex(db) // transactions that began earlier keep using the old one
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"testing"
+)
+
+// A WAL record whose page count is corrupted to 0xffffffff ends the replay without allocating
+// the pages, the records before it are kept.
+func TestWALBadPageCount(t *testing.T) {
+	tests := []struct {
+		record int // the corrupted record
+		full   bool
+		want   int // the number of keys that survive
+	}{
+		{2, false, 2},
+		{2, true, 2},
+		{1, false, 1},
+		{1, true, 1},
+		{0, false, 0},
+		{0, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("record=%d,full=%v", test.record, test.full), func(t *testing.T) {
+			path := t.TempDir() + "/db"
+			db := &KV{Path: path, WAL: true}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 3; i++ {
+				if err := db.Set([]byte(fmt.Sprint("key", i)), []byte("val")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			db.Close()
+
+			data, err := os.ReadFile(path + "-wal")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var records []int
+			for off := WAL_HEADER; off+WAL_RECORD_HEADER <= len(data); {
+				records = append(records, off)
+				npages := int(binary.LittleEndian.Uint32(data[off:]))
+				off += WAL_RECORD_HEADER + npages*(8+db.page.size) + 4
+			}
+			if len(records) != 3 {
+				t.Fatalf("%d records in the WAL", len(records))
+			}
+			binary.LittleEndian.PutUint32(data[records[test.record]:], 0xffffffff)
+			if err := os.WriteFile(path+"-wal", data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db = &KV{Path: path, WAL: true, FullRecovery: test.full}
+			if err := db.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 3; i++ {
+				_, ok, err := db.Get([]byte(fmt.Sprint("key", i)))
+				if err != nil || ok != (i < test.want) {
+					t.Fatalf("key%d: got %v, %v", i, ok, err)
+				}
+			}
+		})
+	}
+}
+
+// A WAL written before the records had the free list is replayed and started over.
+func TestWALV2(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path, WAL: true}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{}
+	set := func(i int) {
+		key, val := fmt.Sprint("key", i%3), fmt.Sprint("val", i)
+		if err := db.Set([]byte(key), []byte(val)); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = val
+	}
+	for i := 0; i < 10; i++ {
+		set(i)
+	}
+	db.Close()
+
+	// rewrite the records without the free list
+	data, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2 := append([]byte(WAL_SIG_V2), data[8:WAL_HEADER]...)
+	for off := WAL_HEADER; off+WAL_RECORD_HEADER <= len(data); {
+		npages := int(binary.LittleEndian.Uint32(data[off:]))
+		end := off + WAL_RECORD_HEADER + npages*(8+db.page.size) + 4
+		start := len(v2)
+		v2 = append(v2, data[off:off+WAL_RECORD_HEADER_V2]...)
+		v2 = append(v2, data[off+WAL_RECORD_HEADER:end-4]...)
+		v2 = binary.LittleEndian.AppendUint32(v2, crc32.Checksum(v2[start:], castagnoli))
+		off = end
+	}
+	if err := os.WriteFile(path+"-wal", v2, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 2; round++ {
+		db = &KV{Path: path, WAL: true}
+		if err := db.Open(); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range want {
+			val, ok, err := db.Get([]byte(key))
+			if err != nil || !ok || string(val) != want {
+				t.Fatalf("%s: got %q, %v, %v, want %q", key, val, ok, err, want)
+			}
+		}
+		for i := 10; i < 13; i++ {
+			set(10*round + i)
+		}
+		db.Close()
+	}
+	head, err := os.ReadFile(path + "-wal")
+	if err != nil || string(head[:8]) != WAL_SIG {
+		t.Fatalf("the WAL starts with %q: %v", head[:8], err)
+	}
+}
+
+func TestWALDump(t *testing.T) {
+	path := t.TempDir() + "/db"
+	db := &KV{Path: path, WAL: true, CheckpointPages: 1 << 20}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i, key := range []string{"user:1", "order:1", "user:2"} {
+		if err := db.Set([]byte(key), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dump := func(opts walDumpOptions) string {
+		t.Helper()
+		fi, err := db.wal.fp.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.flags = db.flags
+		var out bytes.Buffer
+		if err := walDump(&out, io.NewSectionReader(db.wal.fp, 0, fi.Size()), opts); err != nil {
+			t.Fatal(err)
+		}
+		t.Log(out.String())
+		return out.String()
+	}
+	commits := func(out string) []string {
+		var lsns []string
+		for _, line := range strings.Split(out, "\n") {
+			if lsn, _, ok := strings.Cut(line, ": commit version "); ok {
+				lsns = append(lsns, lsn)
+			}
+		}
+		return lsns
+	}
+
+	all := commits(dump(walDumpOptions{to: math.MaxInt64}))
+	if len(all) != 3 || all[0] != fmt.Sprint("lsn ", WAL_HEADER) {
+		t.Fatalf("commits %v", all)
+	}
+	var second int64
+	fmt.Sscanf(all[1], "lsn %d", &second)
+	if got := commits(dump(walDumpOptions{from: second, to: second})); len(got) != 1 || got[0] != all[1] {
+		t.Fatalf("commits from %d to %d: %v", second, second, got)
+	}
+	// the first commit only wrote user:1, the others wrote leaves with order:1
+	out := dump(walDumpOptions{to: math.MaxInt64, prefix: []byte("order:"), keys: true})
+	if got := commits(out); len(got) != 2 || got[0] != all[1] || strings.Contains(out, `"user:`) || !strings.Contains(out, `"order:1"`) {
+		t.Fatalf("commits with order: keys %v", got)
+	}
+
+	// a torn record ends the dump, like the recovery
+	fi, _ := db.wal.fp.Stat()
+	if err := db.wal.fp.Truncate(fi.Size() - 1); err != nil {
+		t.Fatal(err)
+	}
+	out = dump(walDumpOptions{to: math.MaxInt64})
+	if got := commits(out); len(got) != 2 || !strings.Contains(out, all[2]+": incomplete record") {
+		t.Fatalf("commits of a torn WAL %v", got)
+	}
+}
+
+// A copy of the files of a database in WAL mode that is still open is what a crash leaves:
+// the commits since the last checkpoint are only in the WAL. A torn last record is dropped.
+func TestWALCrashRecovery(t *testing.T) {
+	for _, full := range []bool{false, true} {
+		t.Run(fmt.Sprintf("full=%v", full), func(t *testing.T) {
+			dir := t.TempDir()
+			db := openTest(t, &KV{Path: dir + "/db", WAL: true, CheckpointPages: 16, Constrained: true})
+			want := map[string]string{}
+			for round := 0; round < 30; round++ {
+				tx, err := db.Begin(true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i := 0; i < 20; i++ {
+					key, val := fmt.Sprint("key", (round*7+i)%100), fmt.Sprint(round, "-", i)
+					if err := tx.Set([]byte(key), []byte(val)); err != nil {
+						t.Fatal(err)
+					}
+					if round < 29 {
+						want[key] = val
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if db.wal.base <= 1 || db.wal.npages == 0 {
+				t.Fatalf("%d pages checkpointed, %d in the WAL", db.wal.base, db.wal.npages)
+			}
+			for _, name := range []string{"db", "db-wal"} {
+				data, err := os.ReadFile(dir + "/" + name)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name == "db-wal" {
+					data = data[:len(data)-10] // the last commit was torn
+				}
+				if err := os.WriteFile(dir+"/crash-"+name, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for reopen := 0; reopen < 2; reopen++ {
+				db := &KV{Path: dir + "/crash-db", WAL: true, FullRecovery: full}
+				if err := db.Open(); err != nil {
+					t.Fatal(err)
+				}
+				tx, err := db.Begin(false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n := 0
+				for c := tx.Seek(nil); c.Valid(); c.Next() {
+					if want[string(c.Key())] != string(c.Val()) {
+						t.Fatalf("%s = %q, want %q", c.Key(), c.Val(), want[string(c.Key())])
+					}
+					n++
+				}
+				tx.Rollback()
+				if n != len(want) {
+					t.Fatalf("%d keys, want %d", n, len(want))
+				}
+				// the commits after the recovery follow the truncated record
+				if err := db.Set([]byte("after"), []byte(fmt.Sprint(reopen))); err != nil {
+					t.Fatal(err)
+				}
+				want["after"] = fmt.Sprint(reopen)
+				db.Close()
+			}
+		})
+	}
+}
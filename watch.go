@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Watches deliver the committed changes of the keys of the main keyspace with a prefix, see
+// KV.Watch. While there are watchers, a writable transaction records its changes, and Commit
+// sends them to the channels of the watchers whose prefix matches, in the order they were made.
+//
+// Commit never waits for a watcher: each channel has a buffer of WATCH_BUFFER events, and the
+// events that don't fit are dropped. The next event that fits tells how many were dropped
+// before it in Event.Dropped, so a watcher that lags knows it and can read the keys again.
+//
+// Only the commits of transactions that begin after Watch returns are delivered, and only those
+// made by this process: in shared mode, the watchers of the leader see the commits of the
+// followers, the watchers of a follower see nothing until it takes the lease over. The updates of
+// the buckets and of the branches are not watched. Expired keys are reported when they are purged.
+
+// WATCH_BUFFER is the number of events a watcher channel holds before events are dropped
+const WATCH_BUFFER = 1024
+
+// Event is a committed change of a key, see KV.Watch.
+type Event struct {
+	Key     []byte
+	Val     []byte // the new value, nil if deleted
+	Deleted bool
+	Version uint64 // the version committed by the transaction
+	Dropped int    // the number of events dropped before this one, since the channel was full
+}
+
+// watcher is the receiving end of a watch.
+type watcher struct {
+	prefix  []byte
+	ch      chan Event
+	dropped int
+}
+
+// watchers are the watches of a KV.
+type watchers struct {
+	mu   sync.Mutex
+	list map[*watcher]struct{}
+}
+
+// Watch returns a channel of the committed changes of the keys that start with prefix, and a
+// function that cancels the watch and closes the channel. Close cancels all the watches.
+// See above for what is delivered and when events are dropped.
+func (db *KV) Watch(prefix []byte) (<-chan Event, func()) {
+	w := &watcher{prefix: bytes.Clone(prefix), ch: make(chan Event, WATCH_BUFFER)}
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	if db.watch.list == nil {
+		db.watch.list = map[*watcher]struct{}{}
+	}
+	db.watch.list[w] = struct{}{}
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			db.watch.mu.Lock()
+			defer db.watch.mu.Unlock()
+			if _, ok := db.watch.list[w]; ok {
+				delete(db.watch.list, w)
+				close(w.ch)
+			}
+		})
+	}
+	return w.ch, cancel
+}
+
+// watching reports whether there are watchers, for a transaction that begins.
+func (db *KV) watching() bool {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	return len(db.watch.list) > 0
+}
+
+// watchClose cancels all the watches, on Close.
+func (db *KV) watchClose() {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for w := range db.watch.list {
+		close(w.ch)
+	}
+	db.watch.list = nil
+}
+
+// watchSend delivers the changes of a commit to the watchers, see above.
+func (db *KV) watchSend(changes []Event, version uint64) {
+	db.watch.mu.Lock()
+	defer db.watch.mu.Unlock()
+	for w := range db.watch.list {
+		for _, e := range changes {
+			if !bytes.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			e.Version, e.Dropped = version, w.dropped
+			select {
+			case w.ch <- e:
+				w.dropped = 0
+			default:
+				w.dropped++
+			}
+		}
+	}
+}
+
+// watched records a change made by the transaction if there are watchers.
+func (tx *Tx) watched(key []byte, val []byte, deleted bool) {
+	if !tx.watch {
+		return
+	}
+	e := Event{Key: bytes.Clone(key), Deleted: deleted}
+	if !deleted {
+		e.Val = append([]byte{}, val...)
+	}
+	tx.changes = append(tx.changes, e)
+}
+
+// watchedRange returns the keys in [start, end) that Tx.DeleteRange is about to delete,
+// if there are watchers.
+func (tx *Tx) watchedRange(start []byte, end []byte) ([][]byte, error) {
+	if !tx.watch {
+		return nil, nil
+	}
+	var keys [][]byte
+	c := tx.tree.Seek(start)
+	for ; c.Valid() && (len(end) == 0 || bytes.Compare(c.Key(), end) < 0); c.Next() {
+		keys = append(keys, bytes.Clone(c.Key()))
+	}
+	return keys, c.Err()
+}
+
+// watchIter records the KV pairs passing through it, for Tx.BulkLoad.
+// BulkLoad reads each value once.
+type watchIter struct {
+	KVIterator
+	changes []Event
+}
+
+func (it *watchIter) Val() []byte {
+	val := it.KVIterator.Val()
+	it.changes = append(it.changes, Event{Key: bytes.Clone(it.Key()), Val: append([]byte{}, val...)})
+	return val
+}
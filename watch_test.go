@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+// drain returns the events in the buffer of a watch channel.
+func drain(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	db := &KV{Path: t.TempDir() + "/db"}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	users, cancelUsers := db.Watch([]byte("user:"))
+	all, _ := db.Watch(nil)
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"user:1", "order:1", "user:2", "user:3"} {
+		if err := tx.Set([]byte(key), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tx.Del([]byte("user:1")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.DeleteRange([]byte("user:2"), nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err := tx.CreateBucket([]byte("user:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("user:9"), []byte("bucket")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// a rolled back transaction sends nothing
+	tx, err = db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("user:4"), []byte("v")); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	format := func(events []Event) string {
+		var s []string
+		for _, e := range events {
+			if e.Version != db.Stats().Version || e.Dropped != 0 {
+				t.Fatalf("%s: version %d, dropped %d", e.Key, e.Version, e.Dropped)
+			}
+			if e.Deleted {
+				s = append(s, fmt.Sprintf("-%s", e.Key))
+			} else {
+				s = append(s, fmt.Sprintf("%s=%s", e.Key, e.Val))
+			}
+		}
+		return fmt.Sprint(s)
+	}
+	if got, want := format(drain(users)), "[user:1=v user:2=v user:3=v -user:1 -user:2 -user:3]"; got != want {
+		t.Fatalf("user: events %s, want %s", got, want)
+	}
+	if got, want := format(drain(all)), "[user:1=v order:1=v user:2=v user:3=v -user:1 -user:2 -user:3]"; got != want {
+		t.Fatalf("events %s, want %s", got, want)
+	}
+
+	cancelUsers()
+	cancelUsers()
+	if _, ok := <-users; ok {
+		t.Fatal("an event after the watch was canceled")
+	}
+	db.Close()
+	if _, ok := <-all; ok {
+		t.Fatal("an event after Close")
+	}
+}
+
+// A watcher that doesn't keep up learns how many events were dropped.
+func TestWatchDropped(t *testing.T) {
+	db := openTest(t, &KV{})
+	ch, cancel := db.Watch([]byte("k"))
+	defer cancel()
+	set := func(from, to int) {
+		t.Helper()
+		tx, err := db.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := from; i < to; i++ {
+			if err := tx.Set([]byte(fmt.Sprint("k", i)), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set(0, WATCH_BUFFER+10)
+	set(WATCH_BUFFER+10, WATCH_BUFFER+15)
+	events := drain(ch)
+	if len(events) != WATCH_BUFFER {
+		t.Fatalf("%d events", len(events))
+	}
+	for i, e := range events {
+		if e.Dropped != 0 || string(e.Key) != fmt.Sprint("k", i) {
+			t.Fatalf("event %d: %s, dropped %d", i, e.Key, e.Dropped)
+		}
+	}
+	set(1000000, 1000002)
+	events = drain(ch)
+	if len(events) != 2 || string(events[0].Key) != "k1000000" || events[0].Dropped != 15 || events[1].Dropped != 0 {
+		t.Fatalf("events after the drops %+v", events)
+	}
+}
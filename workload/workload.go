@@ -0,0 +1,396 @@
+// Package workload runs synthetic workloads against key-value stores, like YCSB. It's the
+// bench workload subcommand of scratch-db, and the bench module (see bench/) runs the same
+// workloads against other storage engines, so they can be compared on the same machine.
+package workload
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// MAX_VAL_SIZE is the largest value of a workload, MAX_VAL_SIZE of scratch-db, so that
+// every engine gets the same values.
+const MAX_VAL_SIZE = 3000
+
+// Store is the interface the workloads run against.
+// Every Set is a durable single-key transaction, which is what KV.Set of scratch-db does,
+// and adapters configure their engine to sync on every write to match.
+type Store interface {
+	Get(key []byte) error             // read the value of a key, a missing key is not an error
+	Set(key []byte, val []byte) error // durably write a key
+	Scan(start []byte, n int) error   // read up to n values starting at the first key >= start
+	Close() error
+}
+
+// Engines maps engine names to the constructors of their stores.
+type Engines map[string]func(path string) (Store, error)
+
+// names returns the names of the engines, sorted.
+func (e Engines) names() string {
+	var names []string
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// workload operation types
+const (
+	OP_READ = iota
+	OP_WRITE
+	OP_SCAN
+)
+
+var opNames = [...]string{"read", "write", "scan"}
+
+// workload describes a synthetic workload run against a Store.
+type workload struct {
+	records int      // number of keys loaded before the run
+	ops     int      // number of operations in the run
+	keys    string   // key distribution: uniform, zipfian or latest
+	theta   float64  // skew of the zipfian and latest distributions
+	values  sizeDist // value size distribution
+	mix     [3]int   // weights of reads, writes and scans
+	scanLen int      // number of keys read by a scan
+	rate    float64  // target operations per second for open-loop load, 0 runs as fast as possible
+	seed    int64
+}
+
+// sizeDist is a value size distribution parsed from fixed:N, uniform:A-B or exp:MEAN.
+type sizeDist struct {
+	kind string
+	a, b int
+}
+
+func parseSizeDist(spec string) (sizeDist, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	d := sizeDist{kind: kind}
+	var err error
+	switch kind {
+	case "fixed", "exp":
+		d.a, err = strconv.Atoi(arg)
+	case "uniform":
+		lo, hi, ok := strings.Cut(arg, "-")
+		if !ok {
+			return d, fmt.Errorf("bad value size %q, want uniform:MIN-MAX", spec)
+		}
+		if d.a, err = strconv.Atoi(lo); err == nil {
+			d.b, err = strconv.Atoi(hi)
+		}
+		if err == nil && d.a > d.b {
+			err = errors.New("min is larger than max")
+		}
+	default:
+		return d, fmt.Errorf("bad value size %q, want fixed:N, uniform:MIN-MAX or exp:MEAN", spec)
+	}
+	if err == nil && d.a < 0 {
+		err = errors.New("the sizes must not be negative")
+	}
+	if err != nil {
+		return d, fmt.Errorf("bad value size %q: %w", spec, err)
+	}
+	return d, nil
+}
+
+// next returns a value size, capped at MAX_VAL_SIZE.
+func (d sizeDist) next(rng *rand.Rand) int {
+	var n int
+	switch d.kind {
+	case "fixed":
+		n = d.a
+	case "uniform":
+		n = d.a + rng.Intn(d.b-d.a+1)
+	case "exp":
+		n = int(rng.ExpFloat64() * float64(d.a))
+	}
+	if n > MAX_VAL_SIZE {
+		n = MAX_VAL_SIZE
+	}
+	return n
+}
+
+// zipfian generates item numbers in [0, items) where item 0 is the most popular.
+// This is the generator from "Quickly Generating Billion-Record Synthetic Databases" (Gray et al.)
+// as used by YCSB. Unlike rand.Zipf it supports a skew (theta) below 1.
+// The item count can grow, which the latest distribution relies on.
+type zipfian struct {
+	items uint64
+	theta float64
+	alpha float64
+	zeta2 float64
+	zetan float64
+	eta   float64
+}
+
+func newZipfian(items uint64, theta float64) *zipfian {
+	z := &zipfian{theta: theta, alpha: 1 / (1 - theta)}
+	z.zeta2 = 1 + math.Pow(0.5, theta)
+	z.grow(items)
+	return z
+}
+
+// grow increases the number of items, updating zeta(n) incrementally.
+func (z *zipfian) grow(items uint64) {
+	for i := z.items + 1; i <= items; i++ {
+		z.zetan += 1 / math.Pow(float64(i), z.theta)
+	}
+	z.items = items
+	z.eta = (1 - math.Pow(2/float64(items), 1-z.theta)) / (1 - z.zeta2/z.zetan)
+}
+
+func (z *zipfian) next(rng *rand.Rand) uint64 {
+	u := rng.Float64()
+	uz := u * z.zetan
+	var n uint64
+	switch {
+	case uz < 1:
+		n = 0
+	case uz < z.zeta2:
+		n = 1
+	default:
+		n = uint64(float64(z.items) * math.Pow(z.eta*u-z.eta+1, z.alpha))
+	}
+	if n >= z.items {
+		n = z.items - 1
+	}
+	return n
+}
+
+// workloadKey maps an item number to a key. Item numbers are hashed so that
+// popular items are spread over the key space instead of being adjacent.
+func workloadKey(item uint64) []byte {
+	h := fnv.New64a()
+	h.Write(binary.BigEndian.AppendUint64(nil, item))
+	return []byte(fmt.Sprintf("user%016x", h.Sum64()))
+}
+
+// workloadGen produces the operations of a workload.
+type workloadGen struct {
+	w     *workload
+	rng   *rand.Rand
+	zipf  *zipfian
+	items uint64 // number of keys inserted so far
+	total int    // sum of the mix weights
+	val   []byte
+}
+
+func newWorkloadGen(w *workload) *workloadGen {
+	g := &workloadGen{w: w, rng: rand.New(rand.NewSource(w.seed)), items: uint64(w.records)}
+	if w.keys != "uniform" {
+		g.zipf = newZipfian(g.items, w.theta)
+	}
+	for _, weight := range w.mix {
+		g.total += weight
+	}
+	g.val = make([]byte, MAX_VAL_SIZE)
+	g.rng.Read(g.val)
+	return g
+}
+
+// nextOp picks the next operation type according to the mix.
+func (g *workloadGen) nextOp() int {
+	n := g.rng.Intn(g.total)
+	for op, weight := range g.w.mix {
+		if n < weight {
+			return op
+		}
+		n -= weight
+	}
+	panic("unreachable")
+}
+
+// nextKey picks an existing key according to the key distribution.
+func (g *workloadGen) nextKey() []byte {
+	switch g.w.keys {
+	case "zipfian":
+		return workloadKey(g.zipf.next(g.rng))
+	case "latest":
+		// the most recently inserted keys are the most popular
+		return workloadKey(g.items - 1 - g.zipf.next(g.rng))
+	default:
+		return workloadKey(uint64(g.rng.Int63n(int64(g.items))))
+	}
+}
+
+// nextWrite returns the key and value of a write. With the latest distribution
+// writes insert new keys, otherwise they update existing ones.
+func (g *workloadGen) nextWrite() ([]byte, []byte) {
+	val := g.val[:g.w.values.next(g.rng)]
+	if g.w.keys == "latest" {
+		key := workloadKey(g.items)
+		g.items++
+		g.zipf.grow(g.items)
+		return key, val
+	}
+	return g.nextKey(), val
+}
+
+// Command parses the arguments of a command named name, loads a database of one of the engines
+// and runs a synthetic workload against it, printing the latencies.
+func Command(name string, args []string, engines Engines) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("db", "", "database file (or directory for some engines), a temporary one is used if empty")
+	def := "scratch-db"
+	if _, ok := engines[def]; !ok {
+		def = "" // the binaries of the other engines have no default
+	}
+	engine := fs.String("engine", def, "storage engine: "+engines.names())
+	w := &workload{}
+	fs.IntVar(&w.records, "records", 1000, "number of keys loaded before the run")
+	fs.IntVar(&w.ops, "ops", 1000, "number of operations in the run")
+	fs.StringVar(&w.keys, "keys", "uniform", "key distribution: uniform, zipfian or latest")
+	fs.Float64Var(&w.theta, "theta", 0.99, "skew of the zipfian and latest distributions, in (0, 1)")
+	values := fs.String("values", "fixed:100", "value sizes: fixed:N, uniform:MIN-MAX or exp:MEAN")
+	fs.IntVar(&w.mix[OP_READ], "reads", 50, "weight of reads")
+	fs.IntVar(&w.mix[OP_WRITE], "writes", 50, "weight of writes")
+	fs.IntVar(&w.mix[OP_SCAN], "scans", 0, "weight of scans")
+	fs.IntVar(&w.scanLen, "scanlen", 100, "number of keys read by a scan")
+	fs.Float64Var(&w.rate, "rate", 0, "issue operations at a fixed rate (ops/s) instead of back to back")
+	fs.Int64Var(&w.seed, "seed", 1, "random seed, the same seed produces the same workload")
+	fs.Parse(args)
+
+	var err error
+	if w.values, err = parseSizeDist(*values); err != nil {
+		return err
+	}
+	open, ok := engines[*engine]
+	switch {
+	case *engine == "":
+		return fmt.Errorf("no engine given, this binary has %s", engines.names())
+	case !ok:
+		return fmt.Errorf("unknown engine %q, this binary has %s", *engine, engines.names())
+	case w.keys != "uniform" && w.keys != "zipfian" && w.keys != "latest":
+		return fmt.Errorf("bad key distribution %q", w.keys)
+	case w.theta <= 0 || w.theta >= 1:
+		return errors.New("theta must be in (0, 1)")
+	case w.rate < 0:
+		return errors.New("the rate must not be negative")
+	case w.records < 1:
+		return errors.New("at least one record must be loaded")
+	case w.mix[OP_READ] < 0 || w.mix[OP_WRITE] < 0 || w.mix[OP_SCAN] < 0:
+		return errors.New("the operation weights must not be negative")
+	case w.mix[OP_READ]+w.mix[OP_WRITE]+w.mix[OP_SCAN] == 0:
+		return errors.New("at least one operation weight must be positive")
+	}
+
+	if *path == "" {
+		dir, err := os.MkdirTemp("", "scratch-db-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		*path = dir + "/" + *engine
+	}
+	db, err := open(*path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	fmt.Printf("engine %s\n", *engine)
+
+	g := newWorkloadGen(w)
+	begin := time.Now()
+	for i := 0; i < w.records; i++ {
+		if err := db.Set(workloadKey(uint64(i)), g.val[:w.values.next(g.rng)]); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("loaded %d records in %v\n", w.records, time.Since(begin).Round(time.Millisecond))
+
+	// service time is measured from the actual start of an operation. In open-loop mode
+	// response time is measured from the scheduled start, which also counts the time an
+	// operation waited behind a slow predecessor (coordinated omission correction).
+	var service, response [3][]time.Duration
+	var interval time.Duration
+	if w.rate > 0 {
+		interval = time.Duration(float64(time.Second) / w.rate)
+	}
+	begin = time.Now()
+	for i := 0; i < w.ops; i++ {
+		op := g.nextOp()
+		scheduled := begin.Add(time.Duration(i) * interval)
+		if w.rate > 0 {
+			time.Sleep(time.Until(scheduled))
+		}
+		start := time.Now()
+		if err := runOp(db, g, op); err != nil {
+			return err
+		}
+		end := time.Now()
+		service[op] = append(service[op], end.Sub(start))
+		if w.rate > 0 {
+			response[op] = append(response[op], end.Sub(scheduled))
+		}
+	}
+	elapsed := time.Since(begin)
+	fmt.Printf("ran %d operations in %v (%.0f ops/s)\n",
+		w.ops, elapsed.Round(time.Millisecond), float64(w.ops)/elapsed.Seconds())
+
+	if w.rate == 0 {
+		fmt.Println()
+		printLatencies(service)
+		return nil
+	}
+	fmt.Printf("target rate %.0f ops/s\n\n", w.rate)
+	fmt.Println("service time (uncorrected):")
+	printLatencies(service)
+	fmt.Println()
+	fmt.Println("response time (corrected for coordinated omission):")
+	printLatencies(response)
+	return nil
+}
+
+// printLatencies prints the latency distribution of every operation type.
+func printLatencies(samples [3][]time.Duration) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer tw.Flush()
+	fmt.Fprintln(tw, "op\tcount\tavg\tp50\tp90\tp99\tp99.9\tmax\t")
+	for op, lat := range samples {
+		if len(lat) == 0 {
+			continue
+		}
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		var sum time.Duration
+		for _, d := range lat {
+			sum += d
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%v\t%v\t%v\t%v\t\n", opNames[op], len(lat),
+			sum/time.Duration(len(lat)), percentile(lat, 50), percentile(lat, 90),
+			percentile(lat, 99), percentile(lat, 99.9), lat[len(lat)-1])
+	}
+}
+
+// percentile returns the p-th percentile of sorted samples using the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// runOp executes a single workload operation.
+func runOp(db Store, g *workloadGen, op int) error {
+	switch op {
+	case OP_READ:
+		return db.Get(g.nextKey())
+	case OP_WRITE:
+		key, val := g.nextWrite()
+		return db.Set(key, val)
+	case OP_SCAN:
+		return db.Scan(g.nextKey(), g.w.scanLen)
+	}
+	return nil
+}